@@ -0,0 +1,51 @@
+//! Times a first import of many small files, into an empty library (no
+//! duplicate lookups) and into one already holding a photo (a lookup per file),
+//! and with `--continue-on-db-error` (a savepoint per file).
+//!
+//! Run with `cargo bench --bench first_import`. `PHOTOSORT_BENCH_FILES` sets how
+//! many files are generated (default 20000). The files are tiny, so the time is
+//! mostly spent hashing them and writing their records rather than copying.
+
+use assert_fs::TempDir;
+use photosort::photosort_core::import::{ImportOptions, Library};
+use std::fs;
+use std::time::Instant;
+
+fn main() {
+    let count: usize = std::env::var("PHOTOSORT_BENCH_FILES")
+        .ok()
+        .and_then(|v| v.parse().ok())
+        .unwrap_or(20_000);
+
+    let temp_dir = TempDir::new().unwrap();
+    let source = temp_dir.path().join("source");
+    for i in 0..count {
+        let dir = source.join(format!("{:03}", i / 1000));
+        if i % 1000 == 0 {
+            fs::create_dir_all(&dir).unwrap();
+        }
+        fs::write(dir.join(format!("IMG_{:06}.jpg", i)), format!("photo {}", i)).unwrap();
+    }
+    let seed = temp_dir.path().join("seed");
+    fs::create_dir_all(&seed).unwrap();
+    fs::write(seed.join("seed.jpg"), b"already in the library").unwrap();
+
+    for (name, seeded, continue_on_db_error) in [
+        ("empty library", false, false),
+        ("non-empty library", true, false),
+        ("empty library, --continue-on-db-error", false, true),
+    ] {
+        let mut lib = Library::create(&temp_dir.path().join(name)).unwrap();
+        if seeded {
+            lib.import(&seed, &ImportOptions::default()).expect("import failed");
+        }
+        let options = ImportOptions {
+            continue_on_db_error,
+            ..Default::default()
+        };
+
+        let start = Instant::now();
+        let stats = lib.import(&source, &options).expect("import failed");
+        println!("{:<40} {:>8.2?}  ({} imported)", name, start.elapsed(), stats.images_imported);
+    }
+}
@@ -0,0 +1,38 @@
+//! Times importing the same source twice, with and without `--skip-existing-hash`.
+//!
+//! Run with `cargo bench --bench reimport`. Set `PHOTOSORT_BENCH_SOURCE` to a
+//! directory of real photos; otherwise the test fixtures are used.
+
+use assert_fs::TempDir;
+use photosort::photosort_core::import::{ImportOptions, Library};
+use std::path::PathBuf;
+use std::time::{Duration, Instant};
+
+fn time_import(lib: &mut Library, source: &PathBuf, options: &ImportOptions) -> Duration {
+    let start = Instant::now();
+    lib.import(source, options).expect("import failed");
+    start.elapsed()
+}
+
+fn main() {
+    let source = std::env::var_os("PHOTOSORT_BENCH_SOURCE")
+        .map(PathBuf::from)
+        .unwrap_or_else(|| PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("tests/fixtures"));
+
+    for skip_existing_hash in [false, true] {
+        let temp_dir = TempDir::new().unwrap();
+        let mut lib = Library::create(&temp_dir.path().join("library")).unwrap();
+        let options = ImportOptions {
+            skip_existing_hash,
+            ..Default::default()
+        };
+
+        let first = time_import(&mut lib, &source, &options);
+        let second = time_import(&mut lib, &source, &options);
+
+        println!(
+            "skip_existing_hash={:<5}  first import {:>8.2?}  re-import {:>8.2?}",
+            skip_existing_hash, first, second
+        );
+    }
+}
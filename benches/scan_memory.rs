@@ -0,0 +1,54 @@
+//! Peak memory of scanning a large source made up mostly of duplicates.
+//!
+//! Run with `cargo bench --bench scan_memory`. `PHOTOSORT_BENCH_FILES` sets how
+//! many files are generated (default 100000); every tenth one is unique. Peak
+//! RSS is read from /proc, so it is only reported on Linux.
+
+use assert_fs::TempDir;
+use photosort::photosort_core::import::{ImportOptions, Library};
+use std::fs;
+use std::time::Instant;
+
+/// Highest resident set size of this process so far, in kB.
+fn peak_rss_kb() -> Option<u64> {
+    let status = fs::read_to_string("/proc/self/status").ok()?;
+    let line = status.lines().find(|l| l.starts_with("VmHWM:"))?;
+    line.split_whitespace().nth(1)?.parse().ok()
+}
+
+fn main() {
+    let count: usize = std::env::var("PHOTOSORT_BENCH_FILES")
+        .ok()
+        .and_then(|v| v.parse().ok())
+        .unwrap_or(100_000);
+
+    let temp_dir = TempDir::new().unwrap();
+    let source = temp_dir.path().join("source");
+    for i in 0..count {
+        let dir = source.join(format!("{:03}", i / 1000));
+        if i % 1000 == 0 {
+            fs::create_dir_all(&dir).unwrap();
+        }
+        fs::write(dir.join(format!("IMG_{:06}.jpg", i)), format!("photo {}", i / 10)).unwrap();
+    }
+
+    let mut lib = Library::create(&temp_dir.path().join("library")).unwrap();
+    let options = ImportOptions {
+        dry_run: true,
+        ..Default::default()
+    };
+
+    let before = peak_rss_kb();
+    let start = Instant::now();
+    let stats = lib.import(&source, &options).expect("import failed");
+    let elapsed = start.elapsed();
+
+    println!(
+        "{} files ({} duplicates) scanned in {:.2?}",
+        count, stats.duplicates_skipped, elapsed
+    );
+    match (before, peak_rss_kb()) {
+        (Some(before), Some(after)) => println!("peak RSS {} kB (before scan {} kB)", after, before),
+        _ => println!("peak RSS not available on this platform"),
+    }
+}
@@ -1,9 +1,12 @@
-use anyhow::Result;
+use anyhow::{Context, Result};
 use clap::Parser;
-use photosort::photosort_core::{Cli, Commands};
-use photosort::photosort_core::import::Library;
+use photosort::photosort_core::{Cli, Commands, StructureFormat};
+use photosort::photosort_core::import::{CreateOptions, ImportOptions, Library};
+use photosort::photosort_core::{database, progress};
+use photosort::photosort_core::warnings::{self, WarningCollector};
 use simplelog::{CombinedLogger, Config, LevelFilter, SharedLogger, TermLogger, WriteLogger};
-use std::fs::File;
+use std::fs::{File, OpenOptions};
+use std::path::Path;
 
 fn main() -> Result<()> {
     let cli = Cli::parse();
@@ -16,19 +19,74 @@ fn main() -> Result<()> {
         simplelog::ColorChoice::Auto,
     )];
 
-    if cli.log {
-        loggers.push(WriteLogger::new(
-            cli.log_level,
-            Config::default(),
-            File::create("photosort.log")?,
-        ));
+    if cli.log || cli.log_file.is_some() {
+        let path = cli.log_file.as_deref().unwrap_or(Path::new("photosort.log"));
+        let file = OpenOptions::new()
+            .create(true)
+            .write(true)
+            .append(cli.log_append)
+            .truncate(!cli.log_append)
+            .open(path)
+            .with_context(|| format!("could not open log file {}", path.display()))?;
+        loggers.push(WriteLogger::new(cli.log_level, Config::default(), file));
+    }
+
+    if cli.fail_on_warnings {
+        loggers.push(Box::new(WarningCollector));
     }
 
     CombinedLogger::init(loggers)?;
+    progress::configure(cli.progress_theme, cli.progress_width);
+    database::configure_wal_limit(cli.wal_limit.saturating_mul(1024 * 1024));
+
+    if cli.recover {
+        if let Some(library_dir) = cli.command.library_dir() {
+            let recovery = Library::recover(library_dir)?;
+            println!(
+                "Recovered {}: {} of {} logged pages written back",
+                library_dir.display(),
+                recovery.checkpointed,
+                recovery.wal_frames
+            );
+        }
+    }
+
+    run(cli.command)?;
+
+    // Strict runs fail on anything that was only worth a warning
+    if cli.fail_on_warnings {
+        let counts = warnings::counts();
+        if !counts.is_empty() {
+            eprintln!("Warnings:");
+            for (category, count) in &counts {
+                eprintln!("  {}: {}", category, count);
+            }
+            let total: usize = counts.iter().map(|(_, n)| n).sum();
+            anyhow::bail!("{} warnings logged and --fail-on-warnings is set", total);
+        }
+    }
 
-    match cli.command {
-        Commands::Create { library_dir } => {
-            Library::create(&library_dir)?;
+    Ok(())
+}
+
+fn run(command: Commands) -> Result<()> {
+    match command {
+        Commands::Create {
+            library_dir,
+            dir_mode,
+            layout,
+            hash_encoding,
+            granularity,
+        } => {
+            Library::create_with_options(
+                &library_dir,
+                &CreateOptions {
+                    dir_mode,
+                    layout,
+                    hash_encoding,
+                    granularity,
+                },
+            )?;
             println!("Created library at {}", library_dir.display());
             println!("  images/  - for photos");
             println!("  videos/  - for videos");
@@ -38,25 +96,248 @@ fn main() -> Result<()> {
             source_dir,
             library_dir,
             dry_run,
+            include_sidecars_without_photo,
+            dir_mode,
+            file_mode,
+            skip_existing_hash,
+            previews,
+            dedupe_sidecars,
+            since_last_import,
+            force,
+            dest_exists_policy,
+            dest_collision_hash_suffix_length,
+            report_format,
+            exiftool_config,
+            exiftool_args,
+            require_exif,
+            sidecar_subfolders,
+            min_megapixels,
+            max_megapixels,
+            after_import_hook,
+            canonical_ext,
+            ext_aliases,
+            deterministic,
+            prefer_iptc_date,
+            verify_source,
+            on_source_mismatch,
+            on_duplicate_sidecar_conflict,
+            type_routes,
+            catalog,
+            strip,
+            report_duplicates,
+            archive_original_structure,
+            files,
+            null,
+            max_rate,
+            output_structure,
+            estimate,
+            sidecar_date,
+            verify_after_import,
+            verify_sample,
+            include_hidden_dirs,
+            include_hidden_files,
+            include_nested_libraries,
+            normalize_unicode,
+            continue_on_db_error,
+            two_pass_copy,
+            date_from_filename,
+            filename_date_pattern,
+            max_files,
+            import_order,
+            exclude_dirs,
+            import_mtime_window,
+            skip_sidecar_copy,
+            name_case,
         } => {
-            let mut lib = Library::open(&library_dir)?;
-            let stats = lib.import(&source_dir, dry_run)?;
+            use photosort::photosort_core::import::read_file_list;
+            use photosort::photosort_core::PhotosortError;
 
-            if !dry_run {
-                println!("\nImport complete!");
-                println!("  {} images imported", stats.images_imported);
-                println!("  {} videos imported", stats.videos_imported);
-                println!("  {} sidecars imported", stats.sidecars_imported);
-                if stats.duplicates_skipped > 0 {
-                    println!("  {} duplicates skipped", stats.duplicates_skipped);
+            // A source of "-" is a file list on stdin; listed paths are relative to here
+            let (source_dir, files) = if source_dir == Path::new("-") {
+                if files.is_some() || verify_source.is_some() {
+                    return Err(PhotosortError::Argument(
+                        "a source of \"-\" reads the file list from stdin; leave out --files and --verify-source".to_string(),
+                    )
+                    .into());
                 }
+                (Path::new(".").to_path_buf(), Some(source_dir))
+            } else {
+                (source_dir, files)
+            };
+
+            if let Some(config) = exiftool_config {
+                let home = photosort::photosort_core::exif::exiftool_home(&config)?;
+                // SAFETY: no other threads have been started yet; exiftool
+                // processes spawned later inherit the variable.
+                unsafe { std::env::set_var("EXIFTOOL_HOME", home) };
+            }
+
+            // An estimate is a dry run with a different report
+            let dry_run = dry_run || estimate;
+            let mut lib = Library::open(&library_dir)?;
+            let options = ImportOptions {
+                dry_run: dry_run || output_structure.is_some(),
+                include_orphan_sidecars: include_sidecars_without_photo,
+                dir_mode,
+                file_mode,
+                skip_existing_hash,
+                previews,
+                dedupe_sidecars,
+                since_last_import,
+                force,
+                dest_exists: dest_exists_policy,
+                collision_suffix_len: dest_collision_hash_suffix_length.map(usize::from),
+                exiftool_args,
+                require_exif,
+                sidecar_subfolders,
+                min_megapixels,
+                max_megapixels,
+                after_import_hook,
+                canonical_ext,
+                ext_aliases,
+                deterministic,
+                prefer_iptc_date,
+                verify_source,
+                on_source_mismatch,
+                on_sidecar_conflict: on_duplicate_sidecar_conflict,
+                type_routes,
+                catalog,
+                strip,
+                report_duplicates,
+                archive_original_structure,
+                files: files.map(|list| read_file_list(&list, null)).transpose()?,
+                max_rate,
+                plan_layout: output_structure.is_some(),
+                sidecar_date,
+                include_hidden_dirs,
+                include_hidden_files,
+                include_nested_libraries,
+                normalize_unicode,
+                continue_on_db_error,
+                two_pass_copy,
+                date_from_filename,
+                filename_date_patterns: filename_date_pattern,
+                max_files,
+                import_order,
+                exclude_dirs,
+                import_mtime_window,
+                skip_sidecar_copy,
+                name_case,
+                estimate,
+            };
+            let stats = lib.import(&source_dir, &options)?;
+
+            if let Some(StructureFormat::Json) = output_structure {
+                println!("{}", serde_json::to_string_pretty(&stats.planned_layout.unwrap_or_default())?);
+                return Ok(());
+            }
+
+            print!("{}", stats.report(dry_run).render(&report_format));
+
+            if verify_after_import && !dry_run {
+                use photosort::photosort_core::verify::verify;
+
+                let options = verify_options(verify_sample);
+                check_verified(verify(&lib, &options)?, &options, &report_format)?;
             }
         }
 
-        Commands::Scan { library_dir } => {
+        Commands::DedupeDir { dir, dry_run } => {
+            use photosort::photosort_core::dedupe::{dedupe_dir, DedupeOptions};
+            use photosort::photosort_core::ReportFormat;
+
+            let result = dedupe_dir(&dir, &DedupeOptions { dry_run })?;
+            print!("{}", result.report(dry_run).render(&ReportFormat::Text));
+        }
+
+        Commands::Inspect {
+            source_dir,
+            output,
+            hash_prefix_length,
+            hash_encoding,
+            include_hidden_dirs,
+            include_hidden_files,
+        } => {
+            use photosort::photosort_core::import::inspect_source;
+            use photosort::photosort_core::inspect::format_source_files;
+
+            let options = ImportOptions {
+                include_hidden_dirs,
+                include_hidden_files,
+                ..Default::default()
+            };
+            let files = inspect_source(&source_dir, &options, hash_encoding)?;
+            println!("{}", format_source_files(&files, &output, hash_prefix_length));
+        }
+
+        Commands::Scan {
+            library_dir,
+            relink,
+            prune_db_only,
+            report_unmatched_sidecars,
+            dry_run,
+        } => {
+            use photosort::photosort_core::scan::{
+                find_relinks, find_unmatched_sidecars, handle_scan_results, prune_missing, relink_moved_files,
+                scan_library, scan_missing,
+            };
+            use photosort::photosort_core::ReportFormat;
+
+            let mut lib = Library::open(&library_dir)?;
+            let mut result = if prune_db_only { scan_missing(&lib)? } else { scan_library(&lib)? };
+            if report_unmatched_sidecars {
+                result.unmatched_sidecars = find_unmatched_sidecars(&lib, &lib.sidecar_extensions()?)?;
+            }
+            if dry_run {
+                let relinks = if relink {
+                    find_relinks(lib.root(), &result.missing_files, &result.new_files)
+                } else {
+                    Vec::new()
+                };
+                print!("\n{}", result.dry_run_report(&relinks).render(&ReportFormat::Text));
+                return Ok(());
+            }
+            if prune_db_only {
+                let (media, sidecars) = prune_missing(&mut lib, &result)?;
+                println!("\nRemoved records of {} missing files and {} missing sidecars.", media, sidecars);
+                println!("Library now has {}.", lib.totals()?);
+                return Ok(());
+            }
+            if relink {
+                let relinked = relink_moved_files(&mut lib, &mut result)?;
+                println!("\nRelinked {} moved files.", relinked);
+            }
+            handle_scan_results(&mut lib, &result)?;
+            println!("Library now has {}.", lib.totals()?);
+        }
+
+        Commands::RescanSidecars {
+            library_dir,
+            extensions,
+            dry_run,
+        } => {
+            use photosort::photosort_core::scan::rescan_sidecars;
+
             let mut lib = Library::open(&library_dir)?;
-            let result = photosort::photosort_core::scan::scan_library(&lib)?;
-            photosort::photosort_core::scan::handle_scan_results(&mut lib, &result)?;
+            let mut known = lib.sidecar_extensions()?;
+            for ext in extensions {
+                if !known.contains(&ext) {
+                    known.push(ext);
+                }
+            }
+            if !dry_run {
+                lib.set_sidecar_extensions(&known)?;
+            }
+
+            let attached = rescan_sidecars(&mut lib, &known, dry_run)?;
+            for path in &attached {
+                println!("  {}", path.display());
+            }
+            if dry_run {
+                println!("Would attach {} sidecars.", attached.len());
+            } else {
+                println!("Attached {} sidecars. Library now has {}.", attached.len(), lib.totals()?);
+            }
         }
 
         Commands::Search {
@@ -70,16 +351,20 @@ fn main() -> Result<()> {
             camera,
             lens,
             output,
+            hash_prefix_length,
+            sort_within_second,
+            output_relative_paths,
         } => {
             use photosort::photosort_core::search::{search, format_results, SearchQuery};
 
-            let lib = Library::open(&library_dir)?;
+            let lib = Library::open_read_only(&library_dir)?;
 
             // Build query
             let mut query = SearchQuery {
                 media_type: r#type,
                 camera,
                 lens,
+                within_second: sort_within_second,
                 ..Default::default()
             };
 
@@ -110,11 +395,121 @@ fn main() -> Result<()> {
             }
 
             let results = search(&lib, &query)?;
-            println!("{}", format_results(&results, &output));
+            println!("{}", format_results(&results, &output, hash_prefix_length, output_relative_paths));
+        }
+
+        Commands::Merge {
+            library_dir,
+            sources,
+            dry_run,
+        } => {
+            use photosort::photosort_core::merge::merge;
+
+            let mut lib = Library::open(&library_dir)?;
+            let sources = sources
+                .iter()
+                .map(|s| Library::open(s))
+                .collect::<std::result::Result<Vec<_>, _>>()?;
+
+            let result = merge(&mut lib, &sources, dry_run)?;
+
+            println!("\n{}", if dry_run { "Would merge:" } else { "Merge complete!" });
+            for s in &result.sources {
+                println!(
+                    "  {}: {} media, {} sidecars ({} duplicates skipped)",
+                    s.path.display(),
+                    s.media_added,
+                    s.sidecars_added,
+                    s.duplicates
+                );
+                if s.failed > 0 {
+                    println!("    {} media missing from the source, not merged", s.failed);
+                }
+            }
+
+            let conflicts: Vec<_> = result.sources.iter().flat_map(|s| &s.sidecar_conflicts).collect();
+            if !conflicts.is_empty() {
+                println!("\nSidecars kept as they were, since the source's copy differs:");
+                for path in conflicts {
+                    println!("  {}", path.display());
+                }
+            }
+        }
+
+        Commands::Remove {
+            library_dir,
+            paths,
+            dry_run,
+            permanent,
+        } => {
+            use photosort::photosort_core::remove::{remove_media, RemoveOptions};
+
+            let mut lib = Library::open(&library_dir)?;
+            let result = remove_media(&mut lib, &paths, &RemoveOptions { dry_run, permanent })?;
+
+            for path in &result.not_found {
+                println!("Not in library: {}", path.display());
+            }
+            if dry_run {
+                println!("\nDry run - {} media would be removed.", result.media_removed);
+            } else if permanent {
+                println!("Removed {} media ({} files deleted).", result.media_removed, result.files_deleted);
+            } else {
+                println!("Removed {} media ({} files moved to trash).", result.media_removed, result.files_trashed);
+            }
         }
 
-        Commands::Stats { library_dir } => {
+        Commands::ConvertHashes { library_dir, to } => {
+            let mut lib = Library::open(&library_dir)?;
+            let converted = lib.convert_hashes(to)?;
+            println!("Rewrote {} hashes.", converted);
+        }
+
+        Commands::EmptyTrash { library_dir } => {
+            use photosort::photosort_core::trash::empty_trash;
+
             let lib = Library::open(&library_dir)?;
+            let result = empty_trash(lib.root())?;
+            println!(
+                "Emptied trash: {} files ({:.1} MB) freed.",
+                result.files_removed,
+                result.bytes_freed as f64 / 1_048_576.0
+            );
+        }
+
+        Commands::Undo { library_dir, dry_run } => {
+            use photosort::photosort_core::journal::{last_operation, undo_last};
+
+            let mut lib = Library::open(&library_dir)?;
+
+            let Some(op) = last_operation(lib.database().connection_ref())? else {
+                println!("Nothing to undo.");
+                return Ok(());
+            };
+            println!("Last operation: {} at {} ({} changes)", op.kind, op.started_at, op.entries.len());
+
+            if dry_run {
+                println!("\nDry run - nothing was undone.");
+                return Ok(());
+            }
+
+            if let Some(result) = undo_last(&mut lib)? {
+                println!("\nUndid {}:", result.kind);
+                println!("  {} database records reverted", result.rows_reverted);
+                println!("  {} files removed", result.files_removed);
+                println!("  {} files restored from trash", result.files_restored);
+            }
+        }
+
+        Commands::Stats {
+            library_dir,
+            report_format,
+            by_size,
+            top,
+        } => {
+            use photosort::photosort_core::report::Report;
+
+            let lib = Library::open_read_only(&library_dir)?;
             let db = lib.database();
 
             let image_count = db.image_count()?;
@@ -124,14 +519,275 @@ fn main() -> Result<()> {
             let total_video_size = db.total_video_size()?;
             let total_sidecar_size = db.total_sidecar_size()?;
             let total_size = total_image_size + total_video_size + total_sidecar_size;
+            let dup = db.duplicate_sidecar_stats()?;
+
+            let mut report = Report::new(&format!("Library: {}", library_dir.display()))
+                .field("images", "Images", image_count)
+                .field_with_display(
+                    "image_bytes",
+                    "Images size",
+                    total_image_size,
+                    format!("{:.1} GB", total_image_size as f64 / 1_073_741_824.0),
+                )
+                .field("videos", "Videos", video_count)
+                .field_with_display(
+                    "video_bytes",
+                    "Videos size",
+                    total_video_size,
+                    format!("{:.1} GB", total_video_size as f64 / 1_073_741_824.0),
+                )
+                .field("sidecars", "Sidecars", sidecar_count)
+                .field_with_display(
+                    "sidecar_bytes",
+                    "Sidecars size",
+                    total_sidecar_size,
+                    format!("{:.1} MB", total_sidecar_size as f64 / 1_048_576.0),
+                )
+                .field("total_files", "Total files", image_count + video_count + sidecar_count)
+                .field_with_display(
+                    "total_bytes",
+                    "Total size",
+                    total_size,
+                    format!("{:.1} GB", total_size as f64 / 1_073_741_824.0),
+                )
+                .field("duplicate_sidecars", "Sidecars duplicating another's content", dup.extra_copies)
+                .field_with_display(
+                    "duplicate_sidecar_bytes",
+                    "Space used by duplicate sidecars",
+                    dup.extra_bytes,
+                    format!("{:.1} MB unless hardlinked", dup.extra_bytes as f64 / 1_048_576.0),
+                )
+                .list(
+                    "settings",
+                    "Library settings",
+                    &["setting", "value"],
+                    db.settings()?.into_iter().map(|(key, value)| vec![key.into(), value.into()]).collect(),
+                );
+            if by_size {
+                let images = db.image_size_stats()?;
+                report = report
+                    .field_with_display(
+                        "average_image_bytes",
+                        "Average photo size",
+                        images.average_bytes,
+                        format!("{:.1} MB", images.average_bytes / 1_048_576.0),
+                    )
+                    .field_with_display(
+                        "median_image_bytes",
+                        "Median photo size",
+                        images.median_bytes,
+                        format!("{:.1} MB", images.median_bytes / 1_048_576.0),
+                    )
+                    .list(
+                        "largest",
+                        "Largest files",
+                        &["path", "bytes", "media_type", "hash"],
+                        db.largest_media(top)?
+                            .into_iter()
+                            .map(|m| vec![m.path.into(), m.file_size.into(), m.media_type.into(), m.hash.into()])
+                            .collect(),
+                    );
+            }
+            print!("{}", report.render(&report_format));
+        }
+
+        Commands::Folders {
+            library_dir,
+            nonconforming,
+        } => {
+            let lib = Library::open_read_only(&library_dir)?;
+            let folders = lib.folders()?;
+
+            for f in folders.iter().filter(|f| !nonconforming || !f.conforms) {
+                if f.conforms {
+                    println!("{:>8}  {}", f.media_count, f.relpath);
+                } else {
+                    println!("{:>8}  {}  (outside the date layout)", f.media_count, f.relpath);
+                }
+            }
+            let stray = folders.iter().filter(|f| !f.conforms).count();
+            println!("\n{} folders, {} outside the date layout", folders.len(), stray);
+        }
+
+        Commands::NameCollisions {
+            library_dir,
+            report_format,
+        } => {
+            use photosort::photosort_core::import::{short_hash, DEFAULT_SHORT_HASH_LEN};
+            use photosort::photosort_core::report::Report;
+
+            let lib = Library::open_read_only(&library_dir)?;
+            let collisions = lib.name_collisions()?;
+
+            let (mut same_folder, mut across_folders) = (Vec::new(), Vec::new());
+            for c in &collisions {
+                for (relpath, hash) in &c.copies {
+                    let row = vec![
+                        c.filename.clone().into(),
+                        relpath.clone().into(),
+                        short_hash(hash, DEFAULT_SHORT_HASH_LEN).into(),
+                    ];
+                    if c.repeats_in(relpath) {
+                        same_folder.push(row);
+                    } else {
+                        across_folders.push(row);
+                    }
+                }
+            }
+
+            let report = Report::new(&format!("Library: {}", library_dir.display()))
+                .field("names", "Filenames used more than once", collisions.len())
+                .list("same_folder", "repeated within a folder", &["filename", "relpath", "hash"], same_folder)
+                .list("across_folders", "repeated across folders", &["filename", "relpath", "hash"], across_folders);
+            print!("{}", report.render(&report_format));
+        }
+
+        Commands::Verify {
+            library_dir,
+            sample,
+            seed,
+            check_folders,
+            report_format,
+        } => {
+            use photosort::photosort_core::verify::{verify, VerifyOptions};
+
+            let lib = Library::open_read_only(&library_dir)?;
+            let seed = seed.unwrap_or_else(|| time::OffsetDateTime::now_utc().unix_timestamp_nanos() as u64);
+
+            let options = VerifyOptions {
+                sample,
+                seed,
+                cancel: Some(cancel_on_ctrl_c()),
+                check_folders,
+            };
+            check_verified(verify(&lib, &options)?, &options, &report_format)?;
+        }
+
+        Commands::DbCheck {
+            library_dir,
+            report_format,
+        } => {
+            use photosort::photosort_core::PhotosortError;
+
+            let lib = Library::open_read_only(&library_dir)?;
+            let report = lib.database().check_integrity()?;
+            print!("{}", report.report().render(&report_format));
+            if !report.is_ok() {
+                return Err(PhotosortError::IntegrityCheckFailed(report.problems().len()).into());
+            }
+        }
+
+        Commands::Rehydrate {
+            library_dir,
+            source_dir,
+            dry_run,
+        } => {
+            use photosort::photosort_core::rehydrate::{rehydrate, RehydrateOptions};
+            use photosort::photosort_core::ReportFormat;
+
+            let lib = Library::open(&library_dir)?;
+            let result = rehydrate(&lib, &source_dir, &RehydrateOptions { dry_run })?;
+            print!("{}", result.report(dry_run).render(&ReportFormat::Text));
+        }
+
+        Commands::RecomputeWinners {
+            library_dir,
+            source_dir,
+            dry_run,
+        } => {
+            use photosort::photosort_core::ReportFormat;
+
+            let mut lib = Library::open(&library_dir)?;
+            let result = lib.recompute_winners(&source_dir, &ImportOptions::default(), dry_run)?;
+            print!("{}", result.report(dry_run).render(&ReportFormat::Text));
+        }
+
+        Commands::Refresh {
+            library_dir,
+            dimensions,
+            all,
+        } => {
+            use photosort::photosort_core::refresh::{refresh, RefreshOptions};
+            use photosort::photosort_core::ReportFormat;
+
+            let mut lib = Library::open(&library_dir)?;
+            let options = RefreshOptions {
+                dimensions,
+                all,
+                cancel: None,
+            };
+            let result = refresh(&mut lib, &options)?;
+            print!("{}", result.report().render(&ReportFormat::Text));
+        }
 
-            println!("Library: {}", library_dir.display());
-            println!("─────────────────────────────────");
-            println!("Images:    {:>8} ({:.1} GB)", image_count, total_image_size as f64 / 1_073_741_824.0);
-            println!("Videos:    {:>8} ({:.1} GB)", video_count, total_video_size as f64 / 1_073_741_824.0);
-            println!("Sidecars:  {:>8} ({:.1} MB)", sidecar_count, total_sidecar_size as f64 / 1_048_576.0);
-            println!("─────────────────────────────────");
-            println!("Total:     {:>8} files ({:.1} GB)", image_count + video_count + sidecar_count, total_size as f64 / 1_073_741_824.0);
+        Commands::Reimport {
+            library_dir,
+            media,
+            from,
+            date_from_filename,
+            prefer_iptc_date,
+            dry_run,
+        } => {
+            use photosort::photosort_core::ReportFormat;
+
+            let mut lib = Library::open(&library_dir)?;
+            let options = ImportOptions {
+                date_from_filename,
+                prefer_iptc_date,
+                ..Default::default()
+            };
+            let result = lib.reimport(&media, from.as_deref(), &options, dry_run)?;
+            print!("{}", result.report(dry_run).render(&ReportFormat::Text));
+        }
+
+        Commands::Export {
+            library_dir,
+            output,
+            format,
+            sidecars,
+            sort_within_second,
+        } => {
+            use photosort::photosort_core::export::{export_media, export_sidecars};
+            use std::io::BufWriter;
+
+            let lib = Library::open_read_only(&library_dir)?;
+
+            let mut out = BufWriter::new(File::create(&output)?);
+            let count = export_media(&lib, &mut out, &format, sort_within_second)?;
+            println!("Exported {} media to {}", count, output.display());
+
+            if let Some(sidecar_path) = sidecars {
+                let mut out = BufWriter::new(File::create(&sidecar_path)?);
+                let count = export_sidecars(&lib, &mut out, &format)?;
+                println!("Exported {} sidecars to {}", count, sidecar_path.display());
+            }
+        }
+
+        Commands::ExportBundle { library_dir, output } => {
+            use photosort::photosort_core::bundle::export_bundle;
+
+            let lib = Library::open(&library_dir)?;
+            let summary = export_bundle(&lib, &output)?;
+            println!(
+                "Bundled {} files ({} bytes) and {} links into {}",
+                summary.files,
+                summary.bytes,
+                summary.links,
+                output.display()
+            );
+        }
+
+        Commands::ImportBundle { bundle, library_dir } => {
+            use photosort::photosort_core::bundle::import_bundle;
+
+            let summary = import_bundle(&bundle, &library_dir)?;
+            println!(
+                "Restored {} files ({} bytes) and {} links to {}; all match the bundle's manifest.",
+                summary.files,
+                summary.bytes,
+                summary.links,
+                library_dir.display()
+            );
         }
 
         Commands::Backup {
@@ -162,11 +818,28 @@ fn main() -> Result<()> {
             local_library,
             remote_library,
             dry_run,
+            verify_after_sync,
+            verify_sample,
+            keep_going_past_db_lock,
         } => {
-            use photosort::photosort_core::push::push;
+            use photosort::photosort_core::database::wait_while_locked;
+            use photosort::photosort_core::push::{push, RemoteLibrary};
+            use photosort::photosort_core::verify::verify_files;
+            use photosort::photosort_core::{PhotosortError, ReportFormat};
+
+            if verify_after_sync && RemoteLibrary::parse(&remote_library)?.is_ssh {
+                return Err(PhotosortError::Argument(
+                    "--verify-after-sync needs a mounted remote; SSH remotes can't be checked".to_string(),
+                )
+                .into());
+            }
 
-            let mut lib = Library::open(&local_library)?;
-            let result = push(&mut lib, &remote_library, dry_run)?;
+            let lock_wait = keep_going_past_db_lock.map(std::time::Duration::from_secs);
+            let mut lib = match lock_wait {
+                Some(wait) => wait_while_locked(wait, || Library::open(&local_library))?,
+                None => Library::open(&local_library)?,
+            };
+            let result = push(&mut lib, &remote_library, dry_run, lock_wait)?;
 
             if !dry_run {
                 println!("\nPush complete!");
@@ -179,19 +852,38 @@ fn main() -> Result<()> {
                 if result.skipped > 0 {
                     println!("  {} skipped", result.skipped);
                 }
+                println!("  local library has {}", lib.totals()?);
+
+                if verify_after_sync {
+                    let options = verify_options(verify_sample);
+                    check_verified(verify_files(&result.pushed, &options), &options, &ReportFormat::Text)?;
+                }
             }
         }
 
         Commands::Info {
             library_dir,
             file_path,
+            hash_prefix_length,
+            output_relative_paths,
         } => {
-            let lib = Library::open(&library_dir)?;
+            use photosort::photosort_core::search::{format_details, search, SearchQuery};
+            use photosort::photosort_core::PhotosortError;
+
+            let lib = Library::open_read_only(&library_dir)?;
             let db = lib.database();
 
-            if let Some(_file) = file_path {
-                println!("File info not yet implemented");
-                // TODO: Show detailed file info
+            if let Some(file) = file_path {
+                let Some(id) = lib.find_media(&file)? else {
+                    return Err(PhotosortError::PathNotFound(file).into());
+                };
+                let query = SearchQuery {
+                    id: Some(id),
+                    ..Default::default()
+                };
+                for result in search(&lib, &query)? {
+                    print!("{}", format_details(&result, hash_prefix_length, output_relative_paths));
+                }
             } else {
                 let image_count = db.image_count()?;
                 let video_count = db.video_count()?;
@@ -205,3 +897,67 @@ fn main() -> Result<()> {
 
     Ok(())
 }
+
+/// Verify options for a check after a write: the whole target, or a sample of it.
+fn verify_options(sample: Option<f64>) -> photosort::photosort_core::verify::VerifyOptions {
+    use photosort::photosort_core::verify::VerifyOptions;
+
+    let seed = time::OffsetDateTime::now_utc().unix_timestamp_nanos() as u64;
+    VerifyOptions {
+        sample,
+        seed,
+        ..Default::default()
+    }
+}
+
+/// A flag set when the user presses Ctrl-C, so a long run can stop early
+/// and still report what it got through. A second Ctrl-C stops at once.
+#[cfg(unix)]
+fn cancel_on_ctrl_c() -> std::sync::Arc<std::sync::atomic::AtomicBool> {
+    use std::sync::atomic::{AtomicBool, Ordering};
+    use std::sync::{Arc, OnceLock};
+
+    static CANCEL: OnceLock<Arc<AtomicBool>> = OnceLock::new();
+
+    extern "C" fn on_interrupt(_: libc::c_int) {
+        // Only async-signal-safe calls here: an atomic store and signal()
+        if let Some(cancel) = CANCEL.get() {
+            cancel.store(true, Ordering::Relaxed);
+        }
+        unsafe { libc::signal(libc::SIGINT, libc::SIG_DFL) };
+    }
+
+    let cancel = CANCEL.get_or_init(|| Arc::new(AtomicBool::new(false)));
+    let handler = on_interrupt as extern "C" fn(libc::c_int) as libc::sighandler_t;
+    if unsafe { libc::signal(libc::SIGINT, handler) } == libc::SIG_ERR {
+        log::warn!("Ctrl-C will stop photosort without a report");
+    }
+    Arc::clone(cancel)
+}
+
+/// Elsewhere Ctrl-C stops photosort at once, as before.
+#[cfg(not(unix))]
+fn cancel_on_ctrl_c() -> std::sync::Arc<std::sync::atomic::AtomicBool> {
+    std::sync::Arc::new(std::sync::atomic::AtomicBool::new(false))
+}
+
+/// Print a verify result and fail the command if any file didn't pass.
+fn check_verified(
+    result: photosort::photosort_core::verify::VerifyResult,
+    options: &photosort::photosort_core::verify::VerifyOptions,
+    format: &photosort::photosort_core::ReportFormat,
+) -> Result<()> {
+    use photosort::photosort_core::PhotosortError;
+
+    print!("{}", result.report(options).render(format));
+    if result.failures() > 0 {
+        return Err(PhotosortError::VerificationFailed(result.failures()).into());
+    }
+    if !result.misplaced.is_empty() {
+        return Err(PhotosortError::Misplaced(result.misplaced.len()).into());
+    }
+    if result.cancelled {
+        return Err(PhotosortError::Cancelled.into());
+    }
+    Ok(())
+}
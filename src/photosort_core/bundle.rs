@@ -0,0 +1,716 @@
+use crate::photosort_core::error::{PhotosortError, Result};
+use crate::photosort_core::import::{Library, DB_FILE_NAME};
+use crate::photosort_core::objects::symlink;
+use base64::{engine::general_purpose, Engine as _};
+use rusqlite::params;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::io::{self, BufReader, BufWriter, Read, Write};
+use std::path::{Component, Path, PathBuf};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use walkdir::WalkDir;
+
+/// Entry listing every file in a bundle with its hash. It is written last, so
+/// files are hashed as they stream into the bundle rather than read twice.
+pub const MANIFEST_NAME: &str = "photosort-manifest.json";
+
+const MANIFEST_VERSION: u32 = 1;
+
+/// tar works in blocks of this many bytes.
+const BLOCK: usize = 512;
+
+/// Largest size the header's 11 octal digits hold; larger files also get a pax record.
+const MAX_OCTAL_SIZE: u64 = 0o77777777777;
+
+#[derive(Debug, Serialize, Deserialize)]
+struct Manifest {
+    version: u32,
+    files: Vec<ManifestFile>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+struct ManifestFile {
+    path: String,
+    size: u64,
+    /// SHA-256 of the content, base64 like the library's own hashes.
+    sha256: String,
+}
+
+/// What went into or came out of a bundle.
+#[derive(Debug, Default)]
+pub struct BundleSummary {
+    pub files: usize,
+    /// Symlinks, as used by content-addressed libraries.
+    pub links: usize,
+    pub bytes: u64,
+}
+
+/// Write the whole library (files and database) to a single tar file.
+///
+/// The database is bundled as a consistent snapshot, so this is safe while
+/// the library is in use. Everything else streams straight into the bundle.
+pub fn export_bundle(lib: &Library, output: &Path) -> Result<BundleSummary> {
+    let snapshot = std::env::temp_dir().join(format!("photosort-bundle-{}.db", std::process::id()));
+    let _ = fs::remove_file(&snapshot);
+    lib.database()
+        .connection_ref()
+        .execute("VACUUM INTO ?1", params![snapshot.to_string_lossy()])?;
+
+    let result = write_bundle(lib.root(), &snapshot, output);
+    let _ = fs::remove_file(&snapshot);
+    result
+}
+
+fn write_bundle(root: &Path, db_snapshot: &Path, output: &Path) -> Result<BundleSummary> {
+    let mut tar = TarWriter {
+        out: BufWriter::new(fs::File::create(output)?),
+    };
+    // The bundle may be written into the library itself
+    let output = fs::canonicalize(output)?;
+
+    let mut summary = BundleSummary::default();
+    let mut manifest = Manifest {
+        version: MANIFEST_VERSION,
+        files: Vec::new(),
+    };
+
+    let db = tar.append_file(DB_FILE_NAME, db_snapshot)?;
+    summary.files += 1;
+    summary.bytes += db.size;
+    manifest.files.push(db);
+
+    for entry in WalkDir::new(root).min_depth(1).sort_by_file_name() {
+        let entry = entry?;
+        let rel = entry.path().strip_prefix(root).unwrap_or(entry.path());
+        let name = tar_name(rel)?;
+        // The live database and its WAL files are replaced by the snapshot
+        if name.starts_with(DB_FILE_NAME) && !name.contains('/') {
+            continue;
+        }
+
+        let file_type = entry.file_type();
+        if file_type.is_dir() {
+            tar.append_dir(&name, mtime(&entry.metadata()?))?;
+        } else if file_type.is_symlink() {
+            tar.append_symlink(&name, &fs::read_link(entry.path())?, mtime(&entry.metadata()?))?;
+            summary.links += 1;
+        } else if file_type.is_file() {
+            if fs::canonicalize(entry.path()).is_ok_and(|p| p == output) {
+                continue;
+            }
+            let file = tar.append_file(&name, entry.path())?;
+            summary.files += 1;
+            summary.bytes += file.size;
+            manifest.files.push(file);
+        }
+    }
+
+    let manifest = serde_json::to_vec_pretty(&manifest).map_err(|e| PhotosortError::Bundle(e.to_string()))?;
+    tar.append_bytes(MANIFEST_NAME, &manifest)?;
+    tar.finish()?;
+    Ok(summary)
+}
+
+/// Restore a bundle into `dir` as a new library, checking every file against
+/// the bundle's manifest. `dir` must not exist yet or be empty.
+///
+/// The bundle is extracted next to `dir` and only moved into place once it
+/// checks out, so a damaged bundle leaves nothing behind and can be retried.
+pub fn import_bundle(bundle: &Path, dir: &Path) -> Result<BundleSummary> {
+    if dir.join(DB_FILE_NAME).exists() {
+        return Err(PhotosortError::LibraryExists(dir.to_path_buf()));
+    }
+    if dir.exists() && fs::read_dir(dir)?.next().is_some() {
+        return Err(PhotosortError::Bundle(format!("{} is not empty", dir.display())));
+    }
+
+    let mut name = dir.file_name().unwrap_or_default().to_os_string();
+    name.push(".photosort-partial");
+    let partial = dir.with_file_name(name);
+    // Left by an import that was cut short
+    if partial.exists() {
+        fs::remove_dir_all(&partial)?;
+    }
+    fs::create_dir_all(&partial)?;
+
+    let summary = match extract_bundle(bundle, &partial) {
+        Ok(summary) => summary,
+        Err(e) => {
+            let _ = fs::remove_dir_all(&partial);
+            return Err(e);
+        }
+    };
+    if dir.exists() {
+        fs::remove_dir(dir)?;
+    }
+    fs::rename(&partial, dir)?;
+    Ok(summary)
+}
+
+/// Extract a bundle into the empty directory `dir` and check it against its manifest.
+fn extract_bundle(bundle: &Path, dir: &Path) -> Result<BundleSummary> {
+    let mut reader = BufReader::new(fs::File::open(bundle)?);
+    let mut summary = BundleSummary::default();
+    let mut extracted: HashMap<String, (u64, String)> = HashMap::new();
+    let mut manifest: Option<Manifest> = None;
+
+    while let Some(entry) = next_entry(&mut reader)? {
+        let rel = safe_relative(&entry.path)?;
+        check_no_links_on_path(dir, &rel)?;
+        let dest = dir.join(&rel);
+        match entry.kind {
+            b'5' => fs::create_dir_all(&dest)?,
+            b'2' => {
+                check_link(&rel, &entry.link)?;
+                if let Some(parent) = dest.parent() {
+                    fs::create_dir_all(parent)?;
+                }
+                symlink(Path::new(&entry.link), &dest)?;
+                summary.links += 1;
+            }
+            b'0' | 0 if entry.path == MANIFEST_NAME => {
+                let mut data = Vec::new();
+                (&mut reader).take(entry.size).read_to_end(&mut data)?;
+                skip_padding(&mut reader, entry.size)?;
+                manifest = Some(
+                    serde_json::from_slice(&data).map_err(|e| PhotosortError::Bundle(format!("bad manifest: {}", e)))?,
+                );
+            }
+            b'0' | 0 => {
+                if let Some(parent) = dest.parent() {
+                    fs::create_dir_all(parent)?;
+                }
+                let hash = extract_file(&mut reader, &entry, &dest)?;
+                extracted.insert(entry.path.clone(), (entry.size, hash));
+                summary.files += 1;
+                summary.bytes += entry.size;
+            }
+            other => {
+                log::warn!("Skipping {} in bundle (unsupported entry type {})", entry.path, other as char);
+                io::copy(&mut (&mut reader).take(entry.size), &mut io::sink())?;
+                skip_padding(&mut reader, entry.size)?;
+            }
+        }
+    }
+
+    let manifest =
+        manifest.ok_or_else(|| PhotosortError::Bundle(format!("{} has no manifest", bundle.display())))?;
+    let listed: HashSet<&str> = manifest.files.iter().map(|f| f.path.as_str()).collect();
+    let mut unlisted: Vec<&str> = extracted.keys().map(String::as_str).filter(|p| !listed.contains(p)).collect();
+    unlisted.sort_unstable();
+    for path in &unlisted {
+        log::error!("Not in the bundle's manifest: {}", path);
+    }
+    if let Some(first) = unlisted.first() {
+        return Err(PhotosortError::Bundle(format!(
+            "{} files are not in the manifest (first: {})",
+            unlisted.len(),
+            first
+        )));
+    }
+    let damaged: Vec<&str> = manifest
+        .files
+        .iter()
+        .filter(|f| extracted.get(&f.path) != Some(&(f.size, f.sha256.clone())))
+        .map(|f| f.path.as_str())
+        .collect();
+    for path in &damaged {
+        log::error!("Missing or damaged in bundle: {}", path);
+    }
+    if let Some(first) = damaged.first() {
+        return Err(PhotosortError::Bundle(format!(
+            "{} files are missing or damaged (first: {})",
+            damaged.len(),
+            first
+        )));
+    }
+
+    // Make sure what came out is a usable library
+    Library::open(dir)?;
+    Ok(summary)
+}
+
+/// Copy one file's data out of the bundle, returning its hash.
+fn extract_file<R: Read>(reader: &mut R, entry: &TarEntry, dest: &Path) -> Result<String> {
+    let mut out = BufWriter::new(fs::File::create(dest)?);
+    let mut hasher = Sha256::new();
+    let mut data = (&mut *reader).take(entry.size);
+    let mut buf = vec![0u8; 64 * 1024];
+    let mut copied = 0u64;
+    loop {
+        let n = data.read(&mut buf)?;
+        if n == 0 {
+            break;
+        }
+        hasher.update(&buf[..n]);
+        out.write_all(&buf[..n])?;
+        copied += n as u64;
+    }
+    if copied != entry.size {
+        return Err(PhotosortError::Bundle(format!("{} is cut short", entry.path)));
+    }
+    skip_padding(reader, entry.size)?;
+
+    let file = out.into_inner().map_err(|e| e.into_error())?;
+    file.set_modified(UNIX_EPOCH + Duration::from_secs(entry.mtime))?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        if entry.mode != 0 {
+            file.set_permissions(fs::Permissions::from_mode(entry.mode))?;
+        }
+    }
+    Ok(general_purpose::STANDARD.encode(hasher.finalize()))
+}
+
+/// A bundle path as a relative path, refusing anything that would land
+/// outside the target directory.
+fn safe_relative(name: &str) -> Result<PathBuf> {
+    let mut path = PathBuf::new();
+    for component in Path::new(name).components() {
+        match component {
+            Component::Normal(part) => path.push(part),
+            Component::CurDir => {}
+            _ => return Err(PhotosortError::Bundle(format!("unsafe path in bundle: {}", name))),
+        }
+    }
+    if path.as_os_str().is_empty() {
+        return Err(PhotosortError::Bundle("empty path in bundle".to_string()));
+    }
+    Ok(path)
+}
+
+/// Refuse entries that would be written through a symlink the bundle already
+/// created, since a chain of links that each look harmless (`a -> .`, then
+/// `a/b -> ..`) can lead outside the library. Checked on disk, component by
+/// component, including the entry itself.
+fn check_no_links_on_path(dir: &Path, rel: &Path) -> Result<()> {
+    let mut path = dir.to_path_buf();
+    for component in rel.components() {
+        path.push(component);
+        match fs::symlink_metadata(&path) {
+            Ok(metadata) if metadata.file_type().is_symlink() => {
+                return Err(PhotosortError::Bundle(format!(
+                    "{} would be written through the symlink {}",
+                    rel.display(),
+                    path.strip_prefix(dir).unwrap_or(&path).display()
+                )));
+            }
+            Ok(_) => {}
+            // Nothing there yet, so nothing further down either
+            Err(_) => break,
+        }
+    }
+    Ok(())
+}
+
+/// Refuse symlinks that point outside the library.
+fn check_link(rel: &Path, target: &str) -> Result<()> {
+    let mut depth = rel.components().count() - 1;
+    for component in Path::new(target).components() {
+        match component {
+            Component::Normal(_) => depth += 1,
+            Component::CurDir => {}
+            Component::ParentDir if depth > 0 => depth -= 1,
+            _ => {
+                return Err(PhotosortError::Bundle(format!(
+                    "symlink {} points outside the library",
+                    rel.display()
+                )));
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Path inside the bundle, always with forward slashes.
+fn tar_name(rel: &Path) -> Result<String> {
+    let parts: Option<Vec<&str>> = rel.components().map(|c| c.as_os_str().to_str()).collect();
+    parts
+        .map(|p| p.join("/"))
+        .ok_or_else(|| PhotosortError::Bundle(format!("path is not valid UTF-8: {}", rel.display())))
+}
+
+struct TarWriter<W: Write> {
+    out: W,
+}
+
+impl<W: Write> TarWriter<W> {
+    /// Stream a file into the bundle, hashing it on the way.
+    fn append_file(&mut self, name: &str, path: &Path) -> Result<ManifestFile> {
+        let file = fs::File::open(path)?;
+        let metadata = file.metadata()?;
+        let size = metadata.len();
+        self.header(name, b'0', size, file_mode(&metadata, 0o644), mtime(&metadata), "")?;
+
+        let mut hasher = Sha256::new();
+        let mut data = file.take(size);
+        let mut buf = vec![0u8; 64 * 1024];
+        let mut written = 0u64;
+        loop {
+            let n = data.read(&mut buf)?;
+            if n == 0 {
+                break;
+            }
+            hasher.update(&buf[..n]);
+            self.out.write_all(&buf[..n])?;
+            written += n as u64;
+        }
+        if written != size {
+            return Err(PhotosortError::Bundle(format!("{} shrank while being bundled", path.display())));
+        }
+        self.pad(size)?;
+
+        Ok(ManifestFile {
+            path: name.to_string(),
+            size,
+            sha256: general_purpose::STANDARD.encode(hasher.finalize()),
+        })
+    }
+
+    fn append_bytes(&mut self, name: &str, data: &[u8]) -> io::Result<()> {
+        let now = SystemTime::now().duration_since(UNIX_EPOCH).map(|d| d.as_secs()).unwrap_or(0);
+        self.header(name, b'0', data.len() as u64, 0o644, now, "")?;
+        self.out.write_all(data)?;
+        self.pad(data.len() as u64)
+    }
+
+    fn append_dir(&mut self, name: &str, mtime: u64) -> io::Result<()> {
+        self.header(&format!("{}/", name), b'5', 0, 0o755, mtime, "")
+    }
+
+    fn append_symlink(&mut self, name: &str, target: &Path, mtime: u64) -> Result<()> {
+        let target = tar_name(target)?;
+        Ok(self.header(name, b'2', 0, 0o777, mtime, &target)?)
+    }
+
+    /// Write an entry header, preceded by a pax header for anything too long for it.
+    fn header(&mut self, name: &str, kind: u8, size: u64, mode: u32, mtime: u64, link: &str) -> io::Result<()> {
+        let mut pax = String::new();
+        if name.len() > 100 {
+            pax.push_str(&pax_record("path", name));
+        }
+        if link.len() > 100 {
+            pax.push_str(&pax_record("linkpath", link));
+        }
+        if size > MAX_OCTAL_SIZE {
+            pax.push_str(&pax_record("size", &size.to_string()));
+        }
+        if !pax.is_empty() {
+            self.write_header("././@PaxHeader", b'x', pax.len() as u64, 0o644, mtime, "")?;
+            self.out.write_all(pax.as_bytes())?;
+            self.pad(pax.len() as u64)?;
+        }
+        self.write_header(name, kind, size.min(MAX_OCTAL_SIZE), mode, mtime, link)
+    }
+
+    fn write_header(&mut self, name: &str, kind: u8, size: u64, mode: u32, mtime: u64, link: &str) -> io::Result<()> {
+        let mut h = [0u8; BLOCK];
+        put_str(&mut h[0..100], name);
+        put_octal(&mut h[100..108], mode as u64);
+        put_octal(&mut h[108..116], 0);
+        put_octal(&mut h[116..124], 0);
+        put_octal(&mut h[124..136], size);
+        put_octal(&mut h[136..148], mtime);
+        h[156] = kind;
+        put_str(&mut h[157..257], link);
+        h[257..263].copy_from_slice(b"ustar\0");
+        h[263..265].copy_from_slice(b"00");
+
+        // The checksum is taken with its own field as spaces
+        h[148..156].fill(b' ');
+        let sum: u32 = h.iter().map(|&b| b as u32).sum();
+        h[148..156].copy_from_slice(format!("{:06o}\0 ", sum).as_bytes());
+        self.out.write_all(&h)
+    }
+
+    /// Fill the rest of the last block after `size` bytes of data.
+    fn pad(&mut self, size: u64) -> io::Result<()> {
+        let rem = (size % BLOCK as u64) as usize;
+        if rem != 0 {
+            self.out.write_all(&[0u8; BLOCK][..BLOCK - rem])?;
+        }
+        Ok(())
+    }
+
+    fn finish(mut self) -> io::Result<()> {
+        self.out.write_all(&[0u8; BLOCK * 2])?;
+        self.out.flush()
+    }
+}
+
+/// A pax "length key=value\n" record, where length counts the whole record.
+fn pax_record(key: &str, value: &str) -> String {
+    let body = format!(" {}={}\n", key, value);
+    let mut len = body.len();
+    loop {
+        let total = body.len() + len.to_string().len();
+        if total == len {
+            return format!("{}{}", len, body);
+        }
+        len = total;
+    }
+}
+
+fn put_str(field: &mut [u8], s: &str) {
+    let n = s.len().min(field.len());
+    field[..n].copy_from_slice(&s.as_bytes()[..n]);
+}
+
+fn put_octal(field: &mut [u8], value: u64) {
+    let digits = format!("{:0width$o}", value, width = field.len() - 1);
+    put_str(field, &digits);
+}
+
+fn file_mode(metadata: &fs::Metadata, default: u32) -> u32 {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        let _ = default;
+        metadata.permissions().mode() & 0o7777
+    }
+    #[cfg(not(unix))]
+    {
+        let _ = metadata;
+        default
+    }
+}
+
+fn mtime(metadata: &fs::Metadata) -> u64 {
+    metadata
+        .modified()
+        .ok()
+        .and_then(|t| t.duration_since(UNIX_EPOCH).ok())
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+struct TarEntry {
+    path: String,
+    kind: u8,
+    size: u64,
+    mode: u32,
+    mtime: u64,
+    link: String,
+}
+
+/// Read the next entry header, applying any pax records before it. The
+/// entry's data follows in the reader. Returns None at the end of the archive.
+fn next_entry<R: Read>(reader: &mut R) -> Result<Option<TarEntry>> {
+    let mut pax: HashMap<String, String> = HashMap::new();
+    loop {
+        let mut h = [0u8; BLOCK];
+        match reader.read_exact(&mut h) {
+            Ok(()) => {}
+            Err(e) if e.kind() == io::ErrorKind::UnexpectedEof => return Ok(None),
+            Err(e) => return Err(e.into()),
+        }
+        if h.iter().all(|&b| b == 0) {
+            return Ok(None);
+        }
+
+        let stored = parse_octal(&h[148..156])?;
+        h[148..156].fill(b' ');
+        if h.iter().map(|&b| b as u64).sum::<u64>() != stored {
+            return Err(PhotosortError::Bundle("corrupt header in bundle".to_string()));
+        }
+
+        let kind = h[156];
+        let mut size = parse_octal(&h[124..136])?;
+        if kind == b'x' {
+            let mut data = Vec::new();
+            (&mut *reader).take(size).read_to_end(&mut data)?;
+            skip_padding(reader, size)?;
+            pax.extend(parse_pax(&String::from_utf8_lossy(&data)));
+            continue;
+        }
+
+        let mut path = c_str(&h[0..100]);
+        let prefix = c_str(&h[345..500]);
+        if &h[257..262] == b"ustar" && !prefix.is_empty() {
+            path = format!("{}/{}", prefix, path);
+        }
+        if let Some(s) = pax.get("size") {
+            size = s.parse().map_err(|_| PhotosortError::Bundle("bad size in bundle".to_string()))?;
+        }
+
+        return Ok(Some(TarEntry {
+            path: pax.remove("path").unwrap_or(path).trim_end_matches('/').to_string(),
+            kind,
+            size,
+            mode: parse_octal(&h[100..108])? as u32,
+            mtime: parse_octal(&h[136..148])?,
+            link: pax.remove("linkpath").unwrap_or_else(|| c_str(&h[157..257])),
+        }));
+    }
+}
+
+fn parse_pax(records: &str) -> Vec<(String, String)> {
+    let mut parsed = Vec::new();
+    let mut rest = records;
+    while let Some((len, _)) = rest.split_once(' ') {
+        let Ok(len) = len.parse::<usize>() else { break };
+        let Some(record) = rest.get(..len) else { break };
+        if let Some((key, value)) = record.split_once(' ').and_then(|(_, kv)| kv.split_once('=')) {
+            parsed.push((key.to_string(), value.trim_end_matches('\n').to_string()));
+        }
+        rest = &rest[len..];
+    }
+    parsed
+}
+
+fn c_str(field: &[u8]) -> String {
+    let end = field.iter().position(|&b| b == 0).unwrap_or(field.len());
+    String::from_utf8_lossy(&field[..end]).into_owned()
+}
+
+fn parse_octal(field: &[u8]) -> Result<u64> {
+    let s = c_str(field);
+    let s = s.trim();
+    if s.is_empty() {
+        return Ok(0);
+    }
+    u64::from_str_radix(s, 8).map_err(|_| PhotosortError::Bundle("bad number in bundle header".to_string()))
+}
+
+fn skip_padding<R: Read>(reader: &mut R, size: u64) -> io::Result<()> {
+    let rem = (size % BLOCK as u64) as usize;
+    if rem != 0 {
+        let mut pad = [0u8; BLOCK];
+        reader.read_exact(&mut pad[..BLOCK - rem])?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::photosort_core::import::ImportOptions;
+    use crate::photosort_core::verify::{verify, VerifyOptions};
+    use assert_fs::TempDir;
+
+    fn library_with_photos(temp_dir: &TempDir) -> Library {
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("IMG_1.jpg"), b"first photo").unwrap();
+        fs::write(source.join("IMG_1.xmp"), b"<x:xmpmeta/>").unwrap();
+        // Long enough to need a pax header
+        fs::write(source.join(format!("{}.jpg", "long".repeat(30))), b"second photo").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("library")).unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+        lib
+    }
+
+    #[test]
+    fn test_bundle_round_trip() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = library_with_photos(&temp_dir);
+        let bundle = temp_dir.path().join("library.tar");
+
+        let exported = export_bundle(&lib, &bundle).unwrap();
+        // Two photos, a sidecar, and the database
+        assert_eq!(exported.files, 4);
+
+        let restored_dir = temp_dir.path().join("restored");
+        let imported = import_bundle(&bundle, &restored_dir).unwrap();
+        assert_eq!(imported.files, exported.files);
+        assert_eq!(imported.bytes, exported.bytes);
+
+        let restored = Library::open(&restored_dir).unwrap();
+        assert_eq!(restored.database().media_count().unwrap(), 2);
+        let result = verify(&restored, &VerifyOptions::default()).unwrap();
+        assert_eq!(result.checked, 2);
+        assert!(result.is_ok());
+
+        // Not over an existing library
+        assert!(import_bundle(&bundle, &restored_dir).is_err());
+    }
+
+    #[test]
+    fn test_damaged_bundle_is_rejected() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = library_with_photos(&temp_dir);
+        let bundle = temp_dir.path().join("library.tar");
+        export_bundle(&lib, &bundle).unwrap();
+
+        let mut data = fs::read(&bundle).unwrap();
+        let at = data.windows(11).position(|w| w == b"first photo").unwrap();
+        data[at] = b'F';
+        fs::write(&bundle, data).unwrap();
+
+        let restored_dir = temp_dir.path().join("restored");
+        let err = import_bundle(&bundle, &restored_dir).unwrap_err();
+        assert!(err.to_string().contains("missing or damaged"), "{}", err);
+        // Nothing is left behind, so a good bundle can be restored there next
+        assert!(!restored_dir.exists());
+        assert_eq!(fs::read_dir(temp_dir.path()).unwrap().count(), 3);
+
+        export_bundle(&lib, &bundle).unwrap();
+        import_bundle(&bundle, &restored_dir).unwrap();
+        assert_eq!(Library::open(&restored_dir).unwrap().database().media_count().unwrap(), 2);
+    }
+
+    #[test]
+    fn test_files_missing_from_manifest_are_rejected() {
+        let temp_dir = TempDir::new().unwrap();
+        let bundle = temp_dir.path().join("extra.tar");
+        let mut tar = TarWriter {
+            out: BufWriter::new(fs::File::create(&bundle).unwrap()),
+        };
+        let manifest = Manifest {
+            version: MANIFEST_VERSION,
+            files: Vec::new(),
+        };
+        tar.append_bytes("images/extra.jpg", b"slipped in").unwrap();
+        tar.append_bytes(MANIFEST_NAME, &serde_json::to_vec(&manifest).unwrap()).unwrap();
+        tar.finish().unwrap();
+
+        let restored_dir = temp_dir.path().join("restored");
+        let err = import_bundle(&bundle, &restored_dir).unwrap_err();
+        assert!(err.to_string().contains("not in the manifest (first: images/extra.jpg)"), "{}", err);
+        assert!(!restored_dir.exists());
+    }
+
+    #[test]
+    fn test_unsafe_paths_are_refused() {
+        assert!(safe_relative("images/2024/a.jpg").is_ok());
+        assert!(safe_relative("../outside").is_err());
+        assert!(safe_relative("/etc/passwd").is_err());
+
+        let link = Path::new("images/2024/05-21/a.jpg");
+        assert!(check_link(link, "../../../objects/ab/cd/abcd.jpg").is_ok());
+        assert!(check_link(link, "../../../../outside").is_err());
+        assert!(check_link(link, "/etc/passwd").is_err());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_chained_symlinks_are_refused() {
+        let temp_dir = TempDir::new().unwrap();
+        let bundle = temp_dir.path().join("evil.tar");
+        let mut tar = TarWriter {
+            out: BufWriter::new(fs::File::create(&bundle).unwrap()),
+        };
+        // Each link stays inside on its own; together l2 is the parent of the library
+        tar.append_symlink("l1", Path::new("."), 0).unwrap();
+        tar.append_symlink("l1/l2", Path::new(".."), 0).unwrap();
+        tar.append_bytes("l2/x", b"escaped").unwrap();
+        tar.finish().unwrap();
+
+        let restored_dir = temp_dir.path().join("restored");
+        let err = import_bundle(&bundle, &restored_dir).unwrap_err();
+        assert!(err.to_string().contains("through the symlink l1"), "{}", err);
+        assert!(!temp_dir.path().join("x").exists());
+        assert!(!restored_dir.join("l1/l2").exists());
+    }
+
+    #[test]
+    fn test_pax_record_length_counts_itself() {
+        let record = pax_record("path", "a/b.jpg");
+        assert_eq!(record, "16 path=a/b.jpg\n");
+        assert_eq!(parse_pax(&record), vec![("path".to_string(), "a/b.jpg".to_string())]);
+    }
+}
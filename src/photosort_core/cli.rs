@@ -1,6 +1,13 @@
+use crate::photosort_core::database::DEFAULT_WAL_LIMIT;
+use crate::photosort_core::import::{DEFAULT_SHORT_HASH_LEN, ORPHANS_DIR};
+use crate::photosort_core::media::is_media_extension;
+use crate::photosort_core::objects::OBJECTS_DIR;
+use crate::photosort_core::progress::DEFAULT_BAR_WIDTH;
+use crate::photosort_core::verify::parse_sample_rate;
 use clap::{Parser, Subcommand, ValueEnum};
 use simplelog::LevelFilter;
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
+use time::format_description::OwnedFormatItem;
 
 #[derive(Parser, Debug)]
 #[command(author, version, about = "A local filesystem-friendly photo and video library manager")]
@@ -13,9 +20,37 @@ pub struct Cli {
     #[arg(long = "log", global = true)]
     pub log: bool,
 
+    /// Write the file log here instead of photosort.log (implies --log)
+    #[arg(long, value_name = "PATH", global = true)]
+    pub log_file: Option<PathBuf>,
+
+    /// Add to the log file instead of starting it afresh, to keep a history of runs
+    #[arg(long, global = true)]
+    pub log_append: bool,
+
     /// Log level for file logging (debug, info, warn, error)
     #[arg(long, default_value_t = LevelFilter::Debug, global = true)]
     pub log_level: LevelFilter,
+
+    /// Characters progress bars are drawn with
+    #[arg(long, value_enum, default_value_t = ProgressTheme::Unicode, global = true)]
+    pub progress_theme: ProgressTheme,
+
+    /// Width of progress bars, in characters
+    #[arg(long, default_value_t = DEFAULT_BAR_WIDTH, value_parser = clap::value_parser!(u16).range(1..), global = true)]
+    pub progress_width: u16,
+
+    /// Recover the library database after a crashed run (stale write-ahead log or lock) before running the command
+    #[arg(long, global = true)]
+    pub recover: bool,
+
+    /// Exit with an error if anything was logged as a warning, after listing how many of each kind
+    #[arg(long, global = true)]
+    pub fail_on_warnings: bool,
+
+    /// Size, in MB, the database's write-ahead log is kept to during long imports and scans
+    #[arg(long, value_name = "MB", default_value_t = DEFAULT_WAL_LIMIT / (1024 * 1024), value_parser = clap::value_parser!(u64).range(1..), global = true)]
+    pub wal_limit: u64,
 }
 
 #[derive(Subcommand, Debug)]
@@ -25,11 +60,27 @@ pub enum Commands {
         /// Path for the new library (will be created if it doesn't exist)
         #[arg(required = true)]
         library_dir: PathBuf,
+
+        /// Permissions for created directories, in octal (e.g., 700 or 2775)
+        #[arg(long, value_parser = parse_mode)]
+        dir_mode: Option<u32>,
+
+        /// How media files are stored on disk
+        #[arg(long, value_enum, default_value_t = StorageLayout::Date)]
+        layout: StorageLayout,
+
+        /// How file hashes are written in the database; hex matches sha256sum and other tools
+        #[arg(long, value_enum, default_value_t = HashEncoding::Base64)]
+        hash_encoding: HashEncoding,
+
+        /// How finely media are sorted into date folders
+        #[arg(long, value_enum, default_value_t = DateGranularity::Day)]
+        granularity: DateGranularity,
     },
 
     /// Import photos and videos into a library
     Import {
-        /// Directory containing media to import
+        /// Directory containing media to import, or "-" to import the files listed on stdin, one path per line (or NUL-separated with --null)
         #[arg(required = true)]
         source_dir: PathBuf,
 
@@ -40,6 +91,256 @@ pub enum Commands {
         /// Show what would be imported without making changes
         #[arg(long)]
         dry_run: bool,
+
+        /// Copy sidecars with no matching photo into the library's orphans/ folder
+        #[arg(long)]
+        include_sidecars_without_photo: bool,
+
+        /// Permissions for created directories, in octal (e.g., 700 or 2775)
+        #[arg(long, value_parser = parse_mode)]
+        dir_mode: Option<u32>,
+
+        /// Permissions for copied files, in octal (e.g., 600 or 664)
+        #[arg(long, value_parser = parse_mode)]
+        file_mode: Option<u32>,
+
+        /// Skip files already in the library under the same name without reading their metadata
+        #[arg(long)]
+        skip_existing_hash: bool,
+
+        /// How to handle action-camera previews (.lrv, .thm)
+        #[arg(long, value_enum, default_value_t = PreviewMode::Sidecar)]
+        previews: PreviewMode,
+
+        /// Hardlink sidecars with identical content instead of storing copies
+        #[arg(long)]
+        dedupe_sidecars: bool,
+
+        /// Only consider files modified since the last import from this source
+        #[arg(long)]
+        since_last_import: bool,
+
+        /// Ignore the last-import mark and consider every file
+        #[arg(long)]
+        force: bool,
+
+        /// What to do when a file already exists at the destination
+        #[arg(long, value_enum, default_value_t = DestExistsPolicy::Overwrite)]
+        dest_exists_policy: DestExistsPolicy,
+
+        /// Hash characters added to a file renamed by --dest-exists-policy rename (default 8); more are used when needed to keep names unique
+        #[arg(long, value_name = "N", value_parser = clap::value_parser!(u8).range(4..=64))]
+        dest_collision_hash_suffix_length: Option<u8>,
+
+        /// Format of the summary printed at the end
+        #[arg(long, value_enum, default_value_t = ReportFormat::Text)]
+        report_format: ReportFormat,
+
+        /// exiftool config file defining extra tags (must be named .ExifTool_config)
+        #[arg(long)]
+        exiftool_config: Option<PathBuf>,
+
+        /// Extra argument passed to exiftool for every file, one per flag (e.g. --exiftool-arg=-api --exiftool-arg=LargeFileSupport=1)
+        #[arg(long = "exiftool-arg", allow_hyphen_values = true)]
+        exiftool_args: Vec<String>,
+
+        /// Fail if exiftool isn't installed instead of dating files by their timestamps
+        #[arg(long)]
+        require_exif: bool,
+
+        /// Folder next to each photo that also holds sidecars, `*` allowed (repeatable, e.g. "CaptureOne/Settings*")
+        #[arg(long = "sidecar-subfolder")]
+        sidecar_subfolders: Vec<String>,
+
+        /// Leave out images below this resolution (e.g. 2 to skip thumbnails)
+        #[arg(long)]
+        min_megapixels: Option<f64>,
+
+        /// Leave out images above this resolution (e.g. 100 to skip panoramas)
+        #[arg(long)]
+        max_megapixels: Option<f64>,
+
+        /// Shell command run for each newly added photo or video, given its library path and hash
+        #[arg(long)]
+        after_import_hook: Option<String>,
+
+        /// Store aliased extensions under one filetype (JPEG as JPG, TIF as TIFF, HEIF as HEIC)
+        #[arg(long)]
+        canonical_ext: bool,
+
+        /// Extra filetype alias for --canonical-ext, as FROM=TO (repeatable, e.g. JFIF=JPG)
+        #[arg(long = "ext-alias", value_parser = parse_ext_alias, requires = "canonical_ext")]
+        ext_aliases: Vec<(String, String)>,
+
+        /// Make repeated imports of one source produce identical records (no prompts, fixed import time)
+        #[arg(long)]
+        deterministic: bool,
+
+        /// Date files by their IPTC date created before EXIF dates (for scanned prints and film)
+        #[arg(long)]
+        prefer_iptc_date: bool,
+
+        /// Checksum file (sha256sum format, paths relative to the source) to check the source against before importing
+        #[arg(long)]
+        verify_source: Option<PathBuf>,
+
+        /// What to do when a source file doesn't match --verify-source
+        #[arg(long, value_enum, default_value_t = SourceMismatchPolicy::Abort, requires = "verify_source")]
+        on_source_mismatch: SourceMismatchPolicy,
+
+        /// What to do when the same photo is found twice with different sidecars, instead of asking
+        #[arg(long, value_enum, value_name = "POLICY")]
+        on_duplicate_sidecar_conflict: Option<SidecarConflictPolicy>,
+
+        /// Store a filetype under its own top-level folder instead of images/ or videos/, as TYPE=FOLDER (repeatable, e.g. RAW=raw JPG=jpg; RAW covers every raw format). Saved for later imports
+        #[arg(long = "route-by-type", value_parser = parse_type_route)]
+        type_routes: Vec<(String, String)>,
+
+        /// Index files where they are instead of copying them into the library; records point into the source directory
+        #[arg(long, conflicts_with_all = ["include_sidecars_without_photo", "sidecar_subfolders", "type_routes", "dedupe_sidecars"])]
+        catalog: bool,
+
+        /// Remove metadata from the copies in the library (never the source), for sharing it. The database keeps the original values. Only applies to formats exiftool rewrites safely, such as JPEG and HEIC
+        #[arg(long, value_enum, conflicts_with = "catalog")]
+        strip: Option<StripMetadata>,
+
+        /// List every copy of files found more than once in the source, marking the one imported
+        #[arg(long)]
+        report_duplicates: bool,
+
+        /// Record where each file was in the source folder (e.g. Albums/Wedding/IMG_1.jpg), keeping the original organization after sorting by date
+        #[arg(long)]
+        archive_original_structure: bool,
+
+        /// Import only the files listed in this file, one path per line ("-" reads the list from stdin), instead of everything in the source directory. Sidecars next to a listed photo come along
+        #[arg(long, value_name = "LIST", conflicts_with = "verify_source")]
+        files: Option<PathBuf>,
+
+        /// Paths in the file list are separated by NUL characters, as `find -print0` writes them, instead of newlines
+        #[arg(long)]
+        null: bool,
+
+        /// Copy at most this much per second in total, to spare a shared NAS or network link (e.g. 50MB/s; KB, MB, and GB are powers of 1024)
+        #[arg(long, value_parser = parse_rate)]
+        max_rate: Option<u64>,
+
+        /// Print the library folders the import would create or add to, with the files each would hold, instead of importing (implies --dry-run)
+        #[arg(long, value_enum, value_name = "FORMAT")]
+        output_structure: Option<StructureFormat>,
+
+        /// Report the space the import needs and roughly how long copying takes, timing a short write to the library, instead of importing (implies --dry-run)
+        #[arg(long)]
+        estimate: bool,
+
+        /// Which date to record as a sidecar's modification date. `push` uses it to tell which copy of a sidecar is newer
+        #[arg(long, value_enum, default_value_t = SidecarDate::Own)]
+        sidecar_date: SidecarDate,
+
+        /// Verify the library once the import is done, failing if any file is missing or damaged
+        #[arg(long)]
+        verify_after_import: bool,
+
+        /// Check only a random part of the library after importing (e.g. 10%)
+        #[arg(long, value_parser = parse_sample, requires = "verify_after_import")]
+        verify_sample: Option<f64>,
+
+        /// Look inside hidden folders of the source (like .thumbnails or .git), which are skipped by default
+        #[arg(long)]
+        include_hidden_dirs: bool,
+
+        /// Import hidden files (names starting with a dot, like macOS ._IMG_1.JPG), which are skipped by default
+        #[arg(long)]
+        include_hidden_files: bool,
+
+        /// Import from folders holding a photosort library of their own, which are skipped by default
+        #[arg(long)]
+        include_nested_libraries: bool,
+
+        /// Compare and store filenames in Unicode NFC, so accented names written on macOS
+        /// match sidecars and library files named on Linux or Windows
+        #[arg(long)]
+        normalize_unicode: bool,
+
+        /// Skip files whose database record can't be written, reporting them, instead of failing the import
+        #[arg(long)]
+        continue_on_db_error: bool,
+
+        /// Write each copy under a temporary name, sync it to disk and then rename it,
+        /// so a crash never leaves a partial file in the library
+        #[arg(long)]
+        two_pass_copy: bool,
+
+        /// Date files with no capture date in their metadata by a date in their name
+        /// (IMG_20240102_150405.jpg, Screenshot 2024-01-02 at 15.04.05.png) before their file timestamps
+        #[arg(long)]
+        date_from_filename: bool,
+
+        /// Another file name date pattern to try first, e.g. "[day].[month].[year]" (repeatable)
+        #[arg(long, value_name = "PATTERN", value_parser = parse_filename_date_pattern, requires = "date_from_filename")]
+        filename_date_pattern: Vec<OwnedFormatItem>,
+
+        /// Stop before importing anything if the source holds more than this many files
+        #[arg(long, value_name = "N")]
+        max_files: Option<usize>,
+
+        /// Order new photos and videos are recorded in, which their ids follow
+        #[arg(long, value_enum, default_value_t = ImportOrder::Source)]
+        import_order: ImportOrder,
+
+        /// Skip source folders with this name, or at this path relative to the source
+        /// (repeatable or comma-separated, e.g. "MISC,PRIVATE/M4ROOT/THMBNL")
+        #[arg(long = "exclude-dir", value_name = "DIR", value_delimiter = ',')]
+        exclude_dirs: Vec<PathBuf>,
+
+        /// Flag new photos taken within this many seconds of a different library photo from the same camera, as possible re-saved copies
+        #[arg(long, value_name = "SECONDS")]
+        import_mtime_window: Option<u64>,
+
+        /// Don't copy sidecars into the library: "record" still records them in the database, "all" leaves them out entirely
+        #[arg(long, value_enum, value_name = "MODE", num_args = 0..=1, default_missing_value = "record")]
+        skip_sidecar_copy: Option<SkipSidecarCopy>,
+
+        /// Whether names differing only in case, like IMG_1.JPG and img_1.jpg, are the same file when matching sidecars and checking destinations
+        #[arg(long, value_enum, default_value_t = NameCase::Auto)]
+        name_case: NameCase,
+    },
+
+    /// Move photos and videos stored more than once in a folder to its trash, without a library
+    DedupeDir {
+        /// Folder to clean up
+        #[arg(required = true)]
+        dir: PathBuf,
+
+        /// List the duplicates without moving anything
+        #[arg(long)]
+        dry_run: bool,
+    },
+
+    /// Show what an import would make of a source folder, without a library
+    Inspect {
+        /// Folder to inspect
+        #[arg(required = true)]
+        source_dir: PathBuf,
+
+        /// Output format
+        #[arg(long, value_enum, default_value_t = OutputFormat::Table)]
+        output: OutputFormat,
+
+        /// Hash characters shown in table output (0 for the whole hash)
+        #[arg(long, default_value_t = DEFAULT_SHORT_HASH_LEN)]
+        hash_prefix_length: usize,
+
+        /// How hashes are written, as a library created with this encoding would store them
+        #[arg(long, value_enum, default_value_t = HashEncoding::Base64)]
+        hash_encoding: HashEncoding,
+
+        /// Look inside hidden folders of the source, which are skipped by default
+        #[arg(long)]
+        include_hidden_dirs: bool,
+
+        /// Include hidden files, which are skipped by default
+        #[arg(long)]
+        include_hidden_files: bool,
     },
 
     /// Scan library for filesystem changes
@@ -47,6 +348,100 @@ pub enum Commands {
         /// Library to scan
         #[arg(required = true)]
         library_dir: PathBuf,
+
+        /// Match files moved within the library to their database rows by hash
+        #[arg(long)]
+        relink: bool,
+
+        /// Only remove the records of files and sidecars deleted from disk, without asking and without looking for new or changed files
+        #[arg(long, conflicts_with = "relink")]
+        prune_db_only: bool,
+
+        /// Also look for sidecars next to photos that the database doesn't record, such as .xmp files written by an editor after import, and offer to attach them
+        #[arg(long, conflicts_with = "prune_db_only")]
+        report_unmatched_sidecars: bool,
+
+        /// Show what the scan would change without changing anything
+        #[arg(long)]
+        dry_run: bool,
+    },
+
+    /// Attach sidecars already in the library that aren't recorded yet
+    RescanSidecars {
+        /// Library to rescan
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Also treat files with this extension as sidecars, here and in later imports (repeatable)
+        #[arg(long = "ext", value_parser = parse_sidecar_ext)]
+        extensions: Vec<String>,
+
+        /// List the sidecars that would be attached without changing anything
+        #[arg(long)]
+        dry_run: bool,
+    },
+
+    /// Merge other libraries into a library, deduplicating across all of them
+    Merge {
+        /// Library to merge into
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Libraries to merge from
+        #[arg(required = true)]
+        sources: Vec<PathBuf>,
+
+        /// Show what would be merged without making changes
+        #[arg(long)]
+        dry_run: bool,
+    },
+
+    /// Remove media and their sidecars from the library
+    Remove {
+        /// Library to remove from
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Media files to remove, by path or by a unique prefix of their hash
+        #[arg(required = true)]
+        paths: Vec<PathBuf>,
+
+        /// Show what would be removed without making changes
+        #[arg(long)]
+        dry_run: bool,
+
+        /// Delete files outright instead of moving them to the library's trash
+        #[arg(long)]
+        permanent: bool,
+    },
+
+    /// Rewrite a library's stored hashes in another encoding
+    ConvertHashes {
+        /// Library to convert
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Encoding to store hashes in from now on
+        #[arg(long, value_enum)]
+        to: HashEncoding,
+    },
+
+    /// Permanently delete files in the library's trash
+    EmptyTrash {
+        /// Library whose trash to empty
+        #[arg(required = true)]
+        library_dir: PathBuf,
+    },
+
+    /// Revert the most recent import, scan, remove, or merge
+    Undo {
+        /// Library to undo changes in
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Show what would be undone without changing anything
+        #[arg(long)]
+        dry_run: bool,
     },
 
     /// Search for media matching filters
@@ -90,6 +485,18 @@ pub enum Commands {
         /// Output format
         #[arg(long, value_enum, default_value_t = OutputFormat::Paths)]
         output: OutputFormat,
+
+        /// Hash characters shown in table output (0 for the whole hash)
+        #[arg(long, default_value_t = DEFAULT_SHORT_HASH_LEN)]
+        hash_prefix_length: usize,
+
+        /// How media taken within the same second, like burst frames, are ordered
+        #[arg(long, value_enum, default_value_t = WithinSecond::Subsec)]
+        sort_within_second: WithinSecond,
+
+        /// Show paths relative to the library root instead of absolute paths
+        #[arg(long)]
+        output_relative_paths: bool,
     },
 
     /// Show library statistics
@@ -97,6 +504,192 @@ pub enum Commands {
         /// Library to show stats for
         #[arg(required = true)]
         library_dir: PathBuf,
+
+        /// Format of the output
+        #[arg(long, value_enum, default_value_t = ReportFormat::Text)]
+        report_format: ReportFormat,
+
+        /// Also show the average and median photo size and list the largest files
+        #[arg(long)]
+        by_size: bool,
+
+        /// How many of the largest files to list
+        #[arg(long, default_value_t = 10, requires = "by_size")]
+        top: usize,
+    },
+
+    /// List the folders media are stored in, flagging any outside the date layout
+    Folders {
+        /// Library to list folders of
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Only list folders that don't follow the layout
+        #[arg(long)]
+        nonconforming: bool,
+    },
+
+    /// List filenames used by more than one photo or video, within a folder or across folders
+    NameCollisions {
+        /// Library to check
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Format of the output
+        #[arg(long, value_enum, default_value_t = ReportFormat::Text)]
+        report_format: ReportFormat,
+    },
+
+    /// Verify library files against their stored hashes
+    Verify {
+        /// Library to verify
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Only check a random fraction of files (e.g., "10%")
+        #[arg(long, value_parser = parse_sample)]
+        sample: Option<f64>,
+
+        /// Seed for choosing the sample, to reproduce a previous run
+        #[arg(long)]
+        seed: Option<u64>,
+
+        /// Also check that every photo is filed in the folder its date and type sort it into
+        #[arg(long)]
+        check_folders: bool,
+
+        /// Format of the summary printed at the end
+        #[arg(long, value_enum, default_value_t = ReportFormat::Text)]
+        report_format: ReportFormat,
+    },
+
+    /// Check the library database for damage and broken references, as opposed to its files
+    DbCheck {
+        /// Library whose database to check
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Format of the summary printed at the end
+        #[arg(long, value_enum, default_value_t = ReportFormat::Text)]
+        report_format: ReportFormat,
+    },
+
+    /// Copy missing library files back into place from a source, matched by hash
+    Rehydrate {
+        /// Library to repair
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Directory holding copies of the missing files (e.g. the original card)
+        #[arg(required = true)]
+        source_dir: PathBuf,
+
+        /// Show what would be restored without copying anything
+        #[arg(long)]
+        dry_run: bool,
+    },
+
+    /// Rename media stored under a duplicate's name to the copy imports keep today,
+    /// the first in name order, by looking at the source they came from again
+    RecomputeWinners {
+        /// Library to repair
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Directory the media were imported from, holding all their copies
+        #[arg(required = true)]
+        source_dir: PathBuf,
+
+        /// Show what would be renamed without changing anything
+        #[arg(long)]
+        dry_run: bool,
+    },
+
+    /// Recompute derived fields for media already in the library
+    Refresh {
+        /// Library to refresh
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Read pixel width and height
+        #[arg(long)]
+        dimensions: bool,
+
+        /// Recompute fields that are already filled, not only missing ones
+        #[arg(long)]
+        all: bool,
+    },
+
+    /// Read one photo or video's metadata again, moving it if its date changed
+    Reimport {
+        /// Library holding the media
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// The media, by path or by a unique prefix of its hash
+        #[arg(required = true)]
+        media: PathBuf,
+
+        /// Read the metadata from this copy of the file instead of the library's
+        #[arg(long, value_name = "FILE")]
+        from: Option<PathBuf>,
+
+        /// Date the file by a date in its name if its metadata has none
+        #[arg(long)]
+        date_from_filename: bool,
+
+        /// Date the file by its IPTC date created before EXIF dates
+        #[arg(long)]
+        prefer_iptc_date: bool,
+
+        /// Show what would change without changing anything
+        #[arg(long)]
+        dry_run: bool,
+    },
+
+    /// Export the library catalog for use in spreadsheets and other tools
+    Export {
+        /// Library to export
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// File to write media rows to
+        #[arg(required = true)]
+        output: PathBuf,
+
+        /// Output format
+        #[arg(long, value_enum, default_value_t = ExportFormat::Csv)]
+        format: ExportFormat,
+
+        /// Also write sidecar rows to this file
+        #[arg(long)]
+        sidecars: Option<PathBuf>,
+
+        /// How media taken within the same second, like burst frames, are ordered
+        #[arg(long, value_enum, default_value_t = WithinSecond::Subsec)]
+        sort_within_second: WithinSecond,
+    },
+
+    /// Write a library, files and database, to a single .tar bundle
+    ExportBundle {
+        /// Library to bundle
+        #[arg(required = true)]
+        library_dir: PathBuf,
+
+        /// Bundle file to write (e.g., library.tar)
+        #[arg(required = true)]
+        output: PathBuf,
+    },
+
+    /// Restore a library from a bundle, checking every file against its manifest
+    ImportBundle {
+        /// Bundle written by export-bundle
+        #[arg(required = true)]
+        bundle: PathBuf,
+
+        /// Directory for the restored library (must not exist or be empty)
+        #[arg(required = true)]
+        library_dir: PathBuf,
     },
 
     /// Backup library to a directory.
@@ -139,6 +732,18 @@ pub enum Commands {
         /// Show what would be pushed without making changes
         #[arg(long)]
         dry_run: bool,
+
+        /// Check the media copied to the remote against their hashes once the push is done, failing if any is missing or damaged. Needs a mounted remote
+        #[arg(long)]
+        verify_after_sync: bool,
+
+        /// Check only a random part of the copied media (e.g. 10%)
+        #[arg(long, value_parser = parse_sample, requires = "verify_after_sync")]
+        verify_sample: Option<f64>,
+
+        /// Wait up to this many seconds (30 if not given) for either library to be unlocked by another process, instead of failing
+        #[arg(long, value_name = "SECONDS", num_args = 0..=1, default_missing_value = "30")]
+        keep_going_past_db_lock: Option<u64>,
     },
 
     /// Display library or file information
@@ -147,11 +752,54 @@ pub enum Commands {
         #[arg(required = true)]
         library_dir: PathBuf,
 
-        /// Specific file to show detailed info for (optional)
+        /// Specific file to show detailed info for, by path or by a unique prefix of its hash (optional)
         file_path: Option<PathBuf>,
+
+        /// Hash characters shown (0 for the whole hash)
+        #[arg(long, default_value_t = DEFAULT_SHORT_HASH_LEN)]
+        hash_prefix_length: usize,
+
+        /// Show the file's path relative to the library root instead of an absolute path
+        #[arg(long)]
+        output_relative_paths: bool,
     },
 }
 
+impl Commands {
+    /// The existing library a command works on, if any.
+    pub fn library_dir(&self) -> Option<&Path> {
+        match self {
+            Commands::Create { .. }
+            | Commands::DedupeDir { .. }
+            | Commands::Inspect { .. }
+            | Commands::ImportBundle { .. } => None,
+            Commands::Push { local_library, .. } => Some(local_library),
+            Commands::Import { library_dir, .. }
+            | Commands::Scan { library_dir, .. }
+            | Commands::RescanSidecars { library_dir, .. }
+            | Commands::Merge { library_dir, .. }
+            | Commands::Remove { library_dir, .. }
+            | Commands::ConvertHashes { library_dir, .. }
+            | Commands::EmptyTrash { library_dir }
+            | Commands::Undo { library_dir, .. }
+            | Commands::Search { library_dir, .. }
+            | Commands::Stats { library_dir, .. }
+            | Commands::Folders { library_dir, .. }
+            | Commands::NameCollisions { library_dir, .. }
+            | Commands::Verify { library_dir, .. }
+            | Commands::DbCheck { library_dir, .. }
+            | Commands::Rehydrate { library_dir, .. }
+            | Commands::RecomputeWinners { library_dir, .. }
+            | Commands::Refresh { library_dir, .. }
+            | Commands::Reimport { library_dir, .. }
+            | Commands::Export { library_dir, .. }
+            | Commands::ExportBundle { library_dir, .. }
+            | Commands::Backup { library_dir, .. }
+            | Commands::Info { library_dir, .. } => Some(library_dir),
+        }
+    }
+}
+
 #[derive(Debug, Clone, ValueEnum)]
 pub enum MediaTypeFilter {
     Image,
@@ -168,3 +816,328 @@ pub enum OutputFormat {
     /// Detailed table format
     Table,
 }
+
+#[derive(Debug, Clone, ValueEnum)]
+pub enum ExportFormat {
+    /// Comma-separated values, one row per file
+    Csv,
+    /// JSON array of objects
+    Json,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum StructureFormat {
+    /// One object mapping each folder to its filenames
+    Json,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum ReportFormat {
+    /// Human-readable summary
+    #[default]
+    Text,
+    /// A single JSON object
+    Json,
+    /// field,value rows followed by one block per list
+    Csv,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum SidecarDate {
+    /// The sidecar file's own modification time, when it was last edited
+    #[default]
+    Own,
+    /// The capture date of its photo or video
+    Photo,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum WithinSecond {
+    /// By fractions of a second, where the camera recorded them, then by filename
+    #[default]
+    Subsec,
+    /// By filename
+    Name,
+    /// By file size
+    Size,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum ImportOrder {
+    /// The order files were found in the source
+    #[default]
+    Source,
+    /// Oldest capture date first
+    Date,
+    /// By filename
+    Name,
+    /// Smallest file first
+    Size,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum PreviewMode {
+    /// Store previews alongside their full-resolution file as sidecars
+    #[default]
+    Sidecar,
+    /// Import previews as media of their own
+    Import,
+    /// Leave previews out of the library
+    Skip,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum NameCase {
+    /// As the filesystem treats them: the source's for sidecars, the library's for destinations
+    #[default]
+    Auto,
+    /// Names differing in case are different files
+    Sensitive,
+    /// Names differing only in case are the same file, as on macOS and Windows disks
+    Insensitive,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum SkipSidecarCopy {
+    /// Record sidecars in the database without copying their files
+    Record,
+    /// Leave sidecars out of the library and its database
+    All,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum StorageLayout {
+    /// Files live in their date folders
+    #[default]
+    Date,
+    /// Files are stored once under objects/ by hash; date folders hold symlinks
+    Content,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum DateGranularity {
+    /// A folder per year: images/2024
+    Year,
+    /// A folder per month: images/2024/05
+    Month,
+    /// A folder per day: images/2024/05-21
+    #[default]
+    Day,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum HashEncoding {
+    /// SHA-256 in base64, as libraries have always stored it
+    #[default]
+    Base64,
+    /// SHA-256 in lowercase hex, as printed by sha256sum
+    Hex,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum DestExistsPolicy {
+    /// Replace the existing file
+    #[default]
+    Overwrite,
+    /// Keep the existing file (warning if its content differs)
+    Skip,
+    /// Store the new file under a name ending in part of its content hash, such as IMG_0001_3f9a02c1.jpg
+    Rename,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum ProgressTheme {
+    /// Smooth block characters and a braille spinner
+    #[default]
+    Unicode,
+    /// Plain ASCII, for consoles and CI logs that garble the others
+    Ascii,
+}
+
+/// Metadata removed from files copied into the library.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum StripMetadata {
+    /// GPS position tags
+    Gps,
+    /// Everything except what's needed to display the image (orientation, color profile)
+    All,
+}
+
+/// What to do with source files that don't match `--verify-source`.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum SourceMismatchPolicy {
+    /// Import nothing
+    #[default]
+    Abort,
+    /// Leave out files that don't match or aren't listed, importing the rest
+    Skip,
+}
+
+/// Which copy to keep when the same photo turns up twice with different sidecars.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum SidecarConflictPolicy {
+    /// Keep the copy found first, with its sidecars
+    KeepOld,
+    /// Keep the copy found later, with its sidecars
+    KeepNew,
+    /// Keep the copy whose sidecars were modified most recently
+    KeepNewer,
+    /// Keep the first copy with both sets of sidecars, storing differing ones under a suffixed name
+    KeepBoth,
+}
+
+/// Parse an octal permission mode such as "755" or "0o2775".
+pub fn parse_mode(s: &str) -> Result<u32, String> {
+    let digits = s.trim_start_matches("0o");
+    let mode = u32::from_str_radix(digits, 8).map_err(|_| format!("invalid octal mode: {}", s))?;
+    if mode > 0o7777 {
+        return Err(format!("mode out of range: {}", s));
+    }
+    Ok(mode)
+}
+
+/// Parse a filetype alias such as "JFIF=JPG" into uppercase (from, to).
+pub fn parse_ext_alias(s: &str) -> Result<(String, String), String> {
+    let (from, to) = s.split_once('=').ok_or_else(|| format!("expected FROM=TO: {}", s))?;
+    let from = from.trim().trim_start_matches('.');
+    let to = to.trim().trim_start_matches('.');
+    if from.is_empty() || to.is_empty() {
+        return Err(format!("expected FROM=TO: {}", s));
+    }
+    Ok((from.to_uppercase(), to.to_uppercase()))
+}
+
+/// Parse a filetype route such as "NEF=raw" or "jpg=photos/jpg".
+pub fn parse_type_route(s: &str) -> Result<(String, String), String> {
+    let (filetype, folder) = s.split_once('=').ok_or_else(|| format!("expected TYPE=FOLDER: {}", s))?;
+    let filetype = filetype.trim().trim_start_matches('.');
+    let folder = folder.trim().trim_end_matches('/');
+    if filetype.is_empty() || folder.is_empty() {
+        return Err(format!("expected TYPE=FOLDER: {}", s));
+    }
+    // Stays inside the library, and clear of the folders it manages itself
+    let parts: Vec<&str> = folder.split('/').collect();
+    if folder.starts_with('/') || parts.iter().any(|p| p.is_empty() || *p == "." || *p == "..") {
+        return Err(format!("folder must be a relative path inside the library: {}", folder));
+    }
+    if parts[0].starts_with('.') || [OBJECTS_DIR, ORPHANS_DIR].contains(&parts[0]) {
+        return Err(format!("folder is reserved by the library: {}", folder));
+    }
+    Ok((filetype.to_uppercase(), folder.to_string()))
+}
+
+/// Parse a sample rate such as "10%" or "0.1" into a fraction, so a bad
+/// value is reported with the other argument errors.
+pub fn parse_sample(s: &str) -> Result<f64, String> {
+    parse_sample_rate(s).map_err(|e| e.to_string())
+}
+
+/// Parse a file name date pattern in the `time` crate's format description syntax.
+pub fn parse_filename_date_pattern(s: &str) -> Result<OwnedFormatItem, String> {
+    time::format_description::parse_owned::<2>(s).map_err(|e| e.to_string())
+}
+
+/// Parse a transfer rate such as "50MB/s" or "512KB" into bytes per second.
+pub fn parse_rate(s: &str) -> Result<u64, String> {
+    let upper = s.trim().to_uppercase();
+    let size = upper.strip_suffix("/S").unwrap_or(&upper);
+    let (digits, multiplier) = [("GB", 1 << 30), ("MB", 1 << 20), ("KB", 1 << 10), ("B", 1)]
+        .iter()
+        .find_map(|(unit, m)| size.strip_suffix(unit).map(|d| (d, *m)))
+        .unwrap_or((size, 1));
+    match digits.trim().parse::<u64>().ok().and_then(|n| n.checked_mul(multiplier)) {
+        Some(rate) if rate > 0 => Ok(rate),
+        _ => Err(format!("expected a rate such as 50MB/s: {}", s)),
+    }
+}
+
+/// Parse a sidecar extension such as ".pte" into lowercase without the dot.
+pub fn parse_sidecar_ext(s: &str) -> Result<String, String> {
+    let ext = s.trim().trim_start_matches('.');
+    if ext.is_empty() || ext.contains(['/', '\\', '.']) {
+        return Err(format!("invalid extension: {}", s));
+    }
+    if is_media_extension(ext) {
+        return Err(format!("{} files are imported as media, not sidecars", ext));
+    }
+    Ok(ext.to_lowercase())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_type_route() {
+        assert_eq!(parse_type_route(".nef=raw/"), Ok(("NEF".to_string(), "raw".to_string())));
+        assert_eq!(parse_type_route("JPG = photos/jpg"), Ok(("JPG".to_string(), "photos/jpg".to_string())));
+        assert!(parse_type_route("raw").is_err());
+        assert!(parse_type_route("RAW=../raw").is_err());
+        assert!(parse_type_route("RAW=/raw").is_err());
+        assert!(parse_type_route("RAW=objects").is_err());
+    }
+
+    #[test]
+    fn test_parse_mode() {
+        assert_eq!(parse_mode("755"), Ok(0o755));
+        assert_eq!(parse_mode("0700"), Ok(0o700));
+        assert_eq!(parse_mode("0o2775"), Ok(0o2775));
+        assert!(parse_mode("789").is_err());
+        assert!(parse_mode("17777").is_err());
+        assert!(parse_mode("rwx").is_err());
+    }
+
+    #[test]
+    fn test_parse_ext_alias() {
+        assert_eq!(parse_ext_alias("jfif=jpg"), Ok(("JFIF".to_string(), "JPG".to_string())));
+        assert_eq!(parse_ext_alias(".tif = .tiff"), Ok(("TIF".to_string(), "TIFF".to_string())));
+        assert!(parse_ext_alias("jfif").is_err());
+        assert!(parse_ext_alias("=jpg").is_err());
+    }
+
+    #[test]
+    fn test_typed_flags() {
+        let parse = |args: &[&str]| Cli::try_parse_from(["photosort"].iter().chain(args));
+        let verify = |args: &[&str]| match parse(&[&["verify", "lib"], args].concat()).map(|cli| cli.command) {
+            Ok(Commands::Verify { sample, seed, .. }) => Ok((sample, seed)),
+            Ok(other) => panic!("parsed as {:?}", other),
+            Err(e) => Err(e.kind()),
+        };
+
+        assert_eq!(verify(&[]), Ok((None, None)));
+        assert_eq!(verify(&["--sample", "10%", "--seed", "7"]), Ok((Some(0.1), Some(7))));
+        assert_eq!(verify(&["--sample", "0.5"]), Ok((Some(0.5), None)));
+        for bad in [&["--sample", "ten"][..], &["--sample", "150%"], &["--seed", "seven"]] {
+            assert_eq!(verify(bad), Err(clap::error::ErrorKind::ValueValidation), "{:?}", bad);
+        }
+
+        let cli = parse(&["stats", "lib"]).unwrap();
+        assert_eq!(cli.progress_width, DEFAULT_BAR_WIDTH);
+        assert_eq!(parse(&["stats", "lib", "--progress-width", "20"]).unwrap().progress_width, 20);
+        for bad in ["0", "wide", "-3"] {
+            assert!(parse(&["stats", "lib", "--progress-width", bad]).is_err(), "{}", bad);
+        }
+        assert!(parse(&["create", "lib", "--dir-mode", "799"]).is_err());
+        assert!(parse(&["import", "src", "lib", "--max-rate", "fast"]).is_err());
+        // Flags whose values depend on another must come with it
+        assert!(parse(&["import", "src", "lib", "--verify-sample", "10%"]).is_err());
+    }
+
+    #[test]
+    fn test_parse_rate() {
+        assert_eq!(parse_rate("50MB/s"), Ok(50 * 1024 * 1024));
+        assert_eq!(parse_rate("512kb"), Ok(512 * 1024));
+        assert_eq!(parse_rate("1000"), Ok(1000));
+        assert!(parse_rate("0MB/s").is_err());
+        assert!(parse_rate("fast").is_err());
+    }
+
+    #[test]
+    fn test_parse_sidecar_ext() {
+        assert_eq!(parse_sidecar_ext(".PTE"), Ok("pte".to_string()));
+        assert_eq!(parse_sidecar_ext("arp"), Ok("arp".to_string()));
+        assert!(parse_sidecar_ext("").is_err());
+        assert!(parse_sidecar_ext("a/b").is_err());
+        assert!(parse_sidecar_ext("jpg").is_err());
+    }
+}
@@ -1,15 +1,277 @@
-use crate::photosort_core::error::Result;
-use rusqlite::Connection;
+use crate::photosort_core::error::{PhotosortError, Result};
+use crate::photosort_core::report::Report;
+use rusqlite::{Connection, ErrorCode, OpenFlags, OptionalExtension};
 use rusqlite_migration::{M, Migrations};
 use std::path::Path;
+use std::sync::OnceLock;
+use std::time::{Duration, Instant};
+
+/// How long a read-only handle waits for a lock held by a writer.
+const READ_ONLY_BUSY_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// How long recovery waits for other connections before deciding one is still live.
+const RECOVER_BUSY_TIMEOUT: Duration = Duration::from_secs(2);
+
+/// How often a locked library is tried again by `wait_while_locked`.
+const LOCK_RETRY_INTERVAL: Duration = Duration::from_millis(250);
+
+/// Size the write-ahead log is kept to between changes, unless configured otherwise.
+pub const DEFAULT_WAL_LIMIT: u64 = 64 * 1024 * 1024;
+
+static WAL_LIMIT: OnceLock<u64> = OnceLock::new();
+
+/// Choose the write-ahead log size every library opened for writing in this
+/// process keeps to. Only the first call counts.
+pub fn configure_wal_limit(bytes: u64) {
+    let _ = WAL_LIMIT.set(bytes.max(1));
+}
+
+/// Shortest hash prefix looked up, so a short word isn't mistaken for one.
+pub const MIN_HASH_PREFIX: usize = 4;
+
+/// Schema migrations, applied in order. The schema version is how many have run.
+const MIGRATIONS: &[M<'static>] = &[
+    // Migration 1: Initial schema (v2)
+    M::up(
+        r#"
+        -- Main media table (photos and videos)
+        CREATE TABLE IF NOT EXISTS media (
+            id INTEGER PRIMARY KEY,
+            hash TEXT UNIQUE NOT NULL,
+            filename TEXT NOT NULL,
+            relpath TEXT NOT NULL,
+            media_type TEXT NOT NULL CHECK (media_type IN ('image', 'video')),
+            filetype TEXT NOT NULL,
+            file_size INTEGER NOT NULL,
+            created_at TEXT NOT NULL,
+            imported_at TEXT NOT NULL,
+
+            -- EXIF metadata (nullable)
+            camera_make TEXT,
+            camera_model TEXT,
+            lens TEXT,
+            focal_length TEXT,
+            aperture TEXT,
+            shutter_speed TEXT,
+            iso INTEGER,
+            gps_lat REAL,
+            gps_lon REAL
+        );
+
+        -- Sidecars linked to media
+        CREATE TABLE IF NOT EXISTS sidecars (
+            id INTEGER PRIMARY KEY,
+            media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+            filename TEXT NOT NULL,
+            filetype TEXT NOT NULL,
+            file_size INTEGER NOT NULL,
+            hash TEXT NOT NULL,
+            modified_at TEXT NOT NULL,
+            UNIQUE(media_id, filename)
+        );
+
+        -- Backup tracking
+        CREATE TABLE IF NOT EXISTS backup_history (
+            id INTEGER PRIMARY KEY,
+            target_path TEXT NOT NULL,
+            started_at TEXT NOT NULL,
+            completed_at TEXT,
+            files_copied INTEGER DEFAULT 0,
+            bytes_copied INTEGER DEFAULT 0,
+            status TEXT NOT NULL CHECK (status IN ('running', 'completed', 'failed'))
+        );
+
+        CREATE TABLE IF NOT EXISTS backup_state (
+            media_id INTEGER PRIMARY KEY REFERENCES media(id) ON DELETE CASCADE,
+            last_backup_id INTEGER REFERENCES backup_history(id),
+            backed_up_at TEXT
+        );
+
+        -- Indexes for search performance
+        CREATE INDEX IF NOT EXISTS idx_media_type ON media(media_type);
+        CREATE INDEX IF NOT EXISTS idx_media_created ON media(created_at);
+        CREATE INDEX IF NOT EXISTS idx_media_filetype ON media(filetype);
+        CREATE INDEX IF NOT EXISTS idx_media_camera ON media(camera_model);
+        CREATE INDEX IF NOT EXISTS idx_media_file_size ON media(file_size);
+        CREATE INDEX IF NOT EXISTS idx_media_hash ON media(hash);
+        "#,
+    ),
+    // Migration 2: Operation journal for undo
+    M::up(
+        r#"
+        CREATE TABLE IF NOT EXISTS operations (
+            id INTEGER PRIMARY KEY,
+            kind TEXT NOT NULL,
+            started_at TEXT NOT NULL,
+            undone_at TEXT
+        );
+
+        CREATE TABLE IF NOT EXISTS operation_entries (
+            id INTEGER PRIMARY KEY,
+            operation_id INTEGER NOT NULL REFERENCES operations(id) ON DELETE CASCADE,
+            entry TEXT NOT NULL
+        );
+
+        CREATE INDEX IF NOT EXISTS idx_operation_entries_op ON operation_entries(operation_id);
+        "#,
+    ),
+    // Migration 3: Per-source high-water marks for incremental imports
+    M::up(
+        r#"
+        CREATE TABLE IF NOT EXISTS import_marks (
+            source_root TEXT PRIMARY KEY,
+            imported_at INTEGER NOT NULL  -- Unix seconds when the last import started
+        );
+        "#,
+    ),
+    // Migration 4: Library-wide settings chosen at creation
+    M::up(
+        r#"
+        CREATE TABLE IF NOT EXISTS settings (
+            key TEXT PRIMARY KEY,
+            value TEXT NOT NULL
+        );
+        "#,
+    ),
+    // Migration 5: Pixel dimensions, filled on import or by `refresh --dimensions`
+    M::up(
+        r#"
+        ALTER TABLE media ADD COLUMN width INTEGER;
+        ALTER TABLE media ADD COLUMN height INTEGER;
+        "#,
+    ),
+    // Migration 6: Hash of the stored file when it differs from the source's, after `import --strip`
+    M::up(
+        r#"
+        ALTER TABLE media ADD COLUMN stored_hash TEXT;
+        "#,
+    ),
+    // Migration 7: Where in the source a file came from, with `import --archive-original-structure`
+    M::up(
+        r#"
+        ALTER TABLE media ADD COLUMN original_path TEXT;
+        "#,
+    ),
+];
 
 pub struct Database {
     conn: Connection,
 }
 
+/// What `Database::recover` found.
+#[derive(Debug, Default, PartialEq, Eq)]
+pub struct Recovery {
+    /// Pages of committed changes the write-ahead log held.
+    pub wal_frames: i64,
+    /// Of those, how many were written back into the database file.
+    pub checkpointed: i64,
+}
+
+/// What `Database::check_integrity` found. Unlike `verify`, which checks the
+/// library's files, this checks the database file itself.
+#[derive(Debug, Default, PartialEq, Eq)]
+pub struct IntegrityReport {
+    pub schema_version: i32,
+    /// The schema version this photosort writes.
+    pub expected_version: i32,
+    /// Damage reported by SQLite's own check, such as from bad sectors or an
+    /// interrupted write.
+    pub corruption: Vec<String>,
+    /// Rows pointing at a row that doesn't exist, like a sidecar without its photo.
+    pub foreign_key_violations: Vec<ForeignKeyViolation>,
+}
+
+/// A row whose reference to another table leads nowhere.
+#[derive(Debug, PartialEq, Eq)]
+pub struct ForeignKeyViolation {
+    pub table: String,
+    pub rowid: Option<i64>,
+    /// The table the row refers to.
+    pub parent: String,
+}
+
+impl IntegrityReport {
+    /// Each problem found, as a kind and a description.
+    pub fn problems(&self) -> Vec<(&'static str, String)> {
+        let mut problems = Vec::new();
+        if self.schema_version < self.expected_version {
+            problems.push((
+                "schema",
+                format!(
+                    "version {} is older than {}; run a command that changes the library, such as scan",
+                    self.schema_version, self.expected_version
+                ),
+            ));
+        } else if self.schema_version > self.expected_version {
+            problems.push((
+                "schema",
+                format!(
+                    "version {} was written by a newer photosort, which knows up to {}",
+                    self.schema_version, self.expected_version
+                ),
+            ));
+        }
+        problems.extend(self.corruption.iter().map(|line| ("corruption", line.clone())));
+        problems.extend(self.foreign_key_violations.iter().map(|v| {
+            let row = v.rowid.map_or_else(|| "a row".to_string(), |id| format!("row {}", id));
+            ("foreign key", format!("{} of {} refers to a missing {} row", row, v.table, v.parent))
+        }));
+        problems
+    }
+
+    pub fn is_ok(&self) -> bool {
+        self.problems().is_empty()
+    }
+
+    pub fn report(&self) -> Report {
+        let problems = self.problems();
+        let rows = problems.iter().map(|(kind, detail)| vec![(*kind).into(), detail.as_str().into()]).collect();
+        Report::new("Database check")
+            .field("schema_version", "schema version", self.schema_version)
+            .field("corruption", "corruption found", self.corruption.len())
+            .field("foreign_key_violations", "broken references", self.foreign_key_violations.len())
+            .list("problems", "Problems", &["kind", "detail"], rows)
+    }
+}
+
+/// Sidecar rows that share their content with another sidecar.
+#[derive(Debug, Default, PartialEq, Eq)]
+pub struct DuplicateSidecarStats {
+    /// Distinct contents stored more than once.
+    pub groups: i64,
+    /// Rows beyond the first for each content.
+    pub extra_copies: i64,
+    /// Bytes taken by the extra copies, unless they are hardlinked.
+    pub extra_bytes: i64,
+}
+
+/// How large the photos in a library are.
+#[derive(Debug, Default, PartialEq)]
+pub struct ImageSizeStats {
+    pub count: i64,
+    pub total_bytes: i64,
+    pub average_bytes: f64,
+    /// The middle size, or the mean of the two middle sizes for an even count.
+    pub median_bytes: f64,
+}
+
+/// A media file, for listing the largest ones.
+#[derive(Debug, PartialEq, Eq)]
+pub struct MediaSize {
+    pub hash: String,
+    pub media_type: String,
+    /// Path relative to the library root.
+    pub path: String,
+    pub file_size: i64,
+}
+
 impl Database {
     /// Connect to the database at the specified path. Run migrations if necessary.
     pub fn new(path: &Path) -> Result<Self> {
+        Self::open_writable(path).map_err(|e| locked_error(e, path))
+    }
+
+    fn open_writable(path: &Path) -> Result<Self> {
         let mut conn = Connection::open(path)?;
 
         // Enable WAL mode for better concurrency
@@ -17,77 +279,82 @@ impl Database {
         // Enable foreign key constraints
         conn.pragma_update(None, "foreign_keys", "ON")?;
 
-        let migrations = Migrations::new(vec![
-            // Migration 1: Initial schema (v2)
-            M::up(
-                r#"
-                -- Main media table (photos and videos)
-                CREATE TABLE IF NOT EXISTS media (
-                    id INTEGER PRIMARY KEY,
-                    hash TEXT UNIQUE NOT NULL,
-                    filename TEXT NOT NULL,
-                    relpath TEXT NOT NULL,
-                    media_type TEXT NOT NULL CHECK (media_type IN ('image', 'video')),
-                    filetype TEXT NOT NULL,
-                    file_size INTEGER NOT NULL,
-                    created_at TEXT NOT NULL,
-                    imported_at TEXT NOT NULL,
-
-                    -- EXIF metadata (nullable)
-                    camera_make TEXT,
-                    camera_model TEXT,
-                    lens TEXT,
-                    focal_length TEXT,
-                    aperture TEXT,
-                    shutter_speed TEXT,
-                    iso INTEGER,
-                    gps_lat REAL,
-                    gps_lon REAL
-                );
-
-                -- Sidecars linked to media
-                CREATE TABLE IF NOT EXISTS sidecars (
-                    id INTEGER PRIMARY KEY,
-                    media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
-                    filename TEXT NOT NULL,
-                    filetype TEXT NOT NULL,
-                    file_size INTEGER NOT NULL,
-                    hash TEXT NOT NULL,
-                    modified_at TEXT NOT NULL,
-                    UNIQUE(media_id, filename)
-                );
-
-                -- Backup tracking
-                CREATE TABLE IF NOT EXISTS backup_history (
-                    id INTEGER PRIMARY KEY,
-                    target_path TEXT NOT NULL,
-                    started_at TEXT NOT NULL,
-                    completed_at TEXT,
-                    files_copied INTEGER DEFAULT 0,
-                    bytes_copied INTEGER DEFAULT 0,
-                    status TEXT NOT NULL CHECK (status IN ('running', 'completed', 'failed'))
-                );
-
-                CREATE TABLE IF NOT EXISTS backup_state (
-                    media_id INTEGER PRIMARY KEY REFERENCES media(id) ON DELETE CASCADE,
-                    last_backup_id INTEGER REFERENCES backup_history(id),
-                    backed_up_at TEXT
-                );
-
-                -- Indexes for search performance
-                CREATE INDEX IF NOT EXISTS idx_media_type ON media(media_type);
-                CREATE INDEX IF NOT EXISTS idx_media_created ON media(created_at);
-                CREATE INDEX IF NOT EXISTS idx_media_filetype ON media(filetype);
-                CREATE INDEX IF NOT EXISTS idx_media_camera ON media(camera_model);
-                CREATE INDEX IF NOT EXISTS idx_media_file_size ON media(file_size);
-                CREATE INDEX IF NOT EXISTS idx_media_hash ON media(hash);
-                "#,
-            ),
-        ]);
-
-        migrations.to_latest(&mut conn)?;
-
-        Ok(Database { conn })
+        Migrations::from_slice(MIGRATIONS).to_latest(&mut conn)?;
+        // A writer that never finished holds the lock; say so now rather than partway through a change
+        conn.execute_batch("BEGIN IMMEDIATE; COMMIT;")?;
+
+        let db = Database { conn };
+        db.set_wal_limit(WAL_LIMIT.get().copied().unwrap_or(DEFAULT_WAL_LIMIT))?;
+        Ok(db)
+    }
+
+    /// Keep the write-ahead log near `bytes` across many changes, as in a
+    /// large import or a long scan: committed changes are written back into
+    /// the database once the log holds half that, and the log file is cut
+    /// back to `bytes` when it starts over. One transaction larger than the
+    /// limit still grows the log until it commits.
+    pub fn set_wal_limit(&self, bytes: u64) -> Result<()> {
+        let page_size: i64 = self.conn.query_row("PRAGMA page_size", [], |row| row.get(0))?;
+        let pages = (bytes / 2 / page_size.max(1) as u64).clamp(1, i32::MAX as u64) as i64;
+        self.conn.pragma_update(None, "wal_autocheckpoint", pages)?;
+        self.conn.pragma_update(None, "journal_size_limit", bytes.min(i64::MAX as u64) as i64)?;
+        Ok(())
+    }
+
+    /// Connect to the database for reading only, without running migrations.
+    ///
+    /// A read-only handle never takes a write lock, so inspection commands can
+    /// run while another process imports into the library. In WAL mode they see
+    /// the library as of the last committed change.
+    pub fn open_read_only(path: &Path) -> Result<Self> {
+        let conn = Connection::open_with_flags(path, OpenFlags::SQLITE_OPEN_READ_ONLY).map_err(|e| locked_error(e.into(), path))?;
+        // Wait out a writer's brief checkpoint instead of failing outright
+        conn.busy_timeout(READ_ONLY_BUSY_TIMEOUT)?;
+
+        let db = Database { conn };
+        if (db.schema_version().map_err(|e| locked_error(e, path))? as usize) < MIGRATIONS.len() {
+            return Err(PhotosortError::Library(
+                "the library needs upgrading first; run a command that changes it, such as scan".to_string(),
+            ));
+        }
+        Ok(db)
+    }
+
+    /// Bring a database left behind by a crashed run back to a clean state.
+    ///
+    /// Changes committed before the crash are still in the write-ahead log;
+    /// they are written back into the database file and the log truncated,
+    /// and the database is checked for damage. Stale lock state in the `-shm`
+    /// file is rebuilt by SQLite when the first connection opens. Nothing is
+    /// touched if another process is still using the database.
+    pub fn recover(path: &Path) -> Result<Recovery> {
+        let conn = Connection::open(path)?;
+        conn.busy_timeout(RECOVER_BUSY_TIMEOUT)?;
+
+        let (busy, wal_frames, checkpointed): (i64, i64, i64) = conn
+            .query_row("PRAGMA wal_checkpoint(TRUNCATE)", [], |row| Ok((row.get(0)?, row.get(1)?, row.get(2)?)))
+            .map_err(|e| locked_error(e.into(), path))?;
+        if busy != 0 {
+            return Err(PhotosortError::LibraryLocked(path.to_path_buf()));
+        }
+
+        let check: String = conn.query_row("PRAGMA quick_check", [], |row| row.get(0))?;
+        if check != "ok" {
+            return Err(PhotosortError::Library(format!("{} is damaged: {}", path.display(), check)));
+        }
+
+        // An empty log reports -1 frames
+        Ok(Recovery {
+            wal_frames: wal_frames.max(0),
+            checkpointed: checkpointed.max(0),
+        })
+    }
+
+    /// Wait up to `wait` for another connection's lock before a statement fails,
+    /// rather than SQLite's default of a few seconds.
+    pub fn set_busy_timeout(&self, wait: Duration) -> Result<()> {
+        self.conn.busy_timeout(wait)?;
+        Ok(())
     }
 
     /// Get a mutable reference to the database connection.
@@ -100,6 +367,36 @@ impl Database {
         &self.conn
     }
 
+    /// Check the database file for damage, references to missing rows, and a
+    /// schema version this photosort doesn't write.
+    pub fn check_integrity(&self) -> Result<IntegrityReport> {
+        let corruption: Vec<String> = self
+            .conn
+            .prepare("PRAGMA integrity_check")?
+            .query_map([], |row| row.get(0))?
+            .collect::<rusqlite::Result<Vec<String>>>()?
+            .into_iter()
+            .filter(|line| line != "ok")
+            .collect();
+        let foreign_key_violations = self
+            .conn
+            .prepare("PRAGMA foreign_key_check")?
+            .query_map([], |row| {
+                Ok(ForeignKeyViolation {
+                    table: row.get(0)?,
+                    rowid: row.get(1)?,
+                    parent: row.get(2)?,
+                })
+            })?
+            .collect::<rusqlite::Result<_>>()?;
+        Ok(IntegrityReport {
+            schema_version: self.schema_version()?,
+            expected_version: MIGRATIONS.len() as i32,
+            corruption,
+            foreign_key_violations,
+        })
+    }
+
     /// Get the current schema version.
     pub fn schema_version(&self) -> Result<i32> {
         let version: i32 = self
@@ -184,6 +481,117 @@ impl Database {
         Ok(size)
     }
 
+    /// Get the total, mean and median size of the images in the library.
+    pub fn image_size_stats(&self) -> Result<ImageSizeStats> {
+        let (count, total_bytes, average_bytes): (i64, i64, f64) = self.conn.query_row(
+            "SELECT COUNT(*), COALESCE(SUM(file_size), 0), COALESCE(AVG(file_size), 0.0)
+             FROM media WHERE media_type = 'image'",
+            [],
+            |row| Ok((row.get(0)?, row.get(1)?, row.get(2)?)),
+        )?;
+        // One middle row for an odd count, two for an even one
+        let median_bytes: f64 = self.conn.query_row(
+            "SELECT COALESCE(AVG(file_size), 0.0) FROM (
+                 SELECT file_size FROM media WHERE media_type = 'image'
+                 ORDER BY file_size LIMIT 2 - ?1 % 2 OFFSET (?1 - 1) / 2
+             )",
+            [count],
+            |row| row.get(0),
+        )?;
+        Ok(ImageSizeStats {
+            count,
+            total_bytes,
+            average_bytes,
+            median_bytes,
+        })
+    }
+
+    /// Get the `limit` largest photos and videos, largest first.
+    pub fn largest_media(&self, limit: usize) -> Result<Vec<MediaSize>> {
+        let mut stmt = self.conn.prepare(
+            "SELECT hash, media_type, relpath || '/' || filename, file_size FROM media
+             ORDER BY file_size DESC, relpath, filename LIMIT ?1",
+        )?;
+        let rows = stmt.query_map([limit as i64], |row| {
+            Ok(MediaSize {
+                hash: row.get(0)?,
+                media_type: row.get(1)?,
+                path: row.get(2)?,
+                file_size: row.get(3)?,
+            })
+        })?;
+        Ok(rows.collect::<rusqlite::Result<_>>()?)
+    }
+
+    /// Get statistics on sidecars with identical content.
+    pub fn duplicate_sidecar_stats(&self) -> Result<DuplicateSidecarStats> {
+        let stats = self.conn.query_row(
+            "SELECT COUNT(*), COALESCE(SUM(n - 1), 0), COALESCE(SUM((n - 1) * size), 0)
+             FROM (SELECT COUNT(*) AS n, MAX(file_size) AS size FROM sidecars GROUP BY hash HAVING n > 1)",
+            [],
+            |row| {
+                Ok(DuplicateSidecarStats {
+                    groups: row.get(0)?,
+                    extra_copies: row.get(1)?,
+                    extra_bytes: row.get(2)?,
+                })
+            },
+        )?;
+        Ok(stats)
+    }
+
+    /// Get when the last successful import from a source root started (Unix seconds).
+    pub fn import_mark(&self, source_root: &str) -> Result<Option<i64>> {
+        let mark = self
+            .conn
+            .query_row(
+                "SELECT imported_at FROM import_marks WHERE source_root = ?1",
+                [source_root],
+                |row| row.get(0),
+            )
+            .optional()?;
+        Ok(mark)
+    }
+
+    /// Record when a successful import from a source root started (Unix seconds).
+    pub fn set_import_mark(&self, source_root: &str, imported_at: i64) -> Result<()> {
+        self.conn.execute(
+            "INSERT INTO import_marks (source_root, imported_at) VALUES (?1, ?2)
+             ON CONFLICT(source_root) DO UPDATE SET imported_at = excluded.imported_at",
+            rusqlite::params![source_root, imported_at],
+        )?;
+        Ok(())
+    }
+
+    /// Get a library setting.
+    pub fn setting(&self, key: &str) -> Result<Option<String>> {
+        let value = self
+            .conn
+            .query_row("SELECT value FROM settings WHERE key = ?1", [key], |row| row.get(0))
+            .optional()?;
+        Ok(value)
+    }
+
+    /// Store a library setting, replacing any previous value.
+    pub fn set_setting(&self, key: &str, value: &str) -> Result<()> {
+        self.conn.execute(
+            "INSERT INTO settings (key, value) VALUES (?1, ?2)
+             ON CONFLICT(key) DO UPDATE SET value = excluded.value",
+            [key, value],
+        )?;
+        Ok(())
+    }
+
+    /// Every library setting, by key.
+    pub fn settings(&self) -> Result<Vec<(String, String)>> {
+        let settings = self
+            .conn
+            .prepare("SELECT key, value FROM settings ORDER BY key")?
+            .query_map([], |row| Ok((row.get(0)?, row.get(1)?)))?
+            .collect::<rusqlite::Result<_>>()?;
+        Ok(settings)
+    }
+
     /// Check if a hash exists in the database.
     pub fn hash_exists(&self, hash: &str) -> Result<bool> {
         let count: i64 = self.conn.query_row(
@@ -194,6 +602,30 @@ impl Database {
         Ok(count > 0)
     }
 
+    /// Find the media whose hash starts with `prefix`, as typed on the command
+    /// line. Prefixes too short or with characters a hash can't contain
+    /// find nothing; one matching several media is an error.
+    pub fn media_id_by_hash_prefix(&self, prefix: &str) -> Result<Option<i64>> {
+        if !is_hash_prefix(prefix) {
+            return Ok(None);
+        }
+        // LIKE ignores case, and base64 doesn't
+        let mut stmt = self.conn.prepare(
+            "SELECT id FROM media WHERE hash LIKE ?1 || '%' AND substr(hash, 1, length(?1)) = ?1 ORDER BY id",
+        )?;
+        let ids = stmt
+            .query_map([prefix], |row| row.get::<_, i64>(0))?
+            .collect::<rusqlite::Result<Vec<_>>>()?;
+        match ids.as_slice() {
+            [] => Ok(None),
+            [id] => Ok(Some(*id)),
+            _ => Err(PhotosortError::AmbiguousHash {
+                prefix: prefix.to_string(),
+                matches: ids.len(),
+            }),
+        }
+    }
+
     /// Get media ID by hash.
     pub fn get_media_id_by_hash(&self, hash: &str) -> Result<Option<i64>> {
         let result = self.conn.query_row(
@@ -209,6 +641,40 @@ impl Database {
     }
 }
 
+/// Whether `s` could be the start of a stored hash (base64, with the
+/// suffix kept-both duplicates get).
+fn is_hash_prefix(s: &str) -> bool {
+    s.len() >= MIN_HASH_PREFIX && s.chars().all(|c| c.is_ascii_alphanumeric() || matches!(c, '+' | '/' | '=' | '-'))
+}
+
+/// Run `attempt` again while it fails because a library is locked, for up to
+/// `wait`, so a brief lock held by another process (a checkpoint, a short
+/// write) doesn't end a long operation. Other errors are returned at once.
+pub fn wait_while_locked<T>(wait: Duration, mut attempt: impl FnMut() -> Result<T>) -> Result<T> {
+    let deadline = Instant::now() + wait;
+    loop {
+        match attempt() {
+            Err(PhotosortError::LibraryLocked(path)) if Instant::now() < deadline => {
+                log::info!("{} is locked; waiting for it", path.display());
+                std::thread::sleep(LOCK_RETRY_INTERVAL);
+            }
+            result => return result,
+        }
+    }
+}
+
+/// A clearer error for a database another process holds locked.
+fn locked_error(e: PhotosortError, path: &Path) -> PhotosortError {
+    match &e {
+        PhotosortError::Database(err)
+            if matches!(err.sqlite_error_code(), Some(ErrorCode::DatabaseBusy | ErrorCode::DatabaseLocked)) =>
+        {
+            PhotosortError::LibraryLocked(path.to_path_buf())
+        }
+        _ => e,
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -227,6 +693,204 @@ mod tests {
         assert_eq!(db.sidecar_count().unwrap(), 0);
     }
 
+    #[test]
+    fn test_check_integrity_finds_orphaned_sidecar() {
+        let temp_dir = TempDir::new().unwrap();
+        let db = Database::new(&temp_dir.path().join("test.db")).unwrap();
+        assert!(db.check_integrity().unwrap().is_ok());
+
+        // A sidecar whose photo is gone, as an older tool might have left it
+        db.connection_ref().pragma_update(None, "foreign_keys", "OFF").unwrap();
+        db.connection_ref()
+            .execute(
+                "INSERT INTO sidecars (id, media_id, filename, filetype, file_size, hash, modified_at)
+                 VALUES (7, 42, 'IMG_1.xmp', 'XMP', 4, 'h', '')",
+                [],
+            )
+            .unwrap();
+
+        let report = db.check_integrity().unwrap();
+        assert_eq!(
+            report.foreign_key_violations,
+            vec![ForeignKeyViolation {
+                table: "sidecars".to_string(),
+                rowid: Some(7),
+                parent: "media".to_string(),
+            }]
+        );
+        assert!(report.corruption.is_empty());
+        assert_eq!(report.problems(), vec![("foreign key", "row 7 of sidecars refers to a missing media row".to_string())]);
+        assert!(!report.is_ok());
+    }
+
+    #[test]
+    fn test_size_stats_and_largest_media() {
+        let temp_dir = TempDir::new().unwrap();
+        let db = Database::new(&temp_dir.path().join("test.db")).unwrap();
+        assert_eq!(db.image_size_stats().unwrap(), ImageSizeStats::default());
+
+        for (hash, media_type, size) in [
+            ("h1", "image", 100),
+            ("h2", "image", 400),
+            ("h3", "image", 200),
+            ("h4", "video", 5000),
+        ] {
+            db.connection_ref()
+                .execute(
+                    "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+                     VALUES (?1, ?1 || '.jpg', 'images/2024/01-01', ?2, 'JPG', ?3, '', '')",
+                    rusqlite::params![hash, media_type, size],
+                )
+                .unwrap();
+        }
+
+        let stats = db.image_size_stats().unwrap();
+        assert_eq!(stats.count, 3);
+        assert_eq!(stats.total_bytes, 700);
+        assert!((stats.average_bytes - 700.0 / 3.0).abs() < 1e-9);
+        assert_eq!(stats.median_bytes, 200.0);
+
+        let largest: Vec<(String, i64)> =
+            db.largest_media(2).unwrap().into_iter().map(|m| (m.path, m.file_size)).collect();
+        assert_eq!(
+            largest,
+            vec![
+                ("images/2024/01-01/h4.jpg".to_string(), 5000),
+                ("images/2024/01-01/h2.jpg".to_string(), 400),
+            ]
+        );
+
+        // An even count takes the mean of the middle two
+        db.connection_ref().execute("DELETE FROM media WHERE hash = 'h1'", []).unwrap();
+        assert_eq!(db.image_size_stats().unwrap().median_bytes, 300.0);
+    }
+
+    #[test]
+    fn test_read_only_alongside_open_write() {
+        let temp_dir = TempDir::new().unwrap();
+        let db_path = temp_dir.path().join("test.db");
+        let mut writer = Database::new(&db_path).unwrap();
+
+        let tx = writer.connection().transaction().unwrap();
+        tx.execute(
+            "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+             VALUES ('h1', 'a.jpg', 'images/2024/01-01', 'image', 'JPG', 1, '', '')",
+            [],
+        )
+        .unwrap();
+
+        // Reads go through while the write is open, without seeing it
+        let reader = Database::open_read_only(&db_path).unwrap();
+        assert_eq!(reader.media_count().unwrap(), 0);
+        assert!(reader.set_setting("layout", "date").is_err());
+
+        tx.commit().unwrap();
+        assert_eq!(reader.media_count().unwrap(), 1);
+    }
+
+    #[test]
+    fn test_recover_leftover_wal() {
+        let temp_dir = TempDir::new().unwrap();
+        let db_path = temp_dir.path().join("test.db");
+        let wal_path = temp_dir.path().join("test.db-wal");
+        let db = Database::new(&db_path).unwrap();
+        db.set_setting("layout", "date").unwrap();
+        // A crash never closes the connection, leaving the change only in the log
+        std::mem::forget(db);
+        assert!(std::fs::metadata(&wal_path).unwrap().len() > 0);
+
+        let recovery = Database::recover(&db_path).unwrap();
+        assert!(recovery.wal_frames > 0);
+        assert_eq!(recovery.checkpointed, recovery.wal_frames);
+        assert_eq!(std::fs::metadata(&wal_path).unwrap().len(), 0);
+
+        let db = Database::new(&db_path).unwrap();
+        assert_eq!(db.setting("layout").unwrap().as_deref(), Some("date"));
+    }
+
+    #[test]
+    fn test_wal_stays_under_limit() {
+        let temp_dir = TempDir::new().unwrap();
+        let db_path = temp_dir.path().join("test.db");
+        let wal_path = temp_dir.path().join("test.db-wal");
+        let db = Database::new(&db_path).unwrap();
+        let limit = 64 * 1024;
+        db.set_wal_limit(limit).unwrap();
+
+        // Far more is written, one change at a time, than the log may hold
+        let value = "x".repeat(4096);
+        for i in 0..200 {
+            db.set_setting(&format!("key{}", i), &value).unwrap();
+            assert!(std::fs::metadata(&wal_path).unwrap().len() <= limit, "after change {}", i);
+        }
+        // Everything was kept, written back into the database
+        let written = db.settings().unwrap().iter().filter(|(key, _)| key.starts_with("key")).count();
+        assert_eq!(written, 200);
+    }
+
+    #[test]
+    fn test_wal_checkpoint_follows_large_limit() {
+        let temp_dir = TempDir::new().unwrap();
+        let db = Database::new(&temp_dir.path().join("test.db")).unwrap();
+        let page_size: u64 = db.conn.query_row("PRAGMA page_size", [], |row| row.get(0)).unwrap();
+        let checkpoint = |db: &Database| -> u64 {
+            db.conn.query_row("PRAGMA wal_autocheckpoint", [], |row| row.get(0)).unwrap()
+        };
+
+        // Half of a 1 GB limit is far more than SQLite's default of 1000 pages
+        db.set_wal_limit(1024 * 1024 * 1024).unwrap();
+        assert_eq!(checkpoint(&db), 512 * 1024 * 1024 / page_size);
+
+        db.set_wal_limit(u64::MAX).unwrap();
+        assert_eq!(checkpoint(&db), i32::MAX as u64);
+    }
+
+    #[test]
+    fn test_media_id_by_hash_prefix() {
+        let temp_dir = TempDir::new().unwrap();
+        let db = Database::new(&temp_dir.path().join("test.db")).unwrap();
+        for (hash, filename) in [("abcd1234", "a.jpg"), ("abcd5678", "b.jpg"), ("ABCD9999", "c.jpg")] {
+            db.connection_ref()
+                .execute(
+                    "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+                     VALUES (?1, ?2, 'images/2024/01-01', 'image', 'JPG', 1, '', '')",
+                    [hash, filename],
+                )
+                .unwrap();
+        }
+
+        let id = db.media_id_by_hash_prefix("abcd1").unwrap().unwrap();
+        assert_eq!(db.get_media_id_by_hash("abcd1234").unwrap(), Some(id));
+        // Case matters, unlike in LIKE
+        let id = db.media_id_by_hash_prefix("ABCD").unwrap().unwrap();
+        assert_eq!(db.get_media_id_by_hash("ABCD9999").unwrap(), Some(id));
+
+        assert!(matches!(
+            db.media_id_by_hash_prefix("abcd"),
+            Err(PhotosortError::AmbiguousHash { matches: 2, .. })
+        ));
+        assert_eq!(db.media_id_by_hash_prefix("zzzz").unwrap(), None);
+        // Too short, or not a hash at all
+        assert_eq!(db.media_id_by_hash_prefix("abc").unwrap(), None);
+        assert_eq!(db.media_id_by_hash_prefix("ab%d").unwrap(), None);
+    }
+
+    #[test]
+    fn test_settings_round_trip() {
+        let temp_dir = TempDir::new().unwrap();
+        let db = Database::new(&temp_dir.path().join("test.db")).unwrap();
+
+        assert_eq!(db.setting("layout").unwrap(), None);
+        db.set_setting("layout", "date").unwrap();
+        db.set_setting("layout", "content").unwrap();
+        db.set_setting("hash_encoding", "hex").unwrap();
+        assert_eq!(db.setting("layout").unwrap().as_deref(), Some("content"));
+        assert_eq!(
+            db.settings().unwrap(),
+            [("hash_encoding".to_string(), "hex".to_string()), ("layout".to_string(), "content".to_string())]
+        );
+    }
+
     #[test]
     fn test_hash_exists() {
         let temp_dir = TempDir::new().unwrap();
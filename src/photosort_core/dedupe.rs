@@ -0,0 +1,248 @@
+use crate::photosort_core::error::{PhotosortError, Result};
+use crate::photosort_core::import::{hash_file, is_library_root, source_files, ImportOptions};
+use crate::photosort_core::media::detect_media_type;
+use crate::photosort_core::progress;
+use crate::photosort_core::report::Report;
+use crate::photosort_core::sidecar::find_sidecars;
+use crate::photosort_core::trash::{Trash, TRASH_DIR};
+use rayon::prelude::*;
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// Options for removing duplicates within a folder.
+#[derive(Debug, Clone, Default)]
+pub struct DedupeOptions {
+    /// List the duplicates without removing anything.
+    pub dry_run: bool,
+}
+
+/// Copies of one photo or video found in the folder.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct DuplicateSet {
+    pub hash: String,
+    /// Copies left in place: the first in name order, or every copy with sidecars.
+    pub kept: Vec<PathBuf>,
+    /// Copies moved to the trash (or that would be, on a dry run).
+    pub removed: Vec<PathBuf>,
+}
+
+/// Result of removing duplicates within a folder.
+#[derive(Debug, Default)]
+pub struct DedupeResult {
+    /// Media files hashed because another had the same size.
+    pub files_hashed: usize,
+    /// Each content found more than once, by path of its first copy.
+    pub duplicates: Vec<DuplicateSet>,
+    /// Bytes the removed copies took.
+    pub bytes_freed: u64,
+}
+
+impl DedupeResult {
+    pub fn report(&self, dry_run: bool) -> Report {
+        let (title, removed) = if dry_run {
+            ("[DRY RUN] Dedupe", "copies that would be moved to the trash")
+        } else {
+            ("Dedupe complete!", "copies moved to the trash")
+        };
+        let rows = self
+            .duplicates
+            .iter()
+            .flat_map(|d| {
+                d.removed
+                    .iter()
+                    .map(|path| vec![path.display().to_string().into(), d.kept[0].display().to_string().into()])
+            })
+            .collect();
+        Report::new(title)
+            .field("hashed", "media files hashed", self.files_hashed)
+            .field("duplicated", "files found more than once", self.duplicates.len())
+            .field("removed", removed, self.duplicates.iter().map(|d| d.removed.len()).sum::<usize>())
+            .field_with_display(
+                "bytes_freed",
+                "space freed",
+                self.bytes_freed,
+                format!("{:.1} MB", self.bytes_freed as f64 / 1_048_576.0),
+            )
+            .list("removed_files", "Duplicates", &["path", "kept"], rows)
+    }
+}
+
+/// Find photos and videos stored more than once in `dir`, without a library,
+/// and move every copy but one into `dir/.trash/`.
+///
+/// The first copy in name order is kept, as a deterministic import would keep
+/// it. A copy with sidecars is never removed, since its edits would be lost;
+/// when some copies have sidecars, those are kept instead.
+///
+/// Refuses a library or any folder inside one: moving its files would leave
+/// the database pointing at nothing.
+pub fn dedupe_dir(dir: &Path, options: &DedupeOptions) -> Result<DedupeResult> {
+    if !dir.is_dir() {
+        return Err(PhotosortError::NotADirectory(dir.to_path_buf()));
+    }
+    if let Some(library) = fs::canonicalize(dir)?.ancestors().find(|d| is_library_root(d)) {
+        return Err(PhotosortError::Library(format!(
+            "{} is inside the library at {}, whose database tracks its files; use `photosort remove` there instead",
+            dir.display(),
+            library.display()
+        )));
+    }
+
+    // Walked in name order; the trash is hidden, so earlier removals aren't seen again
+    let walk = ImportOptions {
+        deterministic: true,
+        ..Default::default()
+    };
+    let mut by_size: HashMap<u64, Vec<PathBuf>> = HashMap::new();
+    for path in source_files(dir, &walk)? {
+        if detect_media_type(&path).is_none() {
+            continue;
+        }
+        if let Ok(meta) = fs::metadata(&path) {
+            by_size.entry(meta.len()).or_default().push(path);
+        }
+    }
+    // Only files sharing a size can share content
+    let candidates: Vec<(u64, PathBuf)> = by_size
+        .into_iter()
+        .filter(|(size, paths)| *size > 0 && paths.len() > 1)
+        .flat_map(|(size, paths)| paths.into_iter().map(move |p| (size, p)))
+        .collect();
+
+    let bar = progress::bar(candidates.len() as u64);
+    bar.set_message("Hashing files");
+    let hashed: Vec<(String, u64, &PathBuf)> = candidates
+        .par_iter()
+        .filter_map(|(size, path)| {
+            let hash = hash_file(path);
+            bar.inc(1);
+            match hash {
+                Ok(hash) => Some((hash, *size, path)),
+                Err(e) => {
+                    log::warn!("Failed to hash {}: {}", path.display(), e);
+                    None
+                }
+            }
+        })
+        .collect();
+    bar.finish_with_message("Hashing complete");
+
+    let mut by_hash: HashMap<String, (u64, Vec<PathBuf>)> = HashMap::new();
+    for (hash, size, path) in hashed {
+        by_hash.entry(hash).or_insert((size, Vec::new())).1.push(path.clone());
+    }
+
+    let mut result = DedupeResult {
+        files_hashed: candidates.len(),
+        ..Default::default()
+    };
+    let mut sets: BTreeMap<PathBuf, (DuplicateSet, u64)> = BTreeMap::new();
+    for (hash, (size, mut paths)) in by_hash {
+        if paths.len() < 2 {
+            continue;
+        }
+        paths.sort();
+        let (with_sidecars, without): (Vec<PathBuf>, Vec<PathBuf>) =
+            paths.into_iter().partition(|p| !find_sidecars(p, &[]).is_empty());
+        let (kept, removed) = if with_sidecars.is_empty() {
+            let mut without = without.into_iter();
+            (without.next().into_iter().collect(), without.collect())
+        } else {
+            (with_sidecars, without)
+        };
+        let first = kept.iter().chain(&removed).min().cloned().unwrap_or_default();
+        sets.insert(first, (DuplicateSet { hash, kept, removed }, size));
+    }
+
+    let trash = Trash::new(dir);
+    for (set, size) in sets.into_values() {
+        if !options.dry_run {
+            for path in &set.removed {
+                trash.move_file(path)?;
+                log::info!("Moved duplicate {} to {}/", path.display(), TRASH_DIR);
+            }
+        }
+        result.bytes_freed += size * set.removed.len() as u64;
+        result.duplicates.push(set);
+    }
+    Ok(result)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use assert_fs::TempDir;
+
+    #[test]
+    fn test_dedupe_dir_refuses_libraries() {
+        use crate::photosort_core::import::Library;
+
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"photo a").unwrap();
+        let lib_dir = temp_dir.path().join("lib");
+        Library::create(&lib_dir).unwrap().import(&source, &ImportOptions::default()).unwrap();
+        // A stray copy an editor left next to the imported photo
+        let folder = fs::read_dir(lib_dir.join("images")).unwrap().next().unwrap().unwrap().path();
+        let day = fs::read_dir(&folder).unwrap().next().unwrap().unwrap().path();
+        fs::write(day.join("a copy.jpg"), b"photo a").unwrap();
+
+        for dir in [lib_dir.clone(), day.clone()] {
+            let err = dedupe_dir(&dir, &DedupeOptions { dry_run: false }).unwrap_err();
+            assert!(err.to_string().contains("is inside the library"), "{}", err);
+        }
+        assert!(day.join("a.jpg").exists());
+        assert!(day.join("a copy.jpg").exists());
+        assert!(!day.join(TRASH_DIR).exists());
+        assert!(!lib_dir.join(TRASH_DIR).join("images").exists());
+    }
+
+    #[test]
+    fn test_dedupe_dir_keeps_preferred_copy() {
+        let temp_dir = TempDir::new().unwrap();
+        let dir = temp_dir.path();
+        fs::create_dir_all(dir.join("backup")).unwrap();
+        fs::create_dir_all(dir.join("edited")).unwrap();
+        fs::write(dir.join("a.jpg"), b"photo a").unwrap();
+        fs::write(dir.join("backup/a copy.jpg"), b"photo a").unwrap();
+        fs::write(dir.join("backup/b.jpg"), b"photo b").unwrap();
+        fs::write(dir.join("c.jpg"), b"photo b").unwrap();
+        fs::write(dir.join("edited/c.jpg"), b"photo b").unwrap();
+        fs::write(dir.join("edited/c.xmp"), b"<edits/>").unwrap();
+        // Same size, different content
+        fs::write(dir.join("d.jpg"), b"photo d").unwrap();
+
+        let result = dedupe_dir(dir, &DedupeOptions { dry_run: true }).unwrap();
+        assert_eq!(
+            result.duplicates,
+            vec![
+                DuplicateSet {
+                    hash: hash_file(&dir.join("a.jpg")).unwrap(),
+                    kept: vec![dir.join("a.jpg")],
+                    removed: vec![dir.join("backup/a copy.jpg")],
+                },
+                // The copy with edits wins over the first in name order
+                DuplicateSet {
+                    hash: hash_file(&dir.join("c.jpg")).unwrap(),
+                    kept: vec![dir.join("edited/c.jpg")],
+                    removed: vec![dir.join("backup/b.jpg"), dir.join("c.jpg")],
+                },
+            ]
+        );
+        assert_eq!(result.bytes_freed, 21);
+        assert!(dir.join("backup/a copy.jpg").exists());
+
+        dedupe_dir(dir, &DedupeOptions::default()).unwrap();
+        for removed in ["backup/a copy.jpg", "backup/b.jpg", "c.jpg"] {
+            assert!(!dir.join(removed).exists(), "{}", removed);
+        }
+        for kept in ["a.jpg", "edited/c.jpg", "edited/c.xmp", "d.jpg"] {
+            assert!(dir.join(kept).exists(), "{}", kept);
+        }
+        // Removed copies wait in the trash, and another run finds nothing more
+        assert!(dir.join(TRASH_DIR).is_dir());
+        assert!(dedupe_dir(dir, &DedupeOptions::default()).unwrap().duplicates.is_empty());
+    }
+}
@@ -37,6 +37,9 @@ pub enum PhotosortError {
     #[error("Invalid library: missing database at {0}")]
     InvalidLibrary(PathBuf),
 
+    #[error("Library database {0} is locked by another process. If no other photosort is running, a previous run may have crashed; rerun with --recover")]
+    LibraryLocked(PathBuf),
+
     // Metadata errors
     #[error("Exiftool error: {0}")]
     Exiftool(String),
@@ -67,6 +70,30 @@ pub enum PhotosortError {
     #[error("rsync error: {0}")]
     Rsync(String),
 
+    #[error("Bundle error: {0}")]
+    Bundle(String),
+
+    #[error("{dir} holds more than {limit} files, stopping before importing any. Check that this is the right folder, or raise --max-files")]
+    TooManyFiles { dir: PathBuf, limit: usize },
+
+    #[error("Internal error while {phase} {path}: {message}")]
+    Panicked { phase: &'static str, path: PathBuf, message: String },
+
+    #[error("Hash prefix {prefix} is ambiguous: it matches {matches} media")]
+    AmbiguousHash { prefix: String, matches: usize },
+
+    #[error("Source doesn't match its manifest: {problems} files differ, are missing, or aren't listed (first: {first})")]
+    SourceMismatch { problems: usize, first: PathBuf },
+
+    #[error("Verification failed: {0} files missing or corrupt")]
+    VerificationFailed(usize),
+
+    #[error("Verification failed: {0} files aren't in the folder their date sorts them into")]
+    Misplaced(usize),
+
+    #[error("Database check failed: {0} problems found")]
+    IntegrityCheckFailed(usize),
+
     // Generic errors
     #[error("Argument error: {0}")]
     Argument(String),
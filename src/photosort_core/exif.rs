@@ -1,18 +1,58 @@
+use crate::photosort_core::cli::StripMetadata;
 use crate::photosort_core::error::{PhotosortError, Result};
 use crate::photosort_core::media::ExifMetadata;
 use exiftool::ExifTool;
 use serde::Deserialize;
 use serde_json::Value;
-use std::path::Path;
-use time::{OffsetDateTime, PrimitiveDateTime, UtcOffset};
-
-/// Date format used in EXIF data.
-const EXIF_DATE_FORMAT: &[time::format_description::FormatItem] =
-    time::macros::format_description!("[year]:[month]:[day] [hour]:[minute]:[second]");
+use std::cell::RefCell;
+use std::path::{Path, PathBuf};
+use time::format_description::OwnedFormatItem;
+use time::parsing::Parsed;
+use time::{Date, OffsetDateTime, PrimitiveDateTime, UtcOffset};
+
+/// Date formats found in EXIF data, tried in order. The standard layout comes
+/// first; the rest are written by phones, editors and converters that use
+/// dashes, a `T` separator, or add fractional seconds.
+const EXIF_DATE_FORMATS: &[&[time::format_description::FormatItem]] = &[
+    time::macros::format_description!("[year]:[month]:[day] [hour]:[minute]:[second]"),
+    time::macros::format_description!("[year]:[month]:[day] [hour]:[minute]:[second].[subsecond]"),
+    time::macros::format_description!("[year]:[month]:[day]T[hour]:[minute]:[second]"),
+    time::macros::format_description!("[year]:[month]:[day]T[hour]:[minute]:[second].[subsecond]"),
+    time::macros::format_description!("[year]-[month]-[day] [hour]:[minute]:[second]"),
+    time::macros::format_description!("[year]-[month]-[day] [hour]:[minute]:[second].[subsecond]"),
+    time::macros::format_description!("[year]-[month]-[day]T[hour]:[minute]:[second]"),
+    time::macros::format_description!("[year]-[month]-[day]T[hour]:[minute]:[second].[subsecond]"),
+    time::macros::format_description!("[year]/[month]/[day] [hour]:[minute]:[second]"),
+];
+
+/// Dates written into file names by cameras, phones and apps, tried in order
+/// at each run of digits in the name. Those with a time come first.
+const FILENAME_DATE_FORMATS: &[&[time::format_description::FormatItem]] = &[
+    // IMG_20240102_150405.jpg, PXL_20240102_150405123.jpg, VID_20240102_150405.mp4
+    time::macros::format_description!("[year][month][day]_[hour][minute][second]"),
+    time::macros::format_description!("[year][month][day]-[hour][minute][second]"),
+    // 2024-01-02 15.04.05.jpg (Dropbox camera uploads)
+    time::macros::format_description!("[year]-[month]-[day] [hour].[minute].[second]"),
+    // Screenshot 2024-01-02 at 15.04.05.png (macOS)
+    time::macros::format_description!("[year]-[month]-[day] at [hour].[minute].[second]"),
+    // Screenshot_2024-01-02-15-04-05.png (Android)
+    time::macros::format_description!("[year]-[month]-[day]-[hour]-[minute]-[second]"),
+    time::macros::format_description!("[year]-[month]-[day]_[hour]-[minute]-[second]"),
+    // IMG-20240102-WA0001.jpg (WhatsApp), Screenshot_2024-01-02.png
+    time::macros::format_description!("[year][month][day]"),
+    time::macros::format_description!("[year]-[month]-[day]"),
+];
 
 const EXIF_OFFSET_FORMAT: &[time::format_description::FormatItem] =
     time::macros::format_description!("[offset_hour]:[offset_minute]");
 
+/// File name exiftool loads its user configuration from.
+pub const EXIFTOOL_CONFIG_NAME: &str = ".ExifTool_config";
+
+thread_local! {
+    static EXIFTOOL: RefCell<Option<ExifTool>> = const { RefCell::new(None) };
+}
+
 /// Raw EXIF data from exiftool using flexible Value types for fields that vary.
 #[derive(Deserialize, Debug, Default)]
 #[serde(rename_all = "PascalCase")]
@@ -25,6 +65,18 @@ struct RawExifInfo {
     #[serde(default)]
     create_date: String,
     #[serde(default)]
+    media_create_date: String, // QuickTime track date, set by action cams that zero CreateDate
+    #[serde(default)]
+    date_time_digitized: String, // XMP; the EXIF tag of this name is reported as CreateDate
+    #[serde(default)]
+    date_created: String, // IPTC date only, or XMP date and time
+    #[serde(default)]
+    time_created: String,
+    #[serde(default)]
+    digital_creation_date: String, // IPTC; when a print or negative was scanned
+    #[serde(default)]
+    digital_creation_time: String,
+    #[serde(default)]
     offset_time_original: Option<String>,
     #[serde(default)]
     offset_time: Option<String>,
@@ -46,6 +98,52 @@ struct RawExifInfo {
     gps_latitude: Option<Value>,  // Can be string "45 deg 30' 16.91\" N" or number
     #[serde(rename = "GPSLongitude", default)]
     gps_longitude: Option<Value>, // Can be string "122 deg 40' 30.12\" W" or number
+    #[serde(default)]
+    image_width: Option<Value>,
+    #[serde(default)]
+    image_height: Option<Value>,
+}
+
+impl RawExifInfo {
+    /// When the photo was taken, and the tag that said so.
+    ///
+    /// Camera tags come first by default. Scans of prints and negatives carry
+    /// the scan date there, while the original date is often only in IPTC
+    /// `DateCreated`, so `prefer_iptc` looks at the IPTC dates first.
+    fn created_at(&self, prefer_iptc: bool) -> Option<(OffsetDateTime, &'static str)> {
+        let exif = || {
+            parse_exif_date(&self.create_date, self.offset_time.as_deref())
+                .map(|d| (d, "CreateDate"))
+                .or_else(|_| {
+                    parse_exif_date(&self.date_time_original, self.offset_time_original.as_deref())
+                        .map(|d| (d, "DateTimeOriginal"))
+                })
+                .or_else(|_| parse_combined_date(&self.date_time_digitized, "").map(|d| (d, "DateTimeDigitized")))
+                .or_else(|_| parse_exif_date(&self.media_create_date, None).map(|d| (d, "MediaCreateDate")))
+                .ok()
+        };
+        let iptc = || {
+            parse_combined_date(&self.date_created, &self.time_created)
+                .map(|d| (d, "DateCreated"))
+                .or_else(|_| {
+                    parse_combined_date(&self.digital_creation_date, &self.digital_creation_time)
+                        .map(|d| (d, "DigitalCreationDate"))
+                })
+                .ok()
+        };
+        if prefer_iptc {
+            iptc().or_else(exif)
+        } else {
+            exif().or_else(iptc)
+        }
+    }
+
+    /// Pixel dimensions, if exiftool reported both.
+    fn dimensions(&self) -> Option<(u32, u32)> {
+        let width = self.image_width.as_ref().and_then(value_to_i32)?;
+        let height = self.image_height.as_ref().and_then(value_to_i32)?;
+        (width > 0 && height > 0).then_some((width as u32, height as u32))
+    }
 }
 
 /// Helper to extract f64 from Value (handles both string and number)
@@ -127,37 +225,52 @@ fn value_to_string(v: &Value) -> Option<String> {
 /// Result of extracting metadata from a file.
 pub struct ExtractedMetadata {
     pub created_at: OffsetDateTime,
+    /// Whether `created_at` is the file's timestamp, for want of a better date.
+    pub file_dated: bool,
     pub exif: ExifMetadata,
+    /// Width and height in pixels.
+    pub dimensions: Option<(u32, u32)>,
+}
+
+impl ExtractedMetadata {
+    /// What is known about a file without exiftool: its filesystem date.
+    pub fn from_file_date(path: &Path) -> Self {
+        ExtractedMetadata {
+            created_at: file_date(path),
+            file_dated: true,
+            exif: ExifMetadata::default(),
+            dimensions: None,
+        }
+    }
 }
 
 /// Extract metadata from a media file using exiftool.
-pub fn extract_metadata(exiftool: &mut ExifTool, path: &Path) -> Result<ExtractedMetadata> {
-    let raw: RawExifInfo = exiftool.read_metadata(path, &[]).map_err(|e| {
+///
+/// `extra_args` are passed to exiftool along with the file, e.g. `-api` options.
+/// `prefer_iptc` dates the file by its IPTC date before its camera dates.
+pub fn extract_metadata(
+    exiftool: &mut ExifTool,
+    path: &Path,
+    extra_args: &[&str],
+    prefer_iptc: bool,
+) -> Result<ExtractedMetadata> {
+    let raw: RawExifInfo = exiftool.read_metadata(path, extra_args).map_err(|e| {
         PhotosortError::MetadataExtraction {
             path: path.to_path_buf(),
             reason: e.to_string(),
         }
     })?;
 
-    // Parse creation date with fallback chain
-    let created_at = parse_exif_date(&raw.create_date, raw.offset_time.as_deref())
-        .or_else(|_| {
-            parse_exif_date(&raw.date_time_original, raw.offset_time_original.as_deref())
-        })
-        .or_else(|_| {
-            // Fallback to file creation time
-            std::fs::metadata(path)
-                .and_then(|m| m.created())
-                .map(OffsetDateTime::from)
-                .map_err(PhotosortError::Io)
-        })
-        .unwrap_or_else(|_| {
-            log::warn!(
-                "Could not determine creation date for {}, using current time",
-                path.display()
-            );
-            OffsetDateTime::now_local().unwrap_or_else(|_| OffsetDateTime::now_utc())
-        });
+    let (created_at, file_dated) = match raw.created_at(prefer_iptc) {
+        Some((date, tag)) => {
+            log::debug!("Dating {} by {}", path.display(), tag);
+            (date, false)
+        }
+        None => {
+            log::debug!("Dating {} by its file timestamps", path.display());
+            (file_date(path), true)
+        }
+    };
 
     // Extract aperture (f-number)
     let aperture = raw.f_number.as_ref().and_then(|v| {
@@ -168,6 +281,7 @@ pub fn extract_metadata(exiftool: &mut ExifTool, path: &Path) -> Result<Extracte
         }
     });
 
+    let dimensions = raw.dimensions();
     let exif = ExifMetadata {
         camera_make: raw.make,
         camera_model: raw.model,
@@ -180,19 +294,103 @@ pub fn extract_metadata(exiftool: &mut ExifTool, path: &Path) -> Result<Extracte
         gps_lon: raw.gps_longitude.as_ref().and_then(value_to_f64),
     };
 
-    Ok(ExtractedMetadata { created_at, exif })
+    Ok(ExtractedMetadata {
+        created_at,
+        file_dated,
+        exif,
+        dimensions,
+    })
+}
+
+/// Extract metadata using an exiftool process kept for the current thread,
+/// so parallel workers don't start one per file.
+///
+/// Files are sent one per request, and each response is read up to exiftool's
+/// ready marker rather than into a fixed buffer, so there is no batch or
+/// buffer size to tune: a file with a large embedded preview just takes a
+/// longer response.
+pub fn extract_metadata_on_thread(path: &Path, extra_args: &[&str], prefer_iptc: bool) -> Result<ExtractedMetadata> {
+    EXIFTOOL.with(|cell| {
+        read_with_restart(
+            &mut cell.borrow_mut(),
+            || ExifTool::new().ok(),
+            |exiftool| extract_metadata(exiftool, path, extra_args, prefer_iptc),
+            exiftool_responds,
+        )
+    })
+}
+
+/// Read with the thread's `process`, starting one if there is none.
+///
+/// Most failures are the file's (exiftool can't parse it), and the process
+/// carries on. Only if it no longer answers in step (it died, or a read
+/// left output behind that would garble every later file) is it replaced
+/// and the file tried once more.
+fn read_with_restart<P, T>(
+    process: &mut Option<P>,
+    start: impl Fn() -> Option<P>,
+    read: impl Fn(&mut P) -> Result<T>,
+    responds: impl Fn(&mut P) -> bool,
+) -> Result<T> {
+    let mut retried = false;
+    loop {
+        if process.is_none() {
+            *process = start();
+        }
+        let Some(running) = process.as_mut() else {
+            return Err(PhotosortError::Exiftool("exiftool could not be started".to_string()));
+        };
+        match read(running) {
+            Ok(value) => return Ok(value),
+            Err(e) if responds(running) => return Err(e),
+            Err(e) => {
+                // Don't hand the next file a process that just failed
+                *process = None;
+                if retried {
+                    return Err(e);
+                }
+                log::debug!("Restarting exiftool: {}", e);
+                retried = true;
+            }
+        }
+    }
+}
+
+/// Whether an exiftool process still answers in step: asked its version, it
+/// replies with just that, not output left over from an earlier file.
+fn exiftool_responds(exiftool: &mut ExifTool) -> bool {
+    exiftool.execute_raw(&["-ver"]).is_ok_and(|output| {
+        let output = String::from_utf8_lossy(&output);
+        let version = output.trim();
+        !version.is_empty() && version.chars().all(|c| c.is_ascii_digit() || c == '.')
+    })
 }
 
-/// Parse an EXIF date string with optional timezone offset.
+/// Parse an EXIF date string with optional timezone offset. An offset at the
+/// end of the date itself ("...+02:00" or "...Z") is used when none is given.
+/// Subseconds aren't kept.
 fn parse_exif_date(date_str: &str, offset_str: Option<&str>) -> Result<OffsetDateTime> {
+    let date_str = date_str.trim();
     if date_str.is_empty() {
         return Err(PhotosortError::InvalidDateFormat("empty date".to_string()));
     }
 
-    let date_time = PrimitiveDateTime::parse(date_str, EXIF_DATE_FORMAT)
-        .map_err(|e| PhotosortError::InvalidDateFormat(e.to_string()))?;
+    let (date_str, embedded_offset) = split_offset(date_str);
+    let mut error = None;
+    let date_time = EXIF_DATE_FORMATS
+        .iter()
+        .find_map(|format| match PrimitiveDateTime::parse(date_str, format) {
+            Ok(date_time) => Some(date_time),
+            Err(e) => {
+                error.get_or_insert(e);
+                None
+            }
+        })
+        .ok_or_else(|| PhotosortError::InvalidDateFormat(error.map(|e| e.to_string()).unwrap_or_default()))?
+        .replace_nanosecond(0)
+        .expect("zero is a valid nanosecond");
 
-    let offset = match offset_str {
+    let offset = match offset_str.or(embedded_offset) {
         Some(o) if !o.is_empty() => UtcOffset::parse(o, EXIF_OFFSET_FORMAT)
             .unwrap_or_else(|_| get_local_offset()),
         _ => get_local_offset(),
@@ -201,6 +399,92 @@ fn parse_exif_date(date_str: &str, offset_str: Option<&str>) -> Result<OffsetDat
     Ok(date_time.assume_offset(offset))
 }
 
+/// Split a trailing UTC offset ("+02:00" or "Z") off a date.
+fn split_offset(date_str: &str) -> (&str, Option<&str>) {
+    if let Some(date) = date_str.strip_suffix('Z') {
+        return (date, Some("+00:00"));
+    }
+    // Only look past the time, so the dashes of a date aren't taken for a sign
+    let time_start = date_str.find([' ', 'T']).unwrap_or(date_str.len());
+    match date_str[time_start..].rfind(['+', '-']) {
+        Some(i) => (&date_str[..time_start + i], Some(&date_str[time_start + i..])),
+        None => (date_str, None),
+    }
+}
+
+/// Parse a date and time that may be given separately, as IPTC does
+/// ("2024:05:21" and "12:30:00+02:00"), or together, as XMP does, with an
+/// optional offset. A date without a time is taken as midnight.
+fn parse_combined_date(date: &str, time: &str) -> Result<OffsetDateTime> {
+    let (date, time) = match date.trim().split_once([' ', 'T']) {
+        Some((date, time)) => (date, time.trim()),
+        None => (date.trim(), time.trim()),
+    };
+    let (time, offset) = match time.strip_suffix('Z') {
+        Some(time) => (time, Some("+00:00")),
+        None => match time.rfind(['+', '-']) {
+            Some(i) => (&time[..i], Some(&time[i..])),
+            None => (time, None),
+        },
+    };
+    // Subseconds aren't kept
+    let time = time.split('.').next().unwrap_or_default();
+    let time = if time.is_empty() { "00:00:00" } else { time };
+    if date.is_empty() {
+        return Err(PhotosortError::InvalidDateFormat("empty date".to_string()));
+    }
+    parse_exif_date(&format!("{} {}", date, time), offset)
+}
+
+/// Date of a file according to the filesystem: its creation time, or its
+/// modification time where creation times aren't recorded.
+pub fn file_date(path: &Path) -> OffsetDateTime {
+    std::fs::metadata(path)
+        .and_then(|m| m.created().or_else(|_| m.modified()))
+        .map(OffsetDateTime::from)
+        .unwrap_or_else(|_| {
+            log::warn!(
+                "Could not determine creation date for {}, using current time",
+                path.display()
+            );
+            OffsetDateTime::now_local().unwrap_or_else(|_| OffsetDateTime::now_utc())
+        })
+}
+
+/// Find a date in a file name, such as `IMG_20240102_150405.jpg` or
+/// `Screenshot 2024-01-02 at 15.04.05.png`, taken as local time. `custom`
+/// patterns are tried first, anywhere in the name; the built-in ones only
+/// where a run of digits starts. Names holding just a date are dated midnight.
+pub fn date_from_filename(name: &str, custom: &[OwnedFormatItem]) -> Option<OffsetDateTime> {
+    let bytes = name.as_bytes();
+    let parsed = (0..bytes.len()).find_map(|start| {
+        let input = &bytes[start..];
+        let at_digits = input[0].is_ascii_digit() && (start == 0 || !bytes[start - 1].is_ascii_digit());
+        custom
+            .iter()
+            .find_map(|item| {
+                let mut parsed = Parsed::new();
+                parsed.parse_item(input, item).ok().and_then(|_| filename_date(parsed))
+            })
+            .or_else(|| {
+                FILENAME_DATE_FORMATS.iter().filter(|_| at_digits).find_map(|items| {
+                    let mut parsed = Parsed::new();
+                    parsed.parse_items(input, items).ok().and_then(|_| filename_date(parsed))
+                })
+            })
+    })?;
+    Some(parsed.assume_offset(get_local_offset()))
+}
+
+/// The date and time parsed from a file name, if it is a plausible photo date.
+fn filename_date(parsed: Parsed) -> Option<PrimitiveDateTime> {
+    let date = PrimitiveDateTime::try_from(parsed)
+        .ok()
+        .or_else(|| Date::try_from(parsed).ok().map(Date::midnight))?;
+    // Other numbers in a name, like counters, can look like a date
+    (1900..=2100).contains(&date.year()).then_some(date)
+}
+
 /// Get the local timezone offset, falling back to UTC if unavailable.
 fn get_local_offset() -> UtcOffset {
     OffsetDateTime::now_local()
@@ -208,9 +492,65 @@ fn get_local_offset() -> UtcOffset {
         .unwrap_or(UtcOffset::UTC)
 }
 
+/// Directory to point `EXIFTOOL_HOME` at so exiftool loads `config`.
+///
+/// exiftool reads its configuration once at startup and only from a file named
+/// `.ExifTool_config`, so `config` may be such a file or a directory holding one.
+pub fn exiftool_home(config: &Path) -> Result<PathBuf> {
+    let (dir, file) = if config.is_dir() {
+        (config.to_path_buf(), config.join(EXIFTOOL_CONFIG_NAME))
+    } else if config.file_name().is_some_and(|n| n == EXIFTOOL_CONFIG_NAME) {
+        let dir = config.parent().filter(|p| !p.as_os_str().is_empty()).unwrap_or(Path::new("."));
+        (dir.to_path_buf(), config.to_path_buf())
+    } else {
+        return Err(PhotosortError::Argument(format!(
+            "exiftool config must be named {}: {}",
+            EXIFTOOL_CONFIG_NAME,
+            config.display()
+        )));
+    };
+
+    if !file.is_file() {
+        return Err(PhotosortError::Argument(format!(
+            "exiftool config not found: {}",
+            file.display()
+        )));
+    }
+    Ok(dir)
+}
+
+/// Remove metadata from a file in place. Only call this on formats
+/// `is_strippable_filetype` allows.
+pub fn strip_metadata(path: &Path, strip: StripMetadata) -> Result<()> {
+    let tags: &[&str] = match strip {
+        StripMetadata::Gps => &["-gps:all=", "-xmp-exif:gps*="],
+        // Copied back from the original so the image displays as before
+        StripMetadata::All => &["-all=", "-tagsFromFile", "@", "-ColorSpaceTags", "-Orientation"],
+    };
+    let output = std::process::Command::new("exiftool")
+        .args(tags)
+        // Rewrites the file itself, keeping its permissions
+        .arg("-overwrite_original_in_place")
+        .arg(path)
+        .output()?;
+    if !output.status.success() {
+        return Err(PhotosortError::Exiftool(format!(
+            "failed to strip metadata from {}: {}",
+            path.display(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        )));
+    }
+    Ok(())
+}
+
 /// Check if exiftool is available on the system.
 pub fn exiftool_available() -> bool {
-    std::process::Command::new("exiftool")
+    program_available("exiftool")
+}
+
+/// Check if a program runs, using exiftool's `-ver` flag.
+fn program_available(program: &str) -> bool {
+    std::process::Command::new(program)
         .arg("-ver")
         .output()
         .map(|o| o.status.success())
@@ -221,6 +561,69 @@ pub fn exiftool_available() -> bool {
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_dimensions() {
+        let raw: RawExifInfo =
+            serde_json::from_value(serde_json::json!({"ImageWidth": 6000, "ImageHeight": "4000"})).unwrap();
+        assert_eq!(raw.dimensions(), Some((6000, 4000)));
+
+        let raw: RawExifInfo = serde_json::from_value(serde_json::json!({"ImageWidth": 6000})).unwrap();
+        assert_eq!(raw.dimensions(), None);
+    }
+
+    #[test]
+    fn test_missing_exiftool_detected() {
+        assert!(!program_available("photosort-no-such-exiftool"));
+    }
+
+    #[test]
+    fn test_exiftool_restarted_only_when_it_stops_responding() {
+        use std::cell::Cell;
+
+        // Each started process gets a number; reads fail on process 1 only
+        let started = Cell::new(0);
+        let start = || {
+            started.set(started.get() + 1);
+            Some(started.get())
+        };
+        let read = |process: &mut usize| match *process {
+            1 => Err(PhotosortError::Exiftool("bad response".to_string())),
+            n => Ok(n),
+        };
+
+        // A file exiftool can't read is reported without a restart
+        let mut process = None;
+        assert!(read_with_restart(&mut process, start, read, |_| true).is_err());
+        assert_eq!((started.get(), process), (1, Some(1)));
+
+        // A process out of step is replaced and the file read again
+        assert_eq!(read_with_restart(&mut process, start, read, |_| false).unwrap(), 2);
+        assert_eq!((started.get(), process), (2, Some(2)));
+
+        // Retried only once, and the failed process isn't kept
+        let mut process = None;
+        let always_fails = |_: &mut usize| -> Result<usize> { Err(PhotosortError::Exiftool("died".to_string())) };
+        assert!(read_with_restart(&mut process, start, always_fails, |_| false).is_err());
+        assert_eq!((started.get(), process), (4, None));
+    }
+
+    #[test]
+    fn test_exiftool_home() {
+        let temp_dir = assert_fs::TempDir::new().unwrap();
+        let config = temp_dir.path().join(EXIFTOOL_CONFIG_NAME);
+
+        // Missing config is an error rather than a silently ignored flag
+        assert!(exiftool_home(temp_dir.path()).is_err());
+
+        std::fs::write(&config, "%Image::ExifTool::UserDefined = ();\n1;\n").unwrap();
+        assert_eq!(exiftool_home(temp_dir.path()).unwrap(), temp_dir.path());
+        assert_eq!(exiftool_home(&config).unwrap(), temp_dir.path());
+
+        let misnamed = temp_dir.path().join("my.config");
+        std::fs::write(&misnamed, "1;\n").unwrap();
+        assert!(exiftool_home(&misnamed).is_err());
+    }
+
     #[test]
     fn test_parse_exif_date() {
         let date = parse_exif_date("2024:05:21 12:30:00", Some("+09:00"));
@@ -237,12 +640,120 @@ mod tests {
         assert!(date.is_ok());
     }
 
+    #[test]
+    fn test_date_from_filename() {
+        let local = |dt: PrimitiveDateTime| dt.assume_offset(get_local_offset());
+        for (name, expected) in [
+            ("IMG_20240102_150405.jpg", time::macros::datetime!(2024-01-02 15:04:05)),
+            ("PXL_20240102_150405123.jpg", time::macros::datetime!(2024-01-02 15:04:05)),
+            ("VID_20240102_150405.mp4", time::macros::datetime!(2024-01-02 15:04:05)),
+            ("2024-01-02 15.04.05.jpg", time::macros::datetime!(2024-01-02 15:04:05)),
+            ("Screenshot 2024-01-02 at 15.04.05.png", time::macros::datetime!(2024-01-02 15:04:05)),
+            ("Screenshot_2024-01-02-15-04-05.png", time::macros::datetime!(2024-01-02 15:04:05)),
+            ("Screenshot_2024-01-02.png", time::macros::datetime!(2024-01-02 00:00)),
+            ("IMG-20240102-WA0001.jpg", time::macros::datetime!(2024-01-02 00:00)),
+        ] {
+            assert_eq!(date_from_filename(name, &[]), Some(local(expected)), "{}", name);
+        }
+
+        for name in ["IMG_1234.jpg", "DSC_20241399.jpg", "photo.jpg", "12345678.jpg", "x120240102.jpg"] {
+            assert_eq!(date_from_filename(name, &[]), None, "{}", name);
+        }
+
+        let custom = time::format_description::parse_owned::<2>("[day].[month].[year]").unwrap();
+        assert_eq!(
+            date_from_filename("Urlaub 02.01.2024 (3).jpg", &[custom]),
+            Some(local(time::macros::datetime!(2024-01-02 00:00)))
+        );
+    }
+
+    #[test]
+    fn test_parse_exif_date_variants() {
+        use time::macros::datetime;
+
+        let expected = datetime!(2024-01-02 15:04:05 +02:00);
+        for date in [
+            "2024:01:02 15:04:05",
+            "2024:01:02 15:04:05.123",
+            "2024:01:02T15:04:05",
+            "2024:01:02T15:04:05.5",
+            "2024-01-02 15:04:05",
+            "2024-01-02 15:04:05.000123",
+            "2024-01-02T15:04:05",
+            "2024-01-02T15:04:05.25",
+            "2024/01/02 15:04:05",
+            " 2024:01:02 15:04:05 ",
+        ] {
+            assert_eq!(parse_exif_date(date, Some("+02:00")).unwrap(), expected, "{}", date);
+        }
+
+        // Offsets written into the date are used when none is given separately
+        assert_eq!(parse_exif_date("2024-01-02T15:04:05+02:00", None).unwrap(), expected);
+        assert_eq!(parse_exif_date("2024-01-02T13:04:05.9Z", None).unwrap(), expected);
+        assert_eq!(parse_exif_date("2024-01-02T15:04:05-05:00", None).unwrap(), datetime!(2024-01-02 15:04:05 -05:00));
+        assert_eq!(parse_combined_date("2024-01-02T15:04:05+02:00", "").unwrap(), expected);
+
+        assert!(parse_exif_date("2024.01.02 15:04:05", None).is_err());
+        assert!(parse_exif_date("15:04:05", None).is_err());
+    }
+
+    #[test]
+    fn test_parse_zeroed_quicktime_date() {
+        // Some cameras write an all-zero CreateDate
+        assert!(parse_exif_date("0000:00:00 00:00:00", None).is_err());
+    }
+
     #[test]
     fn test_parse_empty_date() {
         let date = parse_exif_date("", None);
         assert!(date.is_err());
     }
 
+    #[test]
+    fn test_parse_combined_date() {
+        let date = parse_combined_date("2024:05:21", "12:30:00+02:00").unwrap();
+        assert_eq!(date, time::macros::datetime!(2024-05-21 12:30 +02:00));
+        let date = parse_combined_date("2024:05:21 12:30:00.25Z", "").unwrap();
+        assert_eq!(date, time::macros::datetime!(2024-05-21 12:30 UTC));
+        let date = parse_combined_date("1987:07:04", "").unwrap();
+        assert_eq!((date.year(), date.hour()), (1987, 0));
+        assert!(parse_combined_date("", "12:30:00").is_err());
+    }
+
+    #[test]
+    fn test_scan_dates() {
+        let raw: RawExifInfo = serde_json::from_value(serde_json::json!({
+            "CreateDate": "2023:11:02 09:00:00",
+            "OffsetTime": "+00:00",
+            "DateCreated": "1987:07:04",
+        }))
+        .unwrap();
+        // The scanner's date by default, the IPTC date of the original when asked
+        assert_eq!(raw.created_at(false).unwrap().1, "CreateDate");
+        let (date, tag) = raw.created_at(true).unwrap();
+        assert_eq!((date.year(), tag), (1987, "DateCreated"));
+
+        let raw: RawExifInfo =
+            serde_json::from_value(serde_json::json!({"DigitalCreationDate": "1999:01:31"})).unwrap();
+        assert_eq!(raw.created_at(false).unwrap().1, "DigitalCreationDate");
+        assert!(RawExifInfo::default().created_at(true).is_none());
+    }
+
+    #[test]
+    fn test_digitized_only_fixture() {
+        if !exiftool_available() {
+            eprintln!("skipping: exiftool not installed");
+            return;
+        }
+        // EXIF DateTimeDigitized (which exiftool calls CreateDate) and nothing else
+        let fixture = Path::new(env!("CARGO_MANIFEST_DIR")).join("tests/fixtures/digitized_only.jpg");
+        let extracted = extract_metadata_on_thread(&fixture, &[], false).unwrap();
+        assert_eq!(
+            (extracted.created_at.year(), extracted.created_at.month() as u8, extracted.created_at.day()),
+            (2001, 2, 3)
+        );
+    }
+
     #[test]
     fn test_parse_gps_string() {
         // Test latitude parsing
@@ -0,0 +1,192 @@
+use crate::photosort_core::cli::{ExportFormat, WithinSecond};
+use crate::photosort_core::error::Result;
+use crate::photosort_core::import::Library;
+use crate::photosort_core::search::date_order;
+use rusqlite::types::Value;
+use std::io::Write;
+
+/// Columns written for each media row, in order.
+pub const MEDIA_COLUMNS: &[&str] = &[
+    "filename", "relpath", "media_type", "filetype", "file_size", "created_at", "imported_at", "hash",
+    "camera_make", "camera_model", "lens", "focal_length", "aperture", "shutter_speed", "iso",
+    "gps_lat", "gps_lon", "original_path",
+];
+
+/// Columns written for each sidecar row, in order.
+pub const SIDECAR_COLUMNS: &[&str] = &[
+    "media_hash", "filename", "relpath", "filetype", "file_size", "modified_at", "hash",
+];
+
+/// Export every media row in the library, oldest first. Returns the number of rows written.
+pub fn export_media<W: Write>(
+    lib: &Library,
+    out: &mut W,
+    format: &ExportFormat,
+    within_second: WithinSecond,
+) -> Result<usize> {
+    let sql = format!(
+        "SELECT {} FROM media ORDER BY {}",
+        MEDIA_COLUMNS.join(", "),
+        date_order("", within_second, "ASC")
+    );
+    export_query(lib, &sql, MEDIA_COLUMNS, out, format)
+}
+
+/// Export every sidecar row in the library. Returns the number of rows written.
+pub fn export_sidecars<W: Write>(lib: &Library, out: &mut W, format: &ExportFormat) -> Result<usize> {
+    let sql = "SELECT m.hash, s.filename, m.relpath, s.filetype, s.file_size, s.modified_at, s.hash
+               FROM sidecars s
+               JOIN media m ON s.media_id = m.id
+               ORDER BY m.created_at, s.filename";
+    export_query(lib, sql, SIDECAR_COLUMNS, out, format)
+}
+
+/// Stream the rows of a query to `out` without collecting them in memory.
+fn export_query<W: Write>(
+    lib: &Library,
+    sql: &str,
+    columns: &[&str],
+    out: &mut W,
+    format: &ExportFormat,
+) -> Result<usize> {
+    let conn = lib.database().connection_ref();
+    let mut stmt = conn.prepare(sql)?;
+    let mut rows = stmt.query([])?;
+    let mut count = 0;
+
+    match format {
+        ExportFormat::Csv => {
+            let header: Vec<String> = columns.iter().map(|c| csv_field(c)).collect();
+            writeln!(out, "{}", header.join(","))?;
+        }
+        ExportFormat::Json => write!(out, "[")?,
+    }
+
+    while let Some(row) = rows.next()? {
+        let mut values = Vec::with_capacity(columns.len());
+        for i in 0..columns.len() {
+            values.push(row.get::<_, Value>(i)?);
+        }
+
+        match format {
+            ExportFormat::Csv => {
+                let fields: Vec<String> = values.iter().map(|v| csv_field(&value_to_text(v))).collect();
+                writeln!(out, "{}", fields.join(","))?;
+            }
+            ExportFormat::Json => {
+                let object: serde_json::Map<String, serde_json::Value> = columns
+                    .iter()
+                    .zip(&values)
+                    .map(|(c, v)| (c.to_string(), value_to_json(v)))
+                    .collect();
+                if count > 0 {
+                    write!(out, ",")?;
+                }
+                write!(out, "\n  {}", serde_json::Value::Object(object))?;
+            }
+        }
+        count += 1;
+    }
+
+    if let ExportFormat::Json = format {
+        writeln!(out, "\n]")?;
+    }
+
+    out.flush()?;
+    Ok(count)
+}
+
+/// Quote a CSV field if it contains a delimiter, quote, or line break.
+pub fn csv_field(s: &str) -> String {
+    if s.contains([',', '"', '\n', '\r']) {
+        format!("\"{}\"", s.replace('"', "\"\""))
+    } else {
+        s.to_string()
+    }
+}
+
+fn value_to_text(v: &Value) -> String {
+    match v {
+        Value::Null => String::new(),
+        Value::Integer(i) => i.to_string(),
+        Value::Real(f) => f.to_string(),
+        Value::Text(s) => s.clone(),
+        Value::Blob(_) => String::new(),
+    }
+}
+
+fn value_to_json(v: &Value) -> serde_json::Value {
+    match v {
+        Value::Integer(i) => serde_json::Value::from(*i),
+        Value::Real(f) => serde_json::Value::from(*f),
+        Value::Text(s) => serde_json::Value::from(s.as_str()),
+        Value::Null | Value::Blob(_) => serde_json::Value::Null,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use assert_fs::TempDir;
+    use rusqlite::params;
+
+    /// Minimal RFC 4180 parser, enough to read back what we write.
+    fn parse_csv(input: &str) -> Vec<Vec<String>> {
+        let mut rows = Vec::new();
+        let mut row = Vec::new();
+        let mut field = String::new();
+        let mut in_quotes = false;
+        let mut chars = input.chars().peekable();
+
+        while let Some(c) = chars.next() {
+            match c {
+                '"' if in_quotes && chars.peek() == Some(&'"') => {
+                    field.push('"');
+                    chars.next();
+                }
+                '"' => in_quotes = !in_quotes,
+                ',' if !in_quotes => row.push(std::mem::take(&mut field)),
+                '\n' if !in_quotes => {
+                    row.push(std::mem::take(&mut field));
+                    rows.push(std::mem::take(&mut row));
+                }
+                _ => field.push(c),
+            }
+        }
+        rows
+    }
+
+    #[test]
+    fn test_csv_field_quoting() {
+        assert_eq!(csv_field("plain.jpg"), "plain.jpg");
+        assert_eq!(csv_field("a,b.jpg"), "\"a,b.jpg\"");
+        assert_eq!(csv_field("say \"hi\".jpg"), "\"say \"\"hi\"\".jpg\"");
+    }
+
+    #[test]
+    fn test_export_media_csv_round_trip() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = Library::create(temp_dir.path()).unwrap();
+        let conn = lib.database().connection_ref();
+        conn.execute(
+            "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at, camera_model, iso)
+             VALUES (?1, ?2, 'images/2024/01-01', 'image', 'JPG', 42, '2024:01:01 10:00:00.0+00:00', '2024:02:01 10:00:00.0+00:00', ?3, 200)",
+            params!["abc=", "beach, \"sunset\".jpg", "X100V"],
+        ).unwrap();
+
+        let mut out = Vec::new();
+        let count = export_media(&lib, &mut out, &ExportFormat::Csv, WithinSecond::Subsec).unwrap();
+        assert_eq!(count, 1);
+
+        let rows = parse_csv(&String::from_utf8(out).unwrap());
+        assert_eq!(rows.len(), 2);
+        assert_eq!(rows[0], MEDIA_COLUMNS.iter().map(|c| c.to_string()).collect::<Vec<_>>());
+        assert_eq!(rows[1][0], "beach, \"sunset\".jpg");
+        assert_eq!(rows[1][1], "images/2024/01-01");
+        assert_eq!(rows[1][4], "42");
+        assert_eq!(rows[1][7], "abc=");
+        assert_eq!(rows[1][9], "X100V");
+        assert_eq!(rows[1][14], "200");
+        assert_eq!(rows[1][15], "");
+    }
+}
@@ -0,0 +1,121 @@
+use rayon::prelude::*;
+use std::path::Path;
+use std::process::{Command, Stdio};
+
+/// How many hook commands run at once.
+const HOOK_CONCURRENCY: usize = 4;
+
+/// A file just added to the library, as passed to a hook.
+#[derive(Debug, Clone)]
+pub struct HookTarget {
+    /// Path relative to the library root, e.g. "images/2024/05-21/IMG_1.jpg".
+    pub path: String,
+    /// Hash the file is recorded under in the library database.
+    pub hash: String,
+}
+
+/// Run `command` once per target, a few at a time, from the library root.
+///
+/// The target's path and hash are appended as arguments and also set as
+/// `PHOTOSORT_PATH` and `PHOTOSORT_HASH` (with `PHOTOSORT_LIBRARY` for the
+/// root). A failing hook is logged and counted; it never undoes the import.
+/// Returns how many hooks failed.
+pub fn run_after_import(command: &str, root: &Path, targets: &[HookTarget]) -> usize {
+    let run = || targets.par_iter().filter(|t| !run_hook(command, root, t)).count();
+    match rayon::ThreadPoolBuilder::new().num_threads(HOOK_CONCURRENCY).build() {
+        Ok(pool) => pool.install(run),
+        Err(e) => {
+            log::warn!("Could not start hook threads ({}), running hooks on the shared pool", e);
+            run()
+        }
+    }
+}
+
+fn run_hook(command: &str, root: &Path, target: &HookTarget) -> bool {
+    let status = shell(command)
+        .arg(&target.path)
+        .arg(&target.hash)
+        .current_dir(root)
+        .env("PHOTOSORT_LIBRARY", root)
+        .env("PHOTOSORT_PATH", &target.path)
+        .env("PHOTOSORT_HASH", &target.hash)
+        .stdin(Stdio::null())
+        .status();
+    match status {
+        Ok(status) if status.success() => true,
+        Ok(status) => {
+            log::warn!("After-import hook failed for {} ({})", target.path, status);
+            false
+        }
+        Err(e) => {
+            log::warn!("Could not run after-import hook for {}: {}", target.path, e);
+            false
+        }
+    }
+}
+
+/// `command` run by the shell, with any arguments added later passed on to it.
+#[cfg(unix)]
+fn shell(command: &str) -> Command {
+    let mut cmd = Command::new("sh");
+    cmd.arg("-c").arg(format!("{} \"$@\"", command)).arg("photosort-hook");
+    cmd
+}
+
+#[cfg(not(unix))]
+fn shell(command: &str) -> Command {
+    let mut cmd = Command::new("cmd");
+    cmd.arg("/C").arg(command);
+    cmd
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use crate::photosort_core::import::{ImportOptions, Library};
+    use assert_fs::TempDir;
+    use std::fs;
+
+    #[test]
+    fn test_hook_runs_once_per_new_photo() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("IMG_1.jpg"), b"first photo").unwrap();
+        fs::write(source.join("IMG_2.jpg"), b"second photo").unwrap();
+        fs::write(source.join("IMG_2_copy.jpg"), b"second photo").unwrap();
+
+        let log = temp_dir.path().join("hook.log");
+        let hook = temp_dir.path().join("hook.sh");
+        fs::write(&hook, format!("#!/bin/sh\necho \"$1 $PHOTOSORT_HASH\" >> '{}'\n", log.display())).unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("library")).unwrap();
+        let options = ImportOptions {
+            after_import_hook: Some(format!("sh '{}'", hook.display())),
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.hooks_failed, 0);
+
+        let lines: Vec<String> = fs::read_to_string(&log).unwrap().lines().map(String::from).collect();
+        assert_eq!(lines.len(), 2);
+        for line in &lines {
+            let (path, hash) = line.split_once(' ').unwrap();
+            assert!(lib.root().join(path).is_file(), "{}", path);
+            assert!(lib.database().hash_exists(hash).unwrap());
+        }
+
+        // Nothing new, so nothing to run
+        lib.import(&source, &options).unwrap();
+        assert_eq!(fs::read_to_string(&log).unwrap().lines().count(), 2);
+
+        // A failing hook leaves the import in place
+        fs::write(source.join("IMG_3.jpg"), b"third photo").unwrap();
+        let options = ImportOptions {
+            after_import_hook: Some("exit 1".to_string()),
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.images_imported, 1);
+        assert_eq!(stats.hooks_failed, 1);
+    }
+}
@@ -1,42 +1,104 @@
-use crate::photosort_core::database::Database;
+use crate::photosort_core::cli::{
+    DateGranularity, DestExistsPolicy, HashEncoding, ImportOrder, NameCase, PreviewMode, SidecarConflictPolicy, SidecarDate,
+    SkipSidecarCopy, SourceMismatchPolicy, StorageLayout, StripMetadata,
+};
+use crate::photosort_core::database::{Database, Recovery};
 use crate::photosort_core::error::{CopyFailures, PhotosortError, Result};
-use crate::photosort_core::exif::extract_metadata;
-use crate::photosort_core::media::{detect_media_type, ExifMetadata, MediaType};
-use crate::photosort_core::sidecar::find_sidecars;
+use crate::photosort_core::exif::{
+    date_from_filename, exiftool_available, extract_metadata_on_thread, strip_metadata, ExtractedMetadata,
+};
+use crate::photosort_core::hooks::{self, HookTarget};
+use crate::photosort_core::inspect::SourceFile;
+use crate::photosort_core::journal::{self, JournalEntry};
+use crate::photosort_core::media::{
+    canonical_filetype, detect_media_type, is_raw_filetype, is_strippable_filetype, ExifMetadata, MediaType,
+};
+use crate::photosort_core::objects::{link_object, move_in_library, object_path, OBJECTS_DIR};
+use crate::photosort_core::progress::{self, Phase, ProgressObserver};
+use crate::photosort_core::remove::resolve_library_path;
+use crate::photosort_core::report::Report;
+use crate::photosort_core::scan::join_library_path;
+use crate::photosort_core::source_manifest::SourceManifest;
+use crate::photosort_core::throttle::{self, RateLimiter};
+use crate::photosort_core::trash::Trash;
+use crate::photosort_core::sidecar::{
+    find_apple_adjustments, find_previews, find_sidecars, find_sidecars_ignoring_case, find_sidecars_in_subfolders,
+    find_sidecars_normalized, get_sidecar_filename, is_preview, is_sidecar, nfc, rename_sidecar_for_media,
+};
 use base64::{engine::general_purpose, Engine};
-use exiftool::ExifTool;
-use indicatif::{ProgressBar, ProgressStyle};
 use rayon::prelude::*;
-use rusqlite::params;
+use rusqlite::{params, Connection, OptionalExtension};
 use sha2::{Digest, Sha256};
-use std::cell::RefCell;
-use std::collections::HashMap;
+use std::any::Any;
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::fs;
 use std::io::{self, Write};
+use std::panic::AssertUnwindSafe;
 use std::path::{Path, PathBuf};
-use std::sync::Mutex;
+use std::sync::atomic::{AtomicU64, AtomicUsize, Ordering};
+use std::sync::{mpsc, Arc, Mutex};
+use std::time::Instant;
+use time::format_description::OwnedFormatItem;
 use time::OffsetDateTime;
 use walkdir::WalkDir;
 
-thread_local! {
-    static EXIFTOOL: RefCell<Option<ExifTool>> = const { RefCell::new(None) };
-}
+pub const DB_FILE_NAME: &str = "library.db";
 
-const DB_FILE_NAME: &str = "library.db";
+/// Copies of the same file whose dates differ by more than this are reported.
+const DATE_CONFLICT_THRESHOLD: time::Duration = time::Duration::days(1);
 
 /// Date format for database storage.
 pub const DB_DATE_FORMAT: &[time::format_description::FormatItem] = time::macros::format_description!(
     "[year]:[month]:[day] [hour]:[minute]:[second].[subsecond][offset_hour sign:mandatory]:[offset_minute]"
 );
 
+/// Appended to the hash of a file kept twice on import, since hashes are unique.
+pub const ALT_HASH_SUFFIX: &str = "-alt";
+
+/// Setting holding the library's `StorageLayout`.
+const LAYOUT_SETTING: &str = "layout";
+
+/// Setting holding when the library was created.
+const CREATED_AT_SETTING: &str = "created_at";
+
+/// Setting holding the photosort version that created the library.
+const CREATOR_VERSION_SETTING: &str = "creator_version";
+
+/// Setting holding the library's `HashEncoding`.
+const HASH_ENCODING_SETTING: &str = "hash_encoding";
+
+/// Setting holding the library's `DateGranularity`.
+const GRANULARITY_SETTING: &str = "granularity";
+
+/// Setting holding the library's filetype routes, one `TYPE=folder` per line.
+const ROUTES_SETTING: &str = "type_routes";
+
+/// Setting holding the library's extra sidecar extensions, one per line.
+const SIDECAR_EXTENSIONS_SETTING: &str = "sidecar_extensions";
+
+/// Folder (relative to the library root) holding sidecars imported without a photo.
+pub const ORPHANS_DIR: &str = "orphans";
+
+/// Added to a file's name while `--two-pass-copy` writes it. One left behind
+/// was cut short by a crash; `scan` offers to delete it.
+const TEMP_COPY_SUFFIX: &str = ".photosort-tmp";
+
 /// Date format for filesystem paths (YYYY/MM-DD).
 pub const PATH_DATE_FORMAT: &[time::format_description::FormatItem] =
     time::macros::format_description!("[year]/[month]-[day]");
 
+/// Date format for filesystem paths in month-granular libraries (YYYY/MM).
+const PATH_MONTH_FORMAT: &[time::format_description::FormatItem] =
+    time::macros::format_description!("[year]/[month]");
+
+/// Date format for filesystem paths in year-granular libraries (YYYY).
+const PATH_YEAR_FORMAT: &[time::format_description::FormatItem] = time::macros::format_description!("[year]");
+
 /// A library of photos and videos.
 pub struct Library {
     root: PathBuf,
     db: Database,
+    observer: Option<Arc<dyn ProgressObserver>>,
 }
 
 /// Information about a file to be imported.
@@ -47,10 +109,41 @@ struct ImportCandidate {
     media_type: MediaType,
     file_size: u64,
     created_at: OffsetDateTime,
+    /// Whether `created_at` was read from the file's name.
+    dated_by_filename: bool,
     filename: String,
     filetype: String,
     sidecars: Vec<SidecarCandidate>,
     exif: ExifMetadata,
+    dimensions: Option<(u32, u32)>,
+}
+
+impl ImportCandidate {
+    /// Library folder the file is stored in, e.g. "images/2024/05-21".
+    fn relpath(&self, routes: &TypeRoutes) -> String {
+        format!(
+            "{}/{}",
+            routes.folder(self.media_type, &self.filetype),
+            date_folder(self.created_at, routes.granularity)
+        )
+    }
+
+    /// Absolute folder of a cataloged file, which stays in the source.
+    /// `source_root` is the canonical form of `source_dir`.
+    fn source_folder(&self, source_dir: &Path, source_root: &Path) -> String {
+        let rel = self.source_path.strip_prefix(source_dir).unwrap_or(&self.source_path);
+        let path = source_root.join(rel);
+        path.parent().unwrap_or(source_root).to_string_lossy().into_owned()
+    }
+
+    /// Path of the file relative to `source_dir`, with forward slashes.
+    fn original_path(&self, source_dir: &Path) -> String {
+        let rel = self.source_path.strip_prefix(source_dir).unwrap_or(&self.source_path);
+        rel.components()
+            .map(|c| c.as_os_str().to_string_lossy())
+            .collect::<Vec<_>>()
+            .join("/")
+    }
 }
 
 #[derive(Debug)]
@@ -63,6 +156,501 @@ struct SidecarCandidate {
     modified_at: OffsetDateTime,
 }
 
+/// Options used when creating a library.
+#[derive(Debug, Clone, Default)]
+pub struct CreateOptions {
+    /// Permission bits for directories the library creates (Unix only).
+    pub dir_mode: Option<u32>,
+    /// How media files are stored on disk.
+    pub layout: StorageLayout,
+    /// How file hashes are written in the database.
+    pub hash_encoding: HashEncoding,
+    /// How finely media are sorted into date folders.
+    pub granularity: DateGranularity,
+}
+
+/// Options controlling an import.
+#[derive(Debug, Clone, Default)]
+pub struct ImportOptions {
+    /// Show what would be imported without making changes.
+    pub dry_run: bool,
+    /// Copy sidecars with no matching photo into the orphans/ folder.
+    pub include_orphan_sidecars: bool,
+    /// Permission bits for directories created in the library (Unix only).
+    pub dir_mode: Option<u32>,
+    /// Permission bits for files copied into the library (Unix only).
+    pub file_mode: Option<u32>,
+    /// Skip files already in the library under the same name without
+    /// reading their metadata, making repeated imports of one source cheap.
+    pub skip_existing_hash: bool,
+    /// How to handle action-camera previews (.lrv, .thm).
+    pub previews: PreviewMode,
+    /// Hardlink sidecars whose content is already stored instead of copying them again.
+    pub dedupe_sidecars: bool,
+    /// Only consider files modified since the last import from the same source.
+    pub since_last_import: bool,
+    /// Ignore the last-import mark, considering every file (a new mark is still recorded).
+    pub force: bool,
+    /// What to do when a destination file already exists.
+    pub dest_exists: DestExistsPolicy,
+    /// Hash characters added to a renamed file's name with `DestExistsPolicy::Rename`
+    /// (`DEFAULT_COLLISION_SUFFIX_LEN` if unset), widened when needed to stay unique.
+    pub collision_suffix_len: Option<usize>,
+    /// Extra arguments passed to exiftool for every file, e.g. `-api LargeFileSupport=1`.
+    pub exiftool_args: Vec<String>,
+    /// Fail instead of falling back to file dates when exiftool isn't installed.
+    pub require_exif: bool,
+    /// Folders next to each photo that may also hold its sidecars, e.g.
+    /// "CaptureOne/Settings*". Sidecars found there are stored next to the photo.
+    pub sidecar_subfolders: Vec<String>,
+    /// Leave out images smaller than this many megapixels.
+    pub min_megapixels: Option<f64>,
+    /// Leave out images larger than this many megapixels.
+    pub max_megapixels: Option<f64>,
+    /// Shell command run for each newly added photo or video once the import is recorded.
+    pub after_import_hook: Option<String>,
+    /// Store aliased extensions under one filetype, e.g. `.jpeg` as JPG.
+    /// The file keeps its name on disk.
+    pub canonical_ext: bool,
+    /// Extra (from, to) filetype aliases used with `canonical_ext`, taking
+    /// precedence over the built-in ones.
+    pub ext_aliases: Vec<(String, String)>,
+    /// Make the resulting rows reproducible: files are looked at in name order,
+    /// duplicates with different edits keep the first copy without asking, and
+    /// the import time comes from `SOURCE_DATE_EPOCH` (or the Unix epoch).
+    pub deterministic: bool,
+    /// Date files by their IPTC date before their camera dates, for scans of
+    /// prints and negatives whose EXIF dates record when they were scanned.
+    pub prefer_iptc_date: bool,
+    /// Checksum file (`sha256sum` format) to check the source against before importing.
+    pub verify_source: Option<PathBuf>,
+    /// What to do with source files that don't match `verify_source`.
+    pub on_source_mismatch: SourceMismatchPolicy,
+    /// Which copy to keep of duplicates that both have sidecars, instead of
+    /// asking (or keeping the first with `deterministic`).
+    pub on_sidecar_conflict: Option<SidecarConflictPolicy>,
+    /// (filetype, folder) pairs storing a filetype under its own top-level
+    /// folder instead of `images/` or `videos/`; "RAW" covers every raw format.
+    /// Saved in the library and used by later imports that don't give any.
+    pub type_routes: Vec<(String, String)>,
+    /// Record files where they are in the source instead of copying them,
+    /// cataloging a collection kept elsewhere. Their relpaths are absolute.
+    pub catalog: bool,
+    /// Metadata to remove from the copies once they are in the library. The
+    /// database records the values read from the source.
+    pub strip: Option<StripMetadata>,
+    /// List every copy of content found more than once, and which was kept.
+    pub report_duplicates: bool,
+    /// Record each file's path relative to the source directory, keeping the
+    /// folders it was organized in (albums, events) after sorting by date.
+    pub archive_original_structure: bool,
+    /// Import only these files (and their sidecars) instead of everything under
+    /// the source directory. Listed paths that aren't files are reported as skipped.
+    pub files: Option<Vec<PathBuf>>,
+    /// Most bytes per second to copy into the library, across all copies at once.
+    pub max_rate: Option<u64>,
+    /// With `dry_run`, work out where every file would go instead of printing
+    /// counts, returning it in `ImportStats::planned_layout`.
+    pub plan_layout: bool,
+    /// Whether sidecars are recorded with their own modification time or
+    /// their media's capture date.
+    pub sidecar_date: SidecarDate,
+    /// Look inside hidden folders (`.thumbnails`, `.git`) of the source, which are skipped by default.
+    pub include_hidden_dirs: bool,
+    /// Import hidden files (`.photo.jpg`, macOS `._IMG_1.JPG` resource forks), which are skipped by default.
+    pub include_hidden_files: bool,
+    /// Look inside folders holding a photosort library of their own, which are
+    /// skipped by default so a library kept inside the source isn't imported into itself.
+    pub include_nested_libraries: bool,
+    /// Compare and store filenames in Unicode NFC, so names written on macOS
+    /// (decomposed) match sidecars and library files named elsewhere (composed).
+    pub normalize_unicode: bool,
+    /// Skip a photo or video whose database record can't be written, such as
+    /// one breaking a constraint, instead of failing the whole import.
+    /// Errors that affect every row, like a lost or full database, still stop it.
+    pub continue_on_db_error: bool,
+    /// Copy each file to a temporary name, flush it to disk and rename it into
+    /// place, so a crash never leaves part of a file under its real name.
+    pub two_pass_copy: bool,
+    /// Date files without a capture date in their metadata by a date in their
+    /// name, such as `IMG_20240102_150405.jpg`, before falling back to their
+    /// filesystem timestamps.
+    pub date_from_filename: bool,
+    /// Patterns tried before the built-in ones by `date_from_filename`.
+    pub filename_date_patterns: Vec<OwnedFormatItem>,
+    /// Give up on a source folder holding more files than this, counted as it
+    /// is walked, so pointing an import at the wrong tree fails fast.
+    pub max_files: Option<usize>,
+    /// Order new media are copied and recorded in, and so the order of their ids.
+    /// Ties keep their source order.
+    pub import_order: ImportOrder,
+    /// Source folders skipped whole: a bare name matches a folder of that name
+    /// anywhere in the source, a longer path only that folder below the source.
+    pub exclude_dirs: Vec<PathBuf>,
+    /// Flag new media taken within this many seconds of a library photo or
+    /// video of the same type, camera and dimensions but other content, as
+    /// possibly the same shot saved again (e.g. re-compressed). They are still imported.
+    pub import_mtime_window: Option<u64>,
+    /// Leave sidecars' files out of the library, either still recording them
+    /// or not at all. Action-camera previews, governed by `previews`, are still copied.
+    pub skip_sidecar_copy: Option<SkipSidecarCopy>,
+    /// Whether names differing only in case are the same file, when matching
+    /// sidecars to photos and checking for files already at a destination.
+    pub name_case: NameCase,
+    /// On a dry run, estimate the space the import needs and how long copying
+    /// takes, from a short write to the library's disk.
+    pub estimate: bool,
+}
+
+impl ImportOptions {
+    /// These options with an `Auto` name case settled by the filesystem `dir` is on.
+    fn with_name_case_of(&self, dir: &Path) -> ImportOptions {
+        let name_case = match self.name_case {
+            NameCase::Auto if filesystem_ignores_case(dir) => NameCase::Insensitive,
+            NameCase::Auto => NameCase::Sensitive,
+            name_case => name_case,
+        };
+        ImportOptions { name_case, ..self.clone() }
+    }
+}
+
+/// Result of looking at one source file.
+enum ScannedFile {
+    /// A media file to consider for import.
+    Candidate(ImportCandidate),
+    /// A media file already in the library unchanged, skipped before metadata extraction.
+    InLibrary { file_size: u64, sidecars: Vec<PathBuf> },
+    /// A file not modified since the last import from this source, skipped before hashing.
+    NotModified { sidecars: Vec<PathBuf> },
+    /// A media file that can't be imported, such as an empty one.
+    Skipped { reason: SkipReason, sidecars: Vec<PathBuf> },
+    /// Not a media file.
+    NotMedia,
+}
+
+/// Media already in the library, used to skip unchanged files on re-import.
+struct KnownMedia {
+    root: PathBuf,
+    /// hash -> (relpath, filename, file_size)
+    by_hash: HashMap<String, (String, String, u64)>,
+    /// Compare names in Unicode NFC.
+    normalize_unicode: bool,
+}
+
+impl KnownMedia {
+    fn load(root: &Path, db: &Database, normalize_unicode: bool) -> Result<Self> {
+        let mut stmt = db
+            .connection_ref()
+            .prepare("SELECT hash, relpath, filename, file_size FROM media")?;
+        let rows = stmt.query_map([], |row| {
+            Ok((
+                row.get::<_, String>(0)?,
+                (row.get::<_, String>(1)?, row.get::<_, String>(2)?, row.get::<_, i64>(3)? as u64),
+            ))
+        })?;
+
+        Ok(KnownMedia {
+            root: root.to_path_buf(),
+            by_hash: rows.collect::<rusqlite::Result<_>>()?,
+            normalize_unicode,
+        })
+    }
+
+    /// Whether a file with this hash is already stored under the same name,
+    /// and the stored copy is still on disk with the same size.
+    fn contains_unchanged(&self, hash: &str, filename: &str, file_size: u64) -> bool {
+        match self.by_hash.get(hash) {
+            Some((relpath, name, size))
+                if *size == file_size && (name == filename || self.normalize_unicode && nfc(name) == filename) =>
+            {
+                fs::metadata(join_library_path(&self.root, relpath, name))
+                    .map(|m| m.len() == file_size)
+                    .unwrap_or(false)
+            }
+            _ => false,
+        }
+    }
+}
+
+/// Keeps one candidate per hash as scan results arrive in any order.
+///
+/// Each candidate carries its position in the source listing, and the earliest
+/// copy wins just as if the files had been looked at one by one.
+#[derive(Default)]
+struct CandidateMerger {
+    unique: HashMap<String, (usize, ImportCandidate)>,
+    /// Copies that have sidecars of their own while the kept copy has too.
+    conflicts: Vec<(usize, ImportCandidate)>,
+    duplicates_skipped: usize,
+    date_conflicts: Vec<DateConflict>,
+    /// Every copy of content found more than once, as (index, source path), by hash.
+    copies: HashMap<String, Vec<(usize, PathBuf)>>,
+}
+
+impl CandidateMerger {
+    fn add(&mut self, index: usize, candidate: ImportCandidate) {
+        let (existing_index, existing) = match self.unique.entry(candidate.hash.clone()) {
+            std::collections::hash_map::Entry::Vacant(e) => {
+                e.insert((index, candidate));
+                return;
+            }
+            std::collections::hash_map::Entry::Occupied(e) => e.into_mut(),
+        };
+        self.copies
+            .entry(candidate.hash.clone())
+            .or_insert_with(|| vec![(*existing_index, existing.source_path.clone())])
+            .push((index, candidate.source_path.clone()));
+
+        let (mut index, mut candidate) = (index, candidate);
+        if index < *existing_index {
+            std::mem::swap(existing_index, &mut index);
+            std::mem::swap(existing, &mut candidate);
+        }
+
+        // Only one date decides the folder; make a disagreement visible
+        if let Some(conflict) = date_conflict(existing, &candidate) {
+            log::warn!(
+                "Identical files disagree on their date: {} ({}) vs {} ({})",
+                conflict.first.display(),
+                conflict.first_date.format(DB_DATE_FORMAT).unwrap(),
+                conflict.second.display(),
+                conflict.second_date.format(DB_DATE_FORMAT).unwrap()
+            );
+            self.date_conflicts.push(conflict);
+        }
+
+        if !existing.sidecars.is_empty() && !candidate.sidecars.is_empty() {
+            // Both have edits - ask once the scan is done
+            self.conflicts.push((index, candidate));
+        } else if candidate.sidecars.is_empty() {
+            // Candidate has no sidecars, just skip it
+            self.duplicates_skipped += 1;
+            log::debug!("Skipping duplicate media (no sidecars): {}", candidate.filename);
+        } else {
+            // Existing has no sidecars but candidate does - merge sidecars
+            log::info!(
+                "Adding {} sidecars from {} to {}",
+                candidate.sidecars.len(),
+                candidate.filename,
+                existing.filename
+            );
+            existing.sidecars.extend(candidate.sidecars);
+            self.duplicates_skipped += 1;
+        }
+    }
+
+    /// Ask which copy to keep for each pair of duplicates that both have edits,
+    /// unless a `policy` decides. Without either, the first copy is kept every time.
+    fn resolve_conflicts(&mut self, ask: bool, policy: Option<SidecarConflictPolicy>) -> Result<()> {
+        let mut conflicts = std::mem::take(&mut self.conflicts);
+        conflicts.sort_by_key(|(index, _)| *index);
+        if let Some(policy) = policy {
+            for (_, candidate) in conflicts {
+                if let Some((_, existing)) = self.unique.get_mut(&candidate.hash) {
+                    settle_sidecar_conflict(existing, candidate, policy);
+                    self.duplicates_skipped += 1;
+                }
+            }
+            return Ok(());
+        }
+        if !ask {
+            if !conflicts.is_empty() {
+                log::info!("Keeping the first of {} duplicates with different edits", conflicts.len());
+            }
+            self.duplicates_skipped += conflicts.len();
+            return Ok(());
+        }
+
+        for (index, candidate) in conflicts {
+            let Some((_, existing)) = self.unique.get_mut(&candidate.hash) else {
+                continue;
+            };
+
+            println!("\nDuplicate media with different edits detected:");
+            println!("  1. {} ({} sidecars)", existing.filename, existing.sidecars.len());
+            for sc in &existing.sidecars {
+                println!("     - {}", sc.filename);
+            }
+            println!("  2. {} ({} sidecars)", candidate.filename, candidate.sidecars.len());
+            for sc in &candidate.sidecars {
+                println!("     - {}", sc.filename);
+            }
+            println!("\nOptions:");
+            println!("  [1] Keep first only (discard second and its edits)");
+            println!("  [2] Keep second only (discard first and its edits)");
+            println!("  [B] Keep both (import both files with their respective edits)");
+            print!("Choice [1/2/B]: ");
+            io::stdout().flush()?;
+
+            let mut input = String::new();
+            io::stdin().read_line(&mut input)?;
+
+            match input.trim().to_uppercase().as_str() {
+                "2" => {
+                    // Replace existing with candidate
+                    *existing = candidate;
+                    log::info!("User chose to keep second file");
+                }
+                "B" => {
+                    // Keep both - add candidate as separate entry with modified hash
+                    // We use a synthetic hash to keep them separate
+                    let synthetic_hash = format!("{}{}", candidate.hash, ALT_HASH_SUFFIX);
+                    let mut alt_candidate = candidate;
+                    alt_candidate.hash = synthetic_hash.clone();
+                    self.unique.insert(synthetic_hash, (index, alt_candidate));
+                    log::info!("User chose to keep both files");
+                }
+                _ => {
+                    // Default: keep first (existing), skip candidate
+                    self.duplicates_skipped += 1;
+                    log::info!("User chose to keep first file");
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Content found more than once in the source, with the copies kept.
+    fn duplicate_groups(&self) -> Vec<DuplicateGroup> {
+        let mut groups: Vec<DuplicateGroup> = self
+            .copies
+            .iter()
+            .map(|(hash, copies)| {
+                let mut copies = copies.clone();
+                copies.sort_by_key(|(index, _)| *index);
+                // Both copies are kept when the user asked for that
+                let kept = [hash.clone(), format!("{}{}", hash, ALT_HASH_SUFFIX)]
+                    .iter()
+                    .filter_map(|h| self.unique.get(h))
+                    .map(|(_, c)| c.source_path.clone())
+                    .collect();
+                DuplicateGroup {
+                    hash: hash.clone(),
+                    copies: copies.into_iter().map(|(_, path)| path).collect(),
+                    kept,
+                }
+            })
+            .collect();
+        groups.sort_by(|a, b| a.copies.cmp(&b.copies));
+        groups
+    }
+
+    /// How many copies in the source were left out for how many kept files,
+    /// and the bytes not copied for them. Copies kept alongside the first, at
+    /// the user's request, saved nothing.
+    fn duplicate_stats(&self) -> DuplicateStats {
+        let mut stats = DuplicateStats::default();
+        for (hash, copies) in &self.copies {
+            let kept: Vec<&ImportCandidate> = [hash.clone(), format!("{}{}", hash, ALT_HASH_SUFFIX)]
+                .iter()
+                .filter_map(|h| self.unique.get(h))
+                .map(|(_, c)| c)
+                .collect();
+            let Some(file_size) = kept.first().map(|c| c.file_size) else {
+                continue;
+            };
+            let left_out = copies.len().saturating_sub(kept.len());
+            stats.copies_left_out += left_out;
+            stats.originals += 1;
+            stats.bytes_saved += left_out as u64 * file_size;
+        }
+        stats
+    }
+
+    /// The kept candidates, in source order.
+    fn into_candidates(self) -> Vec<ImportCandidate> {
+        let mut kept: Vec<(usize, ImportCandidate)> = self.unique.into_values().collect();
+        kept.sort_by_key(|(index, _)| *index);
+        kept.into_iter().map(|(_, c)| c).collect()
+    }
+}
+
+/// Keep one of two copies of a file that both have sidecars in `existing`, as `policy` says.
+fn settle_sidecar_conflict(existing: &mut ImportCandidate, candidate: ImportCandidate, policy: SidecarConflictPolicy) {
+    let last_edit = |c: &ImportCandidate| c.sidecars.iter().map(|sc| sc.modified_at).max();
+    let keep_new = match policy {
+        SidecarConflictPolicy::KeepOld => false,
+        SidecarConflictPolicy::KeepNew => true,
+        SidecarConflictPolicy::KeepNewer => last_edit(&candidate) > last_edit(existing),
+        SidecarConflictPolicy::KeepBoth => {
+            for mut sc in candidate.sidecars {
+                // The same edits need storing only once
+                if existing.sidecars.iter().any(|kept| kept.hash == sc.hash) {
+                    continue;
+                }
+                if candidate.filename != existing.filename {
+                    if let Some(renamed) = rename_sidecar_for_media(&sc.filename, &existing.filename) {
+                        sc.filename = renamed;
+                    }
+                }
+                // Different edits of the same kind go under a name after their content
+                if existing.sidecars.iter().any(|kept| kept.filename == sc.filename) {
+                    let path = Path::new(&sc.filename);
+                    let stem = path.file_stem().unwrap_or_default().to_string_lossy();
+                    let ext = path.extension().map(|e| format!(".{}", e.to_string_lossy())).unwrap_or_default();
+                    sc.filename = format!("{}_{}{}", stem, &collision_suffix(&sc.hash)[..DEFAULT_COLLISION_SUFFIX_LEN], ext);
+                }
+                log::info!("Keeping {} from duplicate {} as {}", sc.source_path.display(), candidate.filename, sc.filename);
+                existing.sidecars.push(sc);
+            }
+            return;
+        }
+    };
+
+    let (kept, dropped) = if keep_new { (&candidate, &*existing) } else { (&*existing, &candidate) };
+    log::info!(
+        "Keeping {} and its sidecars over the duplicate {}",
+        kept.source_path.display(),
+        dropped.source_path.display()
+    );
+    if keep_new {
+        *existing = candidate;
+    }
+}
+
+/// Top-level folders for filetypes stored outside `images/` and `videos/`,
+/// e.g. RAW files under `raw/2024/05-21`.
+#[derive(Debug, Default)]
+struct TypeRoutes {
+    /// Canonical filetype (or "RAW" for every raw format) -> folder.
+    folders: HashMap<String, String>,
+    /// How finely the date folders below each top-level folder go.
+    granularity: DateGranularity,
+}
+
+impl TypeRoutes {
+    fn new(routes: &[(String, String)]) -> Self {
+        TypeRoutes {
+            folders: routes
+                .iter()
+                .map(|(filetype, folder)| (canonical_filetype(filetype, &[]), folder.clone()))
+                .collect(),
+            granularity: DateGranularity::Day,
+        }
+    }
+
+    fn with_granularity(self, granularity: DateGranularity) -> Self {
+        TypeRoutes { granularity, ..self }
+    }
+
+    /// The folder media of this type and filetype are stored under. A route
+    /// for the exact filetype wins over one for all raw formats.
+    fn folder<'a>(&'a self, media_type: MediaType, filetype: &str) -> &'a str {
+        self.folders
+            .get(&canonical_filetype(filetype, &[]))
+            .or_else(|| self.folders.get("RAW").filter(|_| is_raw_filetype(filetype)))
+            .map(String::as_str)
+            .unwrap_or(media_type.folder_name())
+    }
+}
+
+/// The channel scanned files are sent to the merger through. A few per
+/// worker thread: if merging falls behind, the workers wait rather than
+/// queueing up results for the whole source.
+fn scan_channel<T>() -> (mpsc::SyncSender<T>, mpsc::Receiver<T>) {
+    mpsc::sync_channel(rayon::current_num_threads() * 4)
+}
+
 /// File copy operation to be performed.
 #[derive(Debug, Clone)]
 struct FileCopy {
@@ -70,27 +658,161 @@ struct FileCopy {
     destination: PathBuf,
 }
 
+/// Files an import created in the library, and those it overwrote (moved to
+/// the trash first, so undo can put them back). Until the import is committed
+/// nothing records them, so if it fails or panics the created files are
+/// deleted again and the overwritten ones restored.
+struct CreatedFiles {
+    root: PathBuf,
+    paths: Mutex<Vec<PathBuf>>,
+    trash: Trash,
+    /// (original path, where it is in the trash)
+    replaced: Mutex<Vec<(PathBuf, PathBuf)>>,
+    committed: bool,
+}
+
+impl CreatedFiles {
+    fn new(root: &Path) -> Self {
+        CreatedFiles {
+            root: root.to_path_buf(),
+            paths: Mutex::new(Vec::new()),
+            trash: Trash::new(root),
+            replaced: Mutex::new(Vec::new()),
+            committed: false,
+        }
+    }
+
+    fn push(&self, path: PathBuf) {
+        self.paths.lock().unwrap().push(path);
+    }
+
+    fn paths(&self) -> Vec<PathBuf> {
+        self.paths.lock().unwrap().clone()
+    }
+
+    fn replaced(&self) -> Vec<(PathBuf, PathBuf)> {
+        self.replaced.lock().unwrap().clone()
+    }
+
+    /// Move `destination` into the trash before `source` is written over it,
+    /// unless it already holds the same content. Returns whether it was moved.
+    fn trash_replaced(&self, source: &Path, destination: &Path) -> io::Result<bool> {
+        if destination.symlink_metadata().is_err() || same_content(source, destination) {
+            return Ok(false);
+        }
+        let trashed = self.trash.move_file(destination)?;
+        log::info!("Moved {} to the trash before overwriting it", destination.display());
+        self.replaced.lock().unwrap().push((destination.to_path_buf(), trashed));
+        Ok(true)
+    }
+
+    /// Delete the files created at `paths` and put back any they replaced,
+    /// for media whose records couldn't be written after all.
+    fn discard(&self, paths: &HashSet<PathBuf>) {
+        self.paths.lock().unwrap().retain(|path| {
+            if !paths.contains(path) {
+                return true;
+            }
+            match fs::remove_file(path) {
+                Ok(()) => journal::remove_empty_parents(&self.root, path),
+                Err(e) if e.kind() == io::ErrorKind::NotFound => {}
+                Err(e) => log::warn!("Failed to remove {}: {}", path.display(), e),
+            }
+            false
+        });
+        // Kept in the list if it can't go back, so the journal still says where it is
+        self.replaced.lock().unwrap().retain(|(original, trashed)| {
+            if !paths.contains(original) {
+                return true;
+            }
+            match move_in_library(&self.root, trashed, original) {
+                Ok(()) => {
+                    journal::remove_empty_parents(&self.root, trashed);
+                    false
+                }
+                Err(e) => {
+                    log::warn!("Failed to restore {} from {}: {}", original.display(), trashed.display(), e);
+                    true
+                }
+            }
+        });
+    }
+
+    /// The import is committed and journaled; the files stay.
+    fn keep(&mut self) {
+        self.committed = true;
+    }
+}
+
+impl Drop for CreatedFiles {
+    fn drop(&mut self) {
+        if self.committed {
+            return;
+        }
+        // A panic while the list was locked still leaves it intact
+        let paths = self.paths.get_mut().unwrap_or_else(|e| e.into_inner());
+        for path in paths.iter() {
+            match fs::remove_file(path) {
+                Ok(()) => journal::remove_empty_parents(&self.root, path),
+                Err(e) if e.kind() == io::ErrorKind::NotFound => {}
+                Err(e) => log::warn!("Failed to remove {}: {}", path.display(), e),
+            }
+        }
+        let replaced = self.replaced.get_mut().unwrap_or_else(|e| e.into_inner());
+        for (original, trashed) in replaced.iter() {
+            match move_in_library(&self.root, trashed, original) {
+                Ok(()) => journal::remove_empty_parents(&self.root, trashed),
+                Err(e) => log::warn!("Failed to restore {} from {}: {}", original.display(), trashed.display(), e),
+            }
+        }
+    }
+}
+
 impl Library {
     /// Create a new library at the specified directory.
     pub fn create(dir: &Path) -> Result<Self> {
+        Self::create_with_options(dir, &CreateOptions::default())
+    }
+
+    /// Create a new library at the specified directory with custom options.
+    pub fn create_with_options(dir: &Path, options: &CreateOptions) -> Result<Self> {
         if dir.exists() {
             if dir.join(DB_FILE_NAME).exists() {
                 return Err(PhotosortError::LibraryExists(dir.to_path_buf()));
             }
         } else {
-            fs::create_dir_all(dir)?;
+            create_dir_all_with_mode(dir, options.dir_mode)?;
         }
 
         // Create images and videos subdirectories
-        fs::create_dir_all(dir.join("images"))?;
-        fs::create_dir_all(dir.join("videos"))?;
+        create_dir_all_with_mode(&dir.join("images"), options.dir_mode)?;
+        create_dir_all_with_mode(&dir.join("videos"), options.dir_mode)?;
 
         let db_path = dir.join(DB_FILE_NAME);
         let db = Database::new(&db_path)?;
 
+        if options.layout == StorageLayout::Content {
+            create_dir_all_with_mode(&dir.join(OBJECTS_DIR), options.dir_mode)?;
+        }
+
+        // Libraries created before a setting existed have none, and get its default
+        let now = OffsetDateTime::now_local().unwrap_or_else(|_| OffsetDateTime::now_utc());
+        db.set_setting(CREATED_AT_SETTING, &now.format(DB_DATE_FORMAT).unwrap())?;
+        db.set_setting(CREATOR_VERSION_SETTING, env!("CARGO_PKG_VERSION"))?;
+        db.set_setting(
+            LAYOUT_SETTING,
+            match options.layout {
+                StorageLayout::Date => "date",
+                StorageLayout::Content => "content",
+            },
+        )?;
+        db.set_setting(HASH_ENCODING_SETTING, hash_encoding_name(options.hash_encoding))?;
+        db.set_setting(GRANULARITY_SETTING, granularity_name(options.granularity))?;
+
         Ok(Library {
             root: dir.to_path_buf(),
             db,
+            observer: None,
         })
     }
 
@@ -110,14 +832,61 @@ impl Library {
         Ok(Library {
             root: dir.to_path_buf(),
             db,
+            observer: None,
+        })
+    }
+
+    /// Recover the database of a library left behind by a crashed run, before opening it.
+    pub fn recover(dir: &Path) -> Result<Recovery> {
+        let db_path = dir.join(DB_FILE_NAME);
+        if !db_path.exists() {
+            return Err(PhotosortError::InvalidLibrary(dir.to_path_buf()));
+        }
+        Database::recover(&db_path)
+    }
+
+    /// Open an existing library for reading only, e.g. to inspect it while
+    /// another process imports into it.
+    pub fn open_read_only(dir: &Path) -> Result<Self> {
+        if !dir.exists() {
+            return Err(PhotosortError::LibraryNotFound(dir.to_path_buf()));
+        }
+
+        let db_path = dir.join(DB_FILE_NAME);
+        if !db_path.exists() {
+            return Err(PhotosortError::InvalidLibrary(dir.to_path_buf()));
+        }
+
+        let db = Database::open_read_only(&db_path)?;
+
+        Ok(Library {
+            root: dir.to_path_buf(),
+            db,
+            observer: None,
         })
     }
 
+    /// Report the progress of imports, scans and pushes to `observer` instead
+    /// of drawing progress bars.
+    pub fn set_progress_observer(&mut self, observer: Arc<dyn ProgressObserver>) {
+        self.observer = Some(observer);
+    }
+
+    /// The observer set with `set_progress_observer`, if any.
+    pub fn progress_observer(&self) -> Option<&Arc<dyn ProgressObserver>> {
+        self.observer.as_ref()
+    }
+
     /// Get the library root path.
     pub fn root(&self) -> &Path {
         &self.root
     }
 
+    /// Path of a library file from its stored relpath and filename.
+    pub fn file_path(&self, relpath: &str, filename: &str) -> PathBuf {
+        join_library_path(&self.root, relpath, filename)
+    }
+
     /// Get a reference to the database.
     pub fn database(&self) -> &Database {
         &self.db
@@ -128,182 +897,1201 @@ impl Library {
         &mut self.db
     }
 
-    /// Import media from a source directory.
-    pub fn import(&mut self, source_dir: &Path, dry_run: bool) -> Result<ImportStats> {
-        if !source_dir.exists() || !source_dir.is_dir() {
-            return Err(PhotosortError::NotADirectory(source_dir.to_path_buf()));
+    /// How this library stores media files, chosen when it was created.
+    pub fn layout(&self) -> Result<StorageLayout> {
+        match self.db.setting(LAYOUT_SETTING)?.as_deref() {
+            None | Some("date") => Ok(StorageLayout::Date),
+            Some("content") => Ok(StorageLayout::Content),
+            Some(other) => Err(PhotosortError::Library(format!("unknown storage layout: {}", other))),
         }
+    }
 
-        log::info!("Phase 1: Scanning source directory {}", source_dir.display());
+    /// How this library writes file hashes, chosen when it was created.
+    pub fn hash_encoding(&self) -> Result<HashEncoding> {
+        parse_hash_encoding(self.db.setting(HASH_ENCODING_SETTING)?.as_deref())
+    }
 
-        // Collect all files
-        let files: Vec<PathBuf> = WalkDir::new(source_dir)
-            .into_iter()
-            .filter_map(|e| e.ok())
-            .filter(|e| e.file_type().is_file())
-            .map(|e| e.into_path())
-            .collect();
+    /// How finely this library sorts media into date folders, chosen when it was created.
+    pub fn granularity(&self) -> Result<DateGranularity> {
+        parse_granularity(self.db.setting(GRANULARITY_SETTING)?.as_deref())
+    }
 
-        let bar_style = ProgressStyle::default_bar()
-            .template("{spinner:.green} [{elapsed_precise}] [{bar:40.cyan/blue}] {pos}/{len} ({eta}) {msg}")
-            .unwrap();
+    /// Rewrite every stored hash in another encoding, as one undoable operation.
+    /// Returns how many hashes were rewritten.
+    pub fn convert_hashes(&mut self, to: HashEncoding) -> Result<usize> {
+        let from = self.hash_encoding()?;
+        if from == to {
+            return Ok(0);
+        }
+        if self.layout()? == StorageLayout::Content {
+            return Err(PhotosortError::Library(
+                "a content-addressed library names its files after their hashes, so its hash encoding can't change"
+                    .to_string(),
+            ));
+        }
+
+        let op_id = journal::start(self.db.connection_ref(), "convert-hashes")?;
+        let conn = self.db.connection();
+        let tx = conn.transaction()?;
+        let converted = reencode_hashes(&tx, to)?;
+        journal::record(
+            &tx,
+            op_id,
+            &JournalEntry::HashesConverted { from: hash_encoding_name(from).to_string() },
+        )?;
+        tx.commit()?;
+        journal::finish(self.db.connection_ref(), op_id)?;
+        Ok(converted)
+    }
 
-        let scan_bar = ProgressBar::new(files.len() as u64).with_style(bar_style.clone());
-        scan_bar.set_message("Scanning files");
+    /// Store media found more than once in `source_dir` under the copy an
+    /// import keeps today: the first in name order. Libraries imported before
+    /// duplicates were settled in a fixed order may be named after another
+    /// copy. Media named after none of the source's copies (renamed by hand,
+    /// or to avoid a collision) and cataloged media are left alone.
+    ///
+    /// Files and sidecars are moved and their records updated as one
+    /// undoable operation, unless `dry_run`.
+    pub fn recompute_winners(&mut self, source_dir: &Path, options: &ImportOptions, dry_run: bool) -> Result<WinnersResult> {
+        if !source_dir.is_dir() {
+            return Err(PhotosortError::NotADirectory(source_dir.to_path_buf()));
+        }
 
-        // Process files in parallel to extract metadata
-        let candidates: Vec<ImportCandidate> = files
+        // Files are looked at in name order, as a deterministic import does
+        let options = ImportOptions { deterministic: true, ..options.with_name_case_of(source_dir) };
+        let sidecar_exts = self.sidecar_extensions()?;
+        let encoding = self.hash_encoding()?;
+        let routes = TypeRoutes::new(&self.type_routes()?).with_granularity(self.granularity()?);
+        let exiftool_args: Vec<&str> = options.exiftool_args.iter().map(String::as_str).collect();
+        let exiftool_args = check_exiftool(exiftool_available(), options.require_exif)?
+            .then_some(exiftool_args.as_slice());
+
+        let files = source_files(source_dir, &options)?;
+        let scan_bar = Phase::new(self.observer.as_ref(), "Scanning files", files.len() as u64);
+        let scanned: Vec<ScannedFile> = files
             .par_iter()
-            .filter_map(|path| {
-                let result = process_source_file(path);
-                scan_bar.inc(1);
-                match result {
-                    Ok(Some(candidate)) => Some(candidate),
-                    Ok(None) => None, // Not a media file
-                    Err(e) => {
-                        log::warn!("Error processing {}: {}", path.display(), e);
-                        None
-                    }
-                }
+            .map(|path| {
+                let result = process_source_file(path, None, &options, exiftool_args, &sidecar_exts, encoding);
+                scan_bar.file_done(path);
+                result
             })
-            .collect();
-
+            .collect::<Result<_>>()?;
         scan_bar.finish_with_message("Scan complete");
 
-        log::info!("Found {} media files to process", candidates.len());
-
-        // Deduplicate by hash, but handle sidecar conflicts interactively
-        let mut unique_by_hash: HashMap<String, ImportCandidate> = HashMap::new();
-        let mut duplicates_skipped = 0;
+        // Every copy of each file, in the order an import looks at them
+        let mut copies: BTreeMap<String, Vec<ImportCandidate>> = BTreeMap::new();
+        for scanned in scanned {
+            if let ScannedFile::Candidate(candidate) = scanned {
+                copies.entry(candidate.hash.clone()).or_default().push(candidate);
+            }
+        }
 
-        for candidate in candidates {
-            if self.db.hash_exists(&candidate.hash)? {
-                duplicates_skipped += 1;
-                log::debug!("Skipping duplicate (already in library): {}", candidate.filename);
+        let mut result = WinnersResult::default();
+        let mut moves = Vec::new();
+        let conn = self.db.connection_ref();
+        for (hash, group) in copies.iter().filter(|(_, group)| group.len() > 1) {
+            let stored: Option<(i64, String, String)> = conn
+                .query_row("SELECT id, relpath, filename FROM media WHERE hash = ?1", params![hash], |row| {
+                    Ok((row.get(0)?, row.get(1)?, row.get(2)?))
+                })
+                .optional()?;
+            let Some((id, relpath, filename)) = stored else {
+                continue;
+            };
+            let preferred = &group[0];
+            let new_relpath = preferred.relpath(&routes);
+            let is_copy = |c: &ImportCandidate| c.relpath(&routes) == relpath && c.filename == filename;
+            if Path::new(&relpath).is_absolute() || is_copy(preferred) || !group.iter().any(is_copy) {
                 continue;
             }
 
-            match unique_by_hash.entry(candidate.hash.clone()) {
-                std::collections::hash_map::Entry::Vacant(e) => {
-                    e.insert(candidate);
-                }
-                std::collections::hash_map::Entry::Occupied(mut e) => {
-                    let existing = e.get_mut();
-
-                    // Check if both have sidecars (potential edit conflict)
-                    if !existing.sidecars.is_empty() && !candidate.sidecars.is_empty() {
-                        // Both have edits - prompt user
-                        println!("\nDuplicate media with different edits detected:");
-                        println!("  1. {} ({} sidecars)", existing.filename, existing.sidecars.len());
-                        for sc in &existing.sidecars {
-                            println!("     - {}", sc.filename);
-                        }
-                        println!("  2. {} ({} sidecars)", candidate.filename, candidate.sidecars.len());
-                        for sc in &candidate.sidecars {
-                            println!("     - {}", sc.filename);
-                        }
-                        println!("\nOptions:");
-                        println!("  [1] Keep first only (discard second and its edits)");
-                        println!("  [2] Keep second only (discard first and its edits)");
-                        println!("  [B] Keep both (import both files with their respective edits)");
-                        print!("Choice [1/2/B]: ");
-                        io::stdout().flush()?;
-
-                        let mut input = String::new();
-                        io::stdin().read_line(&mut input)?;
-
-                        match input.trim().to_uppercase().as_str() {
-                            "2" => {
-                                // Replace existing with candidate
-                                *existing = candidate;
-                                log::info!("User chose to keep second file");
-                            }
-                            "B" => {
-                                // Keep both - add candidate as separate entry with modified hash
-                                // We use a synthetic hash to keep them separate
-                                let synthetic_hash = format!("{}-alt", candidate.hash);
-                                let mut alt_candidate = candidate;
-                                alt_candidate.hash = synthetic_hash.clone();
-                                unique_by_hash.insert(synthetic_hash, alt_candidate);
-                                log::info!("User chose to keep both files");
-                            }
-                            _ => {
-                                // Default: keep first (existing), skip candidate
-                                duplicates_skipped += 1;
-                                log::info!("User chose to keep first file");
-                            }
-                        }
-                    } else if candidate.sidecars.is_empty() {
-                        // Candidate has no sidecars, just skip it
-                        duplicates_skipped += 1;
-                        log::debug!("Skipping duplicate media (no sidecars): {}", candidate.filename);
-                    } else {
-                        // Existing has no sidecars but candidate does - merge sidecars
-                        log::info!(
-                            "Adding {} sidecars from {} to {}",
-                            candidate.sidecars.len(),
-                            candidate.filename,
-                            existing.filename
-                        );
-                        existing.sidecars.extend(candidate.sidecars);
-                        duplicates_skipped += 1;
-                    }
-                }
+            // Sidecars named after the media follow its new name
+            let old_stem = Path::new(&filename).file_stem().map(|s| s.to_os_string());
+            let mut stmt = conn.prepare("SELECT id, filename FROM sidecars WHERE media_id = ?1 ORDER BY id")?;
+            let sidecars: Vec<(i64, String, String)> = stmt
+                .query_map(params![id], |row| Ok((row.get::<_, i64>(0)?, row.get::<_, String>(1)?)))?
+                .map(|row| {
+                    row.map(|(sidecar_id, name)| {
+                        let renamed = (Path::new(&name).file_stem().map(|s| s.to_os_string()) == old_stem)
+                            .then(|| rename_sidecar_for_media(&name, &preferred.filename))
+                            .flatten()
+                            .unwrap_or_else(|| name.clone());
+                        (sidecar_id, name, renamed)
+                    })
+                })
+                .collect::<rusqlite::Result<_>>()?;
+
+            let change = WinnerChange {
+                hash: hash.clone(),
+                old_path: format!("{}/{}", relpath, filename),
+                new_path: format!("{}/{}", new_relpath, preferred.filename),
+            };
+            let taken = std::iter::once((&filename, &preferred.filename))
+                .chain(sidecars.iter().map(|(_, name, renamed)| (name, renamed)))
+                .map(|(name, renamed)| (self.file_path(&relpath, name), self.file_path(&new_relpath, renamed)))
+                .find(|(from, to)| from != to && (to.exists() || to.is_symlink()))
+                .map(|(_, to)| to);
+            if let Some(taken) = taken {
+                log::warn!("Not moving {}: {} already exists", change.old_path, taken.display());
+                result.skipped.push(change);
+                continue;
             }
+            moves.push(PlannedMove {
+                id,
+                relpath,
+                filename,
+                new_relpath,
+                new_filename: preferred.filename.clone(),
+                sidecars,
+            });
+            result.changes.push(change);
         }
 
-        let to_import: Vec<ImportCandidate> = unique_by_hash.into_values().collect();
-        log::info!(
-            "{} unique files to import ({} duplicates skipped)",
-            to_import.len(),
-            duplicates_skipped
-        );
+        if dry_run || moves.is_empty() {
+            return Ok(result);
+        }
 
-        if dry_run {
-            println!("\n[DRY RUN] Would import:");
-            let mut images = 0;
-            let mut videos = 0;
-            for c in &to_import {
-                match c.media_type {
-                    MediaType::Image => images += 1,
-                    MediaType::Video => videos += 1,
+        let op_id = journal::start(self.db.connection_ref(), "recompute-winners")?;
+        let conn = self.db.connection_ref();
+        for m in moves {
+            // The media file goes first; if it can't move, nothing else does
+            let from = self.file_path(&m.relpath, &m.filename);
+            let to = self.file_path(&m.new_relpath, &m.new_filename);
+            if let Err(e) = move_in_library(&self.root, &from, &to) {
+                log::warn!("Failed to move {} to {}: {}", from.display(), to.display(), e);
+                continue;
+            }
+            journal::record(
+                conn,
+                op_id,
+                &JournalEntry::FileMoved {
+                    from: format!("{}/{}", m.relpath, m.filename),
+                    to: format!("{}/{}", m.new_relpath, m.new_filename),
+                },
+            )?;
+            conn.execute(
+                "UPDATE media SET relpath = ?1, filename = ?2 WHERE id = ?3",
+                params![m.new_relpath, m.new_filename, m.id],
+            )?;
+            journal::record(
+                conn,
+                op_id,
+                &JournalEntry::MediaMoved { id: m.id, relpath: m.relpath.clone(), filename: m.filename.clone() },
+            )?;
+
+            for (sidecar_id, name, renamed) in &m.sidecars {
+                let from = self.file_path(&m.relpath, name);
+                let to = self.file_path(&m.new_relpath, renamed);
+                if let Err(e) = move_in_library(&self.root, &from, &to) {
+                    log::warn!("Failed to move sidecar {} to {}: {}", from.display(), to.display(), e);
+                    continue;
+                }
+                journal::record(
+                    conn,
+                    op_id,
+                    &JournalEntry::FileMoved {
+                        from: format!("{}/{}", m.relpath, name),
+                        to: format!("{}/{}", m.new_relpath, renamed),
+                    },
+                )?;
+                if renamed != name {
+                    conn.execute("UPDATE sidecars SET filename = ?1 WHERE id = ?2", params![renamed, sidecar_id])?;
+                    journal::record(
+                        conn,
+                        op_id,
+                        &JournalEntry::SidecarRenamed { id: *sidecar_id, filename: name.clone() },
+                    )?;
                 }
             }
-            println!("  {} images", images);
-            println!("  {} videos", videos);
-            println!("  {} sidecars", to_import.iter().map(|c| c.sidecars.len()).sum::<usize>());
-            return Ok(ImportStats {
-                images_imported: 0,
-                videos_imported: 0,
-                sidecars_imported: 0,
-                duplicates_skipped,
-                errors: 0,
-            });
+            // A date folder emptied by the move goes too
+            let _ = fs::remove_dir(self.root.join(&m.relpath));
         }
+        journal::finish(conn, op_id)?;
 
-        // Phase 2: Copy files first
+        Ok(result)
+    }
+
+    /// Read one photo or video's metadata again, from `source` or else from the
+    /// library's own copy, and update its record: date, camera details and
+    /// dimensions. If its date now belongs in another date folder, the file and
+    /// its sidecars move there.
+    ///
+    /// `source` must hold the same content as the library's copy. The change
+    /// is one undoable operation, unless `dry_run`.
+    pub fn reimport(
+        &mut self,
+        media: &Path,
+        source: Option<&Path>,
+        options: &ImportOptions,
+        dry_run: bool,
+    ) -> Result<ReimportResult> {
+        let id = self
+            .find_media(media)?
+            .ok_or_else(|| PhotosortError::Library(format!("no photo or video matches {}", media.display())))?;
+        let (relpath, filename, hash, stored_hash, created_at): (String, String, String, Option<String>, String) =
+            self.db.connection_ref().query_row(
+                "SELECT relpath, filename, hash, stored_hash, created_at FROM media WHERE id = ?1",
+                params![id],
+                |row| Ok((row.get(0)?, row.get(1)?, row.get(2)?, row.get(3)?, row.get(4)?)),
+            )?;
+
+        let path = source.map_or_else(|| self.file_path(&relpath, &filename), Path::to_path_buf);
+        if !path.is_file() {
+            return Err(PhotosortError::PathNotFound(path));
+        }
+        let sidecar_exts = self.sidecar_extensions()?;
+        let exiftool_args: Vec<&str> = options.exiftool_args.iter().map(String::as_str).collect();
+        let exiftool_args = check_exiftool(exiftool_available(), options.require_exif)?
+            .then_some(exiftool_args.as_slice());
+        let options = &options.with_name_case_of(path.parent().unwrap_or(&self.root));
+        let scanned = process_source_file(&path, None, options, exiftool_args, &sidecar_exts, self.hash_encoding()?)?;
+        let ScannedFile::Candidate(candidate) = scanned else {
+            return Err(PhotosortError::Library(format!("{} can't be imported", path.display())));
+        };
+        if content_hash(&candidate.hash) != content_hash(&hash) && Some(&candidate.hash) != stored_hash.as_ref() {
+            return Err(PhotosortError::Conflict(format!(
+                "{} isn't the same file as {}/{}; import it instead",
+                path.display(),
+                relpath,
+                filename
+            )));
+        }
+
+        // Cataloged files stay where they are in their source
+        let routes = TypeRoutes::new(&self.type_routes()?).with_granularity(self.granularity()?);
+        let new_relpath = if Path::new(&relpath).is_absolute() {
+            relpath.clone()
+        } else {
+            candidate.relpath(&routes)
+        };
+        let result = ReimportResult {
+            hash,
+            old_date: created_at,
+            new_date: candidate.created_at.format(DB_DATE_FORMAT).unwrap(),
+            old_path: format!("{}/{}", relpath, filename),
+            new_path: format!("{}/{}", new_relpath, filename),
+        };
+        let sidecars: Vec<String> = self
+            .db
+            .connection_ref()
+            .prepare("SELECT filename FROM sidecars WHERE media_id = ?1 ORDER BY id")?
+            .query_map(params![id], |row| row.get(0))?
+            .collect::<rusqlite::Result<_>>()?;
+        if new_relpath != relpath {
+            if self.layout()? == StorageLayout::Content {
+                return Err(PhotosortError::Library(
+                    "moving media between date folders of a content-addressed library isn't supported".to_string(),
+                ));
+            }
+            let taken = std::iter::once(&filename)
+                .chain(&sidecars)
+                .map(|name| self.file_path(&new_relpath, name))
+                .find(|to| to.exists() || to.is_symlink());
+            if let Some(taken) = taken {
+                return Err(PhotosortError::Conflict(format!("{} already exists", taken.display())));
+            }
+        }
+        if dry_run {
+            return Ok(result);
+        }
+
+        let op_id = journal::start(self.db.connection_ref(), "reimport")?;
+        let conn = self.db.connection_ref();
+        if new_relpath != relpath {
+            // The media file goes first; if it can't move, nothing changes
+            for (i, name) in std::iter::once(&filename).chain(&sidecars).enumerate() {
+                let from = self.file_path(&relpath, name);
+                let to = self.file_path(&new_relpath, name);
+                if let Err(e) = move_in_library(&self.root, &from, &to) {
+                    if i == 0 {
+                        journal::finish(conn, op_id)?;
+                        return Err(e.into());
+                    }
+                    log::warn!("Failed to move sidecar {} to {}: {}", from.display(), to.display(), e);
+                    continue;
+                }
+                journal::record(
+                    conn,
+                    op_id,
+                    &JournalEntry::FileMoved {
+                        from: format!("{}/{}", relpath, name),
+                        to: format!("{}/{}", new_relpath, name),
+                    },
+                )?;
+            }
+            // A date folder emptied by the move goes too
+            let _ = fs::remove_dir(self.root.join(&relpath));
+        }
+        if let Some(media) = journal::snapshot_row(conn, "media", id)? {
+            journal::record(conn, op_id, &JournalEntry::MediaUpdated { media })?;
+        }
+        conn.execute(
+            "UPDATE media SET relpath = ?1, created_at = ?2, camera_make = ?3, camera_model = ?4, lens = ?5,
+                              focal_length = ?6, aperture = ?7, shutter_speed = ?8, iso = ?9, gps_lat = ?10,
+                              gps_lon = ?11, width = ?12, height = ?13
+             WHERE id = ?14",
+            params![
+                new_relpath,
+                result.new_date,
+                candidate.exif.camera_make,
+                candidate.exif.camera_model,
+                candidate.exif.lens,
+                candidate.exif.focal_length,
+                candidate.exif.aperture,
+                candidate.exif.shutter_speed,
+                candidate.exif.iso,
+                candidate.exif.gps_lat,
+                candidate.exif.gps_lon,
+                candidate.dimensions.map(|(w, _)| w),
+                candidate.dimensions.map(|(_, h)| h),
+                id,
+            ],
+        )?;
+        journal::finish(conn, op_id)?;
+        log::info!("Reimported {} (now {})", result.old_path, result.new_path);
+        Ok(result)
+    }
+
+    /// Find the media a command-line argument names: a path to the file, relative
+    /// to the current directory or the library root, or a prefix of its hash.
+    pub fn find_media(&self, path_or_hash: &Path) -> Result<Option<i64>> {
+        // Cataloged files are recorded by their absolute path in the source
+        let cataloged = fs::canonicalize(path_or_hash).ok().and_then(|path| {
+            let filename = path.file_name()?.to_string_lossy().into_owned();
+            Some((path.parent()?.to_string_lossy().into_owned(), filename))
+        });
+        for (relpath, filename) in resolve_library_path(&self.root, path_or_hash).into_iter().chain(cataloged) {
+            let id = self
+                .db
+                .connection_ref()
+                .query_row(
+                    "SELECT id FROM media WHERE relpath = ?1 AND filename = ?2",
+                    params![relpath, filename],
+                    |row| row.get(0),
+                )
+                .optional()?;
+            if id.is_some() {
+                return Ok(id);
+            }
+        }
+        match path_or_hash.to_str() {
+            Some(prefix) => self.db.media_id_by_hash_prefix(prefix),
+            None => Ok(None),
+        }
+    }
+
+    /// How many photos and videos, and sidecars, the library holds.
+    pub fn totals(&self) -> Result<LibraryTotals> {
+        Ok(LibraryTotals {
+            media: self.db.media_count()? as usize,
+            sidecars: self.db.sidecar_count()? as usize,
+        })
+    }
+
+    /// Sidecar extensions this library recognizes besides the built-in ones (lowercase).
+    pub fn sidecar_extensions(&self) -> Result<Vec<String>> {
+        let extensions = self.db.setting(SIDECAR_EXTENSIONS_SETTING)?.unwrap_or_default();
+        Ok(extensions.lines().map(str::to_string).collect())
+    }
+
+    /// Save the extra sidecar extensions used by imports and rescans.
+    pub fn set_sidecar_extensions(&self, extensions: &[String]) -> Result<()> {
+        self.db.set_setting(SIDECAR_EXTENSIONS_SETTING, &extensions.join("\n"))
+    }
+
+    /// Filetypes stored under their own top-level folder, as (filetype, folder).
+    pub fn type_routes(&self) -> Result<Vec<(String, String)>> {
+        let routes = self.db.setting(ROUTES_SETTING)?.unwrap_or_default();
+        Ok(routes
+            .lines()
+            .filter_map(|line| line.split_once('='))
+            .map(|(filetype, folder)| (filetype.to_string(), folder.to_string()))
+            .collect())
+    }
+
+    /// Save the filetype routes used by later imports.
+    pub fn set_type_routes(&self, routes: &[(String, String)]) -> Result<()> {
+        let value: Vec<String> = routes.iter().map(|(filetype, folder)| format!("{}={}", filetype, folder)).collect();
+        self.db.set_setting(ROUTES_SETTING, &value.join("\n"))
+    }
+
+    /// List each folder media are stored in, with how many media it holds and
+    /// whether it follows the library's `images|videos/YYYY/MM-DD` layout
+    /// (or a filetype route's `folder/YYYY/MM-DD`), with the date part cut
+    /// down to `YYYY/MM` or `YYYY` in libraries sorted by month or year.
+    /// Folders that don't were sorted under an older scheme or moved by hand.
+    pub fn folders(&self) -> Result<Vec<FolderSummary>> {
+        let routes = self.type_routes()?;
+        let route_folders: Vec<&str> = routes.iter().map(|(_, folder)| folder.as_str()).collect();
+        let granularity = self.granularity()?;
+        let mut stmt = self.db.connection_ref().prepare(
+            "SELECT relpath, media_type, COUNT(*) FROM media GROUP BY relpath, media_type ORDER BY relpath",
+        )?;
+        let rows = stmt.query_map([], |row| {
+            Ok((row.get::<_, String>(0)?, row.get::<_, String>(1)?, row.get::<_, i64>(2)?))
+        })?;
+
+        let mut folders: Vec<FolderSummary> = Vec::new();
+        for row in rows {
+            let (relpath, media_type, count) = row?;
+            let conforms = relpath_conforms(&relpath, &media_type, &route_folders, granularity);
+            match folders.last_mut() {
+                // A folder holding both images and videos can't be right for both
+                Some(last) if last.relpath == relpath => {
+                    last.media_count += count as usize;
+                    last.conforms &= conforms;
+                }
+                _ => folders.push(FolderSummary {
+                    relpath,
+                    media_count: count as usize,
+                    conforms,
+                }),
+            }
+        }
+        Ok(folders)
+    }
+
+    /// Media whose folder isn't the one their stored date and filetype sort them
+    /// into under the library's current routes and granularity: moved by hand,
+    /// sorted under an older scheme, or redated without being moved. Cataloged
+    /// media stay in their source, and media with unreadable dates are skipped.
+    pub fn misplaced_media(&self) -> Result<Vec<MisplacedMedia>> {
+        let routes = TypeRoutes::new(&self.type_routes()?).with_granularity(self.granularity()?);
+        let mut stmt = self
+            .db
+            .connection_ref()
+            .prepare("SELECT relpath, filename, media_type, filetype, created_at FROM media ORDER BY id")?;
+        let rows = stmt.query_map([], |row| {
+            Ok((
+                row.get::<_, String>(0)?,
+                row.get::<_, String>(1)?,
+                row.get::<_, String>(2)?,
+                row.get::<_, String>(3)?,
+                row.get::<_, String>(4)?,
+            ))
+        })?;
+
+        let mut misplaced = Vec::new();
+        for row in rows {
+            let (relpath, filename, media_type, filetype, created_at) = row?;
+            let media_type = match media_type.as_str() {
+                "image" => MediaType::Image,
+                "video" => MediaType::Video,
+                _ => continue,
+            };
+            let Ok(date) = OffsetDateTime::parse(&created_at, DB_DATE_FORMAT) else {
+                continue;
+            };
+            if Path::new(&relpath).is_absolute() {
+                continue;
+            }
+            let expected = format!("{}/{}", routes.folder(media_type, &filetype), date_folder(date, routes.granularity));
+            if expected != relpath {
+                misplaced.push(MisplacedMedia {
+                    path: self.file_path(&relpath, &filename),
+                    relpath,
+                    expected,
+                });
+            }
+        }
+        Ok(misplaced)
+    }
+
+    /// Filenames used by more than one photo or video. These are different
+    /// files, since each hash is stored once, which is confusing when browsing
+    /// the library by hand; two records with the same name in the same folder
+    /// mean one of them no longer matches the file there.
+    pub fn name_collisions(&self) -> Result<Vec<NameCollision>> {
+        let mut stmt = self.db.connection_ref().prepare(
+            "SELECT filename, relpath, hash FROM media
+             WHERE filename IN (SELECT filename FROM media GROUP BY filename HAVING COUNT(*) > 1)
+             ORDER BY filename, relpath, hash",
+        )?;
+        let rows = stmt.query_map([], |row| {
+            Ok((row.get::<_, String>(0)?, row.get::<_, String>(1)?, row.get::<_, String>(2)?))
+        })?;
+
+        let mut collisions: Vec<NameCollision> = Vec::new();
+        for row in rows {
+            let (filename, relpath, hash) = row?;
+            match collisions.last_mut() {
+                Some(last) if last.filename == filename => last.copies.push((relpath, hash)),
+                _ => collisions.push(NameCollision {
+                    filename,
+                    copies: vec![(relpath, hash)],
+                }),
+            }
+        }
+        Ok(collisions)
+    }
+
+    /// Call `f` with the path and hash of every photo and video file in the
+    /// library, in the order they were added. Rows are read one at a time, so
+    /// memory stays flat however large the library is. The hash is that of the
+    /// file on disk, which differs from the media's own for stripped copies.
+    /// Stops at the first error `f` returns, and returns it.
+    pub fn for_each_media_file<F>(&self, mut f: F) -> Result<()>
+    where
+        F: FnMut(&Path, &str) -> Result<()>,
+    {
+        let mut stmt = self
+            .db
+            .connection_ref()
+            .prepare("SELECT relpath, filename, COALESCE(stored_hash, hash) FROM media ORDER BY id")?;
+        let mut rows = stmt.query([])?;
+        while let Some(row) = rows.next()? {
+            let (relpath, filename, hash): (String, String, String) = (row.get(0)?, row.get(1)?, row.get(2)?);
+            f(&self.file_path(&relpath, &filename), &hash)?;
+        }
+        Ok(())
+    }
+
+    /// Call `f` with the path and hash of every sidecar in the library, like
+    /// `for_each_media_file`.
+    pub fn for_each_sidecar_file<F>(&self, mut f: F) -> Result<()>
+    where
+        F: FnMut(&Path, &str) -> Result<()>,
+    {
+        let mut stmt = self.db.connection_ref().prepare(
+            "SELECT m.relpath, s.filename, s.hash FROM sidecars s JOIN media m ON s.media_id = m.id ORDER BY s.id",
+        )?;
+        let mut rows = stmt.query([])?;
+        while let Some(row) = rows.next()? {
+            let (relpath, filename, hash): (String, String, String) = (row.get(0)?, row.get(1)?, row.get(2)?);
+            f(&self.file_path(&relpath, &filename), &hash)?;
+        }
+        Ok(())
+    }
+
+    /// Map each sidecar hash in the library to one stored file with that content.
+    fn stored_sidecar_paths(&self) -> Result<HashMap<String, PathBuf>> {
+        let mut stmt = self.db.connection_ref().prepare(
+            "SELECT s.hash, m.relpath, s.filename FROM sidecars s JOIN media m ON s.media_id = m.id",
+        )?;
+        let rows = stmt.query_map([], |row| {
+            Ok((row.get::<_, String>(0)?, row.get::<_, String>(1)?, row.get::<_, String>(2)?))
+        })?;
+
+        let mut paths = HashMap::new();
+        for row in rows {
+            let (hash, relpath, filename) = row?;
+            let path = self.file_path(&relpath, &filename);
+            if path.is_file() {
+                paths.entry(hash).or_insert(path);
+            }
+        }
+        Ok(paths)
+    }
+
+    /// Media already in the library that a new file may be a re-saved copy of:
+    /// taken within `window` of it, of the same type, camera and dimensions,
+    /// with different content. The closest in date is reported for each file.
+    fn possible_readds(&self, candidates: &[ImportCandidate], window: time::Duration) -> Result<Vec<PossibleReadd>> {
+        let mut stmt = self.db.connection_ref().prepare(
+            "SELECT hash, filename, relpath, media_type, created_at, camera_model, width, height FROM media",
+        )?;
+        let rows = stmt.query_map([], |row| {
+            Ok((
+                row.get::<_, String>(0)?,
+                row.get::<_, String>(1)?,
+                row.get::<_, String>(2)?,
+                row.get::<_, String>(3)?,
+                row.get::<_, String>(4)?,
+                row.get::<_, Option<String>>(5)?,
+                row.get::<_, Option<u32>>(6)?,
+                row.get::<_, Option<u32>>(7)?,
+            ))
+        })?;
+        let mut stored = Vec::new();
+        for row in rows {
+            let (hash, filename, relpath, media_type, created_at, camera_model, width, height) = row?;
+            // Dates that don't parse can't be compared
+            if let Ok(date) = OffsetDateTime::parse(&created_at, DB_DATE_FORMAT) {
+                stored.push((date, hash, filename, relpath, media_type, camera_model, width.zip(height)));
+            }
+        }
+        stored.sort_by_key(|s| s.0);
+
+        let mut readds = Vec::new();
+        for candidate in candidates {
+            let start = stored.partition_point(|s| s.0 < candidate.created_at - window);
+            let closest = stored[start..]
+                .iter()
+                .take_while(|s| s.0 <= candidate.created_at + window)
+                .filter(|(_, hash, _, _, media_type, camera_model, dimensions)| {
+                    *hash != candidate.hash
+                        && media_type == candidate.media_type.as_str()
+                        && *camera_model == candidate.exif.camera_model
+                        && (dimensions.is_none() || candidate.dimensions.is_none() || *dimensions == candidate.dimensions)
+                })
+                .min_by_key(|s| (s.0 - candidate.created_at).abs());
+            if let Some((date, _, filename, relpath, ..)) = closest {
+                readds.push(PossibleReadd {
+                    path: candidate.source_path.clone(),
+                    date: candidate.created_at,
+                    existing: self.file_path(relpath, filename),
+                    existing_date: *date,
+                });
+            }
+        }
+        Ok(readds)
+    }
+
+    /// Import media from a source directory.
+    ///
+    /// A panic along the way, such as from metadata nothing expected, comes
+    /// back as [`PhotosortError::Panicked`] rather than taking the process
+    /// down; the import's transaction is rolled back and the files it copied
+    /// are deleted as it unwinds.
+    pub fn import(&mut self, source_dir: &Path, options: &ImportOptions) -> Result<ImportStats> {
+        let result = std::panic::catch_unwind(AssertUnwindSafe(|| self.import_source(source_dir, options)));
+        result.unwrap_or_else(|payload| {
+            let message = panic_message(payload.as_ref());
+            log::error!("Import of {} panicked: {}", source_dir.display(), message);
+            Err(PhotosortError::Panicked {
+                phase: "importing",
+                path: source_dir.to_path_buf(),
+                message,
+            })
+        })
+    }
+
+    fn import_source(&mut self, source_dir: &Path, options: &ImportOptions) -> Result<ImportStats> {
+        let dry_run = options.dry_run;
+
+        if !source_dir.exists() || !source_dir.is_dir() {
+            return Err(PhotosortError::NotADirectory(source_dir.to_path_buf()));
+        }
+
+        // An object is named by its content and may back several records, so it can't be rewritten
+        if options.strip.is_some() && !options.catalog && self.layout()? == StorageLayout::Content {
+            return Err(PhotosortError::Argument(
+                "--strip can't be used with a content-addressed library, whose stored files are shared by hash"
+                    .to_string(),
+            ));
+        }
+        if options.strip.is_some() && !exiftool_available() {
+            return Err(PhotosortError::Exiftool("stripping metadata needs exiftool, which was not found".to_string()));
+        }
+
+        // Sidecars are matched as the source's disk sees names, destinations as the library's
+        let library_ignores_case = options.with_name_case_of(&self.root).name_case == NameCase::Insensitive;
+        let options = &options.with_name_case_of(source_dir);
+
+        let started_at = OffsetDateTime::now_utc().unix_timestamp();
+        let source_key = fs::canonicalize(source_dir)?.to_string_lossy().into_owned();
+        let mark = match (options.since_last_import, options.force) {
+            (true, false) => self.db.import_mark(&source_key)?,
+            _ => None,
+        };
+        if let Some(mark) = mark {
+            log::info!("Only considering files modified since {}", mark);
+        }
+
+        log::info!("Phase 1: Scanning source directory {}", source_dir.display());
+
+        // Extensions added with rescan-sidecars count as sidecars too
+        let sidecar_exts = self.sidecar_extensions()?;
+        let encoding = self.hash_encoding()?;
+
+        // Collect all files, or the ones listed
+        let mut listed_missing: Vec<SkippedFile> = Vec::new();
+        let mut files: Vec<PathBuf> = match &options.files {
+            Some(list) => {
+                let mut seen = HashSet::new();
+                let mut files = Vec::new();
+                for path in list {
+                    if !seen.insert(path) {
+                        continue;
+                    }
+                    if path.is_file() {
+                        files.push(path.clone());
+                    } else {
+                        log::warn!("Listed file not found: {}", path.display());
+                        listed_missing.push(SkippedFile {
+                            path: path.clone(),
+                            reason: SkipReason::NotFound,
+                        });
+                    }
+                }
+                if options.deterministic {
+                    files.sort();
+                }
+                files
+            }
+            None => source_files(source_dir, options)?,
+        };
+
+        // Files that failed the source check; their sidecars are dropped too
+        let mut unverified: HashSet<PathBuf> = HashSet::new();
+        let mut unverified_skips: Vec<SkippedFile> = Vec::new();
+        if let Some(manifest_path) = &options.verify_source {
+            let manifest = SourceManifest::load(manifest_path)?;
+            log::info!("Checking {} files against {}", manifest.len(), manifest_path.display());
+            // A manifest kept in the source doesn't list itself
+            if let Ok(manifest_path) = fs::canonicalize(manifest_path) {
+                files.retain(|f| fs::canonicalize(f).map_or(true, |f| f != manifest_path));
+            }
+
+            let check = manifest.check(source_dir, &files);
+            if !check.is_ok() && options.on_source_mismatch == SourceMismatchPolicy::Abort {
+                for path in check.mismatched.iter().chain(&check.missing).chain(&check.unlisted) {
+                    log::error!("Source check failed: {}", path.display());
+                }
+                return Err(PhotosortError::SourceMismatch {
+                    problems: check.problems(),
+                    first: check.first().cloned().unwrap_or_default(),
+                });
+            }
+            for path in &check.missing {
+                log::warn!("Listed in the manifest but not in the source: {}", path.display());
+            }
+            for (paths, reason) in [
+                (check.mismatched, SkipReason::SourceMismatch),
+                (check.unlisted, SkipReason::SourceUnlisted),
+            ] {
+                for path in paths {
+                    unverified.insert(path.clone());
+                    unverified_skips.push(SkippedFile { path, reason });
+                }
+            }
+            files.retain(|f| !unverified.contains(f));
+        }
+
+        let scan_bar = Phase::new(self.observer.as_ref(), "Scanning files", files.len() as u64);
+        let library_empty = self.db.media_count()? == 0;
+
+        let known = if options.skip_existing_hash {
+            Some(KnownMedia::load(&self.root, &self.db, options.normalize_unicode)?)
+        } else {
+            None
+        };
+        let exiftool_args: Vec<&str> = options.exiftool_args.iter().map(String::as_str).collect();
+        let exiftool_args = check_exiftool(exiftool_available(), options.require_exif)?
+            .then_some(exiftool_args.as_slice());
+        let unchanged_sidecars: Mutex<Vec<PathBuf>> = Mutex::new(Vec::new());
+        let unchanged_skipped = AtomicUsize::new(0);
+        // Bytes of source files whose content the library already holds
+        let library_copy_bytes = AtomicU64::new(0);
+        let unmodified_skipped = AtomicUsize::new(0);
+        let unusable_files: Mutex<Vec<SkippedFile>> = Mutex::new(Vec::new());
+        // The first file whose processing panicked; the import stops before copying
+        let panicked: Mutex<Option<PhotosortError>> = Mutex::new(None);
+
+        // Files are processed in parallel and merged by hash as they arrive, through
+        // a small bounded channel, so memory follows unique media rather than
+        // every file in the source.
+        let (sender, receiver) = scan_channel::<(usize, ImportCandidate)>();
+        let mut merger = CandidateMerger::default();
+        // Candidates held back to be merged in source order (deterministic imports only)
+        let mut arrived: Vec<(usize, ImportCandidate)> = Vec::new();
+        let mut claimed_sidecars: HashSet<PathBuf> = HashSet::new();
+        let mut megapixel_skips: Vec<SkippedFile> = Vec::new();
+        let mut already_in_library = 0;
+        let mut candidates_found = 0;
+
+        std::thread::scope(|s| -> Result<()> {
+            s.spawn(|| {
+                files.par_iter().enumerate().for_each_with(sender, |sender, (index, path)| {
+                    let result = std::panic::catch_unwind(AssertUnwindSafe(|| {
+                        let result = match mark {
+                            Some(mark) if modified_before(path, mark) => Ok(ScannedFile::NotModified {
+                                sidecars: attached_files(path, options, &sidecar_exts),
+                            }),
+                            _ => {
+                                process_source_file(path, known.as_ref(), options, exiftool_args, &sidecar_exts, encoding)
+                            }
+                        };
+                        scan_bar.file_done(path);
+                        result
+                    }));
+                    let result = match result {
+                        Ok(result) => result,
+                        Err(payload) => {
+                            let message = panic_message(payload.as_ref());
+                            log::error!("Processing {} panicked: {}", path.display(), message);
+                            panicked.lock().unwrap().get_or_insert(PhotosortError::Panicked {
+                                phase: "scanning",
+                                path: path.clone(),
+                                message,
+                            });
+                            return;
+                        }
+                    };
+                    match result {
+                        // Fails only once the receiver gave up on an error
+                        Ok(ScannedFile::Candidate(candidate)) => {
+                            let _ = sender.send((index, candidate));
+                        }
+                        Ok(ScannedFile::NotModified { sidecars }) => {
+                            if !is_sidecar(path, &sidecar_exts) && !is_preview(path) {
+                                unmodified_skipped.fetch_add(1, Ordering::Relaxed);
+                            }
+                            unchanged_sidecars.lock().unwrap().extend(sidecars);
+                        }
+                        Ok(ScannedFile::InLibrary { file_size, sidecars }) => {
+                            unchanged_skipped.fetch_add(1, Ordering::Relaxed);
+                            library_copy_bytes.fetch_add(file_size, Ordering::Relaxed);
+                            unchanged_sidecars.lock().unwrap().extend(sidecars);
+                        }
+                        Ok(ScannedFile::Skipped { reason, sidecars }) => {
+                            unusable_files.lock().unwrap().push(SkippedFile {
+                                path: path.clone(),
+                                reason,
+                            });
+                            // Left behind with their photo rather than reported as orphans
+                            unchanged_sidecars.lock().unwrap().extend(sidecars);
+                        }
+                        Ok(ScannedFile::NotMedia) => {}
+                        Err(e) => log::warn!("Error processing {}: {}", path.display(), e),
+                    }
+                });
+            });
+
+            for (index, mut candidate) in receiver {
+                candidates_found += 1;
+                candidate.sidecars.retain(|s| !unverified.contains(&s.source_path));
+                claimed_sidecars.extend(candidate.sidecars.iter().map(|s| s.source_path.clone()));
+
+                // Images outside the requested resolution stay behind, with their sidecars
+                if candidate.media_type == MediaType::Image
+                    && !megapixels_in_range(candidate.dimensions, options.min_megapixels, options.max_megapixels)
+                {
+                    megapixel_skips.push(SkippedFile {
+                        path: candidate.source_path,
+                        reason: SkipReason::Megapixels,
+                    });
+                    continue;
+                }
+
+                // Nothing can be a duplicate of a library that started out empty
+                if !library_empty && self.db.hash_exists(&candidate.hash)? {
+                    already_in_library += 1;
+                    library_copy_bytes.fetch_add(candidate.file_size, Ordering::Relaxed);
+                    log::debug!("Skipping duplicate (already in library): {}", candidate.filename);
+                    continue;
+                }
+                if options.deterministic {
+                    arrived.push((index, candidate));
+                } else {
+                    merger.add(index, candidate);
+                }
+            }
+            Ok(())
+        })?;
+        if let Some(e) = panicked.into_inner().unwrap() {
+            return Err(e);
+        }
+
+        // Which copy collects a duplicate's sidecars depends on arrival order
+        arrived.sort_by_key(|(index, _)| *index);
+        for (index, candidate) in arrived {
+            merger.add(index, candidate);
+        }
+
+        scan_bar.finish_with_message("Scan complete");
+
+        let unchanged_skipped = unchanged_skipped.into_inner();
+        let unmodified_skipped = unmodified_skipped.into_inner();
+        let unchanged_sidecars = unchanged_sidecars.into_inner().unwrap();
+        if unchanged_skipped > 0 {
+            log::info!("Skipped {} files already in the library", unchanged_skipped);
+        }
+
+        log::info!("Found {} media files to process", candidates_found);
+
+        // Sidecars are only discovered through their photo's base name, so any
+        // sidecar file that no candidate claimed would otherwise be dropped silently.
+        claimed_sidecars.extend(unchanged_sidecars);
+        let orphan_sidecars: Vec<PathBuf> = files
+            .iter()
+            .filter(|p| is_sidecar(p, &sidecar_exts) && !claimed_sidecars.contains(p.as_path()))
+            .cloned()
+            .collect();
+
+        let mut skipped_files: Vec<SkippedFile> = Vec::new();
+        if !orphan_sidecars.is_empty() {
+            log::warn!(
+                "{} sidecars have no matching photo in {}",
+                orphan_sidecars.len(),
+                source_dir.display()
+            );
+        }
+        if !options.include_orphan_sidecars {
+            skipped_files.extend(orphan_sidecars.iter().map(|p| SkippedFile {
+                path: p.clone(),
+                reason: SkipReason::OrphanSidecar,
+            }));
+        }
+
+        // Previews are only imported as media when asked to
+        if options.previews != PreviewMode::Import {
+            skipped_files.extend(
+                files
+                    .iter()
+                    .filter(|p| is_preview(p) && !claimed_sidecars.contains(p.as_path()))
+                    .map(|p| SkippedFile {
+                        path: p.clone(),
+                        reason: match options.previews {
+                            PreviewMode::Skip => SkipReason::Preview,
+                            _ => SkipReason::OrphanPreview,
+                        },
+                    }),
+            );
+        }
+
+        skipped_files.extend(unverified_skips);
+        skipped_files.extend(listed_missing);
+
+        let mut unusable_files = unusable_files.into_inner().unwrap();
+        unusable_files.sort_by(|a, b| a.path.cmp(&b.path));
+        skipped_files.extend(unusable_files);
+
+        let megapixels_skipped = megapixel_skips.len();
+        megapixel_skips.sort_by(|a, b| a.path.cmp(&b.path));
+        skipped_files.extend(megapixel_skips);
+
+        // Copies with different edits are only asked about once the scan is done
+        merger.resolve_conflicts(!options.deterministic, options.on_sidecar_conflict)?;
+        let duplicates_skipped = unchanged_skipped + already_in_library + merger.duplicates_skipped;
+        let mut duplicate_stats = merger.duplicate_stats();
+        duplicate_stats.already_in_library = unchanged_skipped + already_in_library;
+        duplicate_stats.bytes_saved += library_copy_bytes.into_inner();
+        let date_conflicts = std::mem::take(&mut merger.date_conflicts);
+        let duplicates = options.report_duplicates.then(|| merger.duplicate_groups());
+        let mut to_import = merger.into_candidates();
+        claim_sidecars_once(&mut to_import);
+        if options.skip_sidecar_copy == Some(SkipSidecarCopy::All) {
+            for candidate in &mut to_import {
+                candidate.sidecars.retain(|s| is_preview(&s.source_path));
+            }
+        }
+        match options.import_order {
+            ImportOrder::Source => {}
+            ImportOrder::Date => to_import.sort_by_key(|c| c.created_at),
+            ImportOrder::Name => to_import.sort_by(|a, b| a.filename.cmp(&b.filename)),
+            ImportOrder::Size => to_import.sort_by_key(|c| c.file_size),
+        }
+        let possible_readds = match options.import_mtime_window {
+            Some(secs) => self.possible_readds(&to_import, time::Duration::seconds(secs as i64))?,
+            None => Vec::new(),
+        };
+        for readd in &possible_readds {
+            log::warn!(
+                "{} was taken within {}s of {}, and may be the same photo saved again",
+                readd.path.display(),
+                (readd.date - readd.existing_date).abs().whole_seconds(),
+                readd.existing.display()
+            );
+        }
+        log::info!(
+            "{} unique files to import ({} duplicates skipped)",
+            to_import.len(),
+            duplicates_skipped
+        );
+
+        let routes = if options.type_routes.is_empty() {
+            self.type_routes()?
+        } else {
+            options.type_routes.clone()
+        };
+        let routes = TypeRoutes::new(&routes).with_granularity(self.granularity()?);
+        let source_root = PathBuf::from(&source_key);
+        let folder_of = |candidate: &ImportCandidate| {
+            if options.catalog {
+                candidate.source_folder(source_dir, &source_root)
+            } else {
+                candidate.relpath(&routes)
+            }
+        };
+
+        if options.dest_exists != DestExistsPolicy::Overwrite && !options.catalog {
+            to_import = resolve_destinations(
+                &self.root,
+                to_import,
+                options,
+                &routes,
+                library_ignores_case,
+                &mut skipped_files,
+            )?;
+        }
+
+        let estimate = (dry_run && options.estimate).then(|| {
+            let content_layout = self.layout().ok() == Some(StorageLayout::Content);
+            // A catalog copies nothing, and stored content is only linked again
+            let copied = to_import.iter().filter(|c| {
+                !options.catalog && !(content_layout && object_path(&self.root, &c.hash, &c.filetype).is_file())
+            });
+            let sidecars: Vec<&SidecarCandidate> = copied
+                .clone()
+                .flat_map(|c| &c.sidecars)
+                .filter(|s| options.skip_sidecar_copy != Some(SkipSidecarCopy::Record) || is_preview(&s.source_path))
+                .collect();
+            let bytes_per_second = probe_write_speed(&self.root).map(|speed| match options.max_rate {
+                Some(rate) => speed.min(rate as f64),
+                None => speed,
+            });
+            ImportEstimate {
+                media: copied.clone().count(),
+                sidecars: sidecars.len(),
+                bytes: copied.map(|c| c.file_size).sum::<u64>() + sidecars.iter().map(|s| s.file_size).sum::<u64>(),
+                bytes_per_second,
+            }
+        });
+
+        if dry_run && options.plan_layout {
+            let mut layout: BTreeMap<String, Vec<String>> = BTreeMap::new();
+            for candidate in &to_import {
+                let files = layout.entry(folder_of(candidate)).or_default();
+                files.push(candidate.filename.clone());
+                let copied = |s: &&SidecarCandidate| {
+                    options.skip_sidecar_copy != Some(SkipSidecarCopy::Record) || is_preview(&s.source_path)
+                };
+                files.extend(candidate.sidecars.iter().filter(copied).map(|s| s.filename.clone()));
+            }
+            if options.include_orphan_sidecars {
+                for path in &orphan_sidecars {
+                    let rel = path.strip_prefix(source_dir).unwrap_or(path);
+                    let folder = Path::new(ORPHANS_DIR).join(rel.parent().unwrap_or(Path::new("")));
+                    let folder = folder.components().map(|c| c.as_os_str().to_string_lossy()).collect::<Vec<_>>().join("/");
+                    layout.entry(folder).or_default().push(rel.file_name().unwrap_or_default().to_string_lossy().into_owned());
+                }
+            }
+            // Orphans can land next to media of the same name
+            for files in layout.values_mut() {
+                files.sort();
+                files.dedup();
+            }
+            return Ok(ImportStats {
+                duplicates_skipped,
+                megapixels_skipped,
+                skipped_files,
+                date_conflicts,
+                possible_readds,
+                duplicates,
+                duplicate_stats,
+                planned_layout: Some(layout),
+                estimate,
+                ..Default::default()
+            });
+        }
+
+        if dry_run {
+            println!("\n[DRY RUN] Would import:");
+            let mut images = 0;
+            let mut videos = 0;
+            for c in &to_import {
+                match c.media_type {
+                    MediaType::Image => images += 1,
+                    MediaType::Video => videos += 1,
+                }
+            }
+            println!("  {} images", images);
+            println!("  {} videos", videos);
+            println!("  {} sidecars", to_import.iter().map(|c| c.sidecars.len()).sum::<usize>());
+            let previews = to_import
+                .iter()
+                .flat_map(|c| &c.sidecars)
+                .filter(|s| is_preview(&s.source_path))
+                .count();
+            if previews > 0 {
+                println!("    ({} of them action-camera previews)", previews);
+            }
+            if options.include_orphan_sidecars && !orphan_sidecars.is_empty() {
+                println!("  {} sidecars without a photo (to {}/)", orphan_sidecars.len(), ORPHANS_DIR);
+            }
+            return Ok(ImportStats {
+                duplicates_skipped,
+                megapixels_skipped,
+                skipped_files,
+                date_conflicts,
+                possible_readds,
+                duplicates,
+                duplicate_stats,
+                estimate,
+                ..Default::default()
+            });
+        }
+
+        // Phase 2: Copy files first
         log::info!("Phase 2: Copying files to library");
 
+        // Routes given once keep applying, so later imports land in the same folders
+        if !options.type_routes.is_empty() && self.type_routes()? != options.type_routes {
+            log::info!("Saving filetype routes for later imports");
+            self.set_type_routes(&options.type_routes)?;
+        }
+
+        let content_layout = self.layout()? == StorageLayout::Content;
         let mut file_copies: Vec<FileCopy> = Vec::new();
-        let now = OffsetDateTime::now_local().unwrap_or_else(|_| OffsetDateTime::now_utc());
+        // Sidecars to hardlink to a stored file with the same content (source is the stored file)
+        let mut sidecar_links: Vec<FileCopy> = Vec::new();
+        // Date-folder symlinks to content-addressed objects (source is the object)
+        let mut object_links: Vec<FileCopy> = Vec::new();
+        // Copied media to strip metadata from, by hash
+        let mut to_strip: Vec<(&str, PathBuf)> = Vec::new();
+        let mut stored_sidecars = if options.dedupe_sidecars {
+            self.stored_sidecar_paths()?
+        } else {
+            HashMap::new()
+        };
+        let now = if options.deterministic {
+            reproducible_import_time()
+        } else {
+            OffsetDateTime::now_local().unwrap_or_else(|_| OffsetDateTime::now_utc())
+        };
 
-        for candidate in &to_import {
-            let rel_path = format!(
-                "{}/{}",
-                candidate.media_type.folder_name(),
-                candidate.created_at.format(PATH_DATE_FORMAT).unwrap()
-            );
+        let mut sidecars_not_copied = 0;
+        // A catalog leaves every file where it is
+        let to_copy: &[ImportCandidate] = if options.catalog { &[] } else { &to_import };
+        for candidate in to_copy {
+            let rel_path = candidate.relpath(&routes);
             let dest_dir = self.root.join(&rel_path);
             let dest_path = dest_dir.join(&candidate.filename);
 
-            file_copies.push(FileCopy {
-                source: candidate.source_path.clone(),
-                destination: dest_path,
-            });
+            if content_layout {
+                // Content already stored is only linked again
+                let object = object_path(&self.root, &candidate.hash, &candidate.filetype);
+                if !object.is_file() {
+                    file_copies.push(FileCopy {
+                        source: candidate.source_path.clone(),
+                        destination: object.clone(),
+                    });
+                }
+                object_links.push(FileCopy {
+                    source: object,
+                    destination: dest_path,
+                });
+            } else {
+                to_strip.push((&candidate.hash, dest_path.clone()));
+                file_copies.push(FileCopy {
+                    source: candidate.source_path.clone(),
+                    destination: dest_path,
+                });
+            }
 
             // Add sidecar copies
             for sidecar in &candidate.sidecars {
+                if options.skip_sidecar_copy == Some(SkipSidecarCopy::Record) && !is_preview(&sidecar.source_path) {
+                    sidecars_not_copied += 1;
+                    continue;
+                }
                 let sidecar_dest = dest_dir.join(&sidecar.filename);
+                if options.dedupe_sidecars {
+                    match stored_sidecars.get(&sidecar.hash) {
+                        Some(stored) if *stored != sidecar_dest => {
+                            sidecar_links.push(FileCopy {
+                                source: stored.clone(),
+                                destination: sidecar_dest,
+                            });
+                            continue;
+                        }
+                        Some(_) => {}
+                        None => {
+                            stored_sidecars.insert(sidecar.hash.clone(), sidecar_dest.clone());
+                        }
+                    }
+                }
                 file_copies.push(FileCopy {
                     source: sidecar.source_path.clone(),
                     destination: sidecar_dest,
@@ -311,6 +2099,19 @@ impl Library {
             }
         }
 
+        // Orphaned sidecars keep their source-relative layout under orphans/
+        let mut orphan_sidecars_imported = 0;
+        if options.include_orphan_sidecars {
+            for path in &orphan_sidecars {
+                let rel = path.strip_prefix(source_dir).unwrap_or(path);
+                file_copies.push(FileCopy {
+                    source: path.clone(),
+                    destination: self.root.join(ORPHANS_DIR).join(rel),
+                });
+                orphan_sidecars_imported += 1;
+            }
+        }
+
         // Deduplicate by destination path (handles case where JPG and DNG share sidecars)
         let mut seen_destinations: HashMap<PathBuf, PathBuf> = HashMap::new();
         let mut deduped_copies: Vec<FileCopy> = Vec::new();
@@ -335,69 +2136,171 @@ impl Library {
         let file_copies = deduped_copies;
 
         // Perform copies
-        let copy_bar = ProgressBar::new(file_copies.len() as u64).with_style(bar_style.clone());
-        copy_bar.set_message("Copying files");
+        let copy_bar = Phase::new(self.observer.as_ref(), "Copying files", file_copies.len() as u64);
 
         let copy_failures = Mutex::new(CopyFailures::new());
+        let limiter = options.max_rate.map(RateLimiter::new);
+        // Only files that did not exist before are safe to remove on undo
+        let mut created_files = CreatedFiles::new(&self.root);
 
         file_copies.par_iter().for_each(|fc| {
             // Create parent directory
             if let Some(parent) = fc.destination.parent() {
-                if let Err(e) = fs::create_dir_all(parent) {
+                if let Err(e) = create_dir_all_with_mode(parent, options.dir_mode) {
                     copy_failures.lock().unwrap().add(
                         fc.source.clone(),
                         fc.destination.clone(),
                         e,
                     );
-                    copy_bar.inc(1);
+                    copy_bar.file_done(&fc.destination);
                     return;
                 }
             }
 
             // Copy file
-            if let Err(e) = fs::copy(&fc.source, &fc.destination) {
-                copy_failures.lock().unwrap().add(
+            let mut existed = fc.destination.exists();
+            if existed && options.dest_exists == DestExistsPolicy::Skip {
+                if !same_content(&fc.source, &fc.destination) {
+                    log::warn!(
+                        "Leaving existing {} in place, but it differs from {}",
+                        fc.destination.display(),
+                        fc.source.display()
+                    );
+                }
+                copy_bar.file_done(&fc.destination);
+                return;
+            }
+            if existed {
+                match created_files.trash_replaced(&fc.source, &fc.destination) {
+                    Ok(replaced) => existed = !replaced,
+                    Err(e) => {
+                        copy_failures.lock().unwrap().add(fc.source.clone(), fc.destination.clone(), e);
+                        copy_bar.file_done(&fc.destination);
+                        return;
+                    }
+                }
+            }
+            let copy = |from: &Path, to: &Path| match &limiter {
+                Some(limiter) => throttle::copy(from, to, limiter),
+                None => fs::copy(from, to),
+            };
+            let copied = if options.two_pass_copy {
+                copy_via_temp(&fc.source, &fc.destination, copy)
+            } else {
+                copy(&fc.source, &fc.destination).map(|_| ())
+            };
+            let copied = copied.and_then(|_| match options.file_mode {
+                Some(mode) => set_mode(&fc.destination, mode),
+                None => Ok(()),
+            });
+            match copied {
+                Ok(()) if !existed => created_files.push(fc.destination.clone()),
+                Ok(()) => {}
+                Err(e) => copy_failures.lock().unwrap().add(
                     fc.source.clone(),
                     fc.destination.clone(),
                     e,
-                );
+                ),
             }
-            copy_bar.inc(1);
+            copy_bar.file_done(&fc.destination);
         });
 
         copy_bar.finish_with_message("Copy complete");
 
+        // Links go after the copies, since they may point at a file copied just now
+        for link in &object_links {
+            let existed = match created_files.trash_replaced(&link.source, &link.destination) {
+                Ok(replaced) => !replaced && link.destination.symlink_metadata().is_ok(),
+                Err(e) => {
+                    copy_failures.lock().unwrap().add(link.source.clone(), link.destination.clone(), e);
+                    continue;
+                }
+            };
+            match link_object(&self.root, &link.source, &link.destination, options.dir_mode) {
+                Ok(()) if !existed => created_files.push(link.destination.clone()),
+                Ok(()) => {}
+                Err(e) => copy_failures.lock().unwrap().add(
+                    link.source.clone(),
+                    link.destination.clone(),
+                    e,
+                ),
+            }
+        }
+
+        let mut sidecars_linked = 0;
+        for link in &sidecar_links {
+            let existed = match created_files.trash_replaced(&link.source, &link.destination) {
+                Ok(replaced) => !replaced && link.destination.exists(),
+                Err(e) => {
+                    copy_failures.lock().unwrap().add(link.source.clone(), link.destination.clone(), e);
+                    continue;
+                }
+            };
+            match link_or_copy(&link.source, &link.destination, existed, options.dir_mode) {
+                Ok(hardlinked) => {
+                    if hardlinked {
+                        sidecars_linked += 1;
+                    }
+                    if !existed {
+                        created_files.push(link.destination.clone());
+                    }
+                }
+                Err(e) => copy_failures.lock().unwrap().add(
+                    link.source.clone(),
+                    link.destination.clone(),
+                    e,
+                ),
+            }
+        }
+
         let failures = copy_failures.into_inner().unwrap();
         if !failures.is_empty() {
             log::error!("{} files failed to copy", failures.len());
             return Err(PhotosortError::CopyFailed(failures));
         }
 
+        let stored_hashes = match options.strip {
+            Some(strip) => strip_copies(&to_strip, strip, options.dest_exists)?,
+            None => HashMap::new(),
+        };
+
         // Phase 3: Update database (only after successful copies)
         log::info!("Phase 3: Updating database");
 
         let conn = self.db.connection();
         let tx = conn.transaction()?;
+        let op_id = journal::start(&tx, "import")?;
 
         let mut images_imported = 0;
         let mut videos_imported = 0;
         let mut sidecars_imported = 0;
+        let mut previews_attached = 0;
+
+        let mut errors = 0;
+        // Media whose records failed to write, with --continue-on-db-error
+        let mut not_recorded: HashSet<&str> = HashSet::new();
 
         for candidate in &to_import {
-            let rel_path = format!(
-                "{}/{}",
-                candidate.media_type.folder_name(),
-                candidate.created_at.format(PATH_DATE_FORMAT).unwrap()
-            );
+            let rel_path = folder_of(candidate);
 
             let created_at_str = candidate.created_at.format(DB_DATE_FORMAT).unwrap();
             let imported_at_str = now.format(DB_DATE_FORMAT).unwrap();
 
-            tx.execute(
-                "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at,
-                                    camera_make, camera_model, lens, focal_length, aperture, shutter_speed, iso, gps_lat, gps_lon)
-                 VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16, ?17)",
-                params![
+            // With --continue-on-db-error each media and its sidecars are written
+            // under a savepoint, so a row that fails can be dropped without losing the rest
+            if options.continue_on_db_error {
+                tx.execute_batch("SAVEPOINT import_row")?;
+            }
+            // Statements are prepared once for the whole import, which matters
+            // most for a first import into an empty library
+            let written = (|| -> Result<()> {
+                tx.prepare_cached(
+                    "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at,
+                                        camera_make, camera_model, lens, focal_length, aperture, shutter_speed, iso, gps_lat, gps_lon,
+                                        width, height, stored_hash, original_path)
+                     VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16, ?17, ?18, ?19, ?20, ?21)",
+                )?
+                .execute(params![
                     candidate.hash,
                     candidate.filename,
                     rel_path,
@@ -415,36 +2318,110 @@ impl Library {
                     candidate.exif.iso,
                     candidate.exif.gps_lat,
                     candidate.exif.gps_lon,
-                ],
-            )?;
-
-            let media_id = tx.last_insert_rowid();
+                    candidate.dimensions.map(|(w, _)| w),
+                    candidate.dimensions.map(|(_, h)| h),
+                    stored_hashes.get(candidate.hash.as_str()),
+                    options.archive_original_structure.then(|| candidate.original_path(source_dir)),
+                ])?;
 
-            match candidate.media_type {
-                MediaType::Image => images_imported += 1,
-                MediaType::Video => videos_imported += 1,
-            }
+                let media_id = tx.last_insert_rowid();
+                journal::record(
+                    &tx,
+                    op_id,
+                    &JournalEntry::MediaInserted {
+                        hash: candidate.hash.clone(),
+                    },
+                )?;
 
-            // Insert sidecars
-            for sidecar in &candidate.sidecars {
-                let modified_at_str = sidecar.modified_at.format(DB_DATE_FORMAT).unwrap();
-                tx.execute(
-                    "INSERT INTO sidecars (media_id, filename, filetype, file_size, hash, modified_at)
-                     VALUES (?1, ?2, ?3, ?4, ?5, ?6)",
-                    params![
+                // Insert sidecars
+                for sidecar in &candidate.sidecars {
+                    let modified_at = match options.sidecar_date {
+                        SidecarDate::Own => sidecar.modified_at,
+                        SidecarDate::Photo => candidate.created_at,
+                    };
+                    let modified_at_str = modified_at.format(DB_DATE_FORMAT).unwrap();
+                    tx.prepare_cached(
+                        "INSERT INTO sidecars (media_id, filename, filetype, file_size, hash, modified_at)
+                         VALUES (?1, ?2, ?3, ?4, ?5, ?6)",
+                    )?
+                    .execute(params![
                         media_id,
                         sidecar.filename,
                         sidecar.filetype,
                         sidecar.file_size as i64,
                         sidecar.hash,
                         modified_at_str,
-                    ],
-                )?;
-                sidecars_imported += 1;
+                    ])?;
+                }
+                Ok(())
+            })();
+
+            match written {
+                Ok(()) if options.continue_on_db_error => tx.execute_batch("RELEASE import_row")?,
+                Ok(()) => {}
+                Err(PhotosortError::Database(e)) if options.continue_on_db_error && is_row_error(&e) => {
+                    tx.execute_batch("ROLLBACK TO import_row; RELEASE import_row")?;
+                    log::warn!("Skipping {}: {}", candidate.source_path.display(), e);
+                    errors += 1;
+                    not_recorded.insert(&candidate.hash);
+                    skipped_files.push(SkippedFile {
+                        path: candidate.source_path.clone(),
+                        reason: SkipReason::DatabaseError,
+                    });
+                    continue;
+                }
+                Err(e) => return Err(e),
             }
+
+            match candidate.media_type {
+                MediaType::Image => images_imported += 1,
+                MediaType::Video => videos_imported += 1,
+            }
+            sidecars_imported += candidate.sidecars.len();
+            previews_attached += candidate.sidecars.iter().filter(|s| is_preview(&s.source_path)).count();
+        }
+
+        // Files copied for media whose records were dropped would only turn up as new in the next scan
+        if !not_recorded.is_empty() && !options.catalog {
+            let mut unrecorded_files = HashSet::new();
+            for candidate in to_import.iter().filter(|c| not_recorded.contains(c.hash.as_str())) {
+                let dest_dir = self.root.join(candidate.relpath(&routes));
+                unrecorded_files.insert(dest_dir.join(&candidate.filename));
+                unrecorded_files.extend(candidate.sidecars.iter().map(|s| dest_dir.join(&s.filename)));
+                if content_layout {
+                    unrecorded_files.insert(object_path(&self.root, &candidate.hash, &candidate.filetype));
+                }
+            }
+            created_files.discard(&unrecorded_files);
+        }
+
+        for path in created_files.paths() {
+            let rel = path.strip_prefix(&self.root).unwrap_or(&path);
+            journal::record(
+                &tx,
+                op_id,
+                &JournalEntry::FileAdded {
+                    path: rel.to_string_lossy().into_owned(),
+                },
+            )?;
+        }
+        for (original, trashed) in created_files.replaced() {
+            let relative = |path: &Path| path.strip_prefix(&self.root).unwrap_or(path).to_string_lossy().into_owned();
+            journal::record(
+                &tx,
+                op_id,
+                &JournalEntry::FileTrashed {
+                    path: relative(&original),
+                    trashed: relative(&trashed),
+                },
+            )?;
         }
 
+        journal::finish(&tx, op_id)?;
         tx.commit()?;
+        created_files.keep();
+
+        self.db.set_import_mark(&source_key, started_at)?;
 
         log::info!(
             "Import complete: {} images, {} videos, {} sidecars",
@@ -453,94 +2430,787 @@ impl Library {
             sidecars_imported
         );
 
+        // Hooks only see files whose import is committed
+        let hooks_failed = match &options.after_import_hook {
+            Some(command) => {
+                let targets: Vec<HookTarget> = to_import
+                    .iter()
+                    .filter(|c| !not_recorded.contains(c.hash.as_str()))
+                    .map(|c| HookTarget {
+                        path: format!("{}/{}", folder_of(c), c.filename),
+                        hash: c.hash.clone(),
+                    })
+                    .collect();
+                hooks::run_after_import(command, &self.root, &targets)
+            }
+            None => 0,
+        };
+        if hooks_failed > 0 {
+            log::warn!("{} after-import hooks failed", hooks_failed);
+        }
+
+        let dates_from_filenames = to_import
+            .iter()
+            .filter(|c| c.dated_by_filename && !not_recorded.contains(c.hash.as_str()))
+            .count();
+        let library_totals = self.totals()?;
+
         Ok(ImportStats {
             images_imported,
             videos_imported,
             sidecars_imported,
+            orphan_sidecars_imported,
+            previews_attached,
+            sidecars_linked,
+            sidecars_not_copied,
+            unmodified_skipped,
             duplicates_skipped,
-            errors: 0,
+            megapixels_skipped,
+            hooks_failed,
+            dates_from_filenames,
+            errors,
+            skipped_files,
+            date_conflicts,
+            possible_readds,
+            duplicates,
+            duplicate_stats,
+            planned_layout: None,
+            estimate: None,
+            library_totals,
+        })
+    }
+}
+
+/// Strip metadata from copied media, returning the new hash of each file
+/// changed, keyed by its hash in the source. Formats that can't be rewritten
+/// safely are left as they are.
+fn strip_copies(
+    copies: &[(&str, PathBuf)],
+    strip: StripMetadata,
+    dest_exists: DestExistsPolicy,
+) -> Result<HashMap<String, String>> {
+    let failures = Mutex::new(CopyFailures::new());
+    let stripped: Vec<(String, String)> = copies
+        .par_iter()
+        .filter_map(|(hash, path)| {
+            let filetype = path.extension().map(|e| e.to_string_lossy()).unwrap_or_default();
+            if !is_strippable_filetype(&filetype) {
+                log::warn!("Not stripping metadata from {}: {} files can't be rewritten safely", path.display(), filetype);
+                return None;
+            }
+            // A file kept in place under the skip policy wasn't copied just now
+            let encoding = hash_encoding_of(hash);
+            if dest_exists == DestExistsPolicy::Skip && hash_file_as(path, encoding).ok().as_deref() != Some(content_hash(hash)) {
+                return None;
+            }
+            let result = strip_metadata(path, strip).and_then(|()| Ok(hash_file_as(path, encoding)?));
+            match result {
+                Ok(stored) => Some((hash.to_string(), stored)),
+                Err(e) => {
+                    failures.lock().unwrap().add(path.clone(), path.clone(), io::Error::other(e.to_string()));
+                    None
+                }
+            }
         })
+        .collect();
+
+    let failures = failures.into_inner().unwrap();
+    if !failures.is_empty() {
+        log::error!("{} files failed to have their metadata stripped", failures.len());
+        return Err(PhotosortError::CopyFailed(failures));
     }
+    Ok(stripped.into_iter().collect())
 }
 
 /// Process a source file and return import candidate if it's a media file.
-fn process_source_file(path: &Path) -> Result<Option<ImportCandidate>> {
+///
+/// With `known`, files already in the library unchanged are reported without
+/// running exiftool or hashing their sidecars.
+fn process_source_file(
+    path: &Path,
+    known: Option<&KnownMedia>,
+    options: &ImportOptions,
+    exiftool_args: Option<&[&str]>,
+    sidecar_exts: &[String],
+    encoding: HashEncoding,
+) -> Result<ScannedFile> {
     // Detect media type
     let media_type = match detect_media_type(path) {
         Some(mt) => mt,
-        None => return Ok(None), // Not a media file
+        None => return Ok(ScannedFile::NotMedia),
     };
+    if is_preview(path) && options.previews != PreviewMode::Import {
+        return Ok(ScannedFile::NotMedia);
+    }
 
-    // Get file info
-    let metadata = fs::metadata(path)?;
-    let file_size = metadata.len();
-
-    // Calculate hash
-    let hash = hash_file(path)?;
+    let sidecar_paths = attached_files(path, options, sidecar_exts);
 
-    // Extract EXIF metadata using thread-local ExifTool instance
-    let extracted = EXIFTOOL.with(|cell| {
-        let mut exiftool_opt = cell.borrow_mut();
-        if exiftool_opt.is_none() {
-            *exiftool_opt = ExifTool::new().ok();
-        }
-        match exiftool_opt.as_mut() {
-            Some(exiftool) => extract_metadata(exiftool, path).unwrap_or_else(|e| {
-                log::warn!("Failed to extract metadata from {}: {}", path.display(), e);
-                crate::photosort_core::exif::ExtractedMetadata {
-                    created_at: OffsetDateTime::now_local().unwrap_or_else(|_| OffsetDateTime::now_utc()),
-                    exif: Default::default(),
-                } // TODO: never gets called because exiftool doesn't really fail
-                // but exiftool may not find creation date fields correctly and we now
-                // have 2 fallbacks total
-            }),
-            None => {
-                log::warn!("ExifTool not available for {}", path.display());
-                crate::photosort_core::exif::ExtractedMetadata {
-                    created_at: OffsetDateTime::now_local().unwrap_or_else(|_| OffsetDateTime::now_utc()),
-                    exif: Default::default(),
-                }
-            }
+    // Empty files are failed downloads or interrupted transfers, not photos
+    let file_size = match fs::metadata(path) {
+        Ok(metadata) if metadata.len() == 0 => {
+            return Ok(ScannedFile::Skipped {
+                reason: SkipReason::Empty,
+                sidecars: sidecar_paths,
+            });
         }
-    });
+        Ok(metadata) => metadata.len(),
+        Err(e) => return Ok(unreadable(path, e, sidecar_paths)),
+    };
 
-    let filename = path
+    let mut filename = path
         .file_name()
         .unwrap_or_default()
         .to_string_lossy()
         .to_string();
+    if options.normalize_unicode {
+        filename = nfc(&filename);
+    }
 
-    let filetype = path
-        .extension()
-        .unwrap_or_default()
-        .to_string_lossy()
-        .to_uppercase();
+    // Calculate hash
+    let hash = match hash_file_as(path, encoding) {
+        Ok(hash) => hash,
+        Err(e) => return Ok(unreadable(path, e, sidecar_paths)),
+    };
+
+    if known.is_some_and(|k| k.contains_unchanged(&hash, &filename, file_size)) {
+        return Ok(ScannedFile::InLibrary {
+            file_size,
+            sidecars: sidecar_paths,
+        });
+    }
+
+    // Extract EXIF metadata using thread-local ExifTool instance
+    let mut extracted = match exiftool_args {
+        Some(args) => extract_metadata_on_thread(path, args, options.prefer_iptc_date).unwrap_or_else(|e| {
+            log::warn!("Failed to extract metadata from {}: {}", path.display(), e);
+            ExtractedMetadata::from_file_date(path)
+        }),
+        // Already warned about once, up front
+        None => ExtractedMetadata::from_file_date(path),
+    };
+    let mut dated_by_filename = false;
+    if extracted.file_dated && options.date_from_filename {
+        if let Some(date) = date_from_filename(&filename, &options.filename_date_patterns) {
+            log::debug!("Dating {} by its name", path.display());
+            extracted.created_at = date;
+            dated_by_filename = true;
+        }
+    }
+
+    let ext = path.extension().unwrap_or_default().to_string_lossy();
+    let filetype = if options.canonical_ext {
+        canonical_filetype(&ext, &options.ext_aliases)
+    } else {
+        ext.to_uppercase()
+    };
 
-    // Find sidecars
-    let sidecar_paths = find_sidecars(path);
-    let mut sidecars = Vec::new();
+    let mut sidecars: Vec<SidecarCandidate> = Vec::new();
 
     for sidecar_path in sidecar_paths {
-        if let Ok(sc) = process_sidecar(&sidecar_path) {
+        if let Ok(mut sc) = process_sidecar(&sidecar_path, encoding) {
+            if options.normalize_unicode {
+                sc.filename = nfc(&sc.filename);
+            }
+            // The library keeps sidecars next to their photo under its base name,
+            // including one whose name differs only in case
+            let stem = |name: &str| Path::new(name).file_stem().map(|s| s.to_string_lossy().into_owned());
+            let case_differs = stem(&sc.filename) != stem(&filename)
+                && stem(&sc.filename).map(|s| s.to_lowercase()) == stem(&filename).map(|s| s.to_lowercase());
+            if sidecar_path.parent() != path.parent() || case_differs {
+                let ext = sidecar_path.extension().unwrap_or_default().to_string_lossy();
+                sc.filename = get_sidecar_filename(&filename, &ext).unwrap_or(sc.filename);
+                if sidecars.iter().any(|s| s.filename == sc.filename) {
+                    log::warn!(
+                        "Ignoring {}: {} already has a sidecar named {}",
+                        sidecar_path.display(),
+                        filename,
+                        sc.filename
+                    );
+                    continue;
+                }
+            }
             sidecars.push(sc);
         }
     }
 
-    Ok(Some(ImportCandidate {
+    Ok(ScannedFile::Candidate(ImportCandidate {
         source_path: path.to_path_buf(),
         hash,
         media_type,
         file_size,
         created_at: extracted.created_at,
+        dated_by_filename,
         filename,
         filetype,
         sidecars,
         exif: extracted.exif,
+        dimensions: extracted.dimensions,
     }))
 }
 
+/// Read a list of files to import, one path per line, from a file or from
+/// stdin when `path` is "-". Blank lines are ignored. With `nul` the paths
+/// are separated by NUL characters instead, as `find -print0` writes them,
+/// so names holding newlines come through.
+pub fn read_file_list(path: &Path, nul: bool) -> Result<Vec<PathBuf>> {
+    if nul {
+        let bytes = if path == Path::new("-") {
+            let mut bytes = Vec::new();
+            io::Read::read_to_end(&mut io::stdin(), &mut bytes)?;
+            bytes
+        } else {
+            fs::read(path)?
+        };
+        return Ok(parse_nul_file_list(&bytes));
+    }
+    let text = if path == Path::new("-") {
+        io::read_to_string(io::stdin())?
+    } else {
+        fs::read_to_string(path)?
+    };
+    Ok(parse_file_list(&text))
+}
+
+fn parse_nul_file_list(bytes: &[u8]) -> Vec<PathBuf> {
+    bytes
+        .split(|&b| b == 0)
+        .filter(|entry| !entry.is_empty())
+        .map(path_from_bytes)
+        .collect()
+}
+
+/// A path from raw bytes, which on Unix needn't be UTF-8.
+#[cfg(unix)]
+fn path_from_bytes(bytes: &[u8]) -> PathBuf {
+    use std::os::unix::ffi::OsStrExt;
+    PathBuf::from(std::ffi::OsStr::from_bytes(bytes))
+}
+
+#[cfg(not(unix))]
+fn path_from_bytes(bytes: &[u8]) -> PathBuf {
+    PathBuf::from(String::from_utf8_lossy(bytes).into_owned())
+}
+
+fn parse_file_list(text: &str) -> Vec<PathBuf> {
+    text.lines()
+        .map(|line| line.trim_end_matches('\r'))
+        .filter(|line| !line.trim().is_empty())
+        .map(PathBuf::from)
+        .collect()
+}
+
+/// The message a panic was raised with, for reporting it as an error.
+fn panic_message(payload: &(dyn Any + Send)) -> String {
+    payload
+        .downcast_ref::<&str>()
+        .map(|s| s.to_string())
+        .or_else(|| payload.downcast_ref::<String>().cloned())
+        .unwrap_or_else(|| "unknown panic".to_string())
+}
+
+/// Every file under `source_dir` an import would look at, honoring the
+/// hidden file and folder options. Libraries inside the source are skipped
+/// (unless `include_nested_libraries`), and library databases always are.
+pub(crate) fn source_files(source_dir: &Path, options: &ImportOptions) -> Result<Vec<PathBuf>> {
+    let mut walker = WalkDir::new(source_dir);
+    if options.deterministic {
+        walker = walker.sort_by_file_name();
+    }
+    let files = walker
+        .into_iter()
+        // Hidden folders and other libraries are skipped whole rather than file by file
+        .filter_entry(|e| {
+            if e.depth() == 0 || !e.file_type().is_dir() {
+                return true;
+            }
+            if !options.include_nested_libraries && is_library_root(e.path()) {
+                log::info!("Skipping the photosort library in {}", e.path().display());
+                return false;
+            }
+            if is_excluded_dir(source_dir, e.path(), &options.exclude_dirs) {
+                log::info!("Skipping excluded folder {}", e.path().display());
+                return false;
+            }
+            options.include_hidden_dirs || !is_hidden(e.path())
+        })
+        .filter_map(|e| e.ok())
+        .filter(|e| e.file_type().is_file())
+        .filter(|e| options.include_hidden_files || !is_hidden(e.path()))
+        .filter(|e| !is_library_database(e.path()))
+        .map(|e| e.into_path());
+
+    let Some(limit) = options.max_files else {
+        return Ok(files.collect());
+    };
+    let mut found = Vec::new();
+    for path in files {
+        if found.len() == limit {
+            return Err(PhotosortError::TooManyFiles {
+                dir: source_dir.to_path_buf(),
+                limit,
+            });
+        }
+        found.push(path);
+    }
+    Ok(found)
+}
+
+/// Whether `dir` holds a photosort library.
+pub fn is_library_root(dir: &Path) -> bool {
+    dir.join(DB_FILE_NAME).is_file()
+}
+
+/// Whether a file is a library database, or one SQLite keeps next to it
+/// (write-ahead log, shared memory, rollback journal).
+pub fn is_library_database(path: &Path) -> bool {
+    path.file_name()
+        .and_then(|name| name.to_str())
+        .and_then(|name| name.strip_prefix(DB_FILE_NAME))
+        .is_some_and(|rest| ["", "-wal", "-shm", "-journal"].contains(&rest))
+}
+
+/// Whether `path` is the temporary copy `--two-pass-copy` writes before renaming it into place.
+pub fn is_temp_copy(path: &Path) -> bool {
+    path.file_name()
+        .and_then(|name| name.to_str())
+        .is_some_and(|name| name.len() > TEMP_COPY_SUFFIX.len() && name.ends_with(TEMP_COPY_SUFFIX))
+}
+
+/// Read a source folder the way an import would, without a library: each
+/// media file's hash, date, destination folder and sidecars, sorted by path.
+/// Files an import would skip are logged and left out.
+pub fn inspect_source(source_dir: &Path, options: &ImportOptions, encoding: HashEncoding) -> Result<Vec<SourceFile>> {
+    if !source_dir.is_dir() {
+        return Err(PhotosortError::NotADirectory(source_dir.to_path_buf()));
+    }
+
+    let options = &options.with_name_case_of(source_dir);
+    let files = source_files(source_dir, options)?;
+    let exiftool_args: Vec<&str> = options.exiftool_args.iter().map(String::as_str).collect();
+    let exiftool_args = check_exiftool(exiftool_available(), options.require_exif)?
+        .then_some(exiftool_args.as_slice());
+    let routes = TypeRoutes::new(&options.type_routes);
+    let relative = |path: &Path| {
+        path.strip_prefix(source_dir)
+            .unwrap_or(path)
+            .components()
+            .map(|c| c.as_os_str().to_string_lossy())
+            .collect::<Vec<_>>()
+            .join("/")
+    };
+
+    let scan_bar = progress::bar(files.len() as u64);
+    scan_bar.set_message("Scanning files");
+    let scanned: Vec<(&PathBuf, ScannedFile)> = files
+        .par_iter()
+        .map(|path| {
+            let result = process_source_file(path, None, options, exiftool_args, &[], encoding);
+            scan_bar.inc(1);
+            result.map(|scanned| (path, scanned))
+        })
+        .collect::<Result<_>>()?;
+    scan_bar.finish_with_message("Scan complete");
+
+    let mut inspected = Vec::new();
+    for (path, scanned) in scanned {
+        match scanned {
+            ScannedFile::Candidate(candidate) => inspected.push(SourceFile {
+                path: candidate.original_path(source_dir),
+                media_type: candidate.media_type.to_string(),
+                filetype: candidate.filetype.clone(),
+                file_size: candidate.file_size,
+                hash: candidate.hash.clone(),
+                date: candidate.created_at.format(DB_DATE_FORMAT).unwrap(),
+                folder: candidate.relpath(&routes),
+                camera_model: candidate.exif.camera_model.clone(),
+                width: candidate.dimensions.map(|(w, _)| w),
+                height: candidate.dimensions.map(|(_, h)| h),
+                sidecars: candidate.sidecars.iter().map(|s| relative(&s.source_path)).collect(),
+            }),
+            ScannedFile::Skipped { reason, .. } => {
+                log::warn!("Would skip {}: {}", path.display(), reason);
+            }
+            ScannedFile::InLibrary { .. } | ScannedFile::NotModified { .. } | ScannedFile::NotMedia => {}
+        }
+    }
+    inspected.sort_by(|a, b| a.path.cmp(&b.path));
+    Ok(inspected)
+}
+
+/// A file that failed to open or read, logged and reported as skipped.
+fn unreadable(path: &Path, e: impl std::fmt::Display, sidecars: Vec<PathBuf>) -> ScannedFile {
+    log::warn!("Could not read {}: {}", path.display(), e);
+    ScannedFile::Skipped {
+        reason: SkipReason::Unreadable,
+        sidecars,
+    }
+}
+
+/// Apply a `skip` or `rename` policy to candidates whose destination already exists.
+///
+/// Under `skip`, a media file already stored with the same content is kept (and
+/// recorded) as is; one with different content is left out of the import.
+/// Under `rename`, the file and its sidecars get a free `name_N` filename.
+fn resolve_destinations(
+    root: &Path,
+    candidates: Vec<ImportCandidate>,
+    options: &ImportOptions,
+    routes: &TypeRoutes,
+    ignore_case: bool,
+    skipped_files: &mut Vec<SkippedFile>,
+) -> Result<Vec<ImportCandidate>> {
+    // Paths planned so far, lowercased when names differing in case are one file
+    let mut planned: HashSet<PathBuf> = HashSet::new();
+    let key = |path: &Path| match ignore_case {
+        true => PathBuf::from(path.to_string_lossy().to_lowercase()),
+        false => path.to_path_buf(),
+    };
+    let suffix_len = options.collision_suffix_len.unwrap_or(DEFAULT_COLLISION_SUFFIX_LEN);
+
+    // Files claim names in hash order, so which one of a colliding set keeps
+    // the plain name doesn't depend on the order the source was walked in
+    let mut order: Vec<usize> = (0..candidates.len()).collect();
+    if options.dest_exists == DestExistsPolicy::Rename {
+        order.sort_by(|&a, &b| candidates[a].hash.cmp(&candidates[b].hash));
+    }
+    let mut candidates: Vec<Option<ImportCandidate>> = candidates.into_iter().map(Some).collect();
+    let mut resolved: Vec<Option<ImportCandidate>> = (0..candidates.len()).map(|_| None).collect();
+
+    for index in order {
+        let mut candidate = candidates[index].take().unwrap();
+        let dest_dir = root.join(candidate.relpath(routes));
+
+        match options.dest_exists {
+            DestExistsPolicy::Overwrite => {}
+            DestExistsPolicy::Skip => {
+                let dest = existing_path(&dest_dir.join(&candidate.filename), ignore_case);
+                if let Some(dest) = dest.filter(|dest| !same_content(&candidate.source_path, dest)) {
+                    log::warn!(
+                        "Not importing {}: {} already exists with different content",
+                        candidate.source_path.display(),
+                        dest.display()
+                    );
+                    skipped_files.push(SkippedFile {
+                        path: candidate.source_path.clone(),
+                        reason: SkipReason::DestinationExists,
+                    });
+                    continue;
+                }
+            }
+            DestExistsPolicy::Rename => {
+                let is_free = |filename: &str| {
+                    let mut names = vec![filename.to_string()];
+                    names.extend(
+                        candidate
+                            .sidecars
+                            .iter()
+                            .filter_map(|sc| rename_sidecar_for_media(&sc.filename, filename)),
+                    );
+                    names.iter().all(|n| {
+                        let path = dest_dir.join(n);
+                        existing_path(&path, ignore_case).is_none() && !planned.contains(&key(&path))
+                    })
+                };
+
+                if !is_free(&candidate.filename) {
+                    let path = Path::new(&candidate.filename);
+                    let stem = path.file_stem().unwrap_or_default().to_string_lossy().into_owned();
+                    let ext = path.extension().map(|e| format!(".{}", e.to_string_lossy())).unwrap_or_default();
+                    // Named after the content, so the same photo gets the same name on every import;
+                    // the suffix grows until it is unique in the folder
+                    let suffix = collision_suffix(&candidate.hash);
+                    let filename = (suffix_len.min(suffix.len())..=suffix.len())
+                        .map(|len| format!("{}_{}{}", stem, &suffix[..len], ext))
+                        .chain((1..).map(|n| format!("{}_{}_{}{}", stem, suffix, n, ext)))
+                        .find(|f| is_free(f))
+                        .unwrap();
+
+                    log::info!("Renaming {} to {} to avoid overwriting", candidate.filename, filename);
+                    for sc in &mut candidate.sidecars {
+                        if let Some(renamed) = rename_sidecar_for_media(&sc.filename, &filename) {
+                            sc.filename = renamed;
+                        }
+                    }
+                    candidate.filename = filename;
+                }
+            }
+        }
+
+        planned.insert(key(&dest_dir.join(&candidate.filename)));
+        for sc in &candidate.sidecars {
+            planned.insert(key(&dest_dir.join(&sc.filename)));
+        }
+        resolved[index] = Some(candidate);
+    }
+
+    Ok(resolved.into_iter().flatten().collect())
+}
+
+/// The file at `path`, or with `ignore_case`, one in its folder whose name
+/// differs only in case.
+fn existing_path(path: &Path, ignore_case: bool) -> Option<PathBuf> {
+    if path.exists() {
+        return Some(path.to_path_buf());
+    }
+    if !ignore_case {
+        return None;
+    }
+    let name = path.file_name()?.to_string_lossy().to_lowercase();
+    fs::read_dir(path.parent()?)
+        .ok()?
+        .filter_map(|e| e.ok())
+        .find(|e| e.file_name().to_string_lossy().to_lowercase() == name)
+        .map(|e| e.path())
+}
+
+/// Whether the filesystem `dir` is on treats names differing only in case as
+/// one file, judged by looking up one of its entries with the case flipped.
+/// Nothing is written, so read-only sources can be checked.
+pub fn filesystem_ignores_case(dir: &Path) -> bool {
+    let Ok(entries) = fs::read_dir(dir) else {
+        return false;
+    };
+    let names: HashSet<String> = entries.filter_map(|e| e.ok()).filter_map(|e| e.file_name().into_string().ok()).collect();
+    names
+        .iter()
+        .find_map(|name| {
+            let flipped: String = name
+                .chars()
+                .map(|c| if c.is_ascii_lowercase() { c.to_ascii_uppercase() } else { c.to_ascii_lowercase() })
+                .collect();
+            // Both spellings listed are two files, whatever the disk
+            (flipped != *name && !names.contains(&flipped)).then(|| dir.join(&flipped).exists())
+        })
+        .unwrap_or(false)
+}
+
+/// Bytes written to time the library's disk for an estimate.
+const PROBE_BYTES: usize = 8 * 1024 * 1024;
+
+/// How fast the disk `dir` is on takes a file written and flushed, in bytes
+/// per second. The file is removed again; None if it couldn't be written.
+fn probe_write_speed(dir: &Path) -> Option<f64> {
+    let path = dir.join(format!(".photosort-probe-{}", std::process::id()));
+    let started = Instant::now();
+    let written = fs::File::create(&path).and_then(|mut file| {
+        file.write_all(&vec![0; PROBE_BYTES])?;
+        file.sync_all()
+    });
+    let elapsed = started.elapsed();
+    let _ = fs::remove_file(&path);
+    if let Err(e) = written {
+        log::warn!("Could not time writes to {}: {}", dir.display(), e);
+        return None;
+    }
+    Some(PROBE_BYTES as f64 / elapsed.as_secs_f64().max(f64::EPSILON))
+}
+
+/// A rough duration for people, e.g. "about 12 minutes".
+fn about_duration(seconds: f64) -> String {
+    match seconds {
+        s if s < 60.0 => "under a minute".to_string(),
+        s if s < 3600.0 => format!("about {} minutes", (s / 60.0).round() as u64),
+        s => format!("about {:.1} hours", s / 3600.0),
+    }
+}
+
+/// Hash characters added to a renamed file's name unless configured otherwise.
+pub const DEFAULT_COLLISION_SUFFIX_LEN: usize = 8;
+
+/// A filename-safe rendering of a content hash: its bytes in lowercase hex,
+/// since base64 has `/` and differs only by case on case-insensitive disks.
+fn collision_suffix(hash: &str) -> String {
+    reencode_hash(content_hash(hash), HashEncoding::Hex)
+        .unwrap_or_else(|| hash.bytes().map(|b| format!("{:02x}", b)).collect())
+}
+
+/// Decide whether metadata can be read with exiftool. Without it every date
+/// comes from file times, which deserves one clear warning rather than one per file.
+fn check_exiftool(available: bool, require: bool) -> Result<bool> {
+    if available {
+        return Ok(true);
+    }
+    if require {
+        return Err(PhotosortError::Exiftool(
+            "exiftool not found; install it or run without --require-exif".to_string(),
+        ));
+    }
+    log::warn!(
+        "exiftool not found - dates will come from file timestamps; install exiftool for accurate sorting"
+    );
+    Ok(false)
+}
+
+/// Whether a relpath is where the library would store media of this type,
+/// e.g. "images/2024/05-21" for an image, or under one of `route_folders`.
+fn relpath_conforms(relpath: &str, media_type: &str, route_folders: &[&str], granularity: DateGranularity) -> bool {
+    let media_type = match media_type {
+        "image" => MediaType::Image,
+        "video" => MediaType::Video,
+        _ => return false,
+    };
+    // Route folders may be nested, so match the folder part as a prefix
+    let Some(date) = std::iter::once(media_type.folder_name())
+        .chain(route_folders.iter().copied())
+        .find_map(|folder| relpath.strip_prefix(folder).and_then(|rest| rest.strip_prefix('/')))
+    else {
+        return false;
+    };
+    let parts: Vec<&str> = date.split('/').collect();
+    match (granularity, parts.as_slice()) {
+        (DateGranularity::Year, [year]) => digits(year, 4).is_some(),
+        (DateGranularity::Month, [year, month]) => {
+            digits(year, 4).is_some() && digits(month, 2).is_some_and(|m| (1..=12).contains(&m))
+        }
+        (DateGranularity::Day, [year, month_day]) => {
+            let Some((month, day)) = month_day.split_once('-') else {
+                return false;
+            };
+            let (Some(year), Some(month), Some(day)) = (digits(year, 4), digits(month, 2), digits(day, 2)) else {
+                return false;
+            };
+            time::Month::try_from(month as u8)
+                .and_then(|m| time::Date::from_calendar_date(year as i32, m, day as u8))
+                .is_ok()
+        }
+        _ => false,
+    }
+}
+
+/// The date part of a library folder, e.g. "2024/05-21" sorted by day.
+fn date_folder(date: OffsetDateTime, granularity: DateGranularity) -> String {
+    let format = match granularity {
+        DateGranularity::Year => PATH_YEAR_FORMAT,
+        DateGranularity::Month => PATH_MONTH_FORMAT,
+        DateGranularity::Day => PATH_DATE_FORMAT,
+    };
+    date.format(format).unwrap()
+}
+
+/// Parse a fixed-width run of ASCII digits.
+fn digits(s: &str, len: usize) -> Option<u32> {
+    if s.len() != len || !s.bytes().all(|b| b.is_ascii_digit()) {
+        return None;
+    }
+    s.parse().ok()
+}
+
+/// Whether an image's resolution is within the requested range. Images whose
+/// dimensions are unknown are kept rather than guessed at.
+fn megapixels_in_range(dimensions: Option<(u32, u32)>, min: Option<f64>, max: Option<f64>) -> bool {
+    let Some((width, height)) = dimensions else {
+        return true;
+    };
+    let megapixels = width as f64 * height as f64 / 1_000_000.0;
+    min.is_none_or(|min| megapixels >= min) && max.is_none_or(|max| megapixels <= max)
+}
+
+/// Report two same-hash candidates whose dates are further apart than
+/// `DATE_CONFLICT_THRESHOLD`.
+fn date_conflict(first: &ImportCandidate, second: &ImportCandidate) -> Option<DateConflict> {
+    if (first.created_at - second.created_at).abs() <= DATE_CONFLICT_THRESHOLD {
+        return None;
+    }
+    Some(DateConflict {
+        first: first.source_path.clone(),
+        first_date: first.created_at,
+        second: second.source_path.clone(),
+        second_date: second.created_at,
+    })
+}
+
+/// Whether two files have the same content (false if either can't be read).
+fn same_content(a: &Path, b: &Path) -> bool {
+    match (hash_file(a), hash_file(b)) {
+        (Ok(a), Ok(b)) => a == b,
+        _ => false,
+    }
+}
+
+/// Whether a source folder is one of `excluded`, by name or by path below `source_dir`.
+fn is_excluded_dir(source_dir: &Path, dir: &Path, excluded: &[PathBuf]) -> bool {
+    let relative = dir.strip_prefix(source_dir).unwrap_or(dir);
+    excluded.iter().any(|excluded| {
+        if excluded.components().count() == 1 {
+            dir.file_name() == Some(excluded.as_os_str())
+        } else {
+            relative == excluded
+        }
+    })
+}
+
+/// Whether a file or folder is hidden by Unix convention, its name starting with a dot.
+fn is_hidden(path: &Path) -> bool {
+    path.file_name().is_some_and(|name| name.to_string_lossy().starts_with('.'))
+}
+
+/// Find sidecars of a media file (and previews, when they travel with their media).
+fn attached_files(path: &Path, options: &ImportOptions, sidecar_exts: &[String]) -> Vec<PathBuf> {
+    if is_sidecar(path, sidecar_exts) {
+        return Vec::new();
+    }
+    let mut files = if options.name_case == NameCase::Insensitive {
+        find_sidecars_ignoring_case(path, sidecar_exts, options.normalize_unicode)
+    } else if options.normalize_unicode {
+        find_sidecars_normalized(path, sidecar_exts)
+    } else {
+        find_sidecars(path, sidecar_exts)
+    };
+    files.extend(find_apple_adjustments(path));
+    files.extend(find_sidecars_in_subfolders(path, &options.sidecar_subfolders, sidecar_exts));
+    if options.previews == PreviewMode::Sidecar {
+        files.extend(find_previews(path));
+    }
+    // Overlapping lookups, such as a subfolder pattern of "." or an extra
+    // extension that is built in already, find the same file twice
+    let mut seen = HashSet::new();
+    files.retain(|f| seen.insert(f.clone()));
+    files
+}
+
+/// Attach each sidecar to one photo only: the first, in source order, whose
+/// base name matches it (so `IMG_1.CR2` rather than `IMG_1.JPG`).
+fn claim_sidecars_once(candidates: &mut [ImportCandidate]) {
+    let mut claimed: HashMap<PathBuf, String> = HashMap::new();
+    for candidate in candidates {
+        candidate.sidecars.retain(|sc| match claimed.get(&sc.source_path) {
+            Some(owner) => {
+                log::info!(
+                    "Not attaching {} to {}: it belongs to {} already",
+                    sc.source_path.display(),
+                    candidate.filename,
+                    owner
+                );
+                false
+            }
+            None => {
+                claimed.insert(sc.source_path.clone(), candidate.filename.clone());
+                true
+            }
+        });
+    }
+}
+
+/// Import time recorded by deterministic imports: `SOURCE_DATE_EPOCH` if set,
+/// as for reproducible builds, otherwise the Unix epoch.
+fn reproducible_import_time() -> OffsetDateTime {
+    std::env::var("SOURCE_DATE_EPOCH")
+        .ok()
+        .and_then(|v| v.trim().parse::<i64>().ok())
+        .and_then(|secs| OffsetDateTime::from_unix_timestamp(secs).ok())
+        .unwrap_or(OffsetDateTime::UNIX_EPOCH)
+}
+
+/// Whether a file was last modified before `mark` (Unix seconds).
+fn modified_before(path: &Path, mark: i64) -> bool {
+    fs::metadata(path)
+        .and_then(|m| m.modified())
+        .map(|t| OffsetDateTime::from(t).unix_timestamp() < mark)
+        .unwrap_or(false)
+}
+
 /// Process a sidecar file.
-fn process_sidecar(path: &Path) -> Result<SidecarCandidate> {
+fn process_sidecar(path: &Path, encoding: HashEncoding) -> Result<SidecarCandidate> {
     let metadata = fs::metadata(path)?;
     let file_size = metadata.len();
     let modified_at = metadata
@@ -548,7 +3218,7 @@ fn process_sidecar(path: &Path) -> Result<SidecarCandidate> {
         .map(OffsetDateTime::from)
         .unwrap_or_else(|_| OffsetDateTime::now_utc());
 
-    let hash = hash_file(path)?;
+    let hash = hash_file_as(path, encoding)?;
 
     let filename = path
         .file_name()
@@ -572,34 +3242,2939 @@ fn process_sidecar(path: &Path) -> Result<SidecarCandidate> {
     })
 }
 
+/// The content hash of a stored hash, without the suffix marking a second kept copy.
+pub fn content_hash(hash: &str) -> &str {
+    hash.strip_suffix(ALT_HASH_SUFFIX).unwrap_or(hash)
+}
+
+/// Hash characters shown where a hash is displayed for people to read.
+pub const DEFAULT_SHORT_HASH_LEN: usize = 8;
+
+/// The first `len` characters of a hash, as `git` shortens commit ids.
+/// A length of 0 shows the whole hash.
+pub fn short_hash(hash: &str, len: usize) -> &str {
+    match len {
+        0 => hash,
+        // Hashes are base64, so any length is a character boundary
+        len => &hash[..len.min(hash.len())],
+    }
+}
+
 /// Calculate SHA256 hash of a file, returned as base64.
 pub fn hash_file(path: &Path) -> Result<String> {
+    hash_file_as(path, HashEncoding::Base64)
+}
+
+/// Calculate SHA256 hash of a file in the given encoding.
+pub fn hash_file_as(path: &Path, encoding: HashEncoding) -> Result<String> {
     let mut file = fs::File::open(path)?;
     let mut hasher = Sha256::new();
     io::copy(&mut file, &mut hasher)?;
-    let hash = hasher.finalize();
-    Ok(general_purpose::STANDARD.encode(hash))
+    Ok(encode_hash(&hasher.finalize(), encoding))
 }
 
-/// Statistics from an import operation.
-#[derive(Debug, Default)]
-pub struct ImportStats {
-    pub images_imported: usize,
-    pub videos_imported: usize,
-    pub sidecars_imported: usize,
-    pub duplicates_skipped: usize,
-    pub errors: usize,
+fn encode_hash(bytes: &[u8], encoding: HashEncoding) -> String {
+    match encoding {
+        HashEncoding::Base64 => general_purpose::STANDARD.encode(bytes),
+        HashEncoding::Hex => bytes.iter().map(|b| format!("{:02x}", b)).collect(),
+    }
 }
 
-impl std::fmt::Display for ImportStats {
-    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
-        write!(
-            f,
-            "{} images, {} videos, {} sidecars imported ({} duplicates skipped)",
-            self.images_imported,
-            self.videos_imported,
-            self.sidecars_imported,
-            self.duplicates_skipped
-        )
+/// The encoding a stored hash is written in. A library uses one encoding
+/// throughout, so a stored hash tells how to hash a file to compare with it.
+pub fn hash_encoding_of(hash: &str) -> HashEncoding {
+    let hash = content_hash(hash);
+    // Base64 SHA-256 is 44 characters, hex 64
+    if hash.len() == 64 && hash.bytes().all(|b| b.is_ascii_hexdigit()) {
+        HashEncoding::Hex
+    } else {
+        HashEncoding::Base64
+    }
+}
+
+/// A stored hash in another encoding, keeping any suffix. `None` if it can't be decoded.
+fn reencode_hash(hash: &str, to: HashEncoding) -> Option<String> {
+    let content = content_hash(hash);
+    let bytes = match hash_encoding_of(content) {
+        HashEncoding::Hex => (0..content.len())
+            .step_by(2)
+            .map(|i| u8::from_str_radix(&content[i..i + 2], 16).ok())
+            .collect::<Option<Vec<u8>>>()?,
+        HashEncoding::Base64 => general_purpose::STANDARD.decode(content).ok()?,
+    };
+    Some(format!("{}{}", encode_hash(&bytes, to), &hash[content.len()..]))
+}
+
+/// Rewrite every media and sidecar hash in `to`, and record `to` as the
+/// library's encoding. Returns how many hashes were rewritten.
+pub(crate) fn reencode_hashes(conn: &Connection, to: HashEncoding) -> Result<usize> {
+    let mut converted = 0;
+    for (table, column) in [("media", "hash"), ("media", "stored_hash"), ("sidecars", "hash")] {
+        let rows = conn
+            .prepare(&format!("SELECT id, {column} FROM {table} WHERE {column} IS NOT NULL"))?
+            .query_map([], |row| Ok((row.get::<_, i64>(0)?, row.get::<_, String>(1)?)))?
+            .collect::<rusqlite::Result<Vec<_>>>()?;
+        for (id, hash) in rows {
+            let Some(reencoded) = reencode_hash(&hash, to) else {
+                log::warn!("Leaving {} {} as it is: {} is not a SHA-256 hash", table, id, hash);
+                continue;
+            };
+            converted += conn.execute(
+                &format!("UPDATE {table} SET {column} = ?1 WHERE id = ?2"),
+                params![reencoded, id],
+            )?;
+        }
+    }
+    conn.execute(
+        "INSERT INTO settings (key, value) VALUES (?1, ?2)
+         ON CONFLICT(key) DO UPDATE SET value = excluded.value",
+        params![HASH_ENCODING_SETTING, hash_encoding_name(to)],
+    )?;
+    Ok(converted)
+}
+
+/// How a `HashEncoding` is written in the library's settings.
+pub(crate) fn hash_encoding_name(encoding: HashEncoding) -> &'static str {
+    match encoding {
+        HashEncoding::Base64 => "base64",
+        HashEncoding::Hex => "hex",
+    }
+}
+
+pub(crate) fn parse_hash_encoding(name: Option<&str>) -> Result<HashEncoding> {
+    match name {
+        None | Some("base64") => Ok(HashEncoding::Base64),
+        Some("hex") => Ok(HashEncoding::Hex),
+        Some(other) => Err(PhotosortError::Library(format!("unknown hash encoding: {}", other))),
+    }
+}
+
+/// Whether a database error concerns only the row being written, so the
+/// rest of an import can go on without it.
+fn is_row_error(e: &rusqlite::Error) -> bool {
+    match e {
+        rusqlite::Error::SqliteFailure(failure, _) => matches!(
+            failure.code,
+            rusqlite::ErrorCode::ConstraintViolation | rusqlite::ErrorCode::TooBig | rusqlite::ErrorCode::TypeMismatch
+        ),
+        rusqlite::Error::ToSqlConversionFailure(_) => true,
+        _ => false,
+    }
+}
+
+/// How a `DateGranularity` is written in the library's settings.
+pub(crate) fn granularity_name(granularity: DateGranularity) -> &'static str {
+    match granularity {
+        DateGranularity::Year => "year",
+        DateGranularity::Month => "month",
+        DateGranularity::Day => "day",
+    }
+}
+
+pub(crate) fn parse_granularity(name: Option<&str>) -> Result<DateGranularity> {
+    match name {
+        None | Some("day") => Ok(DateGranularity::Day),
+        Some("month") => Ok(DateGranularity::Month),
+        Some("year") => Ok(DateGranularity::Year),
+        Some(other) => Err(PhotosortError::Library(format!("unknown date granularity: {}", other))),
+    }
+}
+
+/// Hardlink `destination` to `source`, falling back to a copy when linking is
+/// not possible or the destination already exists. Returns whether it linked.
+fn link_or_copy(source: &Path, destination: &Path, existed: bool, dir_mode: Option<u32>) -> io::Result<bool> {
+    if let Some(parent) = destination.parent() {
+        create_dir_all_with_mode(parent, dir_mode)?;
+    }
+    if !existed && fs::hard_link(source, destination).is_ok() {
+        return Ok(true);
+    }
+    fs::copy(source, destination)?;
+    Ok(false)
+}
+
+/// Copy `source` to `destination` through a temporary file next to it, which
+/// is synced to disk before being renamed into place. The rename is atomic, so
+/// `destination` only ever holds the previous file or the whole new one.
+fn copy_via_temp(
+    source: &Path,
+    destination: &Path,
+    copy: impl Fn(&Path, &Path) -> io::Result<u64>,
+) -> io::Result<()> {
+    let temp = copy_to_temp(source, destination, copy)?;
+    if let Err(e) = fs::rename(&temp, destination) {
+        let _ = fs::remove_file(&temp);
+        return Err(e);
+    }
+    sync_dir(destination.parent().unwrap_or(Path::new(".")))
+}
+
+/// First half of `copy_via_temp`: write and sync the temporary copy, removing
+/// it again if that fails. Returns its path.
+fn copy_to_temp(
+    source: &Path,
+    destination: &Path,
+    copy: impl Fn(&Path, &Path) -> io::Result<u64>,
+) -> io::Result<PathBuf> {
+    let mut name = destination.file_name().unwrap_or_default().to_os_string();
+    name.push(TEMP_COPY_SUFFIX);
+    let temp = destination.with_file_name(name);
+    let written = copy(source, &temp).and_then(|_| fs::OpenOptions::new().write(true).open(&temp)?.sync_all());
+    if let Err(e) = written {
+        let _ = fs::remove_file(&temp);
+        return Err(e);
+    }
+    Ok(temp)
+}
+
+/// Sync a directory, so a rename within it survives a crash.
+#[cfg(unix)]
+fn sync_dir(dir: &Path) -> io::Result<()> {
+    fs::File::open(dir)?.sync_all()
+}
+
+/// Directories can't be synced on this platform; renames are made durable by the filesystem.
+#[cfg(not(unix))]
+fn sync_dir(_dir: &Path) -> io::Result<()> {
+    Ok(())
+}
+
+/// Create a directory and its parents, applying `mode` to each one created.
+///
+/// The mode is set explicitly after creation so it is not narrowed by the umask.
+pub fn create_dir_all_with_mode(path: &Path, mode: Option<u32>) -> io::Result<()> {
+    let Some(mode) = mode else {
+        return fs::create_dir_all(path);
+    };
+
+    let missing: Vec<&Path> = path.ancestors().take_while(|p| !p.exists()).collect();
+    fs::create_dir_all(path)?;
+    for dir in missing {
+        set_mode(dir, mode)?;
+    }
+    Ok(())
+}
+
+/// Set the permission bits of a file or directory.
+#[cfg(unix)]
+pub fn set_mode(path: &Path, mode: u32) -> io::Result<()> {
+    use std::os::unix::fs::PermissionsExt;
+    fs::set_permissions(path, fs::Permissions::from_mode(mode))
+}
+
+/// Set the permission bits of a file or directory (no-op on this platform).
+#[cfg(not(unix))]
+pub fn set_mode(_path: &Path, _mode: u32) -> io::Result<()> {
+    Ok(())
+}
+
+/// Statistics from an import operation.
+#[derive(Debug, Default)]
+pub struct ImportStats {
+    pub images_imported: usize,
+    pub videos_imported: usize,
+    pub sidecars_imported: usize,
+    pub orphan_sidecars_imported: usize,
+    pub duplicates_skipped: usize,
+    /// Action-camera previews stored as sidecars of their full-resolution file.
+    pub previews_attached: usize,
+    /// Sidecars hardlinked to identical content already in the library.
+    pub sidecars_linked: usize,
+    /// Sidecars recorded without copying their files, with `skip_sidecar_copy`.
+    pub sidecars_not_copied: usize,
+    /// Files not looked at because they predate the last import from this source.
+    pub unmodified_skipped: usize,
+    /// Images left out for being outside the requested megapixel range.
+    pub megapixels_skipped: usize,
+    /// Photos and videos whose after-import hook failed.
+    pub hooks_failed: usize,
+    /// Photos and videos dated by a date in their name.
+    pub dates_from_filenames: usize,
+    /// Photos and videos left out because their records couldn't be written,
+    /// with `continue_on_db_error`.
+    pub errors: usize,
+    /// Files found in the source that were not imported, and why.
+    pub skipped_files: Vec<SkippedFile>,
+    /// Identical files found with dates too far apart to both be right.
+    pub date_conflicts: Vec<DateConflict>,
+    /// New media close in date to different library media from the same
+    /// camera, with `import_mtime_window`.
+    pub possible_readds: Vec<PossibleReadd>,
+    /// Content found more than once in the source, when asked for.
+    pub duplicates: Option<Vec<DuplicateGroup>>,
+    /// What skipping duplicates saved.
+    pub duplicate_stats: DuplicateStats,
+    /// Library folder to the files a dry run would put there, when asked for.
+    pub planned_layout: Option<BTreeMap<String, Vec<String>>>,
+    /// What a dry run expects the import to copy, when asked for.
+    pub estimate: Option<ImportEstimate>,
+    /// What the library holds once the import is done.
+    pub library_totals: LibraryTotals,
+}
+
+/// Copies of the same content found in one import, and which were kept.
+#[derive(Debug, Clone)]
+pub struct DuplicateGroup {
+    pub hash: String,
+    /// Every copy, in source order.
+    pub copies: Vec<PathBuf>,
+    /// The copy imported, or both when asked to keep two with different edits.
+    pub kept: Vec<PathBuf>,
+}
+
+/// How much an import saved by not copying duplicates: copies within the
+/// source collapsed into one file each, and files the library already held.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct DuplicateStats {
+    /// Source files left out as copies of another file in the source.
+    pub copies_left_out: usize,
+    /// Distinct photos and videos those copies were of.
+    pub originals: usize,
+    /// Source files whose content was already in the library.
+    pub already_in_library: usize,
+    /// Bytes not copied for either.
+    pub bytes_saved: u64,
+}
+
+/// The space and time an import is expected to take, from a dry run.
+#[derive(Debug, Clone, PartialEq)]
+pub struct ImportEstimate {
+    /// Photos and videos that would be copied.
+    pub media: usize,
+    /// Sidecars (and previews) that would be copied with them.
+    pub sidecars: usize,
+    /// Bytes all of them take.
+    pub bytes: u64,
+    /// How fast the library's disk took a short write, capped by `max_rate`;
+    /// None if it couldn't be written to.
+    pub bytes_per_second: Option<f64>,
+}
+
+impl ImportEstimate {
+    /// Expected copy time, in seconds.
+    pub fn seconds(&self) -> Option<f64> {
+        self.bytes_per_second.map(|speed| self.bytes as f64 / speed)
+    }
+}
+
+/// How much a library holds, for the summary after a change.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct LibraryTotals {
+    pub media: usize,
+    pub sidecars: usize,
+}
+
+impl std::fmt::Display for LibraryTotals {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{} photos and videos, {} sidecars", self.media, self.sidecars)
+    }
+}
+
+/// A folder of the library as recorded in the database.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct FolderSummary {
+    pub relpath: String,
+    pub media_count: usize,
+    /// False if the folder doesn't follow the library's date layout.
+    pub conforms: bool,
+}
+
+/// Media stored outside the folder its date and filetype sort it into.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct MisplacedMedia {
+    pub path: PathBuf,
+    /// Folder the database records it in.
+    pub relpath: String,
+    /// Folder the library would sort it into now.
+    pub expected: String,
+}
+
+/// Media `Library::recompute_winners` stores under another copy's name.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct WinnerChange {
+    pub hash: String,
+    /// Where the media was, relative to the library root.
+    pub old_path: String,
+    /// Where it goes: the path of the copy an import keeps.
+    pub new_path: String,
+}
+
+/// Outcome of `Library::recompute_winners`.
+#[derive(Debug, Default)]
+pub struct WinnersResult {
+    /// Media moved to their preferred copy's name (or that would be, on a dry run).
+    pub changes: Vec<WinnerChange>,
+    /// Media left alone because something already has the preferred name.
+    pub skipped: Vec<WinnerChange>,
+}
+
+impl WinnersResult {
+    pub fn report(&self, dry_run: bool) -> Report {
+        let (title, moved) = if dry_run {
+            ("[DRY RUN] Recompute winners", "media that would be renamed")
+        } else {
+            ("Recompute winners complete!", "media renamed")
+        };
+        let rows = |changes: &[WinnerChange]| {
+            changes
+                .iter()
+                .map(|c| vec![c.new_path.clone().into(), c.old_path.clone().into()])
+                .collect()
+        };
+        Report::new(title)
+            .field("renamed", moved, self.changes.len())
+            .field("skipped", "left alone, preferred name taken", self.skipped.len())
+            .list("renamed_media", "Renamed", &["new_path", "old_path"], rows(&self.changes))
+            .list("skipped_media", "Preferred name taken", &["new_path", "old_path"], rows(&self.skipped))
+    }
+}
+
+/// Outcome of `Library::reimport`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ReimportResult {
+    pub hash: String,
+    /// Dates as stored in the database, before and after.
+    pub old_date: String,
+    pub new_date: String,
+    /// Where the media was and is, relative to the library root.
+    pub old_path: String,
+    pub new_path: String,
+}
+
+impl ReimportResult {
+    pub fn report(&self, dry_run: bool) -> Report {
+        let title = if dry_run { "[DRY RUN] Reimport" } else { "Reimport complete!" };
+        Report::new(title)
+            .field("hash", "hash", self.hash.as_str())
+            .field("old_date", "date was", self.old_date.as_str())
+            .field("new_date", "date now", self.new_date.as_str())
+            .field("old_path", "path was", self.old_path.as_str())
+            .field("new_path", "path now", self.new_path.as_str())
+    }
+}
+
+/// A media file, with its sidecars, to store under another name.
+#[derive(Debug)]
+struct PlannedMove {
+    id: i64,
+    relpath: String,
+    filename: String,
+    new_relpath: String,
+    new_filename: String,
+    /// (id, filename, new filename)
+    sidecars: Vec<(i64, String, String)>,
+}
+
+/// A filename shared by several media in the library.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct NameCollision {
+    pub filename: String,
+    /// (relpath, hash) of each media with the name, by folder.
+    pub copies: Vec<(String, String)>,
+}
+
+impl NameCollision {
+    /// Whether more than one of the media is recorded in `relpath`.
+    pub fn repeats_in(&self, relpath: &str) -> bool {
+        self.copies.iter().filter(|(r, _)| r == relpath).count() > 1
+    }
+}
+
+/// Two copies of the same content that disagree on when they were taken.
+/// Only one date decides where the file is stored, so the other may be the true one.
+#[derive(Debug, Clone)]
+pub struct DateConflict {
+    pub first: PathBuf,
+    pub first_date: OffsetDateTime,
+    pub second: PathBuf,
+    pub second_date: OffsetDateTime,
+}
+
+/// A new file taken moments from a different one already in the library with
+/// the same camera and size: perhaps the same photo, re-compressed or re-saved.
+#[derive(Debug, Clone)]
+pub struct PossibleReadd {
+    pub path: PathBuf,
+    pub date: OffsetDateTime,
+    /// The library file it may be a copy of.
+    pub existing: PathBuf,
+    pub existing_date: OffsetDateTime,
+}
+
+/// A source file that was left out of an import.
+#[derive(Debug, Clone)]
+pub struct SkippedFile {
+    pub path: PathBuf,
+    pub reason: SkipReason,
+}
+
+/// Why a source file was skipped during import.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SkipReason {
+    /// A sidecar whose photo was not found next to it.
+    OrphanSidecar,
+    /// An action-camera preview whose full-resolution file was not found next to it.
+    OrphanPreview,
+    /// An action-camera preview, left out because previews are skipped.
+    Preview,
+    /// A different file already exists at the destination.
+    DestinationExists,
+    /// An image outside the requested megapixel range.
+    Megapixels,
+    /// A zero-byte file, such as a failed download.
+    Empty,
+    /// A file that could not be opened or read.
+    Unreadable,
+    /// A file whose content doesn't match the source manifest.
+    SourceMismatch,
+    /// A file the source manifest doesn't list.
+    SourceUnlisted,
+    /// A path in the `--files` list that isn't a file.
+    NotFound,
+    /// A file whose database record couldn't be written.
+    DatabaseError,
+}
+
+impl std::fmt::Display for SkipReason {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            SkipReason::OrphanSidecar => write!(f, "sidecar with no matching photo"),
+            SkipReason::OrphanPreview => write!(f, "preview with no matching video"),
+            SkipReason::Preview => write!(f, "preview skipped"),
+            SkipReason::DestinationExists => write!(f, "a different file already exists at the destination"),
+            SkipReason::Megapixels => write!(f, "outside the megapixel range"),
+            SkipReason::Empty => write!(f, "empty file"),
+            SkipReason::Unreadable => write!(f, "could not be read"),
+            SkipReason::SourceMismatch => write!(f, "doesn't match the source manifest"),
+            SkipReason::SourceUnlisted => write!(f, "not in the source manifest"),
+            SkipReason::NotFound => write!(f, "listed but not found"),
+            SkipReason::DatabaseError => write!(f, "could not be recorded in the database"),
+        }
+    }
+}
+
+impl std::fmt::Display for ImportStats {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "{} images, {} videos, {} sidecars imported ({} duplicates skipped)",
+            self.images_imported,
+            self.videos_imported,
+            self.sidecars_imported,
+            self.duplicates_skipped
+        )
+    }
+}
+
+impl ImportStats {
+    /// Summary of the import. A dry run only lists the files it would leave out.
+    pub fn report(&self, dry_run: bool) -> Report {
+        let mut report = if dry_run {
+            Report::new("Dry run - nothing was imported.")
+        } else {
+            Report::new("Import complete!")
+                .field("images_imported", "images imported", self.images_imported)
+                .field("videos_imported", "videos imported", self.videos_imported)
+                .field("sidecars_imported", "sidecars imported", self.sidecars_imported)
+                .field("previews_attached", "action-camera previews attached", self.previews_attached)
+                .field("sidecars_linked", "sidecars hardlinked to identical sidecars", self.sidecars_linked)
+                .field("sidecars_not_copied", "sidecars recorded without copying", self.sidecars_not_copied)
+                .field(
+                    "orphan_sidecars_imported",
+                    "sidecars without a photo copied to orphans/",
+                    self.orphan_sidecars_imported,
+                )
+                .field("duplicates_skipped", "duplicates skipped", self.duplicates_skipped)
+                .field("unmodified_skipped", "files unchanged since the last import", self.unmodified_skipped)
+                .field("megapixels_skipped", "images outside the megapixel range", self.megapixels_skipped)
+                .field("hooks_failed", "after-import hooks failed", self.hooks_failed)
+                .field("dates_from_filenames", "dated by their file name", self.dates_from_filenames)
+                .field("errors", "files not recorded after a database error", self.errors)
+                .field("library_media", "photos and videos in the library", self.library_totals.media)
+                .field("library_sidecars", "sidecars in the library", self.library_totals.sidecars)
+        };
+
+        if self.duplicates_skipped > 0 {
+            let stats = &self.duplicate_stats;
+            report = report
+                .field("duplicate_copies_left_out", "copies within the source left out", stats.copies_left_out)
+                .field("duplicate_originals", "photos and videos they were copies of", stats.originals)
+                .field("duplicates_in_library", "files already in the library", stats.already_in_library)
+                .field_with_display(
+                    "duplicate_bytes_saved",
+                    "space saved by skipping duplicates",
+                    stats.bytes_saved,
+                    format!("{:.1} MB", stats.bytes_saved as f64 / 1_048_576.0),
+                );
+        }
+
+        if let Some(estimate) = &self.estimate {
+            report = report
+                .field("estimated_media", "photos and videos to copy", estimate.media)
+                .field("estimated_sidecars", "sidecars to copy", estimate.sidecars)
+                .field_with_display(
+                    "estimated_bytes",
+                    "space needed",
+                    estimate.bytes,
+                    format!("{:.1} MB", estimate.bytes as f64 / 1_048_576.0),
+                );
+            if let Some(seconds) = estimate.seconds() {
+                report = report.field_with_display("estimated_seconds", "estimated copy time", seconds, about_duration(seconds));
+            }
+        }
+
+        let rows = self
+            .skipped_files
+            .iter()
+            .map(|f| vec![f.path.display().to_string().into(), f.reason.to_string().into()])
+            .collect();
+        report = report.list("skipped_files", "files skipped", &["path", "reason"], rows);
+
+        let rows = self
+            .date_conflicts
+            .iter()
+            .map(|c| {
+                vec![
+                    c.first.display().to_string().into(),
+                    c.first_date.format(DB_DATE_FORMAT).unwrap().into(),
+                    c.second.display().to_string().into(),
+                    c.second_date.format(DB_DATE_FORMAT).unwrap().into(),
+                ]
+            })
+            .collect();
+        report = report.list(
+            "date_conflicts",
+            "identical files with conflicting dates",
+            &["first", "first_date", "second", "second_date"],
+            rows,
+        );
+
+        let rows = self
+            .possible_readds
+            .iter()
+            .map(|r| {
+                vec![
+                    r.path.display().to_string().into(),
+                    r.date.format(DB_DATE_FORMAT).unwrap().into(),
+                    r.existing.display().to_string().into(),
+                    r.existing_date.format(DB_DATE_FORMAT).unwrap().into(),
+                ]
+            })
+            .collect();
+        report = report.list(
+            "possible_readds",
+            "files taken moments from a different library file, possibly re-saved copies",
+            &["path", "date", "existing", "existing_date"],
+            rows,
+        );
+
+        match &self.duplicates {
+            Some(groups) => {
+                let rows = groups
+                    .iter()
+                    .flat_map(|g| {
+                        g.copies.iter().map(|path| {
+                            let outcome = if g.kept.contains(path) { "kept" } else { "skipped" };
+                            vec![path.display().to_string().into(), g.hash.clone().into(), outcome.into()]
+                        })
+                    })
+                    .collect();
+                report.list("duplicates", "copies of duplicate files", &["path", "hash", "outcome"], rows)
+            }
+            None => report,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use assert_fs::TempDir;
+
+    #[cfg(unix)]
+    #[test]
+    fn test_create_with_dir_mode() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let temp_dir = TempDir::new().unwrap();
+        let lib_dir = temp_dir.path().join("private_library");
+        let options = CreateOptions {
+            dir_mode: Some(0o700),
+            ..Default::default()
+        };
+        Library::create_with_options(&lib_dir, &options).unwrap();
+
+        for dir in [&lib_dir, &lib_dir.join("images"), &lib_dir.join("videos")] {
+            let mode = fs::metadata(dir).unwrap().permissions().mode() & 0o7777;
+            assert_eq!(mode, 0o700, "{}", dir.display());
+        }
+    }
+
+    #[test]
+    fn test_two_pass_copy_never_exposes_a_partial_file() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("a.jpg");
+        fs::write(&source, b"photo").unwrap();
+        let folder = temp_dir.path().join("lib");
+        fs::create_dir_all(&folder).unwrap();
+        let destination = folder.join("a.jpg");
+
+        // A crash between writing the copy and renaming it leaves only the temporary file
+        let temp = copy_to_temp(&source, &destination, |from, to| fs::copy(from, to)).unwrap();
+        assert_eq!(temp, folder.join("a.jpg.photosort-tmp"));
+        assert!(!destination.exists());
+        assert_eq!(fs::read(&temp).unwrap(), b"photo");
+
+        // A copy failing partway is cleaned up
+        let failed = copy_to_temp(&source, &destination, |_, to| {
+            fs::write(to, b"ph")?;
+            Err(io::Error::other("disk full"))
+        });
+        assert!(failed.is_err());
+        assert!(!temp.exists());
+        assert!(!destination.exists());
+
+        copy_via_temp(&source, &destination, |from, to| fs::copy(from, to)).unwrap();
+        assert_eq!(fs::read(&destination).unwrap(), b"photo");
+        assert_eq!(fs::read_dir(&folder).unwrap().count(), 1);
+
+        let src = temp_dir.path().join("source");
+        fs::create_dir_all(&src).unwrap();
+        fs::write(src.join("b.jpg"), b"photo b").unwrap();
+        let mut lib = Library::create(&temp_dir.path().join("library")).unwrap();
+        let options = ImportOptions {
+            two_pass_copy: true,
+            ..Default::default()
+        };
+        assert_eq!(lib.import(&src, &options).unwrap().images_imported, 1);
+        let relpath: String = lib
+            .database()
+            .connection_ref()
+            .query_row("SELECT relpath FROM media", [], |row| row.get(0))
+            .unwrap();
+        let names: Vec<_> =
+            fs::read_dir(lib.root().join(relpath)).unwrap().map(|e| e.unwrap().file_name()).collect();
+        assert_eq!(names, ["b.jpg"]);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_create_dir_all_with_mode_only_touches_new_dirs() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let temp_dir = TempDir::new().unwrap();
+        let before = fs::metadata(temp_dir.path()).unwrap().permissions().mode();
+        let nested = temp_dir.path().join("a/b");
+        create_dir_all_with_mode(&nested, Some(0o775)).unwrap();
+
+        assert_eq!(fs::metadata(&nested).unwrap().permissions().mode() & 0o7777, 0o775);
+        assert_eq!(fs::metadata(temp_dir.path().join("a")).unwrap().permissions().mode() & 0o7777, 0o775);
+        assert_eq!(fs::metadata(temp_dir.path()).unwrap().permissions().mode(), before);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_import_into_content_layout() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"photo").unwrap();
+        fs::write(source.join("a.xmp"), b"edits").unwrap();
+
+        let options = CreateOptions {
+            layout: StorageLayout::Content,
+            ..Default::default()
+        };
+        let mut lib = Library::create_with_options(&temp_dir.path().join("lib"), &options).unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+
+        let relpath: String = lib
+            .database()
+            .connection_ref()
+            .query_row("SELECT relpath FROM media", [], |row| row.get(0))
+            .unwrap();
+        let stored = lib.root().join(&relpath).join("a.jpg");
+        let object = object_path(lib.root(), &hash_file(&source.join("a.jpg")).unwrap(), "jpg");
+        assert!(stored.symlink_metadata().unwrap().file_type().is_symlink());
+        assert_eq!(fs::canonicalize(&stored).unwrap(), fs::canonicalize(&object).unwrap());
+        // Sidecars are edited in place, so they stay regular files
+        assert!(lib.root().join(&relpath).join("a.xmp").symlink_metadata().unwrap().is_file());
+
+        journal::undo_last(&mut lib).unwrap().unwrap();
+        assert!(stored.symlink_metadata().is_err());
+        assert!(!object.exists());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_strip_refused_in_content_layout() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"photo").unwrap();
+
+        let create = CreateOptions {
+            layout: StorageLayout::Content,
+            ..Default::default()
+        };
+        let mut lib = Library::create_with_options(&temp_dir.path().join("lib"), &create).unwrap();
+        let options = ImportOptions {
+            strip: Some(StripMetadata::Gps),
+            ..Default::default()
+        };
+        let err = lib.import(&source, &options).unwrap_err();
+        assert!(err.to_string().contains("content-addressed"), "{}", err);
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+        assert!(fs::read_dir(lib.root().join(OBJECTS_DIR)).map_or(true, |mut objects| objects.next().is_none()));
+    }
+
+    #[test]
+    fn test_skip_existing_hash_reimport() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"photo").unwrap();
+        fs::write(source.join("a.xmp"), b"edits").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            skip_existing_hash: true,
+            ..Default::default()
+        };
+        assert_eq!(lib.import(&source, &options).unwrap().images_imported, 1);
+
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.images_imported, 0);
+        assert_eq!(stats.duplicates_skipped, 1);
+        // The skipped photo's sidecar is not mistaken for an orphan
+        assert!(stats.skipped_files.is_empty());
+    }
+
+    #[test]
+    fn test_skip_existing_hash_requires_file_on_disk() {
+        let temp_dir = TempDir::new().unwrap();
+        let known = KnownMedia {
+            root: temp_dir.path().to_path_buf(),
+            by_hash: HashMap::from([(
+                "h".to_string(),
+                ("images/2024/01-01".to_string(), "a.jpg".to_string(), 5),
+            )]),
+            normalize_unicode: false,
+        };
+        assert!(!known.contains_unchanged("h", "a.jpg", 5));
+
+        let dir = temp_dir.path().join("images/2024/01-01");
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(dir.join("a.jpg"), b"photo").unwrap();
+        assert!(known.contains_unchanged("h", "a.jpg", 5));
+        assert!(!known.contains_unchanged("h", "b.jpg", 5));
+        assert!(!known.contains_unchanged("other", "a.jpg", 5));
+    }
+
+    /// A GoPro clip with its low-res preview and thumbnail, plus a stray preview.
+    fn write_gopro_source(dir: &Path) {
+        fs::create_dir_all(dir).unwrap();
+        fs::write(dir.join("GX010123.MP4"), b"full res").unwrap();
+        fs::write(dir.join("GL010123.LRV"), b"low res").unwrap();
+        fs::write(dir.join("GX010123.THM"), b"thumb").unwrap();
+        fs::write(dir.join("GL010999.LRV"), b"stray").unwrap();
+    }
+
+    #[test]
+    fn test_import_previews_as_sidecars() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        write_gopro_source(&source);
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let stats = lib.import(&source, &ImportOptions::default()).unwrap();
+
+        assert_eq!(stats.videos_imported, 1);
+        assert_eq!(stats.images_imported, 0);
+        assert_eq!(stats.sidecars_imported, 2);
+        assert_eq!(stats.previews_attached, 2);
+        assert_eq!(stats.skipped_files.len(), 1);
+        assert_eq!(stats.skipped_files[0].reason, SkipReason::OrphanPreview);
+    }
+
+    #[test]
+    fn test_import_previews_as_media() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        write_gopro_source(&source);
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            previews: PreviewMode::Import,
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+
+        assert_eq!(stats.videos_imported, 3);
+        assert_eq!(stats.images_imported, 1);
+        assert_eq!(stats.sidecars_imported, 0);
+        assert!(stats.skipped_files.is_empty());
+    }
+
+    #[test]
+    fn test_import_previews_skipped() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        write_gopro_source(&source);
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            previews: PreviewMode::Skip,
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+
+        assert_eq!(stats.videos_imported, 1);
+        assert_eq!(stats.sidecars_imported, 0);
+        assert_eq!(stats.skipped_files.len(), 3);
+        assert!(stats.skipped_files.iter().all(|f| f.reason == SkipReason::Preview));
+    }
+
+    #[test]
+    fn test_dedupe_identical_sidecars() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        for name in ["a", "b", "c"] {
+            fs::write(source.join(format!("{}.jpg", name)), name).unwrap();
+            fs::write(source.join(format!("{}.xmp", name)), b"<preset/>").unwrap();
+        }
+        fs::write(source.join("d.jpg"), b"d").unwrap();
+        fs::write(source.join("d.xmp"), b"<own edits/>").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            dedupe_sidecars: true,
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.sidecars_imported, 4);
+        assert_eq!(stats.sidecars_linked, 2);
+
+        let dup = lib.database().duplicate_sidecar_stats().unwrap();
+        assert_eq!(dup.groups, 1);
+        assert_eq!(dup.extra_copies, 2);
+        assert_eq!(dup.extra_bytes, 2 * "<preset/>".len() as i64);
+
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::MetadataExt;
+            let inodes: HashSet<u64> = WalkDir::new(lib.root())
+                .into_iter()
+                .filter_map(|e| e.ok())
+                .filter(|e| e.path().extension().is_some_and(|x| x == "xmp"))
+                .map(|e| e.metadata().unwrap().ino())
+                .collect();
+            assert_eq!(inodes.len(), 2);
+        }
+    }
+
+    #[test]
+    fn test_sidecar_date_source() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"a").unwrap();
+        fs::write(source.join("a.xmp"), b"<a/>").unwrap();
+        // Edited long after the photo was taken
+        let edited = time::macros::datetime!(2020-03-04 05:06:07 UTC);
+        fs::File::options()
+            .write(true)
+            .open(source.join("a.xmp"))
+            .unwrap()
+            .set_modified(edited.into())
+            .unwrap();
+
+        let dates = |sidecar_date| {
+            let mut lib = Library::create(&temp_dir.path().join(format!("{:?}", sidecar_date))).unwrap();
+            let options = ImportOptions {
+                sidecar_date,
+                ..Default::default()
+            };
+            lib.import(&source, &options).unwrap();
+            lib.database()
+                .connection_ref()
+                .query_row(
+                    "SELECT m.created_at, s.modified_at FROM sidecars s JOIN media m ON m.id = s.media_id",
+                    [],
+                    |row| Ok((row.get::<_, String>(0)?, row.get::<_, String>(1)?)),
+                )
+                .unwrap()
+        };
+
+        let (created_at, modified_at) = dates(SidecarDate::Own);
+        assert_eq!(modified_at, edited.format(DB_DATE_FORMAT).unwrap());
+        assert_ne!(modified_at, created_at);
+
+        let (created_at, modified_at) = dates(SidecarDate::Photo);
+        assert_eq!(modified_at, created_at);
+    }
+
+    #[test]
+    fn test_create_records_settings() {
+        let temp_dir = TempDir::new().unwrap();
+        let options = CreateOptions {
+            hash_encoding: HashEncoding::Hex,
+            ..Default::default()
+        };
+        Library::create_with_options(temp_dir.path(), &options).unwrap();
+
+        let lib = Library::open(temp_dir.path()).unwrap();
+        let settings: HashMap<String, String> = lib.database().settings().unwrap().into_iter().collect();
+        assert_eq!(settings["creator_version"], env!("CARGO_PKG_VERSION"));
+        assert!(OffsetDateTime::parse(&settings["created_at"], DB_DATE_FORMAT).is_ok());
+        assert_eq!(settings["layout"], "date");
+        assert_eq!(lib.layout().unwrap(), StorageLayout::Date);
+        assert_eq!(lib.hash_encoding().unwrap(), HashEncoding::Hex);
+    }
+
+    #[test]
+    fn test_hex_hashes_match_sha256sum() {
+        // `printf abc | sha256sum`
+        const ABC_SHA256: &str = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad";
+
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"abc").unwrap();
+        fs::write(source.join("a.xmp"), b"abc").unwrap();
+
+        let options = CreateOptions {
+            hash_encoding: HashEncoding::Hex,
+            ..Default::default()
+        };
+        let mut lib = Library::create_with_options(&temp_dir.path().join("hex"), &options).unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+        let conn = lib.database().connection_ref();
+        let media: String = conn.query_row("SELECT hash FROM media", [], |row| row.get(0)).unwrap();
+        let sidecar: String = conn.query_row("SELECT hash FROM sidecars", [], |row| row.get(0)).unwrap();
+        assert_eq!((media.as_str(), sidecar.as_str()), (ABC_SHA256, ABC_SHA256));
+
+        // A base64 library converts to the same hashes, and back on undo
+        let mut lib = Library::create(&temp_dir.path().join("base64")).unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+        let base64 = hash_file(&source.join("a.jpg")).unwrap();
+        assert_eq!(lib.convert_hashes(HashEncoding::Hex).unwrap(), 2);
+        assert_eq!(lib.hash_encoding().unwrap(), HashEncoding::Hex);
+        let media: String = lib.database().connection_ref()
+            .query_row("SELECT hash FROM media", [], |row| row.get(0))
+            .unwrap();
+        assert_eq!(media, ABC_SHA256);
+
+        // The file is recognized as already imported under its new hash
+        lib.import(&source, &ImportOptions::default()).unwrap();
+        assert_eq!(lib.database().media_count().unwrap(), 1);
+
+        while journal::undo_last(&mut lib).unwrap().unwrap().kind != "convert-hashes" {}
+        assert_eq!(lib.hash_encoding().unwrap(), HashEncoding::Base64);
+        let media: String = lib.database().connection_ref()
+            .query_row("SELECT hash FROM media", [], |row| row.get(0))
+            .unwrap();
+        assert_eq!(media, base64);
+    }
+
+    #[test]
+    fn test_hidden_files_and_folders_skipped() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(source.join(".thumbnails")).unwrap();
+        fs::create_dir_all(source.join(".git/objects")).unwrap();
+        fs::write(source.join(".thumbnails/a.jpg"), b"a").unwrap();
+        fs::write(source.join(".git/objects/b.jpg"), b"b").unwrap();
+        fs::write(source.join("._c.jpg"), b"c").unwrap();
+        fs::write(source.join("d.jpg"), b"d").unwrap();
+
+        let imported = |options: ImportOptions| {
+            let lib_dir = temp_dir.path().join(format!("lib{}{}", options.include_hidden_dirs, options.include_hidden_files));
+            let mut lib = Library::create(&lib_dir).unwrap();
+            lib.import(&source, &options).unwrap();
+            query_values(lib.database().connection_ref(), "SELECT filename FROM media ORDER BY filename")
+                .into_iter()
+                .map(|row| match &row[0] {
+                    rusqlite::types::Value::Text(name) => name.clone(),
+                    other => panic!("expected text, got {:?}", other),
+                })
+                .collect::<Vec<_>>()
+        };
+
+        assert_eq!(imported(ImportOptions::default()), ["d.jpg"]);
+        assert_eq!(
+            imported(ImportOptions { include_hidden_dirs: true, ..Default::default() }),
+            ["a.jpg", "b.jpg", "d.jpg"]
+        );
+        assert_eq!(
+            imported(ImportOptions { include_hidden_files: true, ..Default::default() }),
+            ["._c.jpg", "d.jpg"]
+        );
+    }
+
+    #[test]
+    fn test_exclude_dirs_by_name_and_path() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("card");
+        for (name, content) in [
+            ("DCIM/100CANON/a.jpg", "a"),
+            ("MISC/b.jpg", "b"),
+            ("DCIM/MISC/c.jpg", "c"),
+            ("PRIVATE/M4ROOT/THMBNL/d.jpg", "d"),
+            ("PRIVATE/M4ROOT/CLIP/e.jpg", "e"),
+            ("THMBNL/f.jpg", "f"),
+        ] {
+            let path = source.join(name);
+            fs::create_dir_all(path.parent().unwrap()).unwrap();
+            fs::write(path, content).unwrap();
+        }
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            exclude_dirs: vec![PathBuf::from("MISC"), PathBuf::from("PRIVATE/M4ROOT/THMBNL")],
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.images_imported, 3);
+        // A name matches at any depth; a path only below the source
+        let mut stmt = lib.database().connection_ref().prepare("SELECT filename FROM media ORDER BY filename").unwrap();
+        let names: Vec<String> = stmt.query_map([], |row| row.get(0)).unwrap().map(|r| r.unwrap()).collect();
+        assert_eq!(names, ["a.jpg", "e.jpg", "f.jpg"]);
+    }
+
+    #[test]
+    fn test_date_from_filename_before_file_timestamps() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("Screenshot_2019-07-04-10-20-30.png"), b"screenshot").unwrap();
+        fs::write(source.join("plain.png"), b"no date here").unwrap();
+
+        let relpaths = |lib: &Library| -> Vec<(String, String)> {
+            let mut stmt = lib
+                .database()
+                .connection_ref()
+                .prepare("SELECT filename, relpath FROM media ORDER BY filename")
+                .unwrap();
+            stmt.query_map([], |row| Ok((row.get(0)?, row.get(1)?))).unwrap().map(|r| r.unwrap()).collect()
+        };
+
+        let mut lib = Library::create(&temp_dir.path().join("without")).unwrap();
+        let stats = lib.import(&source, &ImportOptions::default()).unwrap();
+        assert_eq!(stats.dates_from_filenames, 0);
+        assert!(relpaths(&lib).iter().all(|(_, relpath)| !relpath.ends_with("2019/07-04")));
+
+        let mut lib = Library::create(&temp_dir.path().join("with")).unwrap();
+        let options = ImportOptions {
+            date_from_filename: true,
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.dates_from_filenames, 1);
+        let relpaths = relpaths(&lib);
+        assert_eq!(relpaths[0], ("Screenshot_2019-07-04-10-20-30.png".to_string(), "images/2019/07-04".to_string()));
+        // Without a date in its name, a file keeps its timestamp
+        assert_ne!(relpaths[1].1, "images/2019/07-04");
+    }
+
+    #[test]
+    fn test_import_mtime_window_flags_resaved_copy() {
+        let temp_dir = TempDir::new().unwrap();
+        let first = temp_dir.path().join("first");
+        let second = temp_dir.path().join("second");
+        fs::create_dir_all(&first).unwrap();
+        fs::create_dir_all(&second).unwrap();
+        fs::write(first.join("IMG_20240521_120000.jpg"), b"original photo").unwrap();
+        // Re-compressed by an editor, which also rounded its date a second later
+        fs::write(second.join("IMG_20240521_120001.jpg"), b"recompressed").unwrap();
+        fs::write(second.join("IMG_20240601_080000.jpg"), b"another photo").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("library")).unwrap();
+        let options = ImportOptions {
+            date_from_filename: true,
+            ..Default::default()
+        };
+        lib.import(&first, &options).unwrap();
+
+        let dry_run = ImportOptions {
+            dry_run: true,
+            ..options.clone()
+        };
+        assert!(lib.import(&second, &dry_run).unwrap().possible_readds.is_empty());
+
+        let options = ImportOptions {
+            import_mtime_window: Some(2),
+            ..options
+        };
+        let stats = lib.import(&second, &options).unwrap();
+        assert_eq!(stats.possible_readds.len(), 1);
+        let readd = &stats.possible_readds[0];
+        assert_eq!(readd.path, second.join("IMG_20240521_120001.jpg"));
+        assert_eq!(readd.existing, lib.root().join("images/2024/05-21/IMG_20240521_120000.jpg"));
+        // Flagged for review, not skipped
+        assert_eq!(stats.images_imported, 2);
+    }
+
+    #[test]
+    fn test_import_order_sets_id_order() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        // Name order and date order disagree
+        fs::write(source.join("a_20230101_120000.jpg"), b"newest photo").unwrap();
+        fs::write(source.join("b_20210101_120000.jpg"), b"oldest!").unwrap();
+        fs::write(source.join("c_20220101_120000.jpg"), b"mid").unwrap();
+
+        let imported = |import_order| {
+            let lib_dir = temp_dir.path().join(format!("lib_{:?}", import_order));
+            let mut lib = Library::create(&lib_dir).unwrap();
+            let options = ImportOptions {
+                date_from_filename: true,
+                deterministic: true,
+                import_order,
+                ..Default::default()
+            };
+            lib.import(&source, &options).unwrap();
+            let mut stmt = lib.database().connection_ref().prepare("SELECT filename FROM media ORDER BY id").unwrap();
+            stmt.query_map([], |row| row.get(0)).unwrap().map(|r| r.unwrap()).collect::<Vec<String>>()
+        };
+
+        // Chronological ids
+        assert_eq!(
+            imported(ImportOrder::Date),
+            ["b_20210101_120000.jpg", "c_20220101_120000.jpg", "a_20230101_120000.jpg"]
+        );
+        assert_eq!(
+            imported(ImportOrder::Source),
+            ["a_20230101_120000.jpg", "b_20210101_120000.jpg", "c_20220101_120000.jpg"]
+        );
+        assert_eq!(
+            imported(ImportOrder::Size),
+            ["c_20220101_120000.jpg", "b_20210101_120000.jpg", "a_20230101_120000.jpg"]
+        );
+    }
+
+    #[test]
+    fn test_continue_on_db_error_skips_failing_rows() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("bad.jpg"), b"bad").unwrap();
+        fs::write(source.join("bad.xmp"), b"<bad/>").unwrap();
+        fs::write(source.join("good.jpg"), b"good").unwrap();
+        fs::write(source.join("good.xmp"), b"<good/>").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        // The database refuses one row, as it would a malformed one
+        lib.database()
+            .connection_ref()
+            .execute_batch(
+                "CREATE TRIGGER refuse_bad BEFORE INSERT ON media WHEN NEW.filename = 'bad.jpg'
+                 BEGIN SELECT RAISE(ABORT, 'refused'); END",
+            )
+            .unwrap();
+
+        let failed = lib.import(&source, &ImportOptions::default());
+        assert!(matches!(failed, Err(PhotosortError::Database(_))), "{:?}", failed.map(|s| s.to_string()));
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+
+        let options = ImportOptions {
+            continue_on_db_error: true,
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.images_imported, 1);
+        assert_eq!(stats.sidecars_imported, 1);
+        assert_eq!(stats.errors, 1);
+        let skipped: Vec<(PathBuf, SkipReason)> =
+            stats.skipped_files.iter().map(|f| (f.path.clone(), f.reason)).collect();
+        assert_eq!(skipped, vec![(source.join("bad.jpg"), SkipReason::DatabaseError)]);
+
+        let conn = lib.database().connection_ref();
+        let filenames = |sql: &str| -> Vec<String> {
+            let mut stmt = conn.prepare(sql).unwrap();
+            stmt.query_map([], |row| row.get(0)).unwrap().map(|r| r.unwrap()).collect()
+        };
+        assert_eq!(filenames("SELECT filename FROM media"), ["good.jpg"]);
+        // The refused photo's sidecar went with it
+        assert_eq!(filenames("SELECT filename FROM sidecars"), ["good.xmp"]);
+
+        // And neither file was left in the library without a record
+        let on_disk: Vec<String> = WalkDir::new(lib.root().join("images"))
+            .into_iter()
+            .filter_map(|e| e.ok())
+            .filter(|e| e.file_type().is_file())
+            .map(|e| e.file_name().to_string_lossy().into_owned())
+            .collect();
+        assert!(on_disk.contains(&"good.jpg".to_string()), "{:?}", on_disk);
+        assert!(!on_disk.iter().any(|name| name.starts_with("bad")), "{:?}", on_disk);
+    }
+
+    #[test]
+    fn test_normalize_unicode_matches_decomposed_names() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        // The same name, composed (NFC) and decomposed as macOS writes it (NFD)
+        let composed = "Cr\u{e8}me br\u{fb}l\u{e9}e";
+        let decomposed = "Cre\u{300}me bru\u{302}le\u{301}e";
+        fs::write(source.join(format!("{}.jpg", decomposed)), b"dessert").unwrap();
+        fs::write(source.join(format!("{}.xmp", composed)), b"<x/>").unwrap();
+
+        let imported = |options: ImportOptions| {
+            let lib_dir = temp_dir.path().join(format!("lib{}", options.normalize_unicode));
+            let mut lib = Library::create(&lib_dir).unwrap();
+            lib.import(&source, &options).unwrap();
+            let names = |sql: &str| -> Vec<String> {
+                query_values(lib.database().connection_ref(), sql)
+                    .into_iter()
+                    .map(|row| match &row[0] {
+                        rusqlite::types::Value::Text(name) => name.clone(),
+                        other => panic!("expected text, got {:?}", other),
+                    })
+                    .collect()
+            };
+            (names("SELECT filename FROM media"), names("SELECT filename FROM sidecars"))
+        };
+
+        // Byte for byte, the sidecar's name doesn't match its photo
+        let (media, sidecars) = imported(ImportOptions::default());
+        assert_eq!(media, [format!("{}.jpg", decomposed)]);
+        assert!(sidecars.is_empty());
+
+        let (media, sidecars) = imported(ImportOptions { normalize_unicode: true, ..Default::default() });
+        assert_eq!(media, [format!("{}.jpg", composed)]);
+        assert_eq!(sidecars, [format!("{}.xmp", composed)]);
+
+        let known = KnownMedia {
+            root: temp_dir.path().to_path_buf(),
+            by_hash: HashMap::from([("h".to_string(), (String::new(), format!("{}.jpg", decomposed), 7))]),
+            normalize_unicode: true,
+        };
+        fs::write(temp_dir.path().join(format!("{}.jpg", decomposed)), b"dessert").unwrap();
+        assert!(known.contains_unchanged("h", &format!("{}.jpg", composed), 7));
+    }
+
+    #[test]
+    fn test_progress_observer_hears_import() {
+        use crate::photosort_core::progress::ProgressObserver;
+
+        #[derive(Default)]
+        struct Recorder {
+            phases: Mutex<Vec<(String, u64)>>,
+            files: Mutex<Vec<PathBuf>>,
+            progress: Mutex<Vec<(u64, u64)>>,
+        }
+
+        impl ProgressObserver for Recorder {
+            fn on_phase(&self, phase: &str, total: u64) {
+                self.phases.lock().unwrap().push((phase.to_string(), total));
+            }
+            fn on_progress(&self, done: u64, total: u64) {
+                self.progress.lock().unwrap().push((done, total));
+            }
+            fn on_file_done(&self, path: &Path) {
+                self.files.lock().unwrap().push(path.to_path_buf());
+            }
+        }
+
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"a").unwrap();
+        fs::write(source.join("a.xmp"), b"<a/>").unwrap();
+        fs::write(source.join("b.jpg"), b"b").unwrap();
+
+        let recorder = Arc::new(Recorder::default());
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        lib.set_progress_observer(recorder.clone());
+        lib.import(&source, &ImportOptions::default()).unwrap();
+
+        assert_eq!(
+            *recorder.phases.lock().unwrap(),
+            [("Scanning files".to_string(), 3), ("Copying files".to_string(), 3)]
+        );
+        let mut files = recorder.files.lock().unwrap().clone();
+        files.sort();
+        let relpath: String = lib
+            .database()
+            .connection_ref()
+            .query_row("SELECT relpath FROM media WHERE filename = 'a.jpg'", [], |row| row.get(0))
+            .unwrap();
+        let dest = lib.root().join(&relpath);
+        let mut expected = vec![
+            source.join("a.jpg"),
+            source.join("a.xmp"),
+            source.join("b.jpg"),
+            dest.join("a.jpg"),
+            dest.join("a.xmp"),
+            dest.join("b.jpg"),
+        ];
+        expected.sort();
+        assert_eq!(files, expected);
+        // Every step is reported, ending with each phase's total
+        let progress = recorder.progress.lock().unwrap();
+        assert_eq!(progress.len(), 6);
+        assert_eq!(progress.iter().filter(|(done, total)| done == total).count(), 2);
+
+        // Scans report their phases instead of printing them
+        recorder.phases.lock().unwrap().clear();
+        crate::photosort_core::scan::scan_library(&lib).unwrap();
+        let phases = recorder.phases.lock().unwrap();
+        assert_eq!(phases.first().unwrap().0, "Checking for missing files");
+        assert!(phases.iter().all(|(_, total)| *total == 0));
+    }
+
+    #[test]
+    fn test_panic_during_import_becomes_error() {
+        use crate::photosort_core::progress::ProgressObserver;
+
+        // Panics once a file under this path is done, in whichever phase
+        struct Boom(PathBuf);
+
+        impl ProgressObserver for Boom {
+            fn on_phase(&self, _phase: &str, _total: u64) {}
+            fn on_progress(&self, _done: u64, _total: u64) {}
+            fn on_file_done(&self, path: &Path) {
+                if path.starts_with(&self.0) {
+                    panic!("unexpected {}", path.display());
+                }
+            }
+        }
+
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"a").unwrap();
+        fs::write(source.join("boom.jpg"), b"boom").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        lib.set_progress_observer(Arc::new(Boom(source.join("boom.jpg"))));
+        match lib.import(&source, &ImportOptions::default()) {
+            Err(PhotosortError::Panicked { phase, path, message }) => {
+                assert_eq!(phase, "scanning");
+                assert_eq!(path, source.join("boom.jpg"));
+                assert!(message.starts_with("unexpected"), "{}", message);
+            }
+            other => panic!("expected a panic error, got {:?}", other),
+        }
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+
+        // A panic while copying names the source instead, and nothing is recorded
+        let root = lib.root().to_path_buf();
+        lib.set_progress_observer(Arc::new(Boom(root.clone())));
+        let err = lib.import(&source, &ImportOptions::default()).unwrap_err();
+        assert!(matches!(err, PhotosortError::Panicked { phase: "importing", ref path, .. } if *path == source));
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+        // Files copied before the panic are gone again, not left untracked
+        let left: Vec<_> = WalkDir::new(root.join("images"))
+            .into_iter()
+            .filter_map(|e| e.ok())
+            .filter(|e| !e.file_type().is_dir())
+            .collect();
+        assert!(left.is_empty(), "{:?}", left);
+
+        // The library is left usable
+        lib.set_progress_observer(Arc::new(Boom(temp_dir.path().join("nothing"))));
+        assert_eq!(lib.import(&source, &ImportOptions::default()).unwrap().images_imported, 2);
+    }
+
+    #[test]
+    fn test_reimport_moves_media_to_corrected_date() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("IMG_20190704_102030.jpg"), b"photo").unwrap();
+        fs::write(source.join("IMG_20190704_102030.xmp"), b"<edits/>").unwrap();
+
+        // Imported without reading the name, so dated by its timestamp
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+        let stored = |lib: &Library| -> (String, String, String) {
+            lib.database()
+                .connection_ref()
+                .query_row("SELECT hash, relpath, created_at FROM media", [], |row| {
+                    Ok((row.get(0)?, row.get(1)?, row.get(2)?))
+                })
+                .unwrap()
+        };
+        let (hash, old_relpath, old_date) = stored(&lib);
+        assert_ne!(old_relpath, "images/2019/07-04");
+
+        let options = ImportOptions {
+            date_from_filename: true,
+            ..Default::default()
+        };
+        let planned = lib.reimport(Path::new(&hash), None, &options, true).unwrap();
+        assert_eq!(planned.new_path, "images/2019/07-04/IMG_20190704_102030.jpg");
+        assert_eq!(stored(&lib).1, old_relpath);
+
+        let result = lib.reimport(Path::new(&hash), None, &options, false).unwrap();
+        assert_eq!(result, planned);
+        let (_, relpath, date) = stored(&lib);
+        assert_eq!(relpath, "images/2019/07-04");
+        assert!(date.starts_with("2019:07:04 10:20:30"), "{}", date);
+        for name in ["IMG_20190704_102030.jpg", "IMG_20190704_102030.xmp"] {
+            assert!(lib.file_path(&relpath, name).is_file(), "{}", name);
+            assert!(!lib.file_path(&old_relpath, name).exists(), "{}", name);
+        }
+
+        // Undo puts the record and files back
+        assert_eq!(journal::undo_last(&mut lib).unwrap().unwrap().kind, "reimport");
+        assert_eq!(stored(&lib), (hash.clone(), old_relpath.clone(), old_date));
+        assert!(lib.file_path(&old_relpath, "IMG_20190704_102030.xmp").is_file());
+
+        // A different file can't stand in for it
+        fs::write(source.join("other.jpg"), b"other").unwrap();
+        let err = lib.reimport(Path::new(&hash), Some(&source.join("other.jpg")), &options, false).unwrap_err();
+        assert!(matches!(err, PhotosortError::Conflict(_)), "{}", err);
+    }
+
+    #[test]
+    fn test_recompute_winners_switches_to_preferred_copy() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(source.join("a")).unwrap();
+        fs::create_dir_all(source.join("b")).unwrap();
+        fs::write(source.join("a/IMG_1.jpg"), b"same photo").unwrap();
+        fs::write(source.join("b/copy.jpg"), b"same photo").unwrap();
+        fs::write(source.join("b/copy.xmp"), b"<edits/>").unwrap();
+
+        // An import that happened to look at the later copy first
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            files: Some(vec![source.join("b/copy.jpg"), source.join("a/IMG_1.jpg")]),
+            ..Default::default()
+        };
+        lib.import(&source, &options).unwrap();
+        let stored = |lib: &Library| -> (String, String, String) {
+            lib.database()
+                .connection_ref()
+                .query_row(
+                    "SELECT m.relpath, m.filename, s.filename FROM media m JOIN sidecars s ON s.media_id = m.id",
+                    [],
+                    |row| Ok((row.get(0)?, row.get(1)?, row.get(2)?)),
+                )
+                .unwrap()
+        };
+        let (relpath, filename, sidecar) = stored(&lib);
+        assert_eq!((filename.as_str(), sidecar.as_str()), ("copy.jpg", "copy.xmp"));
+
+        let preview = lib.recompute_winners(&source, &ImportOptions::default(), true).unwrap();
+        assert_eq!(preview.changes.len(), 1);
+        assert_eq!(preview.changes[0].old_path, format!("{}/copy.jpg", relpath));
+        assert_eq!(stored(&lib).1, "copy.jpg");
+
+        let result = lib.recompute_winners(&source, &ImportOptions::default(), false).unwrap();
+        assert_eq!(result.changes, preview.changes);
+        let (new_relpath, filename, sidecar) = stored(&lib);
+        assert_eq!((filename.as_str(), sidecar.as_str()), ("IMG_1.jpg", "IMG_1.xmp"));
+        assert!(lib.file_path(&new_relpath, "IMG_1.jpg").is_file());
+        assert!(lib.file_path(&new_relpath, "IMG_1.xmp").is_file());
+        assert!(!lib.file_path(&relpath, "copy.jpg").exists());
+
+        // Already settled, and undone as one operation
+        assert!(lib.recompute_winners(&source, &ImportOptions::default(), true).unwrap().changes.is_empty());
+        let undone = journal::undo_last(&mut lib).unwrap().unwrap();
+        assert_eq!(undone.kind, "recompute-winners");
+        assert_eq!(stored(&lib), (relpath.clone(), "copy.jpg".to_string(), "copy.xmp".to_string()));
+        assert!(lib.file_path(&relpath, "copy.xmp").is_file());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_recompute_winners_relinks_in_content_layout() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(source.join("a")).unwrap();
+        fs::create_dir_all(source.join("b")).unwrap();
+        fs::write(source.join("a/IMG_1.jpg"), b"same photo").unwrap();
+        fs::write(source.join("b/copy.jpg"), b"same photo").unwrap();
+        fs::write(source.join("b/copy.xmp"), b"<edits/>").unwrap();
+
+        let create = CreateOptions {
+            layout: StorageLayout::Content,
+            ..Default::default()
+        };
+        let mut lib = Library::create_with_options(&temp_dir.path().join("lib"), &create).unwrap();
+        let options = ImportOptions {
+            files: Some(vec![source.join("b/copy.jpg"), source.join("a/IMG_1.jpg")]),
+            ..Default::default()
+        };
+        lib.import(&source, &options).unwrap();
+        let relpath = |lib: &Library| -> String {
+            lib.database().connection_ref().query_row("SELECT relpath FROM media", [], |row| row.get(0)).unwrap()
+        };
+        let old_relpath = relpath(&lib);
+
+        lib.recompute_winners(&source, &ImportOptions::default(), false).unwrap();
+        let link = lib.file_path(&relpath(&lib), "IMG_1.jpg");
+        assert!(link.symlink_metadata().unwrap().file_type().is_symlink());
+        assert_eq!(fs::read(&link).unwrap(), b"same photo");
+
+        // Undo moves the link back, still pointing at the object
+        journal::undo_last(&mut lib).unwrap().unwrap();
+        assert_eq!(fs::read(lib.file_path(&old_relpath, "copy.jpg")).unwrap(), b"same photo");
+    }
+
+    #[test]
+    fn test_nested_libraries_skipped() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(source.join("card")).unwrap();
+        fs::write(source.join("card/a.jpg"), b"a").unwrap();
+
+        // An older library kept inside the source, with a photo of its own
+        let old_source = temp_dir.path().join("old_source");
+        fs::create_dir_all(&old_source).unwrap();
+        fs::write(old_source.join("b.jpg"), b"b").unwrap();
+        let mut old = Library::create(&source.join("old_library")).unwrap();
+        old.import(&old_source, &ImportOptions::default()).unwrap();
+        fs::write(source.join("old_library").join(format!("{}-wal", DB_FILE_NAME)), b"").unwrap();
+
+        let imported = |options: ImportOptions| {
+            let lib_dir = temp_dir.path().join(format!("lib{}", options.include_nested_libraries));
+            let mut lib = Library::create(&lib_dir).unwrap();
+            lib.import(&source, &options).unwrap();
+            query_values(lib.database().connection_ref(), "SELECT filename FROM media ORDER BY filename")
+                .into_iter()
+                .map(|row| match &row[0] {
+                    rusqlite::types::Value::Text(name) => name.clone(),
+                    other => panic!("expected text, got {:?}", other),
+                })
+                .collect::<Vec<_>>()
+        };
+
+        assert_eq!(imported(ImportOptions::default()), ["a.jpg"]);
+        assert_eq!(
+            imported(ImportOptions { include_nested_libraries: true, ..Default::default() }),
+            ["a.jpg", "b.jpg"]
+        );
+
+        // The database files themselves are never picked up
+        let files = source_files(&source, &ImportOptions { include_nested_libraries: true, ..Default::default() }).unwrap();
+        assert!(files.iter().all(|f| !is_library_database(f)));
+        assert!(is_library_database(Path::new("x/library.db-shm")));
+        assert!(!is_library_database(Path::new("x/library.db.bak")));
+    }
+
+    #[test]
+    fn test_catalog_indexes_files_in_place() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("external");
+        fs::create_dir_all(source.join("2019")).unwrap();
+        fs::write(source.join("2019/a.jpg"), b"a").unwrap();
+        fs::write(source.join("2019/a.xmp"), b"<a/>").unwrap();
+        fs::write(source.join("b.mp4"), b"b").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            catalog: true,
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.images_imported + stats.videos_imported, 2);
+        assert_eq!(stats.sidecars_imported, 1);
+
+        // Nothing was copied into the library
+        let copied = WalkDir::new(lib.root())
+            .into_iter()
+            .filter_map(|e| e.ok())
+            .filter(|e| e.path().extension().is_some_and(|x| x == "jpg" || x == "mp4" || x == "xmp"))
+            .count();
+        assert_eq!(copied, 0);
+
+        // Records resolve to the files in the source
+        let source = fs::canonicalize(&source).unwrap();
+        let rows = query_values(
+            lib.database().connection_ref(),
+            "SELECT m.relpath, m.filename, s.filename FROM media m LEFT JOIN sidecars s ON s.media_id = m.id ORDER BY m.filename",
+        );
+        let text = |v: &rusqlite::types::Value| match v {
+            rusqlite::types::Value::Text(t) => t.clone(),
+            other => panic!("expected text, got {:?}", other),
+        };
+        assert_eq!(text(&rows[0][0]), source.join("2019").to_string_lossy());
+        assert_eq!(text(&rows[1][0]), source.to_string_lossy());
+        for row in &rows {
+            assert!(lib.root().join(text(&row[0])).join(text(&row[1])).is_file());
+        }
+        assert!(lib.root().join(text(&rows[0][0])).join(text(&rows[0][2])).is_file());
+
+        assert!(lib.find_media(&source.join("2019/a.jpg")).unwrap().is_some());
+        let verified = crate::photosort_core::verify::verify(&lib, &Default::default()).unwrap();
+        assert_eq!(verified.checked, 2);
+        assert_eq!(verified.failures(), 0);
+    }
+
+    #[test]
+    fn test_library_totals_count_sidecars() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"a").unwrap();
+        fs::write(source.join("a.xmp"), b"<a/>").unwrap();
+        fs::write(source.join("a.pp3"), b"[a]").unwrap();
+        fs::write(source.join("b.jpg"), b"b").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let stats = lib.import(&source, &ImportOptions::default()).unwrap();
+        assert_eq!(stats.library_totals, LibraryTotals { media: 2, sidecars: 2 });
+
+        // A second import reports the whole library, not just what it added
+        let more = temp_dir.path().join("more");
+        fs::create_dir_all(&more).unwrap();
+        fs::write(more.join("c.jpg"), b"c").unwrap();
+        fs::write(more.join("c.xmp"), b"<c/>").unwrap();
+        let stats = lib.import(&more, &ImportOptions::default()).unwrap();
+        assert_eq!(stats.sidecars_imported, 1);
+        assert_eq!(stats.library_totals, LibraryTotals { media: 3, sidecars: 3 });
+        assert_eq!(lib.totals().unwrap(), stats.library_totals);
+
+        let report = stats.report(false).render(&crate::photosort_core::cli::ReportFormat::Text);
+        assert!(report.contains("sidecars in the library"));
+    }
+
+    #[test]
+    fn test_since_last_import_only_processes_new_files() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("old.jpg"), b"old").unwrap();
+        fs::write(source.join("old.xmp"), b"old edits").unwrap();
+        let an_hour_ago = std::time::SystemTime::now() - std::time::Duration::from_secs(3600);
+        for name in ["old.jpg", "old.xmp"] {
+            fs::File::options()
+                .write(true)
+                .open(source.join(name))
+                .unwrap()
+                .set_modified(an_hour_ago)
+                .unwrap();
+        }
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            since_last_import: true,
+            ..Default::default()
+        };
+        assert_eq!(lib.import(&source, &options).unwrap().images_imported, 1);
+
+        fs::write(source.join("new.jpg"), b"new").unwrap();
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.images_imported, 1);
+        assert_eq!(stats.unmodified_skipped, 1);
+        assert_eq!(stats.duplicates_skipped, 0);
+        assert!(stats.skipped_files.is_empty());
+
+        // --force looks at everything again
+        let forced = ImportOptions { force: true, ..options };
+        let stats = lib.import(&source, &forced).unwrap();
+        assert_eq!(stats.unmodified_skipped, 0);
+        assert_eq!(stats.duplicates_skipped, 2);
+    }
+
+    fn candidate(path: &str, created_at: OffsetDateTime) -> ImportCandidate {
+        ImportCandidate {
+            source_path: PathBuf::from(path),
+            hash: "same".to_string(),
+            media_type: MediaType::Image,
+            file_size: 1,
+            created_at,
+            dated_by_filename: false,
+            filename: path.to_string(),
+            filetype: "jpg".to_string(),
+            sidecars: Vec::new(),
+            exif: ExifMetadata::default(),
+            dimensions: None,
+        }
+    }
+
+    #[test]
+    fn test_ambiguous_sidecar_lookups_record_one_row() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("IMG_1.jpg"), b"jpeg").unwrap();
+        fs::write(source.join("IMG_1.heic"), b"heic").unwrap();
+        fs::write(source.join("IMG_1.xmp"), b"<edits/>").unwrap();
+
+        // "." finds the same sidecars as the lookup by base name
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            sidecar_subfolders: vec![".".to_string()],
+            deterministic: true,
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.images_imported, 2);
+        assert_eq!(stats.sidecars_imported, 1);
+        assert!(stats.skipped_files.is_empty());
+
+        // Both photos match it by name; only the first in source order gets it
+        let rows: Vec<(String, String)> = lib
+            .database()
+            .connection_ref()
+            .prepare("SELECT m.filename, s.filename FROM sidecars s JOIN media m ON m.id = s.media_id")
+            .unwrap()
+            .query_map([], |row| Ok((row.get(0)?, row.get(1)?)))
+            .unwrap()
+            .map(|r| r.unwrap())
+            .collect();
+        assert_eq!(rows, [("IMG_1.heic".to_string(), "IMG_1.xmp".to_string())]);
+    }
+
+    #[test]
+    fn test_import_sidecars_from_subfolder() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        let settings = source.join("CaptureOne").join("Settings153");
+        fs::create_dir_all(&settings).unwrap();
+        fs::write(source.join("IMG_1234.jpg"), b"photo").unwrap();
+        fs::write(source.join("IMG_5678.jpg"), b"other photo").unwrap();
+        fs::write(settings.join("IMG_1234.jpg.cos"), b"capture one edits").unwrap();
+
+        // Not looked for by default, so reported as an orphan
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let stats = lib.import(&source, &ImportOptions { dry_run: true, ..Default::default() }).unwrap();
+        assert_eq!(stats.skipped_files.len(), 1);
+        assert_eq!(stats.skipped_files[0].path, settings.join("IMG_1234.jpg.cos"));
+
+        let options = ImportOptions {
+            sidecar_subfolders: vec!["CaptureOne/Settings*".to_string()],
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.images_imported, 2);
+        assert_eq!(stats.sidecars_imported, 1);
+        assert!(stats.skipped_files.is_empty());
+
+        let (relpath, filename): (String, String) = lib
+            .database()
+            .connection_ref()
+            .query_row(
+                "SELECT m.relpath, s.filename FROM sidecars s JOIN media m ON m.id = s.media_id",
+                [],
+                |row| Ok((row.get(0)?, row.get(1)?)),
+            )
+            .unwrap();
+        assert_eq!(filename, "IMG_1234.cos");
+        assert!(lib.root().join(relpath).join("IMG_1234.cos").is_file());
+    }
+
+    #[test]
+    fn test_max_files_stops_large_source() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(source.join("nested")).unwrap();
+        for name in ["a.jpg", "b.jpg", "nested/c.jpg"] {
+            fs::write(source.join(name), name).unwrap();
+        }
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            max_files: Some(2),
+            ..Default::default()
+        };
+        let err = lib.import(&source, &options).unwrap_err();
+        assert!(matches!(err, PhotosortError::TooManyFiles { ref dir, limit: 2 } if *dir == source));
+        assert!(err.to_string().contains("holds more than 2 files"), "{}", err);
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+
+        // A source right at the cap is imported
+        let options = ImportOptions {
+            max_files: Some(3),
+            ..Default::default()
+        };
+        assert_eq!(lib.import(&source, &options).unwrap().images_imported, 3);
+    }
+
+    #[test]
+    fn test_import_apple_adjustments_stay_with_original() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("IMG_1234.jpg"), b"original").unwrap();
+        fs::write(source.join("IMG_E1234.jpg"), b"edited").unwrap();
+        fs::write(source.join("IMG_1234.AAE"), b"<plist/>").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let stats = lib.import(&source, &ImportOptions::default()).unwrap();
+        assert_eq!(stats.images_imported, 2);
+        assert_eq!(stats.sidecars_imported, 1);
+        assert!(stats.skipped_files.is_empty());
+
+        let (media, sidecar): (String, String) = lib
+            .database()
+            .connection_ref()
+            .query_row(
+                "SELECT m.filename, s.filename FROM sidecars s JOIN media m ON m.id = s.media_id",
+                [],
+                |row| Ok((row.get(0)?, row.get(1)?)),
+            )
+            .unwrap();
+        assert_eq!((media.as_str(), sidecar.as_str()), ("IMG_1234.jpg", "IMG_1234.AAE"));
+    }
+
+    #[test]
+    fn test_skip_sidecar_copy() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("IMG_1.jpg"), b"photo").unwrap();
+        fs::write(source.join("IMG_1.xmp"), b"<edits/>").unwrap();
+
+        let imported = |mode| {
+            let mut lib = Library::create(&temp_dir.path().join(format!("lib_{:?}", mode))).unwrap();
+            let options = ImportOptions {
+                skip_sidecar_copy: Some(mode),
+                ..Default::default()
+            };
+            let stats = lib.import(&source, &options).unwrap();
+            let relpath: String =
+                lib.database().connection_ref().query_row("SELECT relpath FROM media", [], |row| row.get(0)).unwrap();
+            assert!(lib.file_path(&relpath, "IMG_1.jpg").is_file());
+            assert!(!lib.file_path(&relpath, "IMG_1.xmp").exists());
+            (stats, lib.database().sidecar_count().unwrap())
+        };
+
+        let (stats, recorded) = imported(SkipSidecarCopy::Record);
+        assert_eq!((stats.sidecars_imported, stats.sidecars_not_copied, recorded), (1, 1, 1));
+        let (stats, recorded) = imported(SkipSidecarCopy::All);
+        assert_eq!((stats.sidecars_imported, stats.sidecars_not_copied, recorded), (0, 0, 0));
+        // Left out, not orphaned
+        assert!(stats.skipped_files.is_empty());
+    }
+
+    #[test]
+    fn test_name_case_insensitive_matches_case_variants() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        let taken = time::macros::datetime!(2024-05-21 12:00:00 UTC);
+        for (dir, name, content) in [("a", "IMG_1.JPG", "first"), ("a", "img_1.XMP", "<edits/>"), ("b", "img_1.jpg", "second")] {
+            fs::create_dir_all(source.join(dir)).unwrap();
+            fs::write(source.join(dir).join(name), content).unwrap();
+            fs::File::options()
+                .write(true)
+                .open(source.join(dir).join(name))
+                .unwrap()
+                .set_modified(taken.into())
+                .unwrap();
+        }
+
+        let imported = |name_case| {
+            let mut lib = Library::create(&temp_dir.path().join(format!("lib_{:?}", name_case))).unwrap();
+            let options = ImportOptions {
+                dest_exists: DestExistsPolicy::Rename,
+                name_case,
+                ..Default::default()
+            };
+            let stats = lib.import(&source, &options).unwrap();
+            let mut stmt = lib
+                .database()
+                .connection_ref()
+                .prepare("SELECT m.filename, s.filename FROM media m LEFT JOIN sidecars s ON s.media_id = m.id ORDER BY m.id")
+                .unwrap();
+            let rows = stmt
+                .query_map([], |row| Ok((row.get(0)?, row.get(1)?)))
+                .unwrap()
+                .map(|r| r.unwrap())
+                .collect::<Vec<(String, Option<String>)>>();
+            (stats, rows)
+        };
+
+        let (stats, rows) = imported(NameCase::Insensitive);
+        assert_eq!(stats.images_imported, 2);
+        // The two photos can't share a name that differs only in case
+        let names: HashSet<String> = rows.iter().map(|(media, _)| media.to_lowercase()).collect();
+        assert_eq!(names.len(), 2);
+        // The sidecar is found and stored under its photo's base name
+        let (media, sidecar) = rows.iter().find(|(_, sidecar)| sidecar.is_some()).unwrap();
+        let stem = |name: &str| Path::new(name).file_stem().unwrap().to_string_lossy().into_owned();
+        assert_eq!(stem(sidecar.as_deref().unwrap()), stem(media));
+
+        // Only a case-sensitive disk can hold both names in one folder
+        if !filesystem_ignores_case(&source.join("a")) {
+            let (stats, rows) = imported(NameCase::Sensitive);
+            let names: Vec<&str> = rows.iter().map(|(media, _)| media.as_str()).collect();
+            assert!(names.contains(&"IMG_1.JPG") && names.contains(&"img_1.jpg"));
+            assert!(rows.iter().all(|(_, sidecar)| sidecar.is_none()));
+            assert_eq!(stats.skipped_files[0].reason, SkipReason::OrphanSidecar);
+        }
+    }
+
+    #[test]
+    fn test_estimate_sums_files_to_copy() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(source.join("copy")).unwrap();
+        fs::write(source.join("IMG_1.jpg"), b"first photo").unwrap();
+        fs::write(source.join("IMG_1.xmp"), b"<edits/>").unwrap();
+        fs::write(source.join("IMG_2.jpg"), b"second").unwrap();
+        // A duplicate isn't copied twice
+        fs::write(source.join("copy/IMG_2.jpg"), b"second").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            dry_run: true,
+            estimate: true,
+            ..Default::default()
+        };
+        let estimate = lib.import(&source, &options).unwrap().estimate.unwrap();
+        assert_eq!((estimate.media, estimate.sidecars), (2, 1));
+        assert_eq!(estimate.bytes, ("first photo".len() + "<edits/>".len() + "second".len()) as u64);
+        assert!(estimate.seconds().is_some_and(|s| s >= 0.0));
+        // Nothing is left behind
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+        assert!(fs::read_dir(lib.root()).unwrap().all(|e| !e.unwrap().file_name().to_string_lossy().contains("probe")));
+    }
+
+    #[test]
+    fn test_canonical_ext_shares_filetype() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"first photo").unwrap();
+        fs::write(source.join("b.jpeg"), b"second photo").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            canonical_ext: true,
+            ..Default::default()
+        };
+        assert_eq!(lib.import(&source, &options).unwrap().images_imported, 2);
+
+        let conn = lib.database().connection_ref();
+        let mut stmt = conn.prepare("SELECT filename, filetype FROM media ORDER BY filename").unwrap();
+        let rows: Vec<(String, String)> = stmt
+            .query_map([], |row| Ok((row.get(0)?, row.get(1)?)))
+            .unwrap()
+            .collect::<rusqlite::Result<_>>()
+            .unwrap();
+        // The name on disk keeps its original extension
+        assert_eq!(
+            rows,
+            vec![("a.jpg".to_string(), "JPG".to_string()), ("b.jpeg".to_string(), "JPG".to_string())]
+        );
+    }
+
+    #[test]
+    fn test_folders_flags_nonconforming_relpaths() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        for (i, (relpath, media_type)) in [
+            ("images/2024/05-21", "image"),
+            ("images/2024/05-21", "image"),
+            ("videos/2024/05-21", "video"),
+            ("images/2019/summer", "image"),
+            ("2019/07-04", "image"),
+            ("images/2024/13-01", "image"),
+            ("videos/2023/01-02", "image"),
+            ("images/2023/01-02", "video"),
+            ("images/2023/01-02", "image"),
+        ]
+        .iter()
+        .enumerate()
+        {
+            lib.database()
+                .connection_ref()
+                .execute(
+                    "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+                     VALUES (?1, 'a.jpg', ?2, ?3, 'JPG', 1, '', '')",
+                    params![format!("h{}", i), relpath, media_type],
+                )
+                .unwrap();
+        }
+
+        let folders = lib.folders().unwrap();
+        let summary: Vec<(&str, usize, bool)> =
+            folders.iter().map(|f| (f.relpath.as_str(), f.media_count, f.conforms)).collect();
+        assert_eq!(
+            summary,
+            vec![
+                ("2019/07-04", 1, false),
+                ("images/2019/summer", 1, false),
+                ("images/2023/01-02", 2, false),
+                ("images/2024/05-21", 2, true),
+                ("images/2024/13-01", 1, false),
+                ("videos/2023/01-02", 1, false),
+                ("videos/2024/05-21", 1, true),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_for_each_file_visits_every_file_once() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"photo a").unwrap();
+        fs::write(source.join("a.xmp"), b"<a/>").unwrap();
+        fs::write(source.join("b.mp4"), b"video b").unwrap();
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+
+        let mut media = Vec::new();
+        lib.for_each_media_file(|path, hash| {
+            media.push((path.file_name().unwrap().to_os_string(), hash.to_string()));
+            assert_eq!(hash_file(path).unwrap(), hash);
+            Ok(())
+        })
+        .unwrap();
+        media.sort();
+        assert_eq!(
+            media,
+            [
+                ("a.jpg".into(), hash_file(&source.join("a.jpg")).unwrap()),
+                ("b.mp4".into(), hash_file(&source.join("b.mp4")).unwrap()),
+            ]
+        );
+
+        let mut sidecars = Vec::new();
+        lib.for_each_sidecar_file(|path, hash| {
+            assert!(path.starts_with(lib.root()));
+            sidecars.push((path.file_name().unwrap().to_os_string(), hash.to_string()));
+            Ok(())
+        })
+        .unwrap();
+        assert_eq!(sidecars, [("a.xmp".into(), hash_file(&source.join("a.xmp")).unwrap())]);
+
+        // An error from the callback stops the walk and is passed on
+        let mut calls = 0;
+        let stopped = lib.for_each_media_file(|_, _| {
+            calls += 1;
+            Err(PhotosortError::Library("enough".to_string()))
+        });
+        assert!(matches!(stopped, Err(PhotosortError::Library(_))));
+        assert_eq!(calls, 1);
+    }
+
+    #[test]
+    fn test_date_folders_per_granularity() {
+        let taken = time::macros::datetime!(2024-05-21 10:00 UTC);
+        for (granularity, folder, other) in [
+            (DateGranularity::Year, "2024", "2024/05"),
+            (DateGranularity::Month, "2024/05", "2024/05-21"),
+            (DateGranularity::Day, "2024/05-21", "2024"),
+        ] {
+            assert_eq!(date_folder(taken, granularity), folder);
+            let relpath = format!("images/{}", folder);
+            assert!(relpath_conforms(&relpath, "image", &[], granularity), "{}", relpath);
+            let relpath = format!("images/{}", other);
+            assert!(!relpath_conforms(&relpath, "image", &[], granularity), "{}", relpath);
+        }
+        assert!(!relpath_conforms("images/2024/13", "image", &[], DateGranularity::Month));
+        assert!(!relpath_conforms("images/24", "image", &[], DateGranularity::Year));
+    }
+
+    #[test]
+    fn test_import_sorts_by_library_granularity() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"photo").unwrap();
+
+        for granularity in [DateGranularity::Year, DateGranularity::Month, DateGranularity::Day] {
+            let options = CreateOptions {
+                granularity,
+                ..Default::default()
+            };
+            let lib_dir = temp_dir.path().join(granularity_name(granularity));
+            let mut lib = Library::create_with_options(&lib_dir, &options).unwrap();
+            lib.import(&source, &ImportOptions::default()).unwrap();
+
+            let lib = Library::open(&lib_dir).unwrap();
+            assert_eq!(lib.granularity().unwrap(), granularity);
+            let folders = lib.folders().unwrap();
+            assert_eq!(folders.len(), 1);
+            assert!(folders[0].conforms, "{}", folders[0].relpath);
+            let depth = folders[0].relpath.split('/').count();
+            assert_eq!(depth, if granularity == DateGranularity::Year { 2 } else { 3 });
+            assert!(lib_dir.join(&folders[0].relpath).join("a.jpg").exists());
+        }
+    }
+
+    #[test]
+    fn test_megapixels_in_range() {
+        let thumbnail = Some((320, 240));
+        let full = Some((6000, 4000));
+        let panorama = Some((40000, 8000));
+
+        let in_range = |d| megapixels_in_range(d, Some(2.0), Some(100.0));
+        assert!(!in_range(thumbnail));
+        assert!(in_range(full));
+        assert!(!in_range(panorama));
+        assert!(in_range(None));
+
+        assert!(megapixels_in_range(panorama, Some(2.0), None));
+        assert!(!megapixels_in_range(full, None, Some(20.0)));
+        assert!(megapixels_in_range(full, Some(24.0), Some(24.0)));
+    }
+
+    #[test]
+    fn test_strip_gps_from_copies() {
+        if !exiftool_available() {
+            eprintln!("skipping: exiftool not installed");
+            return;
+        }
+        let gps = |path: &Path| {
+            let output = std::process::Command::new("exiftool").args(["-s3", "-n", "-GPSLatitude"]).arg(path).output().unwrap();
+            String::from_utf8_lossy(&output.stdout).trim().to_string()
+        };
+
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        let photo = source.join("photo.jpg");
+        fs::copy(Path::new(env!("CARGO_MANIFEST_DIR")).join("tests/fixtures/_DSCE7023.JPG"), &photo).unwrap();
+        let tagged = std::process::Command::new("exiftool")
+            .args(["-overwrite_original", "-GPSLatitude=45.5", "-GPSLatitudeRef=N", "-GPSLongitude=122.5", "-GPSLongitudeRef=W"])
+            .arg(&photo)
+            .status()
+            .unwrap();
+        assert!(tagged.success());
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            strip: Some(StripMetadata::Gps),
+            ..Default::default()
+        };
+        lib.import(&source, &options).unwrap();
+
+        let copy = WalkDir::new(lib.root().join("images"))
+            .into_iter()
+            .filter_map(|e| e.ok())
+            .find(|e| e.file_name() == "photo.jpg")
+            .unwrap()
+            .into_path();
+        assert_eq!(gps(&copy), "");
+        assert_eq!(gps(&photo), "45.5");
+
+        let (gps_lat, hash, stored_hash): (f64, String, String) = lib
+            .database()
+            .connection_ref()
+            .query_row("SELECT gps_lat, hash, stored_hash FROM media", [], |row| {
+                Ok((row.get(0)?, row.get(1)?, row.get(2)?))
+            })
+            .unwrap();
+        assert_eq!(gps_lat, 45.5);
+        assert_eq!(hash, hash_file(&photo).unwrap());
+        assert_eq!(stored_hash, hash_file(&copy).unwrap());
+
+        // The stripped copy still verifies
+        let verified = crate::photosort_core::verify::verify(&lib, &Default::default()).unwrap();
+        assert!(verified.is_ok());
+    }
+
+    #[test]
+    fn test_missing_exiftool() {
+        assert!(check_exiftool(true, true).unwrap());
+        assert!(!check_exiftool(false, false).unwrap());
+        assert!(matches!(check_exiftool(false, true), Err(PhotosortError::Exiftool(_))));
+
+        // Files are still imported, dated by the filesystem
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"a").unwrap();
+        let ScannedFile::Candidate(candidate) =
+            process_source_file(&source.join("a.jpg"), None, &ImportOptions::default(), None, &[], HashEncoding::Base64).unwrap()
+        else {
+            panic!("expected a candidate");
+        };
+        assert_eq!(candidate.created_at, crate::photosort_core::exif::file_date(&source.join("a.jpg")));
+        assert!(candidate.exif.camera_model.is_none());
+    }
+
+    #[test]
+    fn test_date_conflict_between_identical_files() {
+        let taken = time::macros::datetime!(2024-05-21 10:00 UTC);
+        let a = candidate("a/IMG_1.jpg", taken);
+
+        // Seconds apart is the same moment as far as sorting goes
+        let close = candidate("b/IMG_1.jpg", taken + time::Duration::minutes(5));
+        assert!(date_conflict(&a, &close).is_none());
+
+        let edited = candidate("b/IMG_1.jpg", taken - time::Duration::days(400));
+        let conflict = date_conflict(&a, &edited).unwrap();
+        assert_eq!(conflict.first, PathBuf::from("a/IMG_1.jpg"));
+        assert_eq!(conflict.second, PathBuf::from("b/IMG_1.jpg"));
+        assert_eq!(conflict.second_date, taken - time::Duration::days(400));
+
+        let stats = ImportStats {
+            date_conflicts: vec![conflict],
+            ..Default::default()
+        };
+        let report = stats.report(false).render(&crate::photosort_core::cli::ReportFormat::Text);
+        assert!(report.contains("identical files with conflicting dates (1)"));
+        assert!(report.contains("a/IMG_1.jpg (2024:05:21"));
+    }
+
+    #[test]
+    fn test_report_duplicates() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(source.join("copy")).unwrap();
+        for path in ["a.jpg", "b.jpg", "copy/a.jpg"] {
+            fs::write(source.join(path), b"same photo").unwrap();
+        }
+        fs::write(source.join("c.jpg"), b"another photo").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            deterministic: true,
+            report_duplicates: true,
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.duplicates_skipped, 2);
+
+        let groups = stats.duplicates.as_ref().unwrap();
+        assert_eq!(groups.len(), 1);
+        let expected: Vec<PathBuf> = ["a.jpg", "b.jpg", "copy/a.jpg"].iter().map(|p| source.join(p)).collect();
+        assert_eq!(groups[0].copies, expected);
+        assert_eq!(groups[0].kept, vec![source.join("a.jpg")]);
+
+        let report = stats.report(false).render(&crate::photosort_core::cli::ReportFormat::Json);
+        let report: serde_json::Value = serde_json::from_str(&report).unwrap();
+        let outcomes: Vec<&str> = report["duplicates"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|row| row["outcome"].as_str().unwrap())
+            .collect();
+        assert_eq!(outcomes, ["kept", "skipped", "skipped"]);
+
+        // Left out of the report unless asked for
+        let stats = lib.import(&source, &ImportOptions::default()).unwrap();
+        assert!(stats.duplicates.is_none());
+    }
+
+    #[test]
+    fn test_duplicate_stats_count_savings() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(source.join("copy")).unwrap();
+        for path in ["a.jpg", "b.jpg", "copy/a.jpg"] {
+            fs::write(source.join(path), b"same photo").unwrap();
+        }
+        for path in ["d.jpg", "copy/d.jpg"] {
+            fs::write(source.join(path), b"third!").unwrap();
+        }
+        fs::write(source.join("c.jpg"), b"another photo").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            deterministic: true,
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.images_imported, 3);
+        assert_eq!(
+            stats.duplicate_stats,
+            DuplicateStats {
+                copies_left_out: 3,
+                originals: 2,
+                already_in_library: 0,
+                bytes_saved: 2 * 10 + 6,
+            }
+        );
+        let report = stats.report(false).render(&crate::photosort_core::cli::ReportFormat::Json);
+        let report: serde_json::Value = serde_json::from_str(&report).unwrap();
+        assert_eq!(report["duplicate_bytes_saved"], 26);
+
+        // Importing again copies nothing, saving every byte
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(
+            stats.duplicate_stats,
+            DuplicateStats {
+                copies_left_out: 0,
+                originals: 0,
+                already_in_library: 6,
+                bytes_saved: 3 * 10 + 2 * 6 + 13,
+            }
+        );
+    }
+
+    #[test]
+    fn test_archive_original_structure() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(source.join("Albums/Wedding")).unwrap();
+        fs::create_dir_all(source.join("Events/Trip 2019")).unwrap();
+        fs::write(source.join("Albums/Wedding/a.jpg"), b"a").unwrap();
+        fs::write(source.join("Events/Trip 2019/b.mp4"), b"b").unwrap();
+        fs::write(source.join("c.jpg"), b"c").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            archive_original_structure: true,
+            ..Default::default()
+        };
+        lib.import(&source, &options).unwrap();
+
+        let rows = query_values(
+            lib.database().connection_ref(),
+            "SELECT filename, original_path FROM media ORDER BY filename",
+        );
+        let text = |s: &str| rusqlite::types::Value::Text(s.to_string());
+        assert_eq!(
+            rows,
+            vec![
+                vec![text("a.jpg"), text("Albums/Wedding/a.jpg")],
+                vec![text("b.mp4"), text("Events/Trip 2019/b.mp4")],
+                vec![text("c.jpg"), text("c.jpg")],
+            ]
+        );
+
+        // Only recorded when asked for
+        fs::write(source.join("d.jpg"), b"d").unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+        let rows = query_values(lib.database().connection_ref(), "SELECT original_path FROM media WHERE filename = 'd.jpg'");
+        assert_eq!(rows, vec![vec![rusqlite::types::Value::Null]]);
+    }
+
+    #[test]
+    fn test_import_listed_files() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(source.join("picked")).unwrap();
+        fs::write(source.join("picked/a.jpg"), b"a").unwrap();
+        fs::write(source.join("picked/a.xmp"), b"<a/>").unwrap();
+        fs::write(source.join("b.jpg"), b"b").unwrap();
+        fs::write(source.join("c.jpg"), b"c").unwrap();
+
+        let list = format!(
+            "{}\r\n\n{}\n{}\n",
+            source.join("picked/a.jpg").display(),
+            source.join("c.jpg").display(),
+            source.join("gone.jpg").display()
+        );
+        let files = parse_file_list(&list);
+        assert_eq!(files.len(), 3);
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            files: Some(files),
+            ..Default::default()
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.images_imported, 2);
+        // Sidecars come along with a listed photo
+        assert_eq!(stats.sidecars_imported, 1);
+        assert_eq!(
+            stats.skipped_files.iter().map(|s| (s.path.clone(), s.reason)).collect::<Vec<_>>(),
+            vec![(source.join("gone.jpg"), SkipReason::NotFound)]
+        );
+
+        let names = query_values(lib.database().connection_ref(), "SELECT filename FROM media ORDER BY filename");
+        assert_eq!(
+            names,
+            vec![
+                vec![rusqlite::types::Value::Text("a.jpg".to_string())],
+                vec![rusqlite::types::Value::Text("c.jpg".to_string())],
+            ]
+        );
+    }
+
+    #[test]
+    fn test_parse_nul_file_list() {
+        let files = parse_nul_file_list(b"card/IMG_1.CR3\0card/line\nbreak.jpg\0\0 spaced .jpg\0");
+        assert_eq!(
+            files,
+            vec![
+                PathBuf::from("card/IMG_1.CR3"),
+                PathBuf::from("card/line\nbreak.jpg"),
+                PathBuf::from(" spaced .jpg"),
+            ]
+        );
+        // A list without a trailing NUL still ends with its last path
+        assert_eq!(parse_nul_file_list(b"a.jpg"), vec![PathBuf::from("a.jpg")]);
+        assert!(parse_nul_file_list(b"").is_empty());
+    }
+
+    #[test]
+    fn test_planned_layout_matches_import() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(source.join("card/DCIM")).unwrap();
+        fs::write(source.join("card/DCIM/IMG_1.jpg"), b"1").unwrap();
+        fs::write(source.join("card/DCIM/IMG_1.xmp"), b"<1/>").unwrap();
+        fs::write(source.join("card/DCIM/IMG_1.dng"), b"1 raw").unwrap();
+        fs::write(source.join("card/DCIM/copy.jpg"), b"1").unwrap();
+        fs::write(source.join("clip.mp4"), b"clip").unwrap();
+        fs::write(source.join("card/lonely.xmp"), b"<lonely/>").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        let options = ImportOptions {
+            dry_run: true,
+            plan_layout: true,
+            include_orphan_sidecars: true,
+            deterministic: true,
+            ..Default::default()
+        };
+        let planned = lib.import(&source, &options).unwrap().planned_layout.unwrap();
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+
+        // Copies are planned once, and a shared sidecar once per folder
+        let mut folders: Vec<(&str, Vec<&str>)> = planned
+            .iter()
+            .map(|(folder, files)| (folder.split('/').next().unwrap(), files.iter().map(String::as_str).collect()))
+            .collect();
+        folders.sort();
+        assert_eq!(
+            folders,
+            vec![
+                ("images", vec!["IMG_1.dng", "IMG_1.jpg", "IMG_1.xmp"]),
+                ("orphans", vec!["lonely.xmp"]),
+                ("videos", vec!["clip.mp4"]),
+            ]
+        );
+        assert!(planned.contains_key("orphans/card"));
+
+        // The import then puts everything exactly there
+        let options = ImportOptions {
+            include_orphan_sidecars: true,
+            deterministic: true,
+            ..Default::default()
+        };
+        lib.import(&source, &options).unwrap();
+        let rows = query_values(
+            lib.database().connection_ref(),
+            "SELECT relpath, filename FROM media UNION ALL
+             SELECT m.relpath, s.filename FROM sidecars s JOIN media m ON m.id = s.media_id",
+        );
+        let mut imported: BTreeMap<String, Vec<String>> = BTreeMap::new();
+        for row in rows {
+            let (rusqlite::types::Value::Text(relpath), rusqlite::types::Value::Text(filename)) = (&row[0], &row[1]) else {
+                panic!("expected text");
+            };
+            imported.entry(relpath.clone()).or_default().push(filename.clone());
+        }
+        for files in imported.values_mut() {
+            files.sort();
+            files.dedup();
+        }
+        imported.insert("orphans/card".to_string(), vec!["lonely.xmp".to_string()]);
+        assert_eq!(planned, imported);
+        assert!(lib.root().join("orphans/card/lonely.xmp").is_file());
+    }
+
+    #[test]
+    fn test_name_collisions() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = Library::create(temp_dir.path()).unwrap();
+        let conn = lib.database().connection_ref();
+        for (hash, relpath, filename) in [
+            ("h1", "images/2024/05-21", "IMG_0001.jpg"),
+            ("h2", "images/2025/01-02", "IMG_0001.jpg"),
+            ("h3", "images/2024/05-21", "IMG_0002.jpg"),
+            ("h4", "images/2024/05-21", "IMG_0002.jpg"),
+            ("h5", "images/2024/05-21", "IMG_0003.jpg"),
+        ] {
+            conn.execute(
+                "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+                 VALUES (?1, ?2, ?3, 'image', 'JPG', 1, '', '')",
+                params![hash, filename, relpath],
+            )
+            .unwrap();
+        }
+
+        let collisions = lib.name_collisions().unwrap();
+        let names: Vec<&str> = collisions.iter().map(|c| c.filename.as_str()).collect();
+        assert_eq!(names, ["IMG_0001.jpg", "IMG_0002.jpg"]);
+        assert_eq!(
+            collisions[0].copies,
+            vec![
+                ("images/2024/05-21".to_string(), "h1".to_string()),
+                ("images/2025/01-02".to_string(), "h2".to_string()),
+            ]
+        );
+        assert!(!collisions[0].repeats_in("images/2024/05-21"));
+        assert!(collisions[1].repeats_in("images/2024/05-21"));
+    }
+
+    #[test]
+    fn test_merger_ignores_arrival_order() {
+        let taken = time::macros::datetime!(2024-05-21 10:00 UTC);
+        let files = || {
+            let mut edited = candidate("b/IMG_1.jpg", taken);
+            edited.sidecars.push(SidecarCandidate {
+                source_path: PathBuf::from("b/IMG_1.xmp"),
+                filename: "IMG_1.xmp".to_string(),
+                filetype: "xmp".to_string(),
+                file_size: 1,
+                hash: "xmp".to_string(),
+                modified_at: taken,
+            });
+            vec![candidate("a/IMG_1.jpg", taken), edited, candidate("c/IMG_1.jpg", taken)]
+        };
+
+        let merge = |order: Vec<usize>| {
+            let mut files: Vec<Option<ImportCandidate>> = files().into_iter().map(Some).collect();
+            let mut merger = CandidateMerger::default();
+            for i in order {
+                merger.add(i, files[i].take().unwrap());
+            }
+            (merger.duplicates_skipped, merger.into_candidates())
+        };
+
+        for order in [vec![0, 1, 2], vec![2, 1, 0], vec![1, 2, 0]] {
+            let (skipped, kept) = merge(order);
+            assert_eq!(skipped, 2);
+            assert_eq!(kept.len(), 1);
+            // The first file in the source wins and picks up the other copy's sidecar
+            assert_eq!(kept[0].source_path, PathBuf::from("a/IMG_1.jpg"));
+            assert_eq!(kept[0].sidecars[0].source_path, PathBuf::from("b/IMG_1.xmp"));
+        }
+    }
+
+    #[test]
+    fn test_scan_memory_follows_unique_media() {
+        // The workers block once a handful of results are waiting
+        let (sender, _receiver) = scan_channel::<usize>();
+        let queued = (0..100_000).take_while(|i| sender.try_send(*i).is_ok()).count();
+        assert_eq!(queued, rayon::current_num_threads() * 4);
+
+        // Ten thousand files of a hundred photos leave a hundred candidates held
+        let taken = time::macros::datetime!(2024-05-21 10:00 UTC);
+        let mut merger = CandidateMerger::default();
+        for i in 0..10_000 {
+            let mut file = candidate(&format!("{}/IMG_{}.jpg", i / 100, i % 100), taken);
+            file.hash = format!("photo {}", i % 100);
+            merger.add(i, file);
+        }
+        assert_eq!(merger.unique.len(), 100);
+        assert!(merger.conflicts.is_empty());
+        assert_eq!(merger.duplicates_skipped, 9_900);
+    }
+
+    #[test]
+    fn test_deterministic_imports_match() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        for dir in ["a", "b", "c"] {
+            fs::create_dir_all(source.join(dir)).unwrap();
+            fs::write(source.join(dir).join("IMG_1.jpg"), b"same photo").unwrap();
+        }
+        // Two copies with different edits, and one without
+        fs::write(source.join("b/IMG_1.xmp"), b"edit b").unwrap();
+        fs::write(source.join("c/IMG_1.xmp"), b"edit c").unwrap();
+        fs::write(source.join("a/IMG_2.jpg"), b"other photo").unwrap();
+        fs::write(source.join("a/IMG_2.xmp"), b"edit").unwrap();
+        fs::write(source.join("c/VID_1.mp4"), b"video").unwrap();
+
+        let options = ImportOptions {
+            deterministic: true,
+            ..Default::default()
+        };
+        let rows = |name: &str| {
+            let mut lib = Library::create(&temp_dir.path().join(name)).unwrap();
+            lib.import(&source, &options).unwrap();
+            let media = query_values(
+                lib.database().connection_ref(),
+                "SELECT hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at
+                 FROM media ORDER BY id",
+            );
+            let sidecars = query_values(
+                lib.database().connection_ref(),
+                "SELECT m.hash, s.filename, s.filetype, s.file_size, s.hash, s.modified_at
+                 FROM sidecars s JOIN media m ON m.id = s.media_id ORDER BY s.id",
+            );
+            (media, sidecars)
+        };
+
+        let (media, sidecars) = rows("first");
+        assert_eq!(media.len(), 3);
+        assert_eq!(sidecars.len(), 2);
+        assert_eq!(rows("second"), (media, sidecars.clone()));
+        // The first copy in name order picked up the edits of the second
+        let edit_b = rusqlite::types::Value::Text(hash_file(&source.join("b/IMG_1.xmp")).unwrap());
+        assert!(sidecars.iter().any(|s| s[4] == edit_b));
+    }
+
+    #[test]
+    fn test_duplicate_sidecar_conflict_policies() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        // The copy found second has the more recent edit
+        for (dir, edit, edited) in [
+            ("a", b"old edit", time::macros::datetime!(2024-01-01 00:00:00 UTC)),
+            ("b", b"new edit", time::macros::datetime!(2024-06-01 00:00:00 UTC)),
+        ] {
+            fs::create_dir_all(source.join(dir)).unwrap();
+            fs::write(source.join(dir).join("IMG_1.jpg"), b"same photo").unwrap();
+            fs::write(source.join(dir).join("IMG_1.xmp"), edit).unwrap();
+            fs::File::options()
+                .write(true)
+                .open(source.join(dir).join("IMG_1.xmp"))
+                .unwrap()
+                .set_modified(edited.into())
+                .unwrap();
+        }
+        let old_edit = hash_file(&source.join("a/IMG_1.xmp")).unwrap();
+        let new_edit = hash_file(&source.join("b/IMG_1.xmp")).unwrap();
+
+        let sidecars = |policy: SidecarConflictPolicy| {
+            let lib_dir = temp_dir.path().join(format!("{:?}", policy));
+            let mut lib = Library::create(&lib_dir).unwrap();
+            let options = ImportOptions {
+                deterministic: true,
+                on_sidecar_conflict: Some(policy),
+                ..Default::default()
+            };
+            lib.import(&source, &options).unwrap();
+            assert_eq!(lib.database().media_count().unwrap(), 1);
+            let mut stmt = lib.database().connection_ref()
+                .prepare("SELECT m.relpath, s.filename, s.hash FROM sidecars s JOIN media m ON m.id = s.media_id ORDER BY s.id")
+                .unwrap();
+            stmt.query_map([], |row| Ok((row.get::<_, String>(0)?, row.get::<_, String>(1)?, row.get::<_, String>(2)?)))
+                .unwrap()
+                .map(|row| {
+                    let (relpath, filename, hash) = row.unwrap();
+                    assert!(lib.file_path(&relpath, &filename).is_file());
+                    (filename, hash)
+                })
+                .collect::<Vec<_>>()
+        };
+
+        let kept = |hash: &str| vec![("IMG_1.xmp".to_string(), hash.to_string())];
+        assert_eq!(sidecars(SidecarConflictPolicy::KeepOld), kept(&old_edit));
+        assert_eq!(sidecars(SidecarConflictPolicy::KeepNew), kept(&new_edit));
+        assert_eq!(sidecars(SidecarConflictPolicy::KeepNewer), kept(&new_edit));
+        let suffixed = format!("IMG_1_{}.xmp", &collision_suffix(&new_edit)[..DEFAULT_COLLISION_SUFFIX_LEN]);
+        assert_eq!(
+            sidecars(SidecarConflictPolicy::KeepBoth),
+            vec![("IMG_1.xmp".to_string(), old_edit.clone()), (suffixed, new_edit.clone())]
+        );
+    }
+
+    #[test]
+    fn test_verify_source_catches_tampered_file() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("IMG_1.jpg"), b"first photo").unwrap();
+        fs::write(source.join("IMG_1.xmp"), b"edit").unwrap();
+        fs::write(source.join("IMG_2.jpg"), b"second photo").unwrap();
+
+        // Checksums taken before the transfer, as sha256sum writes them
+        let hex = |path: &Path| {
+            let hash = general_purpose::STANDARD.decode(hash_file(path).unwrap()).unwrap();
+            hash.iter().map(|b| format!("{:02x}", b)).collect::<String>()
+        };
+        let manifest = source.join("SHA256SUMS");
+        let lines: String = ["IMG_1.jpg", "IMG_1.xmp", "IMG_2.jpg"]
+            .iter()
+            .map(|f| format!("{}  {}\n", hex(&source.join(f)), f))
+            .collect();
+        fs::write(&manifest, lines).unwrap();
+        fs::write(source.join("IMG_2.jpg"), b"second photo, corrupted").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("library")).unwrap();
+        let options = ImportOptions {
+            verify_source: Some(manifest),
+            ..Default::default()
+        };
+        let err = lib.import(&source, &options).unwrap_err();
+        assert!(matches!(err, PhotosortError::SourceMismatch { problems: 1, ref first } if *first == source.join("IMG_2.jpg")));
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+
+        let options = ImportOptions {
+            on_source_mismatch: SourceMismatchPolicy::Skip,
+            ..options
+        };
+        let stats = lib.import(&source, &options).unwrap();
+        assert_eq!(stats.images_imported, 1);
+        assert_eq!(stats.sidecars_imported, 1);
+        assert_eq!(stats.skipped_files.len(), 1);
+        assert_eq!(stats.skipped_files[0].reason, SkipReason::SourceMismatch);
+    }
+
+    #[test]
+    fn test_route_by_type() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("IMG_1.NEF"), b"raw one").unwrap();
+        fs::write(source.join("IMG_1.JPG"), b"jpeg one").unwrap();
+        fs::write(source.join("IMG_2.dng"), b"raw two").unwrap();
+        fs::write(source.join("IMG_3.jpeg"), b"jpeg three").unwrap();
+        fs::write(source.join("IMG_4.png"), b"png four").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("library")).unwrap();
+        let options = ImportOptions {
+            type_routes: vec![("RAW".to_string(), "raw".to_string()), ("JPG".to_string(), "jpg".to_string())],
+            ..Default::default()
+        };
+        lib.import(&source, &options).unwrap();
+
+        let folder_of = |lib: &Library, filename: &str| -> String {
+            let relpath: String = lib
+                .database()
+                .connection_ref()
+                .query_row("SELECT relpath FROM media WHERE filename = ?1", [filename], |row| row.get(0))
+                .unwrap();
+            assert!(lib.root().join(&relpath).join(filename).is_file());
+            relpath.split('/').next().unwrap().to_string()
+        };
+        assert_eq!(folder_of(&lib, "IMG_1.NEF"), "raw");
+        assert_eq!(folder_of(&lib, "IMG_2.dng"), "raw");
+        assert_eq!(folder_of(&lib, "IMG_1.JPG"), "jpg");
+        assert_eq!(folder_of(&lib, "IMG_3.jpeg"), "jpg");
+        assert_eq!(folder_of(&lib, "IMG_4.png"), "images");
+
+        // Later imports keep the routes without being told again
+        fs::write(source.join("IMG_5.CR2"), b"raw five").unwrap();
+        let mut lib = Library::open(lib.root()).unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+        assert_eq!(folder_of(&lib, "IMG_5.CR2"), "raw");
+        assert!(lib.folders().unwrap().iter().all(|f| f.conforms));
+    }
+
+    fn query_values(conn: &rusqlite::Connection, sql: &str) -> Vec<Vec<rusqlite::types::Value>> {
+        let mut stmt = conn.prepare(sql).unwrap();
+        let columns = stmt.column_count();
+        stmt.query_map([], |row| (0..columns).map(|i| row.get(i)).collect())
+            .unwrap()
+            .collect::<rusqlite::Result<_>>()
+            .unwrap()
+    }
+
+    /// A library holding `a.jpg` on disk with the given content, but not in the database.
+    fn library_with_untracked_file(temp_dir: &TempDir, content: &[u8]) -> (Library, PathBuf) {
+        let source = temp_dir.path().join("first");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), content).unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+        lib.database().connection_ref().execute("DELETE FROM media", []).unwrap();
+
+        let dest = WalkDir::new(lib.root().join("images"))
+            .into_iter()
+            .filter_map(|e| e.ok())
+            .find(|e| e.file_name() == "a.jpg")
+            .unwrap()
+            .into_path();
+        (lib, dest)
+    }
+
+    fn import_a_jpg(temp_dir: &TempDir, lib: &mut Library, content: &[u8], policy: DestExistsPolicy) -> ImportStats {
+        let source = temp_dir.path().join("second");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), content).unwrap();
+        let options = ImportOptions {
+            dest_exists: policy,
+            ..Default::default()
+        };
+        lib.import(&source, &options).unwrap()
+    }
+
+    #[test]
+    fn test_dest_exists_overwrite() {
+        let temp_dir = TempDir::new().unwrap();
+        let (mut lib, dest) = library_with_untracked_file(&temp_dir, b"old");
+
+        let stats = import_a_jpg(&temp_dir, &mut lib, b"new", DestExistsPolicy::Overwrite);
+        assert_eq!(stats.images_imported, 1);
+        assert_eq!(fs::read(&dest).unwrap(), b"new");
+
+        // The overwritten file waits in the trash, and undo puts it back
+        let trashed: Vec<_> = WalkDir::new(lib.root().join(crate::photosort_core::trash::TRASH_DIR))
+            .into_iter()
+            .filter_map(|e| e.ok())
+            .filter(|e| e.file_type().is_file())
+            .collect();
+        assert_eq!(trashed.len(), 1);
+        assert_eq!(fs::read(trashed[0].path()).unwrap(), b"old");
+
+        journal::undo_last(&mut lib).unwrap().unwrap();
+        assert_eq!(fs::read(&dest).unwrap(), b"old");
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+    }
+
+    #[test]
+    fn test_dest_exists_skip_matching() {
+        let temp_dir = TempDir::new().unwrap();
+        let (mut lib, dest) = library_with_untracked_file(&temp_dir, b"same");
+
+        let stats = import_a_jpg(&temp_dir, &mut lib, b"same", DestExistsPolicy::Skip);
+        assert_eq!(stats.images_imported, 1);
+        assert!(stats.skipped_files.is_empty());
+        assert_eq!(fs::read(&dest).unwrap(), b"same");
+    }
+
+    #[test]
+    fn test_dest_exists_skip_mismatching() {
+        let temp_dir = TempDir::new().unwrap();
+        let (mut lib, dest) = library_with_untracked_file(&temp_dir, b"old");
+
+        let stats = import_a_jpg(&temp_dir, &mut lib, b"new", DestExistsPolicy::Skip);
+        assert_eq!(stats.images_imported, 0);
+        assert_eq!(stats.skipped_files.len(), 1);
+        assert_eq!(stats.skipped_files[0].reason, SkipReason::DestinationExists);
+        assert_eq!(fs::read(&dest).unwrap(), b"old");
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+    }
+
+    #[test]
+    fn test_dest_exists_rename() {
+        let temp_dir = TempDir::new().unwrap();
+        let (mut lib, dest) = library_with_untracked_file(&temp_dir, b"old");
+
+        let stats = import_a_jpg(&temp_dir, &mut lib, b"new", DestExistsPolicy::Rename);
+        assert_eq!(stats.images_imported, 1);
+        assert_eq!(fs::read(&dest).unwrap(), b"old");
+        let hash = hash_file(&temp_dir.path().join("second/a.jpg")).unwrap();
+        let renamed = format!("a_{}.jpg", &collision_suffix(&hash)[..DEFAULT_COLLISION_SUFFIX_LEN]);
+        assert_eq!(fs::read(dest.with_file_name(&renamed)).unwrap(), b"new");
+
+        let filename: String = lib.database().connection_ref()
+            .query_row("SELECT filename FROM media", [], |row| row.get(0))
+            .unwrap();
+        assert_eq!(filename, renamed);
+    }
+
+    #[test]
+    fn test_collision_names_are_stable() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        // Three different photos named alike from one day land in one folder
+        let taken = time::macros::datetime!(2024-05-21 12:00:00 UTC);
+        for (dir, content) in [("a", b"one"), ("b", b"two"), ("c", b"six")] {
+            fs::create_dir_all(source.join(dir)).unwrap();
+            fs::write(source.join(dir).join("IMG_1.jpg"), content).unwrap();
+            fs::File::options()
+                .write(true)
+                .open(source.join(dir).join("IMG_1.jpg"))
+                .unwrap()
+                .set_modified(taken.into())
+                .unwrap();
+        }
+
+        let names = |lib_name: &str| {
+            let mut lib = Library::create(&temp_dir.path().join(lib_name)).unwrap();
+            let options = ImportOptions {
+                dest_exists: DestExistsPolicy::Rename,
+                collision_suffix_len: Some(4),
+                ..Default::default()
+            };
+            lib.import(&source, &options).unwrap();
+            let mut stmt = lib.database().connection_ref()
+                .prepare("SELECT hash, filename FROM media ORDER BY hash")
+                .unwrap();
+            stmt.query_map([], |row| Ok((row.get::<_, String>(0)?, row.get::<_, String>(1)?)))
+                .unwrap()
+                .collect::<rusqlite::Result<Vec<_>>>()
+                .unwrap()
+        };
+
+        let first = names("first");
+        assert_eq!(first, names("second"));
+        assert_eq!(first[0].1, "IMG_1.jpg");
+        for (hash, filename) in &first[1..] {
+            assert_eq!(filename, &format!("IMG_1_{}.jpg", &collision_suffix(hash)[..4]));
+        }
     }
 }
@@ -0,0 +1,91 @@
+use crate::photosort_core::cli::OutputFormat;
+use crate::photosort_core::import::short_hash;
+use serde::Serialize;
+
+/// What an import would make of one media file in a source folder.
+#[derive(Debug, Clone, Serialize)]
+pub struct SourceFile {
+    /// Path relative to the source folder, with forward slashes.
+    pub path: String,
+    pub media_type: String,
+    pub filetype: String,
+    pub file_size: u64,
+    pub hash: String,
+    /// The date the file would be sorted by, in the database's format.
+    pub date: String,
+    /// Library folder the file would be stored in, e.g. "images/2024/05-21".
+    pub folder: String,
+    pub camera_model: Option<String>,
+    pub width: Option<u32>,
+    pub height: Option<u32>,
+    /// Sidecars (and previews) that would come along, relative to the source folder.
+    pub sidecars: Vec<String>,
+}
+
+/// Format inspected files for output. Tables show the first `hash_len`
+/// characters of each hash (all of it for 0), with each file's sidecars below it.
+pub fn format_source_files(files: &[SourceFile], format: &OutputFormat, hash_len: usize) -> String {
+    match format {
+        OutputFormat::Paths => files.iter().map(|f| f.path.as_str()).collect::<Vec<_>>().join("\n"),
+        OutputFormat::Json => serde_json::to_string_pretty(files).unwrap_or_else(|_| "[]".to_string()),
+        OutputFormat::Table => {
+            let hash_width = files
+                .iter()
+                .map(|f| short_hash(&f.hash, hash_len).len())
+                .max()
+                .unwrap_or(0)
+                .max("Hash".len());
+            let mut output = String::new();
+            output.push_str(&format!(
+                "{:<hash_width$} {:<19} {:>6} {:<20} {}\n",
+                "Hash", "Date", "Type", "Folder", "Path"
+            ));
+            output.push_str(&format!("{}\n", "─".repeat(hash_width + 60)));
+            for f in files {
+                output.push_str(&format!(
+                    "{:<hash_width$} {:<19} {:>6} {:<20} {}\n",
+                    short_hash(&f.hash, hash_len),
+                    // Just YYYY:MM:DD HH:MM:SS
+                    f.date.get(..19).unwrap_or(&f.date),
+                    f.filetype,
+                    f.folder,
+                    f.path
+                ));
+                for sidecar in &f.sidecars {
+                    output.push_str(&format!("{:>width$}+ {}\n", "", sidecar, width = hash_width + 49));
+                }
+            }
+            output.push_str(&format!("\nTotal: {} files", files.len()));
+            output
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_format_source_files_table() {
+        let files = vec![SourceFile {
+            path: "card/IMG_1.jpg".to_string(),
+            media_type: "image".to_string(),
+            filetype: "JPG".to_string(),
+            file_size: 4,
+            hash: "q8Fz0123456789".to_string(),
+            date: "2024:05:21 12:00:00.0+00:00".to_string(),
+            folder: "images/2024/05-21".to_string(),
+            camera_model: None,
+            width: None,
+            height: None,
+            sidecars: vec!["card/IMG_1.xmp".to_string()],
+        }];
+
+        let table = format_source_files(&files, &OutputFormat::Table, 4);
+        let lines: Vec<&str> = table.lines().collect();
+        assert!(lines[2].starts_with("q8Fz 2024:05:21 12:00:00    JPG images/2024/05-21"));
+        assert!(lines[2].ends_with("card/IMG_1.jpg"));
+        assert!(lines[3].trim_start().starts_with("+ card/IMG_1.xmp"));
+        assert_eq!(format_source_files(&files, &OutputFormat::Paths, 4), "card/IMG_1.jpg");
+    }
+}
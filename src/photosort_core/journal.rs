@@ -0,0 +1,436 @@
+use crate::photosort_core::error::Result;
+use crate::photosort_core::import::{parse_hash_encoding, reencode_hashes, Library, DB_DATE_FORMAT};
+use crate::photosort_core::objects::move_in_library;
+use rusqlite::types::Value;
+use rusqlite::{params, Connection, OptionalExtension};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::Path;
+use time::OffsetDateTime;
+
+/// A reversible change recorded as part of a mutating operation.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(tag = "action", rename_all = "snake_case")]
+pub enum JournalEntry {
+    /// A file was created in the library (path relative to the root).
+    FileAdded { path: String },
+    /// A library file was moved into the trash (both paths relative to the root).
+    FileTrashed { path: String, trashed: String },
+    /// A library file was moved or renamed (both paths relative to the root).
+    FileMoved { from: String, to: String },
+    /// A media row was inserted.
+    MediaInserted { hash: String },
+    /// A media row was deleted, along with the sidecar rows that cascaded with it.
+    MediaDeleted { media: RowSnapshot, sidecars: Vec<RowSnapshot> },
+    /// A media row was pointed at a new location.
+    MediaMoved { id: i64, relpath: String, filename: String },
+    /// A media row's metadata was rewritten; this is the row as it was.
+    MediaUpdated { media: RowSnapshot },
+    /// A sidecar row was deleted.
+    SidecarDeleted { sidecar: RowSnapshot },
+    /// A sidecar row's hash was updated.
+    SidecarUpdated { id: i64, hash: String, modified_at: String },
+    /// A sidecar row was moved to a different media row.
+    SidecarReassigned { id: i64, media_id: i64 },
+    /// A sidecar row was inserted for a file already in the library.
+    SidecarInserted { id: i64 },
+    /// A sidecar row was given a new filename.
+    SidecarRenamed { id: i64, filename: String },
+    /// Every stored hash was rewritten from this encoding.
+    HashesConverted { from: String },
+}
+
+/// A full copy of a database row, column name to value.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RowSnapshot {
+    pub table: String,
+    pub values: serde_json::Map<String, serde_json::Value>,
+}
+
+/// A recorded operation.
+#[derive(Debug)]
+pub struct Operation {
+    pub id: i64,
+    pub kind: String,
+    pub started_at: String,
+    pub entries: Vec<JournalEntry>,
+}
+
+/// Outcome of undoing an operation.
+#[derive(Debug)]
+pub struct UndoResult {
+    pub kind: String,
+    pub started_at: String,
+    pub rows_reverted: usize,
+    pub files_removed: usize,
+    pub files_restored: usize,
+}
+
+/// Start recording a new operation. Returns its ID.
+pub fn start(conn: &Connection, kind: &str) -> Result<i64> {
+    let now = OffsetDateTime::now_local().unwrap_or_else(|_| OffsetDateTime::now_utc());
+    conn.execute(
+        "INSERT INTO operations (kind, started_at) VALUES (?1, ?2)",
+        params![kind, now.format(DB_DATE_FORMAT).unwrap()],
+    )?;
+    Ok(conn.last_insert_rowid())
+}
+
+/// Record one change as part of an operation.
+pub fn record(conn: &Connection, op_id: i64, entry: &JournalEntry) -> Result<()> {
+    let json = serde_json::to_string(entry).expect("journal entries always serialize");
+    // Operations record an entry per row, so the statement is prepared once
+    conn.prepare_cached("INSERT INTO operation_entries (operation_id, entry) VALUES (?1, ?2)")?
+        .execute(params![op_id, json])?;
+    Ok(())
+}
+
+/// Finish an operation, dropping it if nothing was recorded so it
+/// does not hide the previous operation from `undo`.
+pub fn finish(conn: &Connection, op_id: i64) -> Result<()> {
+    conn.execute(
+        "DELETE FROM operations
+         WHERE id = ?1 AND NOT EXISTS (SELECT 1 FROM operation_entries WHERE operation_id = ?1)",
+        params![op_id],
+    )?;
+    Ok(())
+}
+
+/// Copy a row so it can be restored later.
+pub fn snapshot_row(conn: &Connection, table: &str, id: i64) -> Result<Option<RowSnapshot>> {
+    let mut stmt = conn.prepare(&format!("SELECT * FROM {} WHERE id = ?1", table))?;
+    let columns: Vec<String> = stmt.column_names().iter().map(|c| c.to_string()).collect();
+
+    let values = stmt
+        .query_row(params![id], |row| {
+            let mut values = serde_json::Map::new();
+            for (i, column) in columns.iter().enumerate() {
+                values.insert(column.clone(), sql_to_json(row.get::<_, Value>(i)?));
+            }
+            Ok(values)
+        })
+        .optional()?;
+
+    Ok(values.map(|values| RowSnapshot {
+        table: table.to_string(),
+        values,
+    }))
+}
+
+/// Delete a media row (and its sidecar rows), recording it for undo.
+pub fn delete_media(conn: &Connection, op_id: i64, id: i64) -> Result<usize> {
+    let Some(media) = snapshot_row(conn, "media", id)? else {
+        return Ok(0);
+    };
+
+    let sidecar_ids = conn
+        .prepare("SELECT id FROM sidecars WHERE media_id = ?1")?
+        .query_map(params![id], |row| row.get::<_, i64>(0))?
+        .collect::<rusqlite::Result<Vec<_>>>()?;
+    let mut sidecars = Vec::new();
+    for sidecar_id in sidecar_ids {
+        sidecars.extend(snapshot_row(conn, "sidecars", sidecar_id)?);
+    }
+
+    record(conn, op_id, &JournalEntry::MediaDeleted { media, sidecars })?;
+    Ok(conn.execute("DELETE FROM media WHERE id = ?1", params![id])?)
+}
+
+/// Delete a sidecar row, recording it for undo.
+pub fn delete_sidecar(conn: &Connection, op_id: i64, id: i64) -> Result<usize> {
+    let Some(sidecar) = snapshot_row(conn, "sidecars", id)? else {
+        return Ok(0);
+    };
+
+    record(conn, op_id, &JournalEntry::SidecarDeleted { sidecar })?;
+    Ok(conn.execute("DELETE FROM sidecars WHERE id = ?1", params![id])?)
+}
+
+/// Get the most recent operation that has not been undone.
+pub fn last_operation(conn: &Connection) -> Result<Option<Operation>> {
+    let op = conn
+        .query_row(
+            "SELECT id, kind, started_at FROM operations
+             WHERE undone_at IS NULL
+             ORDER BY id DESC
+             LIMIT 1",
+            [],
+            |row| Ok((row.get::<_, i64>(0)?, row.get::<_, String>(1)?, row.get::<_, String>(2)?)),
+        )
+        .optional()?;
+
+    let Some((id, kind, started_at)) = op else {
+        return Ok(None);
+    };
+
+    let mut stmt = conn.prepare(
+        "SELECT entry FROM operation_entries WHERE operation_id = ?1 ORDER BY id",
+    )?;
+    let rows = stmt.query_map(params![id], |row| row.get::<_, String>(0))?;
+
+    let mut entries = Vec::new();
+    for row in rows {
+        match serde_json::from_str(&row?) {
+            Ok(entry) => entries.push(entry),
+            Err(e) => log::warn!("Skipping unreadable journal entry in operation {}: {}", id, e),
+        }
+    }
+
+    Ok(Some(Operation {
+        id,
+        kind,
+        started_at,
+        entries,
+    }))
+}
+
+/// Revert the most recent operation. Returns `None` if there is nothing to undo.
+pub fn undo_last(lib: &mut Library) -> Result<Option<UndoResult>> {
+    let root = lib.root().to_path_buf();
+    let conn = lib.database_mut().connection();
+
+    let Some(op) = last_operation(conn)? else {
+        return Ok(None);
+    };
+
+    // Database changes are reverted atomically, newest first
+    let tx = conn.transaction()?;
+    let mut rows_reverted = 0;
+    let mut files_to_remove = Vec::new();
+    let mut files_to_restore = Vec::new();
+
+    for entry in op.entries.iter().rev() {
+        match entry {
+            JournalEntry::FileAdded { path } => files_to_remove.push(root.join(path)),
+            JournalEntry::FileTrashed { path, trashed } => {
+                files_to_restore.push((root.join(trashed), root.join(path)));
+            }
+            JournalEntry::FileMoved { from, to } => files_to_restore.push((root.join(to), root.join(from))),
+            JournalEntry::MediaInserted { hash } => {
+                rows_reverted += tx.execute("DELETE FROM media WHERE hash = ?1", params![hash])?;
+            }
+            JournalEntry::MediaDeleted { media, sidecars } => {
+                restore_row(&tx, media)?;
+                for sidecar in sidecars {
+                    restore_row(&tx, sidecar)?;
+                }
+                rows_reverted += 1;
+            }
+            JournalEntry::MediaMoved { id, relpath, filename } => {
+                rows_reverted += tx.execute(
+                    "UPDATE media SET relpath = ?1, filename = ?2 WHERE id = ?3",
+                    params![relpath, filename, id],
+                )?;
+            }
+            JournalEntry::MediaUpdated { media } => {
+                rows_reverted += update_row(&tx, media)?;
+            }
+            JournalEntry::SidecarDeleted { sidecar } => {
+                restore_row(&tx, sidecar)?;
+                rows_reverted += 1;
+            }
+            JournalEntry::SidecarUpdated { id, hash, modified_at } => {
+                rows_reverted += tx.execute(
+                    "UPDATE sidecars SET hash = ?1, modified_at = ?2 WHERE id = ?3",
+                    params![hash, modified_at, id],
+                )?;
+            }
+            JournalEntry::SidecarReassigned { id, media_id } => {
+                rows_reverted += tx.execute(
+                    "UPDATE sidecars SET media_id = ?1 WHERE id = ?2",
+                    params![media_id, id],
+                )?;
+            }
+            JournalEntry::SidecarInserted { id } => {
+                rows_reverted += tx.execute("DELETE FROM sidecars WHERE id = ?1", params![id])?;
+            }
+            JournalEntry::SidecarRenamed { id, filename } => {
+                rows_reverted += tx.execute(
+                    "UPDATE sidecars SET filename = ?1 WHERE id = ?2",
+                    params![filename, id],
+                )?;
+            }
+            JournalEntry::HashesConverted { from } => {
+                rows_reverted += reencode_hashes(&tx, parse_hash_encoding(Some(from))?)?;
+            }
+        }
+    }
+
+    let now = OffsetDateTime::now_local().unwrap_or_else(|_| OffsetDateTime::now_utc());
+    tx.execute(
+        "UPDATE operations SET undone_at = ?1 WHERE id = ?2",
+        params![now.format(DB_DATE_FORMAT).unwrap(), op.id],
+    )?;
+    tx.commit()?;
+
+    // Files go only after the database no longer references them
+    let mut files_removed = 0;
+    for path in &files_to_remove {
+        match fs::remove_file(path) {
+            Ok(()) => {
+                files_removed += 1;
+                remove_empty_parents(&root, path);
+            }
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => {}
+            Err(e) => log::warn!("Failed to remove {}: {}", path.display(), e),
+        }
+    }
+
+    let mut files_restored = 0;
+    // Trashed and moved files go back where they were
+    for (trashed, original) in &files_to_restore {
+        match move_in_library(&root, trashed, original) {
+            Ok(()) => {
+                files_restored += 1;
+                remove_empty_parents(&root, trashed);
+            }
+            Err(e) => log::warn!("Failed to restore {} from {}: {}", original.display(), trashed.display(), e),
+        }
+    }
+
+    Ok(Some(UndoResult {
+        kind: op.kind,
+        started_at: op.started_at,
+        rows_reverted,
+        files_removed,
+        files_restored,
+    }))
+}
+
+/// Re-insert a snapshotted row with its original ID.
+fn restore_row(conn: &Connection, snapshot: &RowSnapshot) -> Result<()> {
+    let columns: Vec<&str> = snapshot.values.keys().map(|k| k.as_str()).collect();
+    let placeholders: Vec<&str> = columns.iter().map(|_| "?").collect();
+    let sql = format!(
+        "INSERT OR REPLACE INTO {} ({}) VALUES ({})",
+        snapshot.table,
+        columns.join(", "),
+        placeholders.join(", ")
+    );
+
+    let values: Vec<Value> = snapshot.values.values().map(json_to_sql).collect();
+    conn.execute(&sql, rusqlite::params_from_iter(values))?;
+    Ok(())
+}
+
+/// Put a snapshotted row's values back in place, leaving rows that refer to it alone.
+fn update_row(conn: &Connection, snapshot: &RowSnapshot) -> Result<usize> {
+    let Some(id) = snapshot.values.get("id").and_then(|id| id.as_i64()) else {
+        return Ok(0);
+    };
+    let columns: Vec<String> = snapshot.values.keys().filter(|k| *k != "id").map(|k| format!("{} = ?", k)).collect();
+    let sql = format!("UPDATE {} SET {} WHERE id = ?", snapshot.table, columns.join(", "));
+
+    let mut values: Vec<Value> =
+        snapshot.values.iter().filter(|(k, _)| *k != "id").map(|(_, v)| json_to_sql(v)).collect();
+    values.push(Value::Integer(id));
+    Ok(conn.execute(&sql, rusqlite::params_from_iter(values))?)
+}
+
+/// Remove directories left empty by an undo, stopping below the top-level folders.
+pub(crate) fn remove_empty_parents(root: &Path, path: &Path) {
+    let mut dir = path.parent();
+    while let Some(d) = dir {
+        if d.parent() == Some(root) || !d.starts_with(root) || fs::remove_dir(d).is_err() {
+            break;
+        }
+        dir = d.parent();
+    }
+}
+
+fn sql_to_json(v: Value) -> serde_json::Value {
+    match v {
+        Value::Null | Value::Blob(_) => serde_json::Value::Null,
+        Value::Integer(i) => serde_json::Value::from(i),
+        Value::Real(f) => serde_json::Value::from(f),
+        Value::Text(s) => serde_json::Value::from(s),
+    }
+}
+
+fn json_to_sql(v: &serde_json::Value) -> Value {
+    match v {
+        serde_json::Value::Number(n) => match n.as_i64() {
+            Some(i) => Value::Integer(i),
+            None => Value::Real(n.as_f64().unwrap_or_default()),
+        },
+        serde_json::Value::String(s) => Value::Text(s.clone()),
+        serde_json::Value::Bool(b) => Value::Integer(*b as i64),
+        _ => Value::Null,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::photosort_core::import::ImportOptions;
+    use assert_fs::TempDir;
+
+    #[test]
+    fn test_undo_import() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"not really a jpeg").unwrap();
+        fs::write(source.join("a.xmp"), b"<x:xmpmeta/>").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+        assert_eq!(lib.database().media_count().unwrap(), 1);
+
+        let undone = undo_last(&mut lib).unwrap().unwrap();
+        assert_eq!(undone.kind, "import");
+        assert_eq!(undone.files_removed, 2);
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+        assert_eq!(lib.database().sidecar_count().unwrap(), 0);
+        assert!(lib.root().join("images").exists());
+
+        // Nothing left to undo
+        assert!(undo_last(&mut lib).unwrap().is_none());
+    }
+
+    #[test]
+    fn test_undo_remove() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut lib = Library::create(temp_dir.path()).unwrap();
+        let conn = lib.database().connection_ref();
+        conn.execute(
+            "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at, gps_lat)
+             VALUES ('h1', 'a.jpg', 'images/2024/01-01', 'image', 'JPG', 10, '2024:01:01 00:00:00.0+00:00', '2024:01:01 00:00:00.0+00:00', 45.5)",
+            [],
+        ).unwrap();
+        let media_id = conn.last_insert_rowid();
+        conn.execute(
+            "INSERT INTO sidecars (media_id, filename, filetype, file_size, hash, modified_at)
+             VALUES (?1, 'a.xmp', 'XMP', 1, 's1', '2024:01:01 00:00:00.0+00:00')",
+            params![media_id],
+        ).unwrap();
+
+        let op = start(conn, "scan").unwrap();
+        assert_eq!(delete_media(conn, op, media_id).unwrap(), 1);
+        finish(conn, op).unwrap();
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+        assert_eq!(lib.database().sidecar_count().unwrap(), 0);
+
+        let undone = undo_last(&mut lib).unwrap().unwrap();
+        assert_eq!(undone.kind, "scan");
+        assert_eq!(lib.database().media_count().unwrap(), 1);
+        assert_eq!(lib.database().sidecar_count().unwrap(), 1);
+
+        let (id, gps_lat): (i64, f64) = lib.database().connection_ref()
+            .query_row("SELECT id, gps_lat FROM media WHERE hash = 'h1'", [], |row| Ok((row.get(0)?, row.get(1)?)))
+            .unwrap();
+        assert_eq!(id, media_id);
+        assert_eq!(gps_lat, 45.5);
+    }
+
+    #[test]
+    fn test_empty_operation_is_dropped() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = Library::create(temp_dir.path()).unwrap();
+        let conn = lib.database().connection_ref();
+
+        let op = start(conn, "scan").unwrap();
+        finish(conn, op).unwrap();
+        assert!(last_operation(conn).unwrap().is_none());
+    }
+}
@@ -61,15 +61,68 @@ pub struct ExifMetadata {
 /// Image file extensions (lowercase).
 const IMAGE_EXTENSIONS: &[&str] = &[
     "jpg", "jpeg", "png", "gif", "bmp", "tiff", "tif", "webp", "heic", "heif", "avif",
-    // RAW formats
-    "raw", "cr2", "cr3", "nef", "orf", "arw", "dng", "sr2", "raf", "rw2", "pef",
+    // 360 / action cameras (Insta360 photos are JPEG-based; THM is a GoPro thumbnail)
+    "insp", "thm",
 ];
 
+/// Camera RAW extensions (lowercase), also image extensions.
+const RAW_EXTENSIONS: &[&str] = &["raw", "cr2", "cr3", "nef", "orf", "arw", "dng", "sr2", "raf", "rw2", "pef"];
+
+/// Image formats exiftool rewrites safely (lowercase). RAW files are left
+/// out: their maker notes hold offsets that a rewrite can break.
+const STRIPPABLE_EXTENSIONS: &[&str] = &["jpg", "jpeg", "png", "tiff", "tif", "webp", "heic", "heif", "avif"];
+
+/// Whether metadata can be stripped from a file of this filetype or extension.
+pub fn is_strippable_filetype(ext: &str) -> bool {
+    STRIPPABLE_EXTENSIONS.contains(&ext.to_lowercase().as_str())
+}
+
+/// Whether a filetype or extension is a camera RAW format.
+pub fn is_raw_filetype(ext: &str) -> bool {
+    RAW_EXTENSIONS.contains(&ext.to_lowercase().as_str())
+}
+
 /// Video file extensions (lowercase) - used as fallback when ffprobe unavailable.
 const VIDEO_EXTENSIONS: &[&str] = &[
     "mp4", "mov", "m4v", "avi", "mkv", "webm", "mts", "m2ts", "3gp", "wmv", "flv",
+    // 360 / action cameras (QuickTime containers; LRV is a low-res preview)
+    "insv", "360", "lrv",
 ];
 
+/// Whether an extension is one photosort imports as a photo or video.
+pub fn is_media_extension(ext: &str) -> bool {
+    let ext = ext.to_lowercase();
+    [IMAGE_EXTENSIONS, RAW_EXTENSIONS, VIDEO_EXTENSIONS].iter().any(|list| list.contains(&ext.as_str()))
+}
+
+/// Extensions that name the same format, and the filetype they are stored as
+/// when canonicalizing (e.g. `.jpeg` as JPG).
+pub const FILETYPE_ALIASES: &[(&str, &str)] = &[("JPEG", "JPG"), ("JPE", "JPG"), ("TIF", "TIFF"), ("HEIF", "HEIC")];
+
+/// Filetype for an extension: uppercased, with aliases resolved to their
+/// canonical name. `extra` (from, to) pairs take precedence over the built-in ones.
+pub fn canonical_filetype(ext: &str, extra: &[(String, String)]) -> String {
+    let ext = ext.to_uppercase();
+    extra
+        .iter()
+        .map(|(from, to)| (from.as_str(), to.as_str()))
+        .chain(FILETYPE_ALIASES.iter().copied())
+        .find(|(from, _)| from.eq_ignore_ascii_case(&ext))
+        .map(|(_, to)| to.to_uppercase())
+        .unwrap_or(ext)
+}
+
+/// Every filetype naming the same format as `ext` under the built-in aliases,
+/// e.g. JPG, JPEG, and JPE for "jpeg".
+pub fn filetype_family(ext: &str) -> Vec<String> {
+    let canonical = canonical_filetype(ext, &[]);
+    let aliases = FILETYPE_ALIASES
+        .iter()
+        .filter(|(_, to)| *to == canonical)
+        .map(|(from, _)| from.to_string());
+    std::iter::once(canonical.clone()).chain(aliases).collect()
+}
+
 /// Detect media type from a file path.
 /// Uses MIME type detection first, then ffprobe for videos, then falls back to extension.
 pub fn detect_media_type(path: &Path) -> Option<MediaType> {
@@ -77,7 +130,7 @@ pub fn detect_media_type(path: &Path) -> Option<MediaType> {
     if let Some(ext) = path.extension().and_then(|e| e.to_str()) {
         let ext_lower = ext.to_lowercase();
 
-        if IMAGE_EXTENSIONS.contains(&ext_lower.as_str()) {
+        if IMAGE_EXTENSIONS.contains(&ext_lower.as_str()) || RAW_EXTENSIONS.contains(&ext_lower.as_str()) {
             return Some(MediaType::Image);
         }
 
@@ -143,12 +196,34 @@ mod tests {
         assert_eq!(detect_media_type(Path::new("video.mkv")), Some(MediaType::Video));
     }
 
+    #[test]
+    fn test_detect_action_cam_extensions() {
+        assert_eq!(detect_media_type(Path::new("IMG_20240101_120000_00_001.insp")), Some(MediaType::Image));
+        assert_eq!(detect_media_type(Path::new("VID_20240101_120000_00_001.insv")), Some(MediaType::Video));
+        assert_eq!(detect_media_type(Path::new("GS010123.360")), Some(MediaType::Video));
+        assert_eq!(detect_media_type(Path::new("GL010123.LRV")), Some(MediaType::Video));
+    }
+
     #[test]
     fn test_detect_unknown_extension() {
         // Unknown extension without ffprobe detection
         assert_eq!(detect_media_type(Path::new("file.xyz")), None);
     }
 
+    #[test]
+    fn test_canonical_filetype() {
+        assert_eq!(canonical_filetype("jpeg", &[]), "JPG");
+        assert_eq!(canonical_filetype("Tif", &[]), "TIFF");
+        assert_eq!(canonical_filetype("dng", &[]), "DNG");
+
+        let extra = vec![("JFIF".to_string(), "JPG".to_string()), ("JPEG".to_string(), "JPEG".to_string())];
+        assert_eq!(canonical_filetype("jfif", &extra), "JPG");
+        assert_eq!(canonical_filetype("jpeg", &extra), "JPEG");
+
+        assert_eq!(filetype_family("jpg"), vec!["JPG", "JPEG", "JPE"]);
+        assert_eq!(filetype_family("png"), vec!["PNG"]);
+    }
+
     #[test]
     fn test_media_type_display() {
         assert_eq!(MediaType::Image.as_str(), "image");
@@ -0,0 +1,470 @@
+use crate::photosort_core::cli::StorageLayout;
+use crate::photosort_core::error::{PhotosortError, Result};
+use crate::photosort_core::import::{create_dir_all_with_mode, hash_file, Library};
+use crate::photosort_core::journal::{self, JournalEntry};
+use crate::photosort_core::objects::{link_object, object_path};
+use crate::photosort_core::progress;
+use crate::photosort_core::sidecar::rename_sidecar_for_media;
+use rusqlite::types::Value;
+use rusqlite::Connection;
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// What one source library contributed to a merge.
+#[derive(Debug, Default)]
+pub struct SourceContribution {
+    pub path: PathBuf,
+    pub media_added: usize,
+    pub sidecars_added: usize,
+    /// Media already in the target, or taken from another source instead.
+    pub duplicates: usize,
+    /// Media whose file is missing from the source, left out.
+    pub failed: usize,
+    /// Target sidecars left as they were because the source's differs.
+    pub sidecar_conflicts: Vec<PathBuf>,
+}
+
+/// Outcome of a merge, one entry per source in the order given.
+#[derive(Debug, Default)]
+pub struct MergeResult {
+    pub sources: Vec<SourceContribution>,
+}
+
+/// A database row as column name/value pairs, without its ID.
+type Row = Vec<(String, Value)>;
+
+/// A media row chosen from one of the sources.
+struct MergeItem {
+    source: usize,
+    hash: String,
+    relpath: String,
+    filename: String,
+    media: Row,
+    sidecars: Vec<Row>,
+}
+
+/// Merge several libraries into `target`.
+///
+/// Media are deduplicated by hash across the target and all sources at once.
+/// When more than one source has the same media, a copy with sidecars wins
+/// over one without; otherwise the source listed first wins. Files keep
+/// their library-relative paths, with a `_N` suffix if a different file is
+/// already there. A content-addressed target stores each media file once
+/// under `objects/` and links it from its folder, as import does.
+///
+/// Media whose file is missing from their source are left out, as are
+/// sidecars where the target already has a different file.
+pub fn merge(target: &mut Library, sources: &[Library], dry_run: bool) -> Result<MergeResult> {
+    // Media are matched by hash, which only works if every library writes hashes alike
+    let encoding = target.hash_encoding()?;
+    for source in sources {
+        if source.hash_encoding()? != encoding {
+            return Err(PhotosortError::Library(format!(
+                "{} stores hashes in a different encoding; convert it with convert-hashes first",
+                source.root().display()
+            )));
+        }
+    }
+
+    let mut result = MergeResult {
+        sources: sources
+            .iter()
+            .map(|s| SourceContribution {
+                path: s.root().to_path_buf(),
+                ..Default::default()
+            })
+            .collect(),
+    };
+
+    let in_target: HashSet<String> = target
+        .database()
+        .connection_ref()
+        .prepare("SELECT hash FROM media")?
+        .query_map([], |row| row.get(0))?
+        .collect::<rusqlite::Result<_>>()?;
+
+    // Pick one copy of each hash across every source
+    let mut chosen: HashMap<String, MergeItem> = HashMap::new();
+    for (i, source) in sources.iter().enumerate() {
+        for item in read_media(source.database().connection_ref(), i)? {
+            if in_target.contains(&item.hash) {
+                result.sources[i].duplicates += 1;
+                continue;
+            }
+            match chosen.get(&item.hash) {
+                Some(existing) if existing.sidecars.is_empty() && !item.sidecars.is_empty() => {
+                    result.sources[existing.source].duplicates += 1;
+                    chosen.insert(item.hash.clone(), item);
+                }
+                Some(_) => result.sources[i].duplicates += 1,
+                None => {
+                    chosen.insert(item.hash.clone(), item);
+                }
+            }
+        }
+    }
+
+    let mut items: Vec<MergeItem> = chosen.into_values().collect();
+    items.sort_by(|a, b| (a.source, &a.relpath, &a.filename).cmp(&(b.source, &b.relpath, &b.filename)));
+
+    if dry_run {
+        for item in &items {
+            if !sources[item.source].root().join(&item.relpath).join(&item.filename).is_file() {
+                result.sources[item.source].failed += 1;
+                continue;
+            }
+            result.sources[item.source].media_added += 1;
+            result.sources[item.source].sidecars_added += item.sidecars.len();
+        }
+        return Ok(result);
+    }
+
+    let bar = progress::bar(items.len() as u64);
+    bar.set_message("Merging");
+
+    let root = target.root().to_path_buf();
+    let content_layout = target.layout()? == StorageLayout::Content;
+    let conn = target.database_mut().connection();
+    let tx = conn.transaction()?;
+    let op_id = journal::start(&tx, "merge")?;
+
+    for mut item in items {
+        let source_root = sources[item.source].root();
+        let source_dir = source_root.join(&item.relpath);
+        let source_file = source_dir.join(&item.filename);
+        if !source_file.is_file() {
+            // A record without its file would only show up as missing in the target
+            log::warn!("{} is missing; not merged", source_file.display());
+            result.sources[item.source].failed += 1;
+            bar.inc(1);
+            continue;
+        }
+        let dest_dir = root.join(&item.relpath);
+        create_dir_all_with_mode(&dest_dir, None)?;
+
+        // Keep the source name unless a different file already has it
+        let filename = free_filename(&dest_dir, &item.filename, &source_file);
+
+        let mut added = Vec::new();
+        let destination = dest_dir.join(&filename);
+        if content_layout {
+            let filetype = match column(&item.media, "filetype") {
+                Some(Value::Text(t)) => t.clone(),
+                _ => String::new(),
+            };
+            let object = object_path(&root, &item.hash, &filetype);
+            if let Some(parent) = object.parent() {
+                create_dir_all_with_mode(parent, None)?;
+            }
+            if copy_if_new(&source_file, &object)? {
+                added.push(object.clone());
+            }
+            if !destination.exists() {
+                link_object(&root, &object, &destination, None)?;
+                added.push(destination);
+            }
+        } else if copy_if_new(&source_file, &destination)? {
+            added.push(destination);
+        }
+        set_column(&mut item.media, "filename", Value::Text(filename.clone()));
+
+        insert_row(&tx, "media", &item.media)?;
+        let media_id = tx.last_insert_rowid();
+        journal::record(&tx, op_id, &JournalEntry::MediaInserted { hash: item.hash.clone() })?;
+
+        for mut sidecar in item.sidecars {
+            let Some(Value::Text(sc_name)) = column(&sidecar, "filename").cloned() else {
+                continue;
+            };
+            let dest_name = rename_sidecar_for_media(&sc_name, &filename).unwrap_or(sc_name.clone());
+            let (source_sidecar, dest_sidecar) = (source_dir.join(&sc_name), dest_dir.join(&dest_name));
+            if !source_sidecar.is_file() {
+                log::warn!("{} is missing; not merged", source_sidecar.display());
+                continue;
+            }
+            if dest_sidecar.exists() && hash_file(&dest_sidecar)? != hash_file(&source_sidecar)? {
+                // Someone else's edits; neither copy is overwritten or recorded
+                result.sources[item.source].sidecar_conflicts.push(dest_sidecar);
+                continue;
+            }
+            if copy_if_new(&source_sidecar, &dest_sidecar)? {
+                added.push(dest_sidecar);
+            }
+            set_column(&mut sidecar, "filename", Value::Text(dest_name));
+            set_column(&mut sidecar, "media_id", Value::Integer(media_id));
+            insert_row(&tx, "sidecars", &sidecar)?;
+            result.sources[item.source].sidecars_added += 1;
+        }
+
+        for path in added {
+            let rel = path.strip_prefix(&root).unwrap_or(&path);
+            journal::record(
+                &tx,
+                op_id,
+                &JournalEntry::FileAdded {
+                    path: rel.to_string_lossy().into_owned(),
+                },
+            )?;
+        }
+
+        result.sources[item.source].media_added += 1;
+        bar.inc(1);
+    }
+
+    journal::finish(&tx, op_id)?;
+    tx.commit()?;
+    bar.finish_with_message("Merge complete");
+
+    Ok(result)
+}
+
+/// Read every media row (with its sidecar rows) from a library database.
+fn read_media(conn: &Connection, source: usize) -> Result<Vec<MergeItem>> {
+    let mut sidecars: HashMap<i64, Vec<Row>> = HashMap::new();
+    for (id, row) in read_rows(conn, "sidecars", "media_id")? {
+        sidecars.entry(id).or_default().push(row);
+    }
+
+    let mut items = Vec::new();
+    for (id, media) in read_rows(conn, "media", "id")? {
+        let text = |name: &str| match column(&media, name) {
+            Some(Value::Text(s)) => s.clone(),
+            _ => String::new(),
+        };
+        items.push(MergeItem {
+            source,
+            hash: text("hash"),
+            relpath: text("relpath"),
+            filename: text("filename"),
+            sidecars: sidecars.remove(&id).unwrap_or_default(),
+            media,
+        });
+    }
+    Ok(items)
+}
+
+/// Read all rows of a table, keyed by `key_column`, dropping the row ID.
+fn read_rows(conn: &Connection, table: &str, key_column: &str) -> Result<Vec<(i64, Row)>> {
+    let mut stmt = conn.prepare(&format!("SELECT * FROM {}", table))?;
+    let columns: Vec<String> = stmt.column_names().iter().map(|c| c.to_string()).collect();
+
+    let rows = stmt.query_map([], |row| {
+        let mut key = 0;
+        let mut values = Vec::new();
+        for (i, name) in columns.iter().enumerate() {
+            let value: Value = row.get(i)?;
+            if name == key_column {
+                if let Value::Integer(k) = value {
+                    key = k;
+                }
+            }
+            if name != "id" {
+                values.push((name.clone(), value));
+            }
+        }
+        Ok((key, values))
+    })?;
+
+    Ok(rows.collect::<rusqlite::Result<_>>()?)
+}
+
+fn column<'a>(row: &'a Row, name: &str) -> Option<&'a Value> {
+    row.iter().find(|(n, _)| n == name).map(|(_, v)| v)
+}
+
+fn set_column(row: &mut Row, name: &str, value: Value) {
+    if let Some(entry) = row.iter_mut().find(|(n, _)| n == name) {
+        entry.1 = value;
+    }
+}
+
+fn insert_row(conn: &Connection, table: &str, row: &Row) -> Result<()> {
+    let columns: Vec<&str> = row.iter().map(|(n, _)| n.as_str()).collect();
+    let placeholders: Vec<&str> = columns.iter().map(|_| "?").collect();
+    let sql = format!(
+        "INSERT INTO {} ({}) VALUES ({})",
+        table,
+        columns.join(", "),
+        placeholders.join(", ")
+    );
+    conn.execute(&sql, rusqlite::params_from_iter(row.iter().map(|(_, v)| v)))?;
+    Ok(())
+}
+
+/// Pick a filename in `dir` that is either free or already holds the same content as `source`.
+fn free_filename(dir: &Path, filename: &str, source: &Path) -> String {
+    let taken = |name: &str| {
+        let path = dir.join(name);
+        path.exists() && hash_file(&path).ok() != hash_file(source).ok()
+    };
+    if !taken(filename) {
+        return filename.to_string();
+    }
+
+    let path = Path::new(filename);
+    let stem = path.file_stem().unwrap_or_default().to_string_lossy().into_owned();
+    let ext = path.extension().map(|e| format!(".{}", e.to_string_lossy())).unwrap_or_default();
+    (1..).map(|n| format!("{}_{}{}", stem, n, ext)).find(|f| !taken(f)).unwrap()
+}
+
+/// Copy a file unless the destination already exists. Returns whether it copied.
+fn copy_if_new(source: &Path, destination: &Path) -> Result<bool> {
+    if destination.exists() {
+        return Ok(false);
+    }
+    fs::copy(source, destination)?;
+    Ok(true)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use assert_fs::TempDir;
+    use rusqlite::params;
+
+    fn add_media(lib: &Library, filename: &str, content: &[u8], sidecar: Option<&str>) {
+        let relpath = "images/2024/01-01";
+        let dir = lib.root().join(relpath);
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(dir.join(filename), content).unwrap();
+
+        let conn = lib.database().connection_ref();
+        conn.execute(
+            "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+             VALUES (?1, ?2, ?3, 'image', 'JPG', ?4, '2024:01:01 00:00:00.0+00:00', '2024:01:01 00:00:00.0+00:00')",
+            params![hash_file(&dir.join(filename)).unwrap(), filename, relpath, content.len() as i64],
+        )
+        .unwrap();
+
+        if let Some(sc_name) = sidecar {
+            fs::write(dir.join(sc_name), b"edits").unwrap();
+            conn.execute(
+                "INSERT INTO sidecars (media_id, filename, filetype, file_size, hash, modified_at)
+                 VALUES (?1, ?2, 'XMP', 5, 'x', '2024:01:01 00:00:00.0+00:00')",
+                params![conn.last_insert_rowid(), sc_name],
+            )
+            .unwrap();
+        }
+    }
+
+    #[test]
+    fn test_merge_three_overlapping_libraries() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = |name: &str| Library::create(&temp_dir.path().join(name)).unwrap();
+
+        let a = lib("a");
+        add_media(&a, "x.jpg", b"x", None);
+        add_media(&a, "y.jpg", b"y", None);
+
+        let b = lib("b");
+        add_media(&b, "y.jpg", b"y", None);
+        add_media(&b, "z.jpg", b"z", None);
+
+        // c's copy of z has edits, so it wins over b's
+        let c = lib("c");
+        add_media(&c, "z.jpg", b"z", Some("z.xmp"));
+        add_media(&c, "w.jpg", b"w", None);
+
+        let mut target = lib("target");
+        let result = merge(&mut target, &[a, b, c], false).unwrap();
+
+        let counts: Vec<(usize, usize, usize)> = result
+            .sources
+            .iter()
+            .map(|s| (s.media_added, s.sidecars_added, s.duplicates))
+            .collect();
+        assert_eq!(counts, vec![(2, 0, 0), (0, 0, 2), (2, 1, 0)]);
+
+        assert_eq!(target.database().media_count().unwrap(), 4);
+        assert_eq!(target.database().sidecar_count().unwrap(), 1);
+        let dir = target.root().join("images/2024/01-01");
+        for name in ["x.jpg", "y.jpg", "z.jpg", "z.xmp", "w.jpg"] {
+            assert!(dir.join(name).exists(), "{}", name);
+        }
+    }
+
+    #[test]
+    fn test_merge_renames_conflicting_filename() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut target = Library::create(&temp_dir.path().join("target")).unwrap();
+        add_media(&target, "IMG_0001.jpg", b"one camera", None);
+
+        let source = Library::create(&temp_dir.path().join("source")).unwrap();
+        add_media(&source, "IMG_0001.jpg", b"another camera", Some("IMG_0001.xmp"));
+
+        let result = merge(&mut target, &[source], false).unwrap();
+        assert_eq!(result.sources[0].media_added, 1);
+
+        let dir = target.root().join("images/2024/01-01");
+        assert_eq!(fs::read(dir.join("IMG_0001.jpg")).unwrap(), b"one camera");
+        assert_eq!(fs::read(dir.join("IMG_0001_1.jpg")).unwrap(), b"another camera");
+        assert!(dir.join("IMG_0001_1.xmp").exists());
+
+        // Nothing left to merge the second time
+        let source = Library::open(&temp_dir.path().join("source")).unwrap();
+        let result = merge(&mut target, &[source], false).unwrap();
+        assert_eq!(result.sources[0].media_added, 0);
+        assert_eq!(result.sources[0].duplicates, 1);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_merge_into_content_layout_links_objects() {
+        use crate::photosort_core::import::CreateOptions;
+        use crate::photosort_core::objects::object_path;
+
+        let temp_dir = TempDir::new().unwrap();
+        let create = CreateOptions {
+            layout: StorageLayout::Content,
+            ..Default::default()
+        };
+        let mut target = Library::create_with_options(&temp_dir.path().join("target"), &create).unwrap();
+        let source = Library::create(&temp_dir.path().join("source")).unwrap();
+        add_media(&source, "a.jpg", b"photo", Some("a.xmp"));
+        let hash = hash_file(&source.root().join("images/2024/01-01/a.jpg")).unwrap();
+
+        merge(&mut target, &[source], false).unwrap();
+
+        let dir = target.root().join("images/2024/01-01");
+        let object = object_path(target.root(), &hash, "JPG");
+        assert!(dir.join("a.jpg").symlink_metadata().unwrap().file_type().is_symlink());
+        assert_eq!(fs::canonicalize(dir.join("a.jpg")).unwrap(), fs::canonicalize(&object).unwrap());
+        assert_eq!(fs::read(&object).unwrap(), b"photo");
+        // Sidecars are edited in place, so they stay regular files
+        assert!(dir.join("a.xmp").symlink_metadata().unwrap().file_type().is_file());
+
+        // Undo takes away both the link and the object
+        let undone = journal::undo_last(&mut target).unwrap().unwrap();
+        assert_eq!(undone.kind, "merge");
+        assert!(dir.join("a.jpg").symlink_metadata().is_err());
+        assert!(!object.exists());
+    }
+
+    #[test]
+    fn test_merge_skips_missing_files_and_reports_sidecar_conflicts() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut target = Library::create(&temp_dir.path().join("target")).unwrap();
+        let dir = target.root().join("images/2024/01-01");
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(dir.join("b.xmp"), b"other edits").unwrap();
+
+        let source = Library::create(&temp_dir.path().join("source")).unwrap();
+        add_media(&source, "a.jpg", b"gone", None);
+        add_media(&source, "b.jpg", b"here", Some("b.xmp"));
+        fs::remove_file(source.root().join("images/2024/01-01/a.jpg")).unwrap();
+
+        let preview = merge(&mut target, std::slice::from_ref(&source), true).unwrap();
+        assert_eq!((preview.sources[0].media_added, preview.sources[0].failed), (1, 1));
+
+        let result = merge(&mut target, &[source], false).unwrap();
+        let merged = &result.sources[0];
+        assert_eq!((merged.media_added, merged.sidecars_added, merged.failed), (1, 0, 1));
+        assert_eq!(merged.sidecar_conflicts, vec![dir.join("b.xmp")]);
+
+        assert_eq!(target.database().media_count().unwrap(), 1);
+        assert_eq!(target.database().sidecar_count().unwrap(), 0);
+        assert!(!dir.join("a.jpg").exists());
+        assert_eq!(fs::read(dir.join("b.xmp")).unwrap(), b"other edits");
+    }
+}
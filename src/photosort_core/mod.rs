@@ -7,15 +7,38 @@ pub mod sidecar;
 
 // Feature modules
 pub mod backup;
+pub mod bundle;
+pub mod dedupe;
 pub mod exif;
+pub mod export;
+pub mod hooks;
 pub mod import;
+pub mod inspect;
+pub mod journal;
+pub mod merge;
+pub mod objects;
+pub mod progress;
 pub mod push;
+pub mod refresh;
+pub mod rehydrate;
+pub mod remove;
+pub mod report;
 pub mod scan;
 pub mod search;
+pub mod source_manifest;
+pub mod throttle;
+pub mod trash;
+pub mod verify;
+pub mod warnings;
 
 // Re-exports for convenience
-pub use cli::{Cli, Commands, MediaTypeFilter, OutputFormat};
+pub use cli::{
+    Cli, Commands, DateGranularity, DestExistsPolicy, ExportFormat, HashEncoding, ImportOrder, MediaTypeFilter, NameCase, OutputFormat,
+    PreviewMode, ProgressTheme, ReportFormat, SidecarConflictPolicy, SidecarDate, SkipSidecarCopy, SourceMismatchPolicy, StorageLayout, StripMetadata,
+    StructureFormat, WithinSecond,
+};
 pub use database::Database;
 pub use error::{PhotosortError, Result};
 pub use media::{ExifMetadata, Media, MediaType};
+pub use progress::ProgressObserver;
 pub use sidecar::Sidecar;
@@ -0,0 +1,206 @@
+use crate::photosort_core::import::{content_hash, create_dir_all_with_mode};
+use std::collections::HashSet;
+use std::fs;
+use std::io;
+use std::path::{Component, Path, PathBuf};
+use walkdir::WalkDir;
+
+/// Folder (relative to the library root) holding content-addressed media.
+pub const OBJECTS_DIR: &str = "objects";
+
+/// Where a file with this hash is stored in a content-addressed library,
+/// e.g. "objects/q8/Fz/q8Fz...Qk.jpg".
+///
+/// Hashes are base64, so `/` and `+` are swapped for filename-safe characters.
+pub fn object_path(root: &Path, hash: &str, extension: &str) -> PathBuf {
+    let name: String = content_hash(hash)
+        .trim_end_matches('=')
+        .chars()
+        .map(|c| match c {
+            '/' => '_',
+            '+' => '-',
+            c => c,
+        })
+        .collect();
+    let mut path = root.join(OBJECTS_DIR);
+    if name.len() > 4 {
+        path = path.join(&name[..2]).join(&name[2..4]);
+    }
+    path.join(format!("{}.{}", name, extension.to_lowercase()))
+}
+
+/// Point `link` at `object` with a relative symlink, so the library can be
+/// moved or backed up as a whole. An existing file at `link` is replaced.
+pub fn link_object(root: &Path, object: &Path, link: &Path, dir_mode: Option<u32>) -> io::Result<()> {
+    let parent = link
+        .parent()
+        .ok_or_else(|| io::Error::new(io::ErrorKind::InvalidInput, "link has no parent"))?;
+    create_dir_all_with_mode(parent, dir_mode)?;
+
+    let depth = parent
+        .strip_prefix(root)
+        .map_err(|_| io::Error::new(io::ErrorKind::InvalidInput, "link is outside the library"))?
+        .components()
+        .filter(|c| matches!(c, Component::Normal(_)))
+        .count();
+    let mut target = PathBuf::new();
+    for _ in 0..depth {
+        target.push("..");
+    }
+    target.push(object.strip_prefix(root).unwrap_or(object));
+
+    if link.symlink_metadata().is_ok() {
+        fs::remove_file(link)?;
+    }
+    symlink(&target, link)
+}
+
+/// The object a library symlink points at, worked out from the link's text
+/// (the object needn't exist). None for anything but a link into `objects/`.
+pub fn linked_object(root: &Path, link: &Path) -> Option<PathBuf> {
+    if !link.symlink_metadata().ok()?.file_type().is_symlink() {
+        return None;
+    }
+    let mut object = PathBuf::new();
+    for component in link.parent()?.join(fs::read_link(link).ok()?).components() {
+        match component {
+            Component::ParentDir => {
+                object.pop();
+            }
+            Component::CurDir => {}
+            other => object.push(other),
+        }
+    }
+    object.starts_with(root.join(OBJECTS_DIR)).then_some(object)
+}
+
+/// Move a file within the library at `root`, creating its new folder if
+/// needed. A link to an object is made again at its new place, since its
+/// relative target only leads to the object from the folder it was made in.
+pub fn move_in_library(root: &Path, from: &Path, to: &Path) -> io::Result<()> {
+    if let Some(parent) = to.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    match linked_object(root, from) {
+        Some(object) => {
+            link_object(root, &object, to, None)?;
+            fs::remove_file(from)
+        }
+        None => fs::rename(from, to),
+    }
+}
+
+/// Delete objects no link in the library (trash included) points at any
+/// more, such as after their records were removed for good. Returns how
+/// many were deleted and the bytes freed.
+pub fn remove_unlinked_objects(root: &Path) -> io::Result<(usize, u64)> {
+    let objects_dir = root.join(OBJECTS_DIR);
+    if !objects_dir.is_dir() {
+        return Ok((0, 0));
+    }
+    let linked: HashSet<PathBuf> = WalkDir::new(root)
+        .into_iter()
+        .filter_entry(|e| e.path() != objects_dir)
+        .filter_map(|e| e.ok())
+        .filter(|e| e.path_is_symlink())
+        .filter_map(|e| linked_object(root, e.path()))
+        .collect();
+
+    let mut removed = (0, 0);
+    for entry in WalkDir::new(&objects_dir).into_iter().filter_map(|e| e.ok()) {
+        if !entry.file_type().is_file() || linked.contains(entry.path()) {
+            continue;
+        }
+        let size = entry.metadata().map(|m| m.len()).unwrap_or(0);
+        fs::remove_file(entry.path())?;
+        removed.0 += 1;
+        removed.1 += size;
+    }
+    Ok(removed)
+}
+
+/// Create a symlink at `link` pointing to `target` (Unix only).
+#[cfg(unix)]
+pub fn symlink(target: &Path, link: &Path) -> io::Result<()> {
+    std::os::unix::fs::symlink(target, link)
+}
+
+#[cfg(not(unix))]
+pub fn symlink(_target: &Path, _link: &Path) -> io::Result<()> {
+    Err(io::Error::new(
+        io::ErrorKind::Unsupported,
+        "content-addressed libraries need symlinks, which are only supported on Unix",
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::photosort_core::cli::StorageLayout;
+    use crate::photosort_core::import::{hash_file, CreateOptions, Library, ALT_HASH_SUFFIX};
+    use crate::photosort_core::verify::{verify, VerifyOptions};
+    use assert_fs::TempDir;
+    use rusqlite::params;
+
+    #[test]
+    fn test_object_path_is_filename_safe() {
+        let root = Path::new("/lib");
+        let path = object_path(root, "ab+/cdefgh=", "JPG");
+        assert_eq!(path, Path::new("/lib/objects/ab/-_/ab-_cdefgh.jpg"));
+        assert_eq!(object_path(root, &format!("ab+/cdefgh={}", ALT_HASH_SUFFIX), "jpg"), path);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_two_references_share_one_object() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = Library::create_with_options(
+            &temp_dir.path().join("lib"),
+            &CreateOptions {
+                layout: StorageLayout::Content,
+                ..Default::default()
+            },
+        )
+        .unwrap();
+        assert_eq!(lib.layout().unwrap(), StorageLayout::Content);
+
+        let source = temp_dir.path().join("IMG_1.jpg");
+        fs::write(&source, b"pixels").unwrap();
+        let hash = hash_file(&source).unwrap();
+        let alt_hash = format!("{}{}", hash, ALT_HASH_SUFFIX);
+
+        // Two records of one file (as when both copies are kept on import)
+        let object = object_path(lib.root(), &hash, "jpg");
+        assert_eq!(object_path(lib.root(), &alt_hash, "jpg"), object);
+        fs::create_dir_all(object.parent().unwrap()).unwrap();
+        fs::copy(&source, &object).unwrap();
+
+        for (hash, relpath) in [(&hash, "images/2024/05-21"), (&alt_hash, "images/2019/01-01")] {
+            link_object(lib.root(), &object, &lib.root().join(relpath).join("IMG_1.jpg"), None).unwrap();
+            lib.database()
+                .connection_ref()
+                .execute(
+                    "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+                     VALUES (?1, 'IMG_1.jpg', ?2, 'image', 'JPG', 6, '', '')",
+                    params![hash, relpath],
+                )
+                .unwrap();
+        }
+
+        let objects: Vec<_> = walkdir::WalkDir::new(lib.root().join(OBJECTS_DIR))
+            .into_iter()
+            .filter_map(|e| e.ok())
+            .filter(|e| e.file_type().is_file())
+            .collect();
+        assert_eq!(objects.len(), 1);
+
+        let link = lib.root().join("images/2024/05-21/IMG_1.jpg");
+        assert!(link.symlink_metadata().unwrap().file_type().is_symlink());
+        assert_eq!(fs::read_link(&link).unwrap(), Path::new("../../..").join(object.strip_prefix(lib.root()).unwrap()));
+        assert_eq!(fs::read(lib.root().join("images/2019/01-01/IMG_1.jpg")).unwrap(), b"pixels");
+
+        let result = verify(&lib, &VerifyOptions::default()).unwrap();
+        assert_eq!(result.checked, 2);
+        assert!(result.is_ok());
+    }
+}
@@ -0,0 +1,191 @@
+use crate::photosort_core::cli::ProgressTheme;
+use indicatif::{ProgressBar, ProgressStyle};
+use std::path::Path;
+use std::sync::{Arc, Mutex, OnceLock};
+
+/// Width of the bar itself, in characters, unless configured otherwise.
+pub const DEFAULT_BAR_WIDTH: u16 = 40;
+
+static SETTINGS: OnceLock<(ProgressTheme, u16)> = OnceLock::new();
+
+/// Choose how every progress bar in this process looks. Only the first call
+/// counts; bars made before any call use the defaults.
+pub fn configure(theme: ProgressTheme, width: u16) {
+    let _ = SETTINGS.set((theme, width.max(1)));
+}
+
+/// A progress bar of `len` steps in the configured style.
+pub fn bar(len: u64) -> ProgressBar {
+    let (theme, width) = SETTINGS.get().copied().unwrap_or((ProgressTheme::Unicode, DEFAULT_BAR_WIDTH));
+    ProgressBar::new(len).with_style(style(theme, width))
+}
+
+/// Receives progress from a library's long-running operations (imports, scans
+/// and pushes), for applications that draw their own progress instead of the
+/// terminal bars. Set one with `Library::set_progress_observer`.
+///
+/// Calls may come from several threads at once, but a phase's `on_progress`
+/// calls never overlap, and their `done` counts only go up.
+pub trait ProgressObserver: Send + Sync {
+    /// A phase of the operation started, with `total` steps (0 if unknown).
+    fn on_phase(&self, phase: &str, total: u64);
+    /// `done` of the current phase's `total` steps are finished.
+    fn on_progress(&self, done: u64, total: u64);
+    /// The current phase is done with a file.
+    fn on_file_done(&self, path: &Path);
+}
+
+/// Progress through one phase of an operation: reported to an observer if
+/// one is set, otherwise drawn as a progress bar (or not shown, for `quiet`).
+pub struct Phase {
+    bar: Option<ProgressBar>,
+    observer: Option<Arc<dyn ProgressObserver>>,
+    total: u64,
+    /// Steps finished so far. Held while the observer hears of a step, so
+    /// workers finishing together report in order rather than racing.
+    done: Mutex<u64>,
+}
+
+impl Phase {
+    /// Start a phase of `total` steps, drawing a bar labeled `name` when
+    /// there is no observer.
+    pub fn new(observer: Option<&Arc<dyn ProgressObserver>>, name: &str, total: u64) -> Self {
+        let mut phase = Phase::quiet(observer, name, total);
+        if observer.is_none() {
+            let bar = bar(total);
+            bar.set_message(name.to_string());
+            phase.bar = Some(bar);
+        }
+        phase
+    }
+
+    /// Start a phase that only an observer hears about, for operations
+    /// that print their own messages instead of drawing a bar.
+    pub fn quiet(observer: Option<&Arc<dyn ProgressObserver>>, name: &str, total: u64) -> Self {
+        if let Some(observer) = observer {
+            observer.on_phase(name, total);
+        }
+        Phase {
+            bar: None,
+            observer: observer.cloned(),
+            total,
+            done: Mutex::new(0),
+        }
+    }
+
+    /// Whether an observer is listening, so terminal output can be left out.
+    pub fn is_observed(&self) -> bool {
+        self.observer.is_some()
+    }
+
+    /// One step finished.
+    pub fn inc(&self) {
+        let mut done = self.done.lock().unwrap_or_else(|e| e.into_inner());
+        *done += 1;
+        if let Some(bar) = &self.bar {
+            bar.inc(1);
+        }
+        if let Some(observer) = &self.observer {
+            observer.on_progress(*done, self.total);
+        }
+    }
+
+    /// One step finished, which was about `path`.
+    pub fn file_done(&self, path: &Path) {
+        if let Some(observer) = &self.observer {
+            observer.on_file_done(path);
+        }
+        self.inc();
+    }
+
+    /// Finish the phase, leaving `message` on its bar.
+    pub fn finish_with_message(&self, message: &'static str) {
+        if let Some(bar) = &self.bar {
+            bar.finish_with_message(message);
+        }
+    }
+}
+
+/// The style bars get for a theme and width.
+pub fn style(theme: ProgressTheme, width: u16) -> ProgressStyle {
+    let style = ProgressStyle::default_bar()
+        .template(&format!(
+            "{{spinner:.green}} [{{elapsed_precise}}] [{{bar:{}.cyan/blue}}] {{pos}}/{{len}} ({{eta}}) {{msg}}",
+            width
+        ))
+        .unwrap();
+    match theme {
+        ProgressTheme::Unicode => style,
+        // Block and braille characters come out garbled in some consoles and CI logs
+        ProgressTheme::Ascii => style.progress_chars("#>-").tick_chars("|/-\\ "),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Mutex;
+
+    #[derive(Default)]
+    struct Recorder(Mutex<Vec<String>>);
+
+    impl ProgressObserver for Recorder {
+        fn on_phase(&self, phase: &str, total: u64) {
+            self.0.lock().unwrap().push(format!("phase {} {}", phase, total));
+        }
+        fn on_progress(&self, done: u64, total: u64) {
+            self.0.lock().unwrap().push(format!("{}/{}", done, total));
+        }
+        fn on_file_done(&self, path: &Path) {
+            self.0.lock().unwrap().push(format!("done {}", path.display()));
+        }
+    }
+
+    #[test]
+    fn test_phase_reports_to_observer() {
+        let recorder = Arc::new(Recorder::default());
+        let observer: Arc<dyn ProgressObserver> = recorder.clone();
+        let phase = Phase::new(Some(&observer), "Copying files", 2);
+        assert!(phase.bar.is_none());
+        phase.file_done(Path::new("a.jpg"));
+        phase.inc();
+        phase.finish_with_message("Copy complete");
+        assert_eq!(
+            *recorder.0.lock().unwrap(),
+            ["phase Copying files 2", "done a.jpg", "1/2", "2/2"]
+        );
+
+        // Without an observer, a bar is drawn instead
+        let phase = Phase::new(None, "Copying files", 2);
+        assert!(phase.bar.is_some() && !phase.is_observed());
+        assert!(Phase::quiet(None, "Pushing files", 2).bar.is_none());
+    }
+
+    #[test]
+    fn test_phase_progress_in_order_across_threads() {
+        let recorder = Arc::new(Recorder::default());
+        let observer: Arc<dyn ProgressObserver> = recorder.clone();
+        let phase = Phase::new(Some(&observer), "Hashing files", 8 * 500);
+        std::thread::scope(|s| {
+            for _ in 0..8 {
+                s.spawn(|| (0..500).for_each(|_| phase.inc()));
+            }
+        });
+
+        let events = recorder.0.lock().unwrap();
+        let expected: Vec<String> = std::iter::once("phase Hashing files 4000".to_string())
+            .chain((1..=4000).map(|done| format!("{}/4000", done)))
+            .collect();
+        assert_eq!(*events, expected);
+    }
+
+    #[test]
+    fn test_ascii_theme_ticks() {
+        let ascii = style(ProgressTheme::Ascii, 20);
+        assert!((0..4).all(|i| ascii.get_tick_str(i).is_ascii()));
+        assert!(ascii.get_final_tick_str().is_ascii());
+
+        let unicode = style(ProgressTheme::Unicode, 20);
+        assert!(!(0..4).all(|i| unicode.get_tick_str(i).is_ascii()));
+    }
+}
@@ -1,10 +1,13 @@
 use crate::photosort_core::error::{PhotosortError, Result};
-use crate::photosort_core::import::{Library, DB_DATE_FORMAT};
+use crate::photosort_core::import::{parse_hash_encoding, Library, DB_DATE_FORMAT};
+use crate::photosort_core::progress::Phase;
+use crate::photosort_core::scan::join_library_path;
 use rusqlite::params;
 use std::collections::HashMap;
 use std::io::{self, Write};
 use std::path::{Path, PathBuf};
 use std::process::Command;
+use std::time::Duration;
 use time::OffsetDateTime;
 
 /// Result of a push operation.
@@ -15,6 +18,9 @@ pub struct PushResult {
     pub bytes_transferred: u64,
     pub conflicts_resolved: usize,
     pub skipped: usize,
+    /// Media copied to a mounted remote, as (path there, hash it should have).
+    /// SSH remotes are copied with rsync and not listed.
+    pub pushed: Vec<(PathBuf, String)>,
 }
 
 /// A detected conflict between local and remote sidecars.
@@ -151,10 +157,14 @@ struct SidecarInfo {
 }
 
 /// Push local library to remote library.
+///
+/// With `lock_wait`, either library's database being locked by another
+/// process makes the push wait up to that long instead of failing.
 pub fn push(
     lib: &mut Library,
     remote_str: &str,
     dry_run: bool,
+    lock_wait: Option<Duration>,
 ) -> Result<PushResult> {
     let remote = RemoteLibrary::parse(remote_str)?;
 
@@ -176,6 +186,22 @@ pub fn push(
     // Get remote database for comparison
     let remote_db_path = remote.get_database_path()?;
     let remote_conn = rusqlite::Connection::open(&remote_db_path)?;
+    if let Some(wait) = lock_wait {
+        remote_conn.busy_timeout(wait)?;
+        lib.database().set_busy_timeout(wait)?;
+    }
+
+    // Media are matched by hash, which only works if both write hashes alike.
+    // Libraries from before settings existed have none, and use base64.
+    let remote_encoding: Option<String> = remote_conn
+        .query_row("SELECT value FROM settings WHERE key = ?1", ["hash_encoding"], |row| row.get(0))
+        .ok();
+    if parse_hash_encoding(remote_encoding.as_deref())? != lib.hash_encoding()? {
+        return Err(PhotosortError::Library(format!(
+            "{} stores hashes in a different encoding; convert one library with convert-hashes first",
+            remote_str
+        )));
+    }
 
     // Build maps of what exists in each library
     let local_media = get_media_map(lib.database().connection_ref())?;
@@ -188,8 +214,15 @@ pub fn push(
     let mut new_media: Vec<&MediaInfo> = Vec::new();
     let mut sidecar_updates: Vec<(&str, &SidecarInfo)> = Vec::new();
     let mut conflicts: Vec<SidecarConflict> = Vec::new();
+    let mut cataloged = 0;
 
     for (hash, local_info) in &local_media {
+        // Cataloged media live in their source, outside the library, and stay there
+        if Path::new(&local_info.relpath).is_absolute() {
+            log::debug!("Not pushing cataloged {}/{}", local_info.relpath, local_info.filename);
+            cataloged += 1;
+            continue;
+        }
         if !remote_media.contains_key(hash) {
             // New media - doesn't exist on remote
             new_media.push(local_info);
@@ -216,22 +249,18 @@ pub fn push(
                                     local_size: local_sc.file_size,
                                     remote_modified: remote_sc.modified_at.clone(),
                                     remote_size: remote_sc.file_size,
-                                    local_path: lib
-                                        .root()
-                                        .join(&local_info.relpath)
-                                        .join(sc_name),
+                                    local_path: lib.file_path(&local_info.relpath, sc_name),
                                     remote_path: if remote.is_ssh {
                                         PathBuf::from(format!(
                                             "{}/{}",
                                             remote_info.relpath, sc_name
                                         ))
                                     } else {
-                                        remote
-                                            .local_path
-                                            .as_ref()
-                                            .unwrap()
-                                            .join(&remote_info.relpath)
-                                            .join(sc_name)
+                                        join_library_path(
+                                            remote.local_path.as_ref().unwrap(),
+                                            &remote_info.relpath,
+                                            sc_name,
+                                        )
                                     },
                                 });
                             }
@@ -255,6 +284,9 @@ pub fn push(
     println!("  New media:        {}", new_media.len());
     println!("  Sidecar updates:  {}", sidecar_updates.len());
     println!("  Conflicts:        {}", conflicts.len());
+    if cataloged > 0 {
+        println!("  Cataloged (kept): {}", cataloged);
+    }
     println!("─────────────────────────────────\n");
 
     if new_media.is_empty() && sidecar_updates.is_empty() && conflicts.is_empty() {
@@ -264,7 +296,8 @@ pub fn push(
             sidecars_pushed: 0,
             bytes_transferred: 0,
             conflicts_resolved: 0,
-            skipped: 0,
+            skipped: cataloged,
+            pushed: Vec::new(),
         });
     }
 
@@ -363,7 +396,8 @@ pub fn push(
             sidecars_pushed: 0,
             bytes_transferred: 0,
             conflicts_resolved: 0,
-            skipped: 0,
+            skipped: cataloged,
+            pushed: Vec::new(),
         });
     }
 
@@ -372,23 +406,39 @@ pub fn push(
     let mut sidecars_pushed = 0;
     let mut bytes_transferred = 0u64;
     let mut conflicts_resolved = 0;
-    let mut skipped = 0;
+    let mut skipped = cataloged;
+    let mut pushed = Vec::new();
+    // Each photo or video counts as one step with its sidecars
+    let phase = Phase::quiet(
+        lib.progress_observer(),
+        "Pushing files",
+        (new_media.len() + sidecar_updates.len() + conflicts.len()) as u64,
+    );
 
     // Push new media files
     for media in &new_media {
-        let local_path = lib.root().join(&media.relpath).join(&media.filename);
+        let local_path = lib.file_path(&media.relpath, &media.filename);
         let result = push_file(&local_path, &remote, &media.relpath)?;
         if result {
             files_pushed += 1;
             if let Ok(metadata) = std::fs::metadata(&local_path) {
                 bytes_transferred += metadata.len();
             }
+            if let Some(remote_root) = &remote.local_path {
+                // The copy matches the stored file, which differs from the source after --strip
+                let stored_hash: String = lib.database().connection_ref().query_row(
+                    "SELECT COALESCE(stored_hash, hash) FROM media WHERE hash = ?1",
+                    params![media.hash],
+                    |row| row.get(0),
+                )?;
+                pushed.push((join_library_path(remote_root, &media.relpath, &media.filename), stored_hash));
+            }
         }
 
         // Also push any sidecars for this media
         if let Some(sidecars) = local_sidecars.get(&media.hash) {
             for sc_name in sidecars.keys() {
-                let sc_path = lib.root().join(&media.relpath).join(sc_name);
+                let sc_path = lib.file_path(&media.relpath, sc_name);
                 if sc_path.exists() {
                     let result = push_file(&sc_path, &remote, &media.relpath)?;
                     if result {
@@ -400,12 +450,13 @@ pub fn push(
                 }
             }
         }
+        phase.file_done(&local_path);
     }
 
     // Push sidecar updates
     for (hash, sc) in &sidecar_updates {
         if let Some(media) = local_media.get(*hash) {
-            let sc_path = lib.root().join(&media.relpath).join(&sc.filename);
+            let sc_path = lib.file_path(&media.relpath, &sc.filename);
             if sc_path.exists() {
                 let result = push_file(&sc_path, &remote, &media.relpath)?;
                 if result {
@@ -415,6 +466,9 @@ pub fn push(
                     }
                 }
             }
+            phase.file_done(&sc_path);
+        } else {
+            phase.inc();
         }
     }
 
@@ -442,6 +496,7 @@ pub fn push(
                 }
             }
         }
+        phase.file_done(&conflict.local_path);
     }
 
     // Record push in history
@@ -466,6 +521,7 @@ pub fn push(
         bytes_transferred,
         conflicts_resolved,
         skipped,
+        pushed,
     })
 }
 
@@ -525,11 +581,19 @@ fn get_sidecar_map(
     Ok(map)
 }
 
-/// Push a single file to the remote.
+/// Push a single file to the remote, into the library folder `relpath`.
 fn push_file(local_path: &Path, remote: &RemoteLibrary, relpath: &str) -> Result<bool> {
     if !local_path.exists() {
         return Ok(false);
     }
+    // Joined onto the remote root, these would write outside it (or onto the file itself)
+    if Path::new(relpath).is_absolute() || relpath.split('/').any(|part| part == "..") {
+        return Err(PhotosortError::Library(format!(
+            "won't push {} outside the remote library ({})",
+            local_path.display(),
+            relpath
+        )));
+    }
 
     if remote.is_ssh {
         // Use rsync for SSH
@@ -569,6 +633,77 @@ fn push_file(local_path: &Path, remote: &RemoteLibrary, relpath: &str) -> Result
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::photosort_core::database::wait_while_locked;
+    use crate::photosort_core::import::{ImportOptions, DB_FILE_NAME};
+    use assert_fs::TempDir;
+    use std::time::Instant;
+
+    #[test]
+    fn test_push_waits_out_brief_lock() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        std::fs::create_dir_all(&source).unwrap();
+        std::fs::write(source.join("IMG_1.jpg"), b"photo").unwrap();
+        let local_dir = temp_dir.path().join("local");
+        let remote_dir = temp_dir.path().join("remote");
+        Library::create(&local_dir).unwrap().import(&source, &ImportOptions::default()).unwrap();
+        Library::create(&remote_dir).unwrap();
+
+        // Another process holds the local library's write lock for a moment
+        let hold = Duration::from_millis(300);
+        let lock = |dir: &Path| {
+            let conn = rusqlite::Connection::open(dir.join(DB_FILE_NAME)).unwrap();
+            conn.execute_batch("BEGIN IMMEDIATE").unwrap();
+            std::thread::spawn(move || {
+                std::thread::sleep(hold);
+                conn.execute_batch("COMMIT").unwrap();
+            })
+        };
+
+        let started = Instant::now();
+        let holder = lock(&local_dir);
+        let mut lib = wait_while_locked(Duration::from_secs(30), || Library::open(&local_dir)).unwrap();
+        holder.join().unwrap();
+
+        // And again while the push records itself
+        let holder = lock(&local_dir);
+        let result = push(&mut lib, remote_dir.to_str().unwrap(), false, Some(Duration::from_secs(30))).unwrap();
+        holder.join().unwrap();
+        assert_eq!(result.files_pushed, 1);
+        assert!(started.elapsed() >= hold);
+    }
+
+    #[test]
+    fn test_push_leaves_cataloged_files_in_their_source() {
+        let temp_dir = TempDir::new().unwrap();
+        let archive = temp_dir.path().join("archive");
+        std::fs::create_dir_all(&archive).unwrap();
+        std::fs::write(archive.join("IMG_1.jpg"), b"archived photo").unwrap();
+        std::fs::write(archive.join("IMG_1.xmp"), b"<edits/>").unwrap();
+        let local_dir = temp_dir.path().join("local");
+        let remote_dir = temp_dir.path().join("remote");
+        let mut lib = Library::create(&local_dir).unwrap();
+        let options = ImportOptions { catalog: true, ..Default::default() };
+        lib.import(&archive, &options).unwrap();
+        Library::create(&remote_dir).unwrap();
+
+        let result = push(&mut lib, remote_dir.to_str().unwrap(), false, None).unwrap();
+        assert_eq!((result.files_pushed, result.sidecars_pushed, result.skipped), (0, 0, 1));
+        assert_eq!(std::fs::read(archive.join("IMG_1.jpg")).unwrap(), b"archived photo");
+        assert_eq!(std::fs::read(archive.join("IMG_1.xmp")).unwrap(), b"<edits/>");
+    }
+
+    #[test]
+    fn test_push_file_refuses_paths_outside_the_remote() {
+        let temp_dir = TempDir::new().unwrap();
+        let file = temp_dir.path().join("IMG_1.jpg");
+        std::fs::write(&file, b"photo").unwrap();
+        let remote = RemoteLibrary::parse(temp_dir.path().to_str().unwrap()).unwrap();
+        for relpath in [temp_dir.path().to_str().unwrap(), "images/../../elsewhere"] {
+            assert!(push_file(&file, &remote, relpath).is_err(), "{}", relpath);
+        }
+        assert_eq!(std::fs::read(&file).unwrap(), b"photo");
+    }
 
     #[test]
     fn test_parse_local_path() {
@@ -0,0 +1,203 @@
+use crate::photosort_core::error::{PhotosortError, Result};
+use crate::photosort_core::exif::{exiftool_available, extract_metadata_on_thread};
+use crate::photosort_core::import::Library;
+use crate::photosort_core::progress;
+use crate::photosort_core::report::Report;
+use crate::photosort_core::scan::join_library_path;
+use rayon::prelude::*;
+use rusqlite::params;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+
+/// Rows read and written per transaction. A cancelled run keeps every
+/// finished batch, and the next run picks up from there.
+const REFRESH_BATCH: usize = 500;
+
+/// Which derived fields to recompute for media already in the library.
+#[derive(Debug, Clone, Default)]
+pub struct RefreshOptions {
+    /// Pixel width and height.
+    pub dimensions: bool,
+    /// Recompute fields that are already filled, not just missing ones.
+    pub all: bool,
+    /// Set from another thread to stop after the current batch.
+    pub cancel: Option<Arc<AtomicBool>>,
+}
+
+/// Result of refreshing a library.
+#[derive(Debug, Default)]
+pub struct RefreshResult {
+    /// Media files read.
+    pub checked: usize,
+    /// Media rows whose fields were updated.
+    pub updated: usize,
+    /// Media files that are no longer on disk.
+    pub missing: usize,
+    /// True if the run was cancelled before every file was read.
+    pub cancelled: bool,
+}
+
+impl RefreshResult {
+    pub fn report(&self) -> Report {
+        Report::new(if self.cancelled { "Refresh cancelled." } else { "Refresh complete!" })
+            .field("checked", "files read", self.checked)
+            .field("updated", "records updated", self.updated)
+            .field("missing", "files missing", self.missing)
+    }
+}
+
+/// Recompute derived fields for media already in the library, so data added
+/// by a newer version doesn't require importing everything again.
+pub fn refresh(lib: &mut Library, options: &RefreshOptions) -> Result<RefreshResult> {
+    if !options.dimensions {
+        return Err(PhotosortError::Argument(
+            "nothing to refresh; pick a field such as --dimensions".to_string(),
+        ));
+    }
+    if !exiftool_available() {
+        return Err(PhotosortError::Exiftool(
+            "exiftool is not installed or not in PATH".to_string(),
+        ));
+    }
+
+    let root = lib.root().to_path_buf();
+    let query = if options.all {
+        "SELECT id, relpath, filename FROM media ORDER BY id"
+    } else {
+        "SELECT id, relpath, filename FROM media WHERE width IS NULL OR height IS NULL ORDER BY id"
+    };
+    let rows = {
+        let conn = lib.database().connection_ref();
+        let mut stmt = conn.prepare(query)?;
+        stmt.query_map([], |row| {
+            Ok((row.get::<_, i64>(0)?, row.get::<_, String>(1)?, row.get::<_, String>(2)?))
+        })?
+        .collect::<rusqlite::Result<Vec<_>>>()?
+    };
+
+    let bar = progress::bar(rows.len() as u64);
+    bar.set_message("Refreshing metadata");
+
+    let mut result = RefreshResult::default();
+    for batch in rows.chunks(REFRESH_BATCH) {
+        if options.cancel.as_ref().is_some_and(|c| c.load(Ordering::Relaxed)) {
+            result.cancelled = true;
+            break;
+        }
+
+        // None for a file that's gone; Some(None) if exiftool can't tell its size
+        let read: Vec<(i64, Option<Option<(u32, u32)>>)> = batch
+            .par_iter()
+            .map(|(id, relpath, filename)| {
+                let path = join_library_path(&root, relpath, filename);
+                let dimensions = if path.exists() {
+                    Some(match extract_metadata_on_thread(&path, &[], false) {
+                        Ok(extracted) => extracted.dimensions,
+                        Err(e) => {
+                            log::warn!("Failed to extract metadata from {}: {}", path.display(), e);
+                            None
+                        }
+                    })
+                } else {
+                    None
+                };
+                bar.inc(1);
+                (*id, dimensions)
+            })
+            .collect();
+
+        let tx = lib.database_mut().connection().transaction()?;
+        for (id, dimensions) in read {
+            match dimensions {
+                None => result.missing += 1,
+                Some(dimensions) => {
+                    result.checked += 1;
+                    if let Some((width, height)) = dimensions {
+                        tx.execute(
+                            "UPDATE media SET width = ?1, height = ?2 WHERE id = ?3",
+                            params![width, height, id],
+                        )?;
+                        result.updated += 1;
+                    }
+                }
+            }
+        }
+        tx.commit()?;
+    }
+
+    bar.finish_with_message(if result.cancelled { "Refresh cancelled" } else { "Refresh complete" });
+    Ok(result)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::photosort_core::import::hash_file;
+    use assert_fs::TempDir;
+    use std::fs;
+    use std::path::Path;
+
+    #[test]
+    fn test_refresh_fills_missing_dimensions() {
+        if !exiftool_available() {
+            eprintln!("skipping: exiftool not installed");
+            return;
+        }
+
+        let temp_dir = TempDir::new().unwrap();
+        let mut lib = Library::create(temp_dir.path()).unwrap();
+        let relpath = "images/2024/01-01";
+        let dir = temp_dir.path().join(relpath);
+        fs::create_dir_all(&dir).unwrap();
+        let fixture = Path::new(env!("CARGO_MANIFEST_DIR")).join("tests/fixtures/IMG_E8109.JPG");
+        fs::copy(&fixture, dir.join("IMG_E8109.JPG")).unwrap();
+
+        // As stored by a version that didn't record dimensions
+        lib.database()
+            .connection_ref()
+            .execute(
+                "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+                 VALUES (?1, 'IMG_E8109.JPG', ?2, 'image', 'JPG', 1, '2024:01:01 00:00:00.0+00:00', '2024:01:01 00:00:00.0+00:00')",
+                params![hash_file(&fixture).unwrap(), relpath],
+            )
+            .unwrap();
+        lib.database()
+            .connection_ref()
+            .execute(
+                "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+                 VALUES ('gone', 'gone.jpg', ?1, 'image', 'JPG', 1, '2024:01:01 00:00:00.0+00:00', '2024:01:01 00:00:00.0+00:00')",
+                params![relpath],
+            )
+            .unwrap();
+
+        let options = RefreshOptions {
+            dimensions: true,
+            ..Default::default()
+        };
+        let result = refresh(&mut lib, &options).unwrap();
+        assert_eq!(result.checked, 1);
+        assert_eq!(result.updated, 1);
+        assert_eq!(result.missing, 1);
+
+        let (width, height): (i64, i64) = lib
+            .database()
+            .connection_ref()
+            .query_row("SELECT width, height FROM media WHERE filename = 'IMG_E8109.JPG'", [], |row| {
+                Ok((row.get(0)?, row.get(1)?))
+            })
+            .unwrap();
+        assert!(width > 0 && height > 0);
+
+        // Already filled, so only the missing file is looked at again
+        let result = refresh(&mut lib, &options).unwrap();
+        assert_eq!(result.checked, 0);
+        assert_eq!(result.missing, 1);
+    }
+
+    #[test]
+    fn test_refresh_needs_a_field() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut lib = Library::create(temp_dir.path()).unwrap();
+        assert!(refresh(&mut lib, &RefreshOptions::default()).is_err());
+    }
+}
@@ -0,0 +1,277 @@
+use crate::photosort_core::cli::StorageLayout;
+use crate::photosort_core::error::{PhotosortError, Result};
+use crate::photosort_core::import::{content_hash, create_dir_all_with_mode, hash_file_as, Library};
+use crate::photosort_core::objects::{link_object, object_path};
+use crate::photosort_core::progress;
+use crate::photosort_core::report::Report;
+use rayon::prelude::*;
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+use walkdir::WalkDir;
+
+/// Options for restoring missing library files.
+#[derive(Debug, Clone, Default)]
+pub struct RehydrateOptions {
+    /// List what would be restored without copying anything.
+    pub dry_run: bool,
+}
+
+/// Result of restoring missing library files from a source.
+#[derive(Debug, Default)]
+pub struct RehydrateResult {
+    /// Library files (media and sidecars) missing from disk.
+    pub missing: usize,
+    /// Library paths restored (or that would be, in a dry run).
+    pub restored: Vec<PathBuf>,
+    /// Library paths with no file of the same content in the source.
+    pub not_found: Vec<PathBuf>,
+    /// Source files hashed while looking for matches.
+    pub source_files_hashed: usize,
+}
+
+impl RehydrateResult {
+    pub fn report(&self, dry_run: bool) -> Report {
+        let (title, restored) = if dry_run {
+            ("[DRY RUN] Rehydrate", "files that would be restored")
+        } else {
+            ("Rehydrate complete!", "files restored")
+        };
+        let rows = self
+            .not_found
+            .iter()
+            .map(|p| vec![p.display().to_string().into()])
+            .collect();
+        Report::new(title)
+            .field("missing", "files missing", self.missing)
+            .field("restored", restored, self.restored.len())
+            .field("not_found", "not found in source", self.not_found.len())
+            .field("hashed", "source files hashed", self.source_files_hashed)
+            .list("not_found_files", "not found in source", &["path"], rows)
+    }
+}
+
+/// A library file that's gone from disk.
+struct MissingFile {
+    /// Where the content is stored: the file itself, or its object in a
+    /// content-addressed library.
+    destination: PathBuf,
+    /// Date-folder symlink to recreate after restoring an object.
+    link: Option<PathBuf>,
+    hash: String,
+    file_size: u64,
+}
+
+/// Copy library files that have gone missing back into place from `source`,
+/// matching them by hash. The database is left as it is, so every record
+/// keeps its metadata.
+pub fn rehydrate(lib: &Library, source: &Path, options: &RehydrateOptions) -> Result<RehydrateResult> {
+    if !source.is_dir() {
+        return Err(PhotosortError::NotADirectory(source.to_path_buf()));
+    }
+
+    let missing = missing_files(lib)?;
+    let mut result = RehydrateResult {
+        missing: missing.len(),
+        ..Default::default()
+    };
+    if missing.is_empty() {
+        return Ok(result);
+    }
+    log::info!("{} library files are missing; looking for them in {}", missing.len(), source.display());
+
+    // Only files of a size something is missing at are worth hashing
+    let sizes: HashSet<u64> = missing.iter().map(|m| m.file_size).collect();
+    let wanted: HashSet<&str> = missing.iter().map(|m| m.hash.as_str()).collect();
+    let encoding = lib.hash_encoding()?;
+    let candidates: Vec<PathBuf> = WalkDir::new(source)
+        .sort_by_file_name()
+        .into_iter()
+        .filter_map(|e| e.ok())
+        .filter(|e| e.file_type().is_file())
+        .filter(|e| e.metadata().is_ok_and(|m| sizes.contains(&m.len())))
+        .map(|e| e.into_path())
+        .collect();
+    result.source_files_hashed = candidates.len();
+
+    let bar = progress::bar(candidates.len() as u64);
+    bar.set_message("Hashing source files");
+
+    let hashed: Vec<(String, &PathBuf)> = candidates
+        .par_iter()
+        .filter_map(|path| {
+            let hash = hash_file_as(path, encoding);
+            bar.inc(1);
+            match hash {
+                Ok(hash) if wanted.contains(hash.as_str()) => Some((hash, path)),
+                Ok(_) => None,
+                Err(e) => {
+                    log::warn!("Failed to hash {}: {}", path.display(), e);
+                    None
+                }
+            }
+        })
+        .collect();
+    bar.finish_with_message("Hashing complete");
+
+    // The first copy in name order wins, so a rerun picks the same file
+    let mut found: HashMap<String, &PathBuf> = HashMap::new();
+    for (hash, path) in hashed.into_iter().rev() {
+        found.insert(hash, path);
+    }
+
+    for file in missing {
+        let shown = file.link.clone().unwrap_or_else(|| file.destination.clone());
+        let Some(source_path) = found.get(&file.hash) else {
+            result.not_found.push(shown);
+            continue;
+        };
+        if !options.dry_run {
+            restore(lib.root(), source_path, &file)?;
+            log::info!("Restored {} from {}", shown.display(), source_path.display());
+        }
+        result.restored.push(shown);
+    }
+
+    result.restored.sort();
+    result.not_found.sort();
+    Ok(result)
+}
+
+fn restore(root: &Path, source: &Path, file: &MissingFile) -> Result<()> {
+    // Another record of the same content may have brought the object back already
+    if !file.destination.exists() {
+        if let Some(parent) = file.destination.parent() {
+            create_dir_all_with_mode(parent, None)?;
+        }
+        fs::copy(source, &file.destination)?;
+    }
+    if let Some(link) = &file.link {
+        if !link.exists() {
+            link_object(root, &file.destination, link, None)?;
+        }
+    }
+    Ok(())
+}
+
+/// Media and sidecar records whose file isn't on disk.
+fn missing_files(lib: &Library) -> Result<Vec<MissingFile>> {
+    let root = lib.root();
+    let content_layout = lib.layout()? == StorageLayout::Content;
+    let conn = lib.database().connection_ref();
+    let mut missing = Vec::new();
+
+    let mut stmt = conn.prepare("SELECT relpath, filename, hash, file_size, filetype FROM media ORDER BY id")?;
+    let rows = stmt.query_map([], |row| {
+        Ok((
+            row.get::<_, String>(0)?,
+            row.get::<_, String>(1)?,
+            row.get::<_, String>(2)?,
+            row.get::<_, i64>(3)? as u64,
+            row.get::<_, String>(4)?,
+        ))
+    })?;
+    for row in rows {
+        let (relpath, filename, hash, file_size, filetype) = row?;
+        let path = lib.file_path(&relpath, &filename);
+        if path.exists() {
+            continue;
+        }
+        let (destination, link) = if content_layout {
+            (object_path(root, &hash, &filetype), Some(path))
+        } else {
+            (path, None)
+        };
+        missing.push(MissingFile {
+            destination,
+            link,
+            hash: content_hash(&hash).to_string(),
+            file_size,
+        });
+    }
+
+    // Sidecars are always regular files in the date folders
+    let mut stmt = conn.prepare(
+        "SELECT m.relpath, s.filename, s.hash, s.file_size
+         FROM sidecars s JOIN media m ON m.id = s.media_id ORDER BY s.id",
+    )?;
+    let rows = stmt.query_map([], |row| {
+        Ok((
+            row.get::<_, String>(0)?,
+            row.get::<_, String>(1)?,
+            row.get::<_, String>(2)?,
+            row.get::<_, i64>(3)? as u64,
+        ))
+    })?;
+    for row in rows {
+        let (relpath, filename, hash, file_size) = row?;
+        let path = lib.file_path(&relpath, &filename);
+        if !path.exists() {
+            missing.push(MissingFile {
+                destination: path,
+                link: None,
+                hash,
+                file_size,
+            });
+        }
+    }
+
+    Ok(missing)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::photosort_core::import::ImportOptions;
+    use crate::photosort_core::verify::{verify, VerifyOptions};
+    use assert_fs::TempDir;
+
+    #[test]
+    fn test_rehydrate_restores_missing_files() {
+        let temp_dir = TempDir::new().unwrap();
+        let card = temp_dir.path().join("card");
+        fs::create_dir_all(&card).unwrap();
+        fs::write(card.join("IMG_1.jpg"), b"first photo").unwrap();
+        fs::write(card.join("IMG_1.xmp"), b"edit").unwrap();
+        fs::write(card.join("IMG_2.jpg"), b"second photo").unwrap();
+        fs::write(card.join("IMG_3.jpg"), b"third photo").unwrap();
+
+        let mut lib = Library::create(&temp_dir.path().join("library")).unwrap();
+        lib.import(&card, &ImportOptions::default()).unwrap();
+        let stored = |name: &str| {
+            WalkDir::new(lib.root().join("images"))
+                .into_iter()
+                .filter_map(|e| e.ok())
+                .find(|e| e.file_name() == name)
+                .unwrap()
+                .into_path()
+        };
+        let (photo, sidecar, gone) = (stored("IMG_1.jpg"), stored("IMG_1.xmp"), stored("IMG_3.jpg"));
+        fs::remove_file(&photo).unwrap();
+        fs::remove_file(&sidecar).unwrap();
+        fs::remove_file(&gone).unwrap();
+
+        // The card was reorganized since, and lost one photo
+        let source = temp_dir.path().join("card_copy");
+        fs::create_dir_all(source.join("DCIM")).unwrap();
+        fs::copy(card.join("IMG_1.jpg"), source.join("DCIM/renamed.jpg")).unwrap();
+        fs::copy(card.join("IMG_1.xmp"), source.join("DCIM/renamed.xmp")).unwrap();
+        fs::copy(card.join("IMG_2.jpg"), source.join("IMG_2.jpg")).unwrap();
+
+        let dry_run = rehydrate(&lib, &source, &RehydrateOptions { dry_run: true }).unwrap();
+        assert_eq!(dry_run.restored.len(), 2);
+        assert!(!photo.exists());
+
+        let result = rehydrate(&lib, &source, &RehydrateOptions::default()).unwrap();
+        assert_eq!(result.missing, 3);
+        assert_eq!(result.restored.len(), 2);
+        assert_eq!(result.not_found, vec![gone]);
+        assert_eq!(fs::read(&photo).unwrap(), b"first photo");
+        assert_eq!(fs::read(&sidecar).unwrap(), b"edit");
+
+        let verified = verify(&lib, &VerifyOptions::default()).unwrap();
+        assert_eq!(verified.checked, 3);
+        assert_eq!(verified.missing.len(), 1);
+        assert!(verified.mismatched.is_empty());
+    }
+}
@@ -0,0 +1,366 @@
+use crate::photosort_core::error::Result;
+use crate::photosort_core::import::Library;
+use crate::photosort_core::journal::{self, JournalEntry};
+use crate::photosort_core::objects::{move_in_library, remove_unlinked_objects};
+use crate::photosort_core::scan::{join_library_path, split_library_path};
+use crate::photosort_core::trash::Trash;
+use rusqlite::params;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+
+/// Options controlling a removal.
+#[derive(Debug, Clone, Default)]
+pub struct RemoveOptions {
+    /// Show what would be removed without making changes.
+    pub dry_run: bool,
+    /// Delete files outright instead of moving them to the trash.
+    pub permanent: bool,
+}
+
+/// Outcome of a removal.
+#[derive(Debug, Default)]
+pub struct RemoveResult {
+    pub media_removed: usize,
+    pub files_trashed: usize,
+    pub files_deleted: usize,
+    /// Requested paths with no matching media record.
+    pub not_found: Vec<PathBuf>,
+}
+
+/// Remove media (and their sidecars) from the library.
+///
+/// Database rows are deleted; files go to `.trash/<timestamp>/` unless
+/// `permanent` is set. Both can be restored with `undo`, until the trash is emptied.
+/// Files cataloged outside the library are left alone.
+pub fn remove_media(lib: &mut Library, paths: &[PathBuf], options: &RemoveOptions) -> Result<RemoveResult> {
+    let root = lib.root().to_path_buf();
+    let mut result = RemoveResult::default();
+
+    // Resolve each path (or hash prefix) to its media row and the files on disk that belong to it
+    let mut targets: Vec<(i64, Vec<PathBuf>)> = Vec::new();
+    for path in paths {
+        let Some(id) = lib.find_media(path)? else {
+            result.not_found.push(path.clone());
+            continue;
+        };
+
+        let conn = lib.database().connection_ref();
+        let (relpath, filename): (String, String) = conn.query_row(
+            "SELECT relpath, filename FROM media WHERE id = ?1",
+            params![id],
+            |row| Ok((row.get(0)?, row.get(1)?)),
+        )?;
+
+        let mut files = vec![join_library_path(&root, &relpath, &filename)];
+        let mut stmt = conn.prepare("SELECT filename FROM sidecars WHERE media_id = ?1")?;
+        for sidecar in stmt.query_map(params![id], |row| row.get::<_, String>(0))? {
+            files.push(join_library_path(&root, &relpath, &sidecar?));
+        }
+        targets.push((id, files));
+    }
+
+    if options.dry_run {
+        for (_, files) in &targets {
+            for f in files {
+                println!("Would remove {}", f.display());
+            }
+        }
+        result.media_removed = targets.len();
+        return Ok(result);
+    }
+
+    let trash = Trash::new(&root);
+    let conn = lib.database_mut().connection();
+    // Files trashed so far, put back if the removal can't be committed
+    let mut trashed_files: Vec<(PathBuf, PathBuf)> = Vec::new();
+    let mut remove = || -> Result<()> {
+        let tx = conn.transaction()?;
+        let op_id = journal::start(&tx, "remove")?;
+
+        for (id, files) in &targets {
+            result.media_removed += journal::delete_media(&tx, op_id, *id)?;
+
+            for file in files {
+                // Cataloged files belong to their source; only the record goes
+                if !file.starts_with(&root) || !file.exists() {
+                    continue;
+                }
+                if options.permanent {
+                    // Deleted below, once nothing refers to them
+                    continue;
+                }
+
+                let trashed = trash.move_file(file)?;
+                trashed_files.push((file.clone(), trashed.clone()));
+                journal::record(
+                    &tx,
+                    op_id,
+                    &JournalEntry::FileTrashed {
+                        path: relative_to(&root, file),
+                        trashed: relative_to(&root, &trashed),
+                    },
+                )?;
+                result.files_trashed += 1;
+            }
+        }
+
+        journal::finish(&tx, op_id)?;
+        tx.commit()?;
+        Ok(())
+    };
+    if let Err(e) = remove() {
+        for (original, trashed) in &trashed_files {
+            match move_in_library(&root, trashed, original) {
+                Ok(()) => journal::remove_empty_parents(&root, trashed),
+                Err(e) => log::warn!("Failed to restore {} from {}: {}", original.display(), trashed.display(), e),
+            }
+        }
+        return Err(e);
+    }
+
+    if options.permanent {
+        for file in targets.iter().flat_map(|(_, files)| files).filter(|f| f.starts_with(&root)) {
+            match fs::remove_file(file) {
+                Ok(()) => result.files_deleted += 1,
+                Err(e) if e.kind() == io::ErrorKind::NotFound => {}
+                Err(e) => return Err(e.into()),
+            }
+        }
+    }
+
+    // Deleting a link to an object leaves the object; collect any nothing points at now
+    if options.permanent {
+        result.files_deleted += remove_unlinked_objects(&root)?.0;
+    }
+    Ok(result)
+}
+
+/// Find the relpath and filename of a media path given on the command line,
+/// either relative to the current directory or to the library root.
+///
+/// Only the folder is canonicalized, so a link to an object in a
+/// content-addressed library names itself rather than the object.
+pub(crate) fn resolve_library_path(root: &Path, path: &Path) -> Option<(String, String)> {
+    let canonical = path.parent().filter(|p| !p.as_os_str().is_empty()).unwrap_or(Path::new(".")).canonicalize();
+    if let (Ok(root), Ok(dir), Some(name)) = (root.canonicalize(), canonical, path.file_name()) {
+        if let Some(split) = split_library_path(&root, &dir.join(name)) {
+            return Some(split);
+        }
+    }
+    split_library_path(root, path).or_else(|| split_library_path(root, &root.join(path)))
+}
+
+fn relative_to(root: &Path, path: &Path) -> String {
+    path.strip_prefix(root).unwrap_or(path).to_string_lossy().into_owned()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::photosort_core::error::PhotosortError;
+    use crate::photosort_core::trash::{empty_trash, TRASH_DIR};
+    use assert_fs::TempDir;
+
+    fn setup(temp_dir: &TempDir) -> (Library, PathBuf) {
+        let lib = Library::create(temp_dir.path()).unwrap();
+        let dir = temp_dir.path().join("images/2024/01-01");
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(dir.join("a.jpg"), b"photo").unwrap();
+        fs::write(dir.join("a.xmp"), b"sidecar").unwrap();
+
+        let conn = lib.database().connection_ref();
+        conn.execute(
+            "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+             VALUES ('h1', 'a.jpg', 'images/2024/01-01', 'image', 'JPG', 5, '2024:01:01 00:00:00.0+00:00', '2024:01:01 00:00:00.0+00:00')",
+            [],
+        ).unwrap();
+        conn.execute(
+            "INSERT INTO sidecars (media_id, filename, filetype, file_size, hash, modified_at)
+             VALUES (?1, 'a.xmp', 'XMP', 7, 's1', '2024:01:01 00:00:00.0+00:00')",
+            params![conn.last_insert_rowid()],
+        ).unwrap();
+
+        (lib, dir.join("a.jpg"))
+    }
+
+    #[test]
+    fn test_remove_moves_files_to_trash() {
+        let temp_dir = TempDir::new().unwrap();
+        let (mut lib, photo) = setup(&temp_dir);
+
+        let result = remove_media(&mut lib, &[photo.clone()], &RemoveOptions::default()).unwrap();
+        assert_eq!(result.media_removed, 1);
+        assert_eq!(result.files_trashed, 2);
+        assert_eq!(lib.database().media_count().unwrap(), 0);
+        assert!(!photo.exists());
+
+        let trashed: Vec<_> = walkdir::WalkDir::new(temp_dir.path().join(TRASH_DIR))
+            .into_iter()
+            .filter_map(|e| e.ok())
+            .filter(|e| e.file_type().is_file())
+            .collect();
+        assert_eq!(trashed.len(), 2);
+
+        let emptied = empty_trash(temp_dir.path()).unwrap();
+        assert_eq!(emptied.files_removed, 2);
+        assert_eq!(emptied.bytes_freed, 12);
+        assert!(!temp_dir.path().join(TRASH_DIR).exists());
+    }
+
+    #[test]
+    fn test_undo_remove_restores_files() {
+        let temp_dir = TempDir::new().unwrap();
+        let (mut lib, photo) = setup(&temp_dir);
+
+        remove_media(&mut lib, &[photo.clone()], &RemoveOptions::default()).unwrap();
+        let undone = journal::undo_last(&mut lib).unwrap().unwrap();
+
+        assert_eq!(undone.files_restored, 2);
+        assert_eq!(fs::read(&photo).unwrap(), b"photo");
+        assert!(photo.with_extension("xmp").exists());
+        assert_eq!(lib.database().media_count().unwrap(), 1);
+        assert_eq!(lib.database().sidecar_count().unwrap(), 1);
+    }
+
+    #[test]
+    fn test_failed_remove_puts_files_back() {
+        let temp_dir = TempDir::new().unwrap();
+        let (mut lib, photo) = setup(&temp_dir);
+        let other = photo.with_file_name("b.jpg");
+        fs::write(&other, b"other").unwrap();
+        let conn = lib.database().connection_ref();
+        conn.execute(
+            "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+             VALUES ('h2', 'b.jpg', 'images/2024/01-01', 'image', 'JPG', 5, '', '')",
+            [],
+        )
+        .unwrap();
+        // The second record can't be deleted, after the first one's files are trashed
+        conn.execute_batch(
+            "CREATE TRIGGER keep_b BEFORE DELETE ON media WHEN OLD.filename = 'b.jpg'
+             BEGIN SELECT RAISE(ABORT, 'kept'); END;",
+        )
+        .unwrap();
+
+        assert!(remove_media(&mut lib, &[photo.clone(), other.clone()], &RemoveOptions::default()).is_err());
+        assert_eq!(fs::read(&photo).unwrap(), b"photo");
+        assert!(photo.with_extension("xmp").exists());
+        assert!(other.exists());
+        assert_eq!(lib.database().media_count().unwrap(), 2);
+    }
+
+    #[test]
+    fn test_remove_permanent_skips_trash() {
+        let temp_dir = TempDir::new().unwrap();
+        let (mut lib, photo) = setup(&temp_dir);
+
+        let options = RemoveOptions { permanent: true, ..Default::default() };
+        let result = remove_media(&mut lib, &[photo.clone()], &options).unwrap();
+        assert_eq!(result.files_deleted, 2);
+        assert!(!photo.exists());
+        assert!(!temp_dir.path().join(TRASH_DIR).exists());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_remove_in_content_layout_keeps_links_working() {
+        use crate::photosort_core::cli::StorageLayout;
+        use crate::photosort_core::import::{CreateOptions, ImportOptions};
+        use crate::photosort_core::objects::OBJECTS_DIR;
+
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        fs::create_dir_all(&source).unwrap();
+        fs::write(source.join("a.jpg"), b"photo").unwrap();
+        fs::write(source.join("b.jpg"), b"other").unwrap();
+
+        let create = CreateOptions {
+            layout: StorageLayout::Content,
+            ..Default::default()
+        };
+        let root = temp_dir.path().join("lib");
+        let mut lib = Library::create_with_options(&root, &create).unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+        let stored = |lib: &Library, name: &str| -> PathBuf {
+            let relpath: String = lib
+                .database()
+                .connection_ref()
+                .query_row("SELECT relpath FROM media WHERE filename = ?1", params![name], |row| row.get(0))
+                .unwrap();
+            root.join(relpath).join(name)
+        };
+        let objects = || {
+            walkdir::WalkDir::new(root.join(OBJECTS_DIR))
+                .into_iter()
+                .filter_map(|e| e.ok())
+                .filter(|e| e.file_type().is_file())
+                .count()
+        };
+        let (a, b) = (stored(&lib, "a.jpg"), stored(&lib, "b.jpg"));
+
+        // The trashed link still reaches its object, and undo puts back a working link
+        let result = remove_media(&mut lib, &[a.clone()], &RemoveOptions::default()).unwrap();
+        assert_eq!(result.media_removed, 1);
+        assert!(a.symlink_metadata().is_err());
+        let trashed: Vec<_> = walkdir::WalkDir::new(root.join(TRASH_DIR))
+            .into_iter()
+            .filter_map(|e| e.ok())
+            .filter(|e| e.path_is_symlink())
+            .collect();
+        assert_eq!(trashed.len(), 1);
+        assert_eq!(fs::read(trashed[0].path()).unwrap(), b"photo");
+
+        journal::undo_last(&mut lib).unwrap().unwrap();
+        assert!(a.symlink_metadata().unwrap().file_type().is_symlink());
+        assert_eq!(fs::read(&a).unwrap(), b"photo");
+
+        // Emptying the trash collects the object nothing links to any more
+        remove_media(&mut lib, &[a.clone()], &RemoveOptions::default()).unwrap();
+        assert_eq!(objects(), 2);
+        let emptied = empty_trash(&root).unwrap();
+        assert_eq!((emptied.files_removed, emptied.bytes_freed), (1, 5));
+        assert_eq!(objects(), 1);
+
+        // A permanent removal collects it at once
+        let options = RemoveOptions { permanent: true, ..Default::default() };
+        let result = remove_media(&mut lib, &[b.clone()], &options).unwrap();
+        assert_eq!(result.files_deleted, 2);
+        assert_eq!(objects(), 0);
+    }
+
+    #[test]
+    fn test_remove_unknown_path() {
+        let temp_dir = TempDir::new().unwrap();
+        let (mut lib, _) = setup(&temp_dir);
+
+        let result = remove_media(&mut lib, &[PathBuf::from("images/nope.jpg")], &RemoveOptions::default()).unwrap();
+        assert_eq!(result.media_removed, 0);
+        assert_eq!(result.not_found.len(), 1);
+        assert_eq!(lib.database().media_count().unwrap(), 1);
+    }
+
+    #[test]
+    fn test_remove_by_hash_prefix() {
+        let temp_dir = TempDir::new().unwrap();
+        let (mut lib, photo) = setup(&temp_dir);
+        let conn = lib.database().connection_ref();
+        conn.execute("UPDATE media SET hash = 'q8Fz0123abcd'", []).unwrap();
+        conn.execute(
+            "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+             VALUES ('q8Fz9999wxyz', 'b.jpg', 'images/2024/01-01', 'image', 'JPG', 5, '', '')",
+            [],
+        )
+        .unwrap();
+
+        // Matches both, so nothing is removed
+        let ambiguous = remove_media(&mut lib, &[PathBuf::from("q8Fz")], &RemoveOptions::default());
+        assert!(matches!(ambiguous, Err(PhotosortError::AmbiguousHash { matches: 2, .. })));
+        assert_eq!(lib.database().media_count().unwrap(), 2);
+
+        let result = remove_media(&mut lib, &[PathBuf::from("q8Fz0")], &RemoveOptions::default()).unwrap();
+        assert_eq!(result.media_removed, 1);
+        assert!(!photo.exists());
+        assert!(lib.database().hash_exists("q8Fz9999wxyz").unwrap());
+    }
+}
@@ -0,0 +1,206 @@
+use crate::photosort_core::cli::ReportFormat;
+use crate::photosort_core::export::csv_field;
+use serde_json::Value;
+
+/// How many list entries the text format shows before summarizing the rest.
+const TEXT_LIST_LIMIT: usize = 10;
+
+/// A command's summary, renderable as text, JSON, or CSV.
+#[derive(Debug, Default)]
+pub struct Report {
+    title: String,
+    fields: Vec<Field>,
+    lists: Vec<List>,
+}
+
+#[derive(Debug)]
+struct Field {
+    key: String,
+    label: String,
+    value: Value,
+    /// Replaces the value in text output, e.g. a human-readable size.
+    display: Option<String>,
+}
+
+#[derive(Debug)]
+struct List {
+    key: String,
+    label: String,
+    columns: Vec<String>,
+    rows: Vec<Vec<Value>>,
+}
+
+impl Report {
+    pub fn new(title: &str) -> Self {
+        Report {
+            title: title.to_string(),
+            ..Default::default()
+        }
+    }
+
+    /// Add a summary value. `key` names it in JSON and CSV, `label` in text.
+    pub fn field(mut self, key: &str, label: &str, value: impl Into<Value>) -> Self {
+        self.fields.push(Field {
+            key: key.to_string(),
+            label: label.to_string(),
+            value: value.into(),
+            display: None,
+        });
+        self
+    }
+
+    /// Add a summary value shown differently in text output.
+    pub fn field_with_display(mut self, key: &str, label: &str, value: impl Into<Value>, display: String) -> Self {
+        self.fields.push(Field {
+            key: key.to_string(),
+            label: label.to_string(),
+            value: value.into(),
+            display: Some(display),
+        });
+        self
+    }
+
+    /// Add a list of items. In text output the first column is shown,
+    /// followed by the rest in parentheses.
+    pub fn list(mut self, key: &str, label: &str, columns: &[&str], rows: Vec<Vec<Value>>) -> Self {
+        self.lists.push(List {
+            key: key.to_string(),
+            label: label.to_string(),
+            columns: columns.iter().map(|c| c.to_string()).collect(),
+            rows,
+        });
+        self
+    }
+
+    pub fn render(&self, format: &ReportFormat) -> String {
+        match format {
+            ReportFormat::Text => self.render_text(),
+            ReportFormat::Json => self.render_json(),
+            ReportFormat::Csv => self.render_csv(),
+        }
+    }
+
+    fn render_text(&self) -> String {
+        let mut out = format!("{}\n", self.title);
+        for f in &self.fields {
+            let value = f.display.clone().unwrap_or_else(|| text(&f.value));
+            out.push_str(&format!("  {}: {}\n", f.label, value));
+        }
+
+        for list in self.lists.iter().filter(|l| !l.rows.is_empty()) {
+            out.push_str(&format!("\n{} ({}):\n", list.label, list.rows.len()));
+            for row in list.rows.iter().take(TEXT_LIST_LIMIT) {
+                let mut line = format!("  - {}", row.first().map(text).unwrap_or_default());
+                let rest: Vec<String> = row.iter().skip(1).map(text).filter(|s| !s.is_empty()).collect();
+                if !rest.is_empty() {
+                    line.push_str(&format!(" ({})", rest.join(", ")));
+                }
+                out.push_str(&line);
+                out.push('\n');
+            }
+            if list.rows.len() > TEXT_LIST_LIMIT {
+                out.push_str(&format!("  ... and {} more\n", list.rows.len() - TEXT_LIST_LIMIT));
+            }
+        }
+        out
+    }
+
+    fn render_json(&self) -> String {
+        let mut object = serde_json::Map::new();
+        for f in &self.fields {
+            object.insert(f.key.clone(), f.value.clone());
+        }
+        for list in &self.lists {
+            let rows = list
+                .rows
+                .iter()
+                .map(|row| Value::Object(list.columns.iter().cloned().zip(row.iter().cloned()).collect()))
+                .collect();
+            object.insert(list.key.clone(), Value::Array(rows));
+        }
+        serde_json::to_string_pretty(&Value::Object(object)).unwrap()
+    }
+
+    /// Summary values as `field,value` rows, then one block per list,
+    /// each row prefixed by the list's key.
+    fn render_csv(&self) -> String {
+        let mut out = String::from("field,value\n");
+        for f in &self.fields {
+            out.push_str(&format!("{},{}\n", csv_field(&f.key), csv_field(&text(&f.value))));
+        }
+
+        for list in self.lists.iter().filter(|l| !l.rows.is_empty()) {
+            let header: Vec<String> = list.columns.iter().map(|c| csv_field(c)).collect();
+            out.push_str(&format!("\nlist,{}\n", header.join(",")));
+            for row in &list.rows {
+                let fields: Vec<String> = row.iter().map(|v| csv_field(&text(v))).collect();
+                out.push_str(&format!("{},{}\n", csv_field(&list.key), fields.join(",")));
+            }
+        }
+        out
+    }
+}
+
+fn text(v: &Value) -> String {
+    match v {
+        Value::Null => String::new(),
+        Value::String(s) => s.clone(),
+        other => other.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn sample() -> Report {
+        Report::new("Import complete!")
+            .field("images_imported", "images imported", 3)
+            .field_with_display("bytes", "size", 2048, "2.0 KB".to_string())
+            .list(
+                "skipped_files",
+                "files skipped",
+                &["path", "reason"],
+                vec![vec![Value::from("a, b.xmp"), Value::from("sidecar with no matching photo")]],
+            )
+    }
+
+    #[test]
+    fn test_render_text() {
+        let out = sample().render(&ReportFormat::Text);
+        assert_eq!(
+            out,
+            "Import complete!\n  images imported: 3\n  size: 2.0 KB\n\n\
+             files skipped (1):\n  - a, b.xmp (sidecar with no matching photo)\n"
+        );
+    }
+
+    #[test]
+    fn test_render_text_truncates_long_lists() {
+        let rows = (0..12).map(|i| vec![Value::from(format!("f{}", i))]).collect();
+        let out = Report::new("t").list("files", "files", &["path"], rows).render(&ReportFormat::Text);
+        assert!(out.contains("  - f9\n"));
+        assert!(!out.contains("f10"));
+        assert!(out.contains("... and 2 more"));
+    }
+
+    #[test]
+    fn test_render_json() {
+        let out = sample().render(&ReportFormat::Json);
+        let parsed: Value = serde_json::from_str(&out).unwrap();
+        assert_eq!(parsed["images_imported"], 3);
+        assert_eq!(parsed["bytes"], 2048);
+        assert_eq!(parsed["skipped_files"][0]["path"], "a, b.xmp");
+        assert_eq!(parsed["skipped_files"][0]["reason"], "sidecar with no matching photo");
+    }
+
+    #[test]
+    fn test_render_csv() {
+        let out = sample().render(&ReportFormat::Csv);
+        assert_eq!(
+            out,
+            "field,value\nimages_imported,3\nbytes,2048\n\n\
+             list,path,reason\nskipped_files,\"a, b.xmp\",sidecar with no matching photo\n"
+        );
+    }
+}
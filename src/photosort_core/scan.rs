@@ -1,9 +1,15 @@
 use crate::photosort_core::database::Database;
 use crate::photosort_core::error::Result;
-use crate::photosort_core::import::{hash_file, Library, DB_DATE_FORMAT};
+use crate::photosort_core::import::{
+    hash_encoding_of, hash_file_as, is_library_database, is_library_root, is_temp_copy, Library, DB_DATE_FORMAT,
+};
+use crate::photosort_core::journal::{self, JournalEntry};
 use crate::photosort_core::media::detect_media_type;
+use crate::photosort_core::report::Report;
+use crate::photosort_core::sidecar::find_sidecars;
+use rayon::prelude::*;
 use rusqlite::params;
-use std::collections::HashSet;
+use std::collections::{HashMap, HashSet};
 use std::io::{self, Write};
 use std::path::{Path, PathBuf};
 use time::OffsetDateTime;
@@ -16,11 +22,18 @@ pub struct ScanResult {
     pub new_files: Vec<PathBuf>,
     pub modified_sidecars: Vec<ModifiedSidecar>,
     pub orphaned_sidecars: Vec<OrphanedSidecar>,
+    pub duplicate_paths: Vec<DuplicatePath>,
+    /// Sidecars on disk that the database doesn't record, when looked for.
+    pub unmatched_sidecars: Vec<UnmatchedSidecar>,
+    /// Temporary copies left behind by an import that was cut short.
+    pub leftover_temp_files: Vec<PathBuf>,
 }
 
 #[derive(Debug)]
 pub struct MissingFile {
     pub id: i64,
+    /// Hash of the file as stored, which differs from the source's if metadata was stripped.
+    pub hash: String,
     pub filename: String,
     pub relpath: String,
     pub media_type: String,
@@ -40,17 +53,130 @@ pub struct ModifiedSidecar {
 #[derive(Debug)]
 pub struct OrphanedSidecar {
     pub id: i64,
+    pub media_id: i64,
     pub filename: String,
     pub relpath: String,
     pub expected_path: PathBuf,
 }
 
+/// A sidecar next to library media with no record of its own.
+#[derive(Debug)]
+pub struct UnmatchedSidecar {
+    /// The media it would be attached to.
+    pub media_id: i64,
+    pub path: PathBuf,
+}
+
+/// A missing media row matched by hash to a file that was moved within the library.
+#[derive(Debug)]
+pub struct Relink {
+    pub id: i64,
+    pub old_path: PathBuf,
+    pub new_path: PathBuf,
+    pub new_relpath: String,
+    pub new_filename: String,
+}
+
+/// Several media rows that resolve to the same file on disk.
+#[derive(Debug)]
+pub struct DuplicatePath {
+    pub relpath: String,
+    pub filename: String,
+    pub path: PathBuf,
+    /// Row to keep: the one whose hash matches the file, else the oldest.
+    pub keep_id: i64,
+    pub redundant_ids: Vec<i64>,
+}
+
 impl ScanResult {
     pub fn is_clean(&self) -> bool {
         self.missing_files.is_empty()
             && self.new_files.is_empty()
             && self.modified_sidecars.is_empty()
             && self.orphaned_sidecars.is_empty()
+            && self.duplicate_paths.is_empty()
+            && self.unmatched_sidecars.is_empty()
+            && self.leftover_temp_files.is_empty()
+    }
+
+    /// What handling these results would change, for `scan --dry-run`.
+    /// Nothing is written; `relinks` are the moves `--relink` would record.
+    pub fn dry_run_report(&self, relinks: &[Relink]) -> Report {
+        let relinked: HashSet<i64> = relinks.iter().map(|r| r.id).collect();
+        let moved_to: HashSet<&PathBuf> = relinks.iter().map(|r| &r.new_path).collect();
+        let missing: Vec<&MissingFile> = self.missing_files.iter().filter(|m| !relinked.contains(&m.id)).collect();
+        let new_files: Vec<&PathBuf> = self.new_files.iter().filter(|p| !moved_to.contains(p)).collect();
+        // Sidecars moved along with their relinked photo are found again, not removed
+        let orphaned: Vec<&OrphanedSidecar> = self
+            .orphaned_sidecars
+            .iter()
+            .filter(|s| {
+                !relinks
+                    .iter()
+                    .any(|r| r.id == s.media_id && r.new_path.with_file_name(&s.filename).exists())
+            })
+            .collect();
+
+        let path_rows = |paths: Vec<&PathBuf>| paths.iter().map(|p| vec![p.display().to_string().into()]).collect();
+
+        Report::new("Dry run - nothing was changed. The scan would offer to:")
+            .field("relinked", "relink moved files", relinks.len())
+            .field("missing_removed", "remove records of missing files", missing.len())
+            .field("orphaned_sidecars_removed", "remove records of missing sidecars", orphaned.len())
+            .field("sidecars_rehashed", "update modified sidecars", self.modified_sidecars.len())
+            .field("new_files_added", "add new files", new_files.len())
+            .field("duplicate_paths_merged", "merge records sharing a file", self.duplicate_paths.len())
+            .field("unmatched_sidecars_attached", "attach unrecorded sidecars", self.unmatched_sidecars.len())
+            .field("temp_files_deleted", "delete leftover temporary copies", self.leftover_temp_files.len())
+            .list(
+                "relinks",
+                "Moved files to relink",
+                &["old_path", "new_path"],
+                relinks
+                    .iter()
+                    .map(|r| vec![r.old_path.display().to_string().into(), r.new_path.display().to_string().into()])
+                    .collect(),
+            )
+            .list(
+                "missing_files",
+                "Missing files whose records would be removed",
+                &["path"],
+                path_rows(missing.iter().map(|m| &m.expected_path).collect()),
+            )
+            .list(
+                "orphaned_sidecars",
+                "Missing sidecars whose records would be removed",
+                &["path"],
+                path_rows(orphaned.iter().map(|s| &s.expected_path).collect()),
+            )
+            .list(
+                "modified_sidecars",
+                "Modified sidecars to re-hash",
+                &["path"],
+                path_rows(self.modified_sidecars.iter().map(|s| &s.path).collect()),
+            )
+            .list("new_files", "New files to add", &["path"], path_rows(new_files))
+            .list(
+                "duplicate_paths",
+                "Files with several records to merge",
+                &["path", "redundant_records"],
+                self.duplicate_paths
+                    .iter()
+                    .map(|d| vec![d.path.display().to_string().into(), d.redundant_ids.len().into()])
+                    .collect(),
+            )
+            .list(
+                "unmatched_sidecars",
+                "Unrecorded sidecars to attach",
+                &["path"],
+                path_rows(self.unmatched_sidecars.iter().map(|s| &s.path).collect()),
+            )
+            .list(
+                "leftover_temp_files",
+                "Leftover temporary copies to delete",
+                &["path"],
+                path_rows(self.leftover_temp_files.iter().collect()),
+            )
     }
 }
 
@@ -59,35 +185,88 @@ pub fn scan_library(lib: &Library) -> Result<ScanResult> {
     let root = lib.root();
     let db = lib.database();
 
-    let mut result = ScanResult::default();
-
-    println!("Scanning library for changes...");
-
-    // Phase 1: Check for missing files (in DB but not on disk)
-    println!("\nChecking for missing files...");
-    result.missing_files = find_missing_files(db, root)?;
+    if lib.progress_observer().is_none() {
+        println!("Scanning library for changes...\n");
+    }
 
-    // Phase 2: Check for orphaned sidecars
-    println!("Checking for orphaned sidecars...");
-    result.orphaned_sidecars = find_orphaned_sidecars(db, root)?;
+    // Phases 1 and 2: files and sidecars in the DB but not on disk
+    let mut result = scan_missing(lib)?;
 
     // Phase 3: Check for modified sidecars
-    println!("Checking for modified sidecars...");
+    announce(lib, "Checking for modified sidecars");
     result.modified_sidecars = find_modified_sidecars(db, root)?;
 
     // Phase 4: Check for new files (on disk but not in DB)
-    println!("Checking for new files...");
-    result.new_files = find_new_files(db, root)?;
+    announce(lib, "Checking for new files");
+    let route_folders: Vec<String> = lib.type_routes()?.into_iter().map(|(_, folder)| folder).collect();
+    result.new_files = find_new_files(db, root, &route_folders)?;
+
+    // Phase 5: Check for rows sharing one file on disk
+    announce(lib, "Checking for duplicate paths");
+    result.duplicate_paths = find_duplicate_paths(db, root)?;
+
+    // Phase 6: Check for copies an interrupted import didn't finish
+    announce(lib, "Checking for leftover temporary copies");
+    result.leftover_temp_files = find_leftover_temp_files(root);
 
     Ok(result)
 }
 
+/// Check only for media files and sidecars in the database but gone from disk.
+/// Unlike `scan_library` this reads no file contents and doesn't walk the library.
+pub fn scan_missing(lib: &Library) -> Result<ScanResult> {
+    let root = lib.root();
+    let db = lib.database();
+
+    announce(lib, "Checking for missing files");
+    let missing_files = find_missing_files(db, root)?;
+
+    announce(lib, "Checking for orphaned sidecars");
+    let orphaned_sidecars = find_orphaned_sidecars(db, root)?;
+
+    Ok(ScanResult {
+        missing_files,
+        orphaned_sidecars,
+        ..Default::default()
+    })
+}
+
+/// Tell the library's progress observer, or the terminal, that a scan phase started.
+fn announce(lib: &Library, phase: &str) {
+    match lib.progress_observer() {
+        Some(observer) => observer.on_phase(phase, 0),
+        None => println!("{}...", phase),
+    }
+}
+
+/// Remove the records of missing files and sidecars without asking, as one
+/// undoable operation. Returns how many media and sidecar records were removed.
+pub fn prune_missing(lib: &mut Library, result: &ScanResult) -> Result<(usize, usize)> {
+    let op_id = journal::start(lib.database().connection_ref(), "prune")?;
+    let conn = lib.database_mut().connection();
+    let tx = conn.transaction()?;
+
+    let mut media_removed = 0;
+    for f in &result.missing_files {
+        media_removed += journal::delete_media(&tx, op_id, f.id)?;
+    }
+    // Sidecars of a removed media file went with it
+    let mut sidecars_removed = 0;
+    for f in &result.orphaned_sidecars {
+        sidecars_removed += journal::delete_sidecar(&tx, op_id, f.id)?;
+    }
+
+    tx.commit()?;
+    journal::finish(lib.database().connection_ref(), op_id)?;
+    Ok((media_removed, sidecars_removed))
+}
+
 /// Find files that are in the database but missing from disk.
 fn find_missing_files(db: &Database, root: &Path) -> Result<Vec<MissingFile>> {
     let mut missing = Vec::new();
 
     let mut stmt = db.connection_ref().prepare(
-        "SELECT id, filename, relpath, media_type FROM media"
+        "SELECT id, COALESCE(stored_hash, hash), filename, relpath, media_type FROM media"
     )?;
 
     let rows = stmt.query_map([], |row| {
@@ -96,16 +275,18 @@ fn find_missing_files(db: &Database, root: &Path) -> Result<Vec<MissingFile>> {
             row.get::<_, String>(1)?,
             row.get::<_, String>(2)?,
             row.get::<_, String>(3)?,
+            row.get::<_, String>(4)?,
         ))
     })?;
 
     for row in rows {
-        let (id, filename, relpath, media_type) = row?;
-        let expected_path = root.join(&relpath).join(&filename);
+        let (id, hash, filename, relpath, media_type) = row?;
+        let expected_path = join_library_path(root, &relpath, &filename);
 
         if !expected_path.exists() {
             missing.push(MissingFile {
                 id,
+                hash,
                 filename,
                 relpath,
                 media_type,
@@ -122,7 +303,7 @@ fn find_orphaned_sidecars(db: &Database, root: &Path) -> Result<Vec<OrphanedSide
     let mut orphaned = Vec::new();
 
     let mut stmt = db.connection_ref().prepare(
-        "SELECT s.id, s.filename, m.relpath
+        "SELECT s.id, s.media_id, s.filename, m.relpath
          FROM sidecars s
          JOIN media m ON s.media_id = m.id"
     )?;
@@ -130,18 +311,20 @@ fn find_orphaned_sidecars(db: &Database, root: &Path) -> Result<Vec<OrphanedSide
     let rows = stmt.query_map([], |row| {
         Ok((
             row.get::<_, i64>(0)?,
-            row.get::<_, String>(1)?,
+            row.get::<_, i64>(1)?,
             row.get::<_, String>(2)?,
+            row.get::<_, String>(3)?,
         ))
     })?;
 
     for row in rows {
-        let (id, filename, relpath) = row?;
-        let expected_path = root.join(&relpath).join(&filename);
+        let (id, media_id, filename, relpath) = row?;
+        let expected_path = join_library_path(root, &relpath, &filename);
 
         if !expected_path.exists() {
             orphaned.push(OrphanedSidecar {
                 id,
+                media_id,
                 filename,
                 relpath,
                 expected_path,
@@ -174,10 +357,10 @@ fn find_modified_sidecars(db: &Database, root: &Path) -> Result<Vec<ModifiedSide
 
     for row in rows {
         let (id, media_id, filename, old_hash, relpath) = row?;
-        let path = root.join(&relpath).join(&filename);
+        let path = join_library_path(root, &relpath, &filename);
 
         if path.exists() {
-            if let Ok(new_hash) = hash_file(&path) {
+            if let Ok(new_hash) = hash_file_as(&path, hash_encoding_of(&old_hash)) {
                 if new_hash != old_hash {
                     modified.push(ModifiedSidecar {
                         id,
@@ -195,8 +378,9 @@ fn find_modified_sidecars(db: &Database, root: &Path) -> Result<Vec<ModifiedSide
     Ok(modified)
 }
 
-/// Find files on disk that are not in the database.
-fn find_new_files(db: &Database, root: &Path) -> Result<Vec<PathBuf>> {
+/// Find files on disk that are not in the database, under `images/`, `videos/`
+/// and the folders filetypes are routed to.
+fn find_new_files(db: &Database, root: &Path, route_folders: &[String]) -> Result<Vec<PathBuf>> {
     // Get all known file paths from DB
     let mut known_paths: HashSet<PathBuf> = HashSet::new();
 
@@ -209,7 +393,7 @@ fn find_new_files(db: &Database, root: &Path) -> Result<Vec<PathBuf>> {
     })?;
     for row in rows {
         let (relpath, filename) = row?;
-        known_paths.insert(root.join(&relpath).join(&filename));
+        known_paths.insert(join_library_path(root, &relpath, &filename));
     }
 
     // Add sidecar files
@@ -221,27 +405,40 @@ fn find_new_files(db: &Database, root: &Path) -> Result<Vec<PathBuf>> {
     })?;
     for row in rows {
         let (relpath, filename) = row?;
-        known_paths.insert(root.join(&relpath).join(&filename));
+        known_paths.insert(join_library_path(root, &relpath, &filename));
     }
 
     // Scan filesystem
     let mut new_files = Vec::new();
-    let images_dir = root.join("images");
-    let videos_dir = root.join("videos");
-
-    for dir in [&images_dir, &videos_dir] {
+    let mut dirs = vec![root.join("images"), root.join("videos")];
+    dirs.extend(
+        route_folders
+            .iter()
+            .filter(|folder| Path::new(folder).is_relative())
+            .map(|folder| root.join(folder)),
+    );
+
+    for dir in &dirs {
         if !dir.exists() {
             continue;
         }
+        // A route folder inside another one is walked with it
+        if dirs.iter().any(|other| other != dir && dir.starts_with(other)) {
+            continue;
+        }
 
-        for entry in WalkDir::new(dir).into_iter().filter_map(|e| e.ok()) {
+        // A library kept inside this one has its own records
+        let walker = WalkDir::new(dir)
+            .into_iter()
+            .filter_entry(|e| e.depth() == 0 || !e.file_type().is_dir() || !is_library_root(e.path()));
+        for entry in walker.filter_map(|e| e.ok()) {
             let path = entry.path();
             if !path.is_file() {
                 continue;
             }
 
-            // Skip database file
-            if path.file_name().map(|f| f == "library.db").unwrap_or(false) {
+            // Skip database files
+            if is_library_database(path) {
                 continue;
             }
 
@@ -260,6 +457,317 @@ fn find_new_files(db: &Database, root: &Path) -> Result<Vec<PathBuf>> {
     Ok(new_files)
 }
 
+/// Find temporary copies `--two-pass-copy` left anywhere in the library
+/// when an import was cut short before renaming them into place.
+fn find_leftover_temp_files(root: &Path) -> Vec<PathBuf> {
+    // A library kept inside this one has its own imports
+    WalkDir::new(root)
+        .into_iter()
+        .filter_entry(|e| e.depth() == 0 || !e.file_type().is_dir() || !is_library_root(e.path()))
+        .filter_map(|e| e.ok())
+        .filter(|e| e.file_type().is_file() && is_temp_copy(e.path()))
+        .map(|e| e.into_path())
+        .collect()
+}
+
+/// Delete leftover temporary copies, returning how many were deleted. They
+/// were never part of the library, so this isn't journaled.
+pub fn delete_leftover_temp_files(paths: &[PathBuf]) -> Result<usize> {
+    for path in paths {
+        match std::fs::remove_file(path) {
+            Ok(()) => {}
+            Err(e) if e.kind() == io::ErrorKind::NotFound => {}
+            Err(e) => return Err(e.into()),
+        }
+    }
+    Ok(paths.len())
+}
+
+/// Match missing media rows to new files with the same hash.
+///
+/// Files moved or renamed by hand inside the library show up as one missing
+/// row plus one new file; relinking keeps the row (and everything attached
+/// to it) instead of deleting it and importing the file again.
+pub fn find_relinks(root: &Path, missing: &[MissingFile], new_files: &[PathBuf]) -> Vec<Relink> {
+    if missing.is_empty() || new_files.is_empty() {
+        return Vec::new();
+    }
+
+    let mut wanted: HashMap<&str, &MissingFile> =
+        missing.iter().map(|m| (m.hash.as_str(), m)).collect();
+
+    // A library writes all its hashes in one encoding
+    let encoding = hash_encoding_of(&missing[0].hash);
+    let hashed: Vec<(&PathBuf, String)> = new_files
+        .par_iter()
+        .filter_map(|path| hash_file_as(path, encoding).ok().map(|hash| (path, hash)))
+        .collect();
+
+    let mut relinks = Vec::new();
+    for (path, hash) in hashed {
+        let Some(m) = wanted.remove(hash.as_str()) else {
+            continue;
+        };
+        let Some((new_relpath, new_filename)) = split_library_path(root, path) else {
+            continue;
+        };
+        relinks.push(Relink {
+            id: m.id,
+            old_path: m.expected_path.clone(),
+            new_path: path.clone(),
+            new_relpath,
+            new_filename,
+        });
+    }
+
+    relinks
+}
+
+/// Point relinked rows at their new location, recording the old one in
+/// journal operation `op_id`. Returns the number of rows updated.
+pub fn apply_relinks(lib: &mut Library, relinks: &[Relink], op_id: i64) -> Result<usize> {
+    let conn = lib.database_mut().connection();
+    let tx = conn.transaction()?;
+    let mut updated = 0;
+
+    for r in relinks {
+        let (relpath, filename) = tx.query_row(
+            "SELECT relpath, filename FROM media WHERE id = ?1",
+            params![r.id],
+            |row| Ok((row.get::<_, String>(0)?, row.get::<_, String>(1)?)),
+        )?;
+        journal::record(&tx, op_id, &JournalEntry::MediaMoved { id: r.id, relpath, filename })?;
+        updated += tx.execute(
+            "UPDATE media SET relpath = ?1, filename = ?2 WHERE id = ?3",
+            params![r.new_relpath, r.new_filename, r.id],
+        )?;
+    }
+
+    tx.commit()?;
+    Ok(updated)
+}
+
+/// Relink moved files and drop them from the scan's missing and new lists.
+pub fn relink_moved_files(lib: &mut Library, result: &mut ScanResult) -> Result<usize> {
+    let relinks = find_relinks(lib.root(), &result.missing_files, &result.new_files);
+    if relinks.is_empty() {
+        return Ok(0);
+    }
+
+    for r in &relinks {
+        log::info!("Relinking {} -> {}", r.old_path.display(), r.new_path.display());
+    }
+    let op_id = journal::start(lib.database().connection_ref(), "relink")?;
+    let updated = apply_relinks(lib, &relinks, op_id)?;
+    journal::finish(lib.database().connection_ref(), op_id)?;
+
+    let ids: HashSet<i64> = relinks.iter().map(|r| r.id).collect();
+    let paths: HashSet<&PathBuf> = relinks.iter().map(|r| &r.new_path).collect();
+    result.missing_files.retain(|m| !ids.contains(&m.id));
+    result.new_files.retain(|p| !paths.contains(p));
+    // Sidecars were looked for next to the old paths; look again where their photos are now
+    let db = lib.database();
+    result.orphaned_sidecars = find_orphaned_sidecars(db, lib.root())?;
+    result.modified_sidecars = find_modified_sidecars(db, lib.root())?;
+
+    Ok(updated)
+}
+
+/// Find sidecars sitting next to library media that the database doesn't know
+/// about, such as files of an extension that wasn't recognized when they were
+/// imported, or an `.xmp` an editor wrote afterwards. A file next to several
+/// media goes to the earliest imported one.
+pub fn find_unmatched_sidecars(lib: &Library, extensions: &[String]) -> Result<Vec<UnmatchedSidecar>> {
+    let root = lib.root();
+    let conn = lib.database().connection_ref();
+
+    let mut claimed: HashSet<PathBuf> = conn
+        .prepare(
+            "SELECT m.relpath, s.filename FROM sidecars s JOIN media m ON m.id = s.media_id",
+        )?
+        .query_map([], |row| Ok((row.get::<_, String>(0)?, row.get::<_, String>(1)?)))?
+        .collect::<rusqlite::Result<Vec<_>>>()?
+        .into_iter()
+        .map(|(relpath, filename)| join_library_path(root, &relpath, &filename))
+        .collect();
+
+    let media: Vec<(i64, String, String)> = conn
+        .prepare("SELECT id, relpath, filename FROM media ORDER BY id")?
+        .query_map([], |row| Ok((row.get(0)?, row.get(1)?, row.get(2)?)))?
+        .collect::<rusqlite::Result<_>>()?;
+
+    let mut found = Vec::new();
+    for (media_id, relpath, filename) in media {
+        for path in find_sidecars(&join_library_path(root, &relpath, &filename), extensions) {
+            if claimed.insert(path.clone()) {
+                found.push(UnmatchedSidecar { media_id, path });
+            }
+        }
+    }
+    Ok(found)
+}
+
+/// Record found sidecars as belonging to their media, as part of operation `op_id`.
+pub fn attach_sidecars(lib: &mut Library, sidecars: &[UnmatchedSidecar], op_id: i64) -> Result<()> {
+    let encoding = lib.hash_encoding()?;
+    let conn = lib.database_mut().connection();
+    let tx = conn.transaction()?;
+    for sidecar in sidecars {
+        let path = &sidecar.path;
+        let metadata = std::fs::metadata(path)?;
+        let modified_at = metadata
+            .modified()
+            .map(OffsetDateTime::from)
+            .unwrap_or_else(|_| OffsetDateTime::now_utc());
+        tx.execute(
+            "INSERT INTO sidecars (media_id, filename, filetype, file_size, hash, modified_at)
+             VALUES (?1, ?2, ?3, ?4, ?5, ?6)",
+            params![
+                sidecar.media_id,
+                path.file_name().unwrap_or_default().to_string_lossy(),
+                path.extension().unwrap_or_default().to_string_lossy().to_uppercase(),
+                metadata.len() as i64,
+                hash_file_as(path, encoding)?,
+                modified_at.format(DB_DATE_FORMAT).unwrap(),
+            ],
+        )?;
+        journal::record(&tx, op_id, &JournalEntry::SidecarInserted { id: tx.last_insert_rowid() })?;
+    }
+    tx.commit()?;
+    Ok(())
+}
+
+/// Attach the sidecars `find_unmatched_sidecars` finds, as one undoable operation.
+/// Returns the paths attached (or that would be, with `dry_run`).
+pub fn rescan_sidecars(lib: &mut Library, extensions: &[String], dry_run: bool) -> Result<Vec<PathBuf>> {
+    let found = find_unmatched_sidecars(lib, extensions)?;
+    if !dry_run && !found.is_empty() {
+        let op_id = journal::start(lib.database().connection_ref(), "rescan-sidecars")?;
+        attach_sidecars(lib, &found, op_id)?;
+        journal::finish(lib.database().connection_ref(), op_id)?;
+    }
+    Ok(found.into_iter().map(|s| s.path).collect())
+}
+
+/// Build the path of a library file from its stored relpath and filename.
+///
+/// Relpaths are stored with forward slashes, but backslashes (from a library
+/// first filled on Windows) are accepted too, so the same row resolves to the
+/// same file on every platform. This is the inverse of [`split_library_path`].
+pub fn join_library_path(root: &Path, relpath: &str, filename: &str) -> PathBuf {
+    let mut path = root.to_path_buf();
+    path.extend(relpath.split(['/', '\\']).filter(|c| !c.is_empty()));
+    path.push(filename);
+    path
+}
+
+/// Split a path inside the library into its relpath (with forward slashes) and filename.
+pub fn split_library_path(root: &Path, path: &Path) -> Option<(String, String)> {
+    let rel = path.strip_prefix(root).ok()?;
+    let filename = rel.file_name()?.to_string_lossy().to_string();
+    let relpath = rel
+        .parent()?
+        .components()
+        .map(|c| c.as_os_str().to_string_lossy())
+        .collect::<Vec<_>>()
+        .join("/");
+    Some((relpath, filename))
+}
+
+/// Find media rows whose relpath and filename point at the same file.
+pub fn find_duplicate_paths(db: &Database, root: &Path) -> Result<Vec<DuplicatePath>> {
+    let conn = db.connection_ref();
+    let mut duplicates = Vec::new();
+
+    let mut stmt = conn.prepare(
+        "SELECT relpath, filename FROM media
+         GROUP BY relpath, filename
+         HAVING COUNT(*) > 1"
+    )?;
+    let groups = stmt
+        .query_map([], |row| Ok((row.get::<_, String>(0)?, row.get::<_, String>(1)?)))?
+        .collect::<rusqlite::Result<Vec<_>>>()?;
+
+    let mut rows_stmt = conn.prepare(
+        "SELECT id, hash FROM media WHERE relpath = ?1 AND filename = ?2 ORDER BY id"
+    )?;
+
+    for (relpath, filename) in groups {
+        let rows = rows_stmt
+            .query_map(params![relpath, filename], |row| {
+                Ok((row.get::<_, i64>(0)?, row.get::<_, String>(1)?))
+            })?
+            .collect::<rusqlite::Result<Vec<_>>>()?;
+
+        let path = join_library_path(root, &relpath, &filename);
+
+        // Prefer the row describing the bytes actually on disk
+        let disk_hash = rows.first().and_then(|(_, hash)| hash_file_as(&path, hash_encoding_of(hash)).ok());
+        let keep_id = rows
+            .iter()
+            .find(|(_, hash)| Some(hash) == disk_hash.as_ref())
+            .or(rows.first())
+            .map(|(id, _)| *id)
+            .unwrap_or_default();
+
+        let redundant_ids = rows
+            .iter()
+            .map(|(id, _)| *id)
+            .filter(|id| *id != keep_id)
+            .collect();
+
+        duplicates.push(DuplicatePath {
+            relpath,
+            filename,
+            path,
+            keep_id,
+            redundant_ids,
+        });
+    }
+
+    Ok(duplicates)
+}
+
+/// Remove redundant media rows, moving their sidecars to the kept row.
+/// Changes are recorded in journal operation `op_id`. Returns the number of rows removed.
+pub fn compact_duplicate_paths(
+    lib: &mut Library,
+    duplicates: &[DuplicatePath],
+    op_id: i64,
+) -> Result<usize> {
+    let conn = lib.database_mut().connection();
+    let tx = conn.transaction()?;
+    let mut removed = 0;
+
+    for dup in duplicates {
+        for &id in &dup.redundant_ids {
+            let sidecar_ids = tx
+                .prepare("SELECT id FROM sidecars WHERE media_id = ?1")?
+                .query_map(params![id], |row| row.get::<_, i64>(0))?
+                .collect::<rusqlite::Result<Vec<_>>>()?;
+
+            // A sidecar the kept row already has under the same name is the same file
+            for sidecar_id in sidecar_ids {
+                let moved = tx.execute(
+                    "UPDATE OR IGNORE sidecars SET media_id = ?1 WHERE id = ?2",
+                    params![dup.keep_id, sidecar_id],
+                )?;
+                if moved > 0 {
+                    journal::record(
+                        &tx,
+                        op_id,
+                        &JournalEntry::SidecarReassigned { id: sidecar_id, media_id: id },
+                    )?;
+                }
+            }
+            removed += journal::delete_media(&tx, op_id, id)?;
+        }
+    }
+
+    tx.commit()?;
+    Ok(removed)
+}
+
 /// Interactive handler for scan results.
 pub fn handle_scan_results(lib: &mut Library, result: &ScanResult) -> Result<()> {
     if result.is_clean() {
@@ -273,21 +781,31 @@ pub fn handle_scan_results(lib: &mut Library, result: &ScanResult) -> Result<()>
     println!("  Orphaned sidecars:  {}", result.orphaned_sidecars.len());
     println!("  Modified sidecars:  {}", result.modified_sidecars.len());
     println!("  New files:          {}", result.new_files.len());
+    println!("  Duplicate paths:    {}", result.duplicate_paths.len());
+    if !result.unmatched_sidecars.is_empty() {
+        println!("  Unrecorded sidecars: {}", result.unmatched_sidecars.len());
+    }
+    if !result.leftover_temp_files.is_empty() {
+        println!("  Temporary copies:   {}", result.leftover_temp_files.len());
+    }
     println!("─────────────────────────────────\n");
 
+    // Everything accepted below is undone together
+    let op_id = journal::start(lib.database().connection_ref(), "scan")?;
+
     // Handle missing files
     if !result.missing_files.is_empty() {
-        handle_missing_files(lib, &result.missing_files)?;
+        handle_missing_files(lib, &result.missing_files, op_id)?;
     }
 
     // Handle orphaned sidecars
     if !result.orphaned_sidecars.is_empty() {
-        handle_orphaned_sidecars(lib, &result.orphaned_sidecars)?;
+        handle_orphaned_sidecars(lib, &result.orphaned_sidecars, op_id)?;
     }
 
     // Handle modified sidecars
     if !result.modified_sidecars.is_empty() {
-        handle_modified_sidecars(lib, &result.modified_sidecars)?;
+        handle_modified_sidecars(lib, &result.modified_sidecars, op_id)?;
     }
 
     // Handle new files
@@ -295,10 +813,26 @@ pub fn handle_scan_results(lib: &mut Library, result: &ScanResult) -> Result<()>
         handle_new_files(lib, &result.new_files)?;
     }
 
+    // Handle rows sharing a path
+    if !result.duplicate_paths.is_empty() {
+        handle_duplicate_paths(lib, &result.duplicate_paths, op_id)?;
+    }
+
+    // Handle sidecars written next to media after they were imported
+    if !result.unmatched_sidecars.is_empty() {
+        handle_unmatched_sidecars(lib, &result.unmatched_sidecars, op_id)?;
+    }
+
+    // Handle copies an interrupted import left behind
+    if !result.leftover_temp_files.is_empty() {
+        handle_leftover_temp_files(&result.leftover_temp_files)?;
+    }
+
+    journal::finish(lib.database().connection_ref(), op_id)?;
     Ok(())
 }
 
-fn handle_missing_files(lib: &mut Library, missing: &[MissingFile]) -> Result<()> {
+fn handle_missing_files(lib: &mut Library, missing: &[MissingFile], op_id: i64) -> Result<()> {
     println!("Missing files ({}):", missing.len());
     for (i, f) in missing.iter().enumerate() {
         println!("  {}. {} ({})", i + 1, f.filename, f.media_type);
@@ -321,7 +855,7 @@ fn handle_missing_files(lib: &mut Library, missing: &[MissingFile]) -> Result<()
             let conn = lib.database_mut().connection();
             let tx = conn.transaction()?;
             for f in missing {
-                tx.execute("DELETE FROM media WHERE id = ?1", params![f.id])?;
+                journal::delete_media(&tx, op_id, f.id)?;
             }
             tx.commit()?;
             println!("Removed {} records from database.", missing.len());
@@ -336,7 +870,7 @@ fn handle_missing_files(lib: &mut Library, missing: &[MissingFile]) -> Result<()
                 let mut input = String::new();
                 io::stdin().read_line(&mut input)?;
                 if input.trim().to_lowercase() == "y" {
-                    tx.execute("DELETE FROM media WHERE id = ?1", params![f.id])?;
+                    journal::delete_media(&tx, op_id, f.id)?;
                     removed += 1;
                 }
             }
@@ -351,7 +885,34 @@ fn handle_missing_files(lib: &mut Library, missing: &[MissingFile]) -> Result<()
     Ok(())
 }
 
-fn handle_orphaned_sidecars(lib: &mut Library, orphaned: &[OrphanedSidecar]) -> Result<()> {
+fn handle_unmatched_sidecars(lib: &mut Library, unmatched: &[UnmatchedSidecar], op_id: i64) -> Result<()> {
+    println!("\nSidecars not in the database ({}):", unmatched.len());
+    for s in unmatched.iter().take(10) {
+        println!("  - {}", s.path.display());
+    }
+    if unmatched.len() > 10 {
+        println!("  ... and {} more", unmatched.len() - 10);
+    }
+
+    print!("\nAttach them to their photos? [Y/n]: ");
+    io::stdout().flush()?;
+
+    let mut input = String::new();
+    io::stdin().read_line(&mut input)?;
+
+    if input.trim().to_lowercase() != "n" {
+        attach_sidecars(lib, unmatched, op_id)?;
+        println!("Attached {} sidecars.", unmatched.len());
+    }
+
+    Ok(())
+}
+
+fn handle_orphaned_sidecars(
+    lib: &mut Library,
+    orphaned: &[OrphanedSidecar],
+    op_id: i64,
+) -> Result<()> {
     println!("\nOrphaned sidecars ({}):", orphaned.len());
     for f in orphaned.iter().take(10) {
         println!("  - {}", f.filename);
@@ -370,7 +931,7 @@ fn handle_orphaned_sidecars(lib: &mut Library, orphaned: &[OrphanedSidecar]) ->
         let conn = lib.database_mut().connection();
         let tx = conn.transaction()?;
         for f in orphaned {
-            tx.execute("DELETE FROM sidecars WHERE id = ?1", params![f.id])?;
+            journal::delete_sidecar(&tx, op_id, f.id)?;
         }
         tx.commit()?;
         println!("Removed {} orphaned sidecar records.", orphaned.len());
@@ -379,7 +940,11 @@ fn handle_orphaned_sidecars(lib: &mut Library, orphaned: &[OrphanedSidecar]) ->
     Ok(())
 }
 
-fn handle_modified_sidecars(lib: &mut Library, modified: &[ModifiedSidecar]) -> Result<()> {
+fn handle_modified_sidecars(
+    lib: &mut Library,
+    modified: &[ModifiedSidecar],
+    op_id: i64,
+) -> Result<()> {
     println!("\nModified sidecars ({}):", modified.len());
     for f in modified.iter().take(10) {
         println!("  - {} (hash changed)", f.filename);
@@ -401,6 +966,20 @@ fn handle_modified_sidecars(lib: &mut Library, modified: &[ModifiedSidecar]) ->
         let conn = lib.database_mut().connection();
         let tx = conn.transaction()?;
         for f in modified {
+            let old_modified_at: String = tx.query_row(
+                "SELECT modified_at FROM sidecars WHERE id = ?1",
+                params![f.id],
+                |row| row.get(0),
+            )?;
+            journal::record(
+                &tx,
+                op_id,
+                &JournalEntry::SidecarUpdated {
+                    id: f.id,
+                    hash: f.old_hash.clone(),
+                    modified_at: old_modified_at,
+                },
+            )?;
             tx.execute(
                 "UPDATE sidecars SET hash = ?1, modified_at = ?2 WHERE id = ?3",
                 params![f.new_hash, now_str, f.id],
@@ -429,9 +1008,345 @@ fn handle_new_files(_lib: &mut Library, new_files: &[PathBuf]) -> Result<()> {
     Ok(())
 }
 
+fn handle_leftover_temp_files(paths: &[PathBuf]) -> Result<()> {
+    println!("\nLeftover temporary copies ({}):", paths.len());
+    for p in paths.iter().take(10) {
+        println!("  - {}", p.display());
+    }
+    if paths.len() > 10 {
+        println!("  ... and {} more", paths.len() - 10);
+    }
+
+    println!("\nThese were being written by an import that was cut short.");
+    print!("Delete them? [Y/n]: ");
+    io::stdout().flush()?;
+
+    let mut input = String::new();
+    io::stdin().read_line(&mut input)?;
+
+    if input.trim().to_lowercase() != "n" {
+        let deleted = delete_leftover_temp_files(paths)?;
+        println!("Deleted {} temporary copies.", deleted);
+    }
+
+    Ok(())
+}
+
+fn handle_duplicate_paths(
+    lib: &mut Library,
+    duplicates: &[DuplicatePath],
+    op_id: i64,
+) -> Result<()> {
+    println!("\nDuplicate paths ({}):", duplicates.len());
+    for d in duplicates.iter().take(10) {
+        println!("  - {} ({} rows)", d.path.display(), d.redundant_ids.len() + 1);
+    }
+    if duplicates.len() > 10 {
+        println!("  ... and {} more", duplicates.len() - 10);
+    }
+
+    print!("\nMerge duplicate rows, keeping the one matching the file? [Y/n]: ");
+    io::stdout().flush()?;
+
+    let mut input = String::new();
+    io::stdin().read_line(&mut input)?;
+
+    if input.trim().to_lowercase() != "n" {
+        let removed = compact_duplicate_paths(lib, duplicates, op_id)?;
+        println!("Removed {} redundant records.", removed);
+    }
+
+    Ok(())
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::photosort_core::import::hash_file;
+    use assert_fs::TempDir;
+
+    fn insert_media(lib: &Library, hash: &str, relpath: &str, filename: &str) -> i64 {
+        let conn = lib.database().connection_ref();
+        conn.execute(
+            "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+             VALUES (?1, ?2, ?3, 'image', 'JPG', 4, '2024:01:01 00:00:00.0+00:00', '2024:01:01 00:00:00.0+00:00')",
+            params![hash, filename, relpath],
+        )
+        .unwrap();
+        conn.last_insert_rowid()
+    }
+
+    #[test]
+    fn test_join_library_path_slash_conventions() {
+        let root = Path::new("lib");
+        let expected = root.join("images").join("2024").join("05-21").join("IMG_1.jpg");
+        for relpath in ["images/2024/05-21", "images\\2024\\05-21", "images/2024\\05-21/"] {
+            assert_eq!(join_library_path(root, relpath, "IMG_1.jpg"), expected, "{}", relpath);
+        }
+        assert_eq!(join_library_path(root, "", "a.jpg"), root.join("a.jpg"));
+
+        let (relpath, filename) = split_library_path(root, &expected).unwrap();
+        assert_eq!(join_library_path(root, &relpath, &filename), expected);
+    }
+
+    #[test]
+    fn test_prune_missing_removes_only_deleted_files() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut lib = Library::create(temp_dir.path()).unwrap();
+
+        let dir = temp_dir.path().join("images/2024/01-01");
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("kept.jpg"), b"kept").unwrap();
+        std::fs::write(dir.join("untracked.jpg"), b"new").unwrap();
+        let kept = insert_media(&lib, "kept", "images/2024/01-01", "kept.jpg");
+        insert_media(&lib, "gone", "images/2024/01-01", "deleted.jpg");
+
+        let result = scan_missing(&lib).unwrap();
+        assert_eq!(result.missing_files.len(), 1);
+        // Nothing else is looked for
+        assert!(result.new_files.is_empty());
+
+        assert_eq!(prune_missing(&mut lib, &result).unwrap(), (1, 0));
+        let ids: Vec<i64> = lib.database().connection_ref()
+            .prepare("SELECT id FROM media")
+            .unwrap()
+            .query_map([], |row| row.get(0))
+            .unwrap()
+            .collect::<rusqlite::Result<_>>()
+            .unwrap();
+        assert_eq!(ids, vec![kept]);
+
+        let undone = journal::undo_last(&mut lib).unwrap().unwrap();
+        assert_eq!(undone.kind, "prune");
+        assert_eq!(lib.database().media_count().unwrap(), 2);
+    }
+
+    #[test]
+    fn test_relink_moved_file_keeps_row() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut lib = Library::create(temp_dir.path()).unwrap();
+
+        // The user moved a.jpg from 01-01 to 01-02 and renamed it
+        let moved_dir = temp_dir.path().join("images/2024/01-02");
+        std::fs::create_dir_all(&moved_dir).unwrap();
+        std::fs::write(moved_dir.join("renamed.jpg"), b"moved").unwrap();
+        let hash = hash_file(&moved_dir.join("renamed.jpg")).unwrap();
+        let id = insert_media(&lib, &hash, "images/2024/01-01", "a.jpg");
+
+        let mut result = scan_library(&lib).unwrap();
+        assert_eq!(result.missing_files.len(), 1);
+        assert_eq!(result.new_files.len(), 1);
+
+        assert_eq!(relink_moved_files(&mut lib, &mut result).unwrap(), 1);
+        assert!(result.missing_files.is_empty());
+        assert!(result.new_files.is_empty());
+
+        let (relpath, filename): (String, String) = lib.database().connection_ref()
+            .query_row("SELECT relpath, filename FROM media WHERE id = ?1", params![id], |row| {
+                Ok((row.get(0)?, row.get(1)?))
+            })
+            .unwrap();
+        assert_eq!(relpath, "images/2024/01-02");
+        assert_eq!(filename, "renamed.jpg");
+        assert_eq!(lib.database().media_count().unwrap(), 1);
+    }
+
+    #[test]
+    fn test_relink_keeps_sidecar_moved_with_its_photo() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut lib = Library::create(temp_dir.path()).unwrap();
+
+        // a.jpg and its a.xmp were moved together from 01-01 to 01-02
+        let moved_dir = temp_dir.path().join("images/2024/01-02");
+        std::fs::create_dir_all(&moved_dir).unwrap();
+        std::fs::write(moved_dir.join("a.jpg"), b"moved").unwrap();
+        std::fs::write(moved_dir.join("a.xmp"), b"<edits/>").unwrap();
+        let id = insert_media(&lib, &hash_file(&moved_dir.join("a.jpg")).unwrap(), "images/2024/01-01", "a.jpg");
+        lib.database()
+            .connection_ref()
+            .execute(
+                "INSERT INTO sidecars (media_id, filename, filetype, file_size, hash, modified_at)
+                 VALUES (?1, 'a.xmp', 'XMP', 8, ?2, '2024:01:01 00:00:00.0+00:00')",
+                params![id, hash_file(&moved_dir.join("a.xmp")).unwrap()],
+            )
+            .unwrap();
+
+        let mut result = scan_library(&lib).unwrap();
+        assert_eq!(result.orphaned_sidecars.len(), 1);
+        let relinks = find_relinks(lib.root(), &result.missing_files, &result.new_files);
+        let preview = result.dry_run_report(&relinks).render(&crate::photosort_core::cli::ReportFormat::Text);
+        assert!(!preview.contains("a.xmp"), "{}", preview);
+
+        assert_eq!(relink_moved_files(&mut lib, &mut result).unwrap(), 1);
+        assert!(result.orphaned_sidecars.is_empty());
+        assert!(result.is_clean());
+        handle_scan_results(&mut lib, &result).unwrap();
+        assert_eq!(lib.database().sidecar_count().unwrap(), 1);
+    }
+
+    #[test]
+    fn test_compact_duplicate_paths() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut lib = Library::create(temp_dir.path()).unwrap();
+
+        let dir = temp_dir.path().join("images/2024/01-01");
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("a.jpg"), b"real").unwrap();
+        let real_hash = hash_file(&dir.join("a.jpg")).unwrap();
+
+        let stale_id = insert_media(&lib, "stale", "images/2024/01-01", "a.jpg");
+        let real_id = insert_media(&lib, &real_hash, "images/2024/01-01", "a.jpg");
+        lib.database().connection_ref().execute(
+            "INSERT INTO sidecars (media_id, filename, filetype, file_size, hash, modified_at)
+             VALUES (?1, 'a.xmp', 'XMP', 1, 'x', '2024:01:01 00:00:00.0+00:00')",
+            params![stale_id],
+        ).unwrap();
+
+        let duplicates = find_duplicate_paths(lib.database(), lib.root()).unwrap();
+        assert_eq!(duplicates.len(), 1);
+        assert_eq!(duplicates[0].keep_id, real_id);
+        assert_eq!(duplicates[0].redundant_ids, vec![stale_id]);
+
+        let op_id = journal::start(lib.database().connection_ref(), "scan").unwrap();
+        assert_eq!(compact_duplicate_paths(&mut lib, &duplicates, op_id).unwrap(), 1);
+        assert_eq!(lib.database().media_count().unwrap(), 1);
+        assert!(lib.database().hash_exists(&real_hash).unwrap());
+
+        // The sidecar survives on the kept row
+        let sidecar_owner: i64 = lib.database().connection_ref()
+            .query_row("SELECT media_id FROM sidecars WHERE filename = 'a.xmp'", [], |row| row.get(0))
+            .unwrap();
+        assert_eq!(sidecar_owner, real_id);
+
+        // Undo puts the stale row and its sidecar back
+        journal::undo_last(&mut lib).unwrap().unwrap();
+        assert_eq!(lib.database().media_count().unwrap(), 2);
+        let sidecar_owner: i64 = lib.database().connection_ref()
+            .query_row("SELECT media_id FROM sidecars WHERE filename = 'a.xmp'", [], |row| row.get(0))
+            .unwrap();
+        assert_eq!(sidecar_owner, stale_id);
+    }
+
+    #[test]
+    fn test_dry_run_report_lists_missing_and_new_files() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = Library::create(temp_dir.path()).unwrap();
+
+        let dir = temp_dir.path().join("images/2024/01-01");
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("new.jpg"), b"new").unwrap();
+        insert_media(&lib, "gone", "images/2024/01-01", "deleted.jpg");
+
+        let result = scan_library(&lib).unwrap();
+        let relinks = find_relinks(lib.root(), &result.missing_files, &result.new_files);
+        assert!(relinks.is_empty());
+
+        let report = result.dry_run_report(&relinks).render(&crate::photosort_core::cli::ReportFormat::Text);
+        assert!(report.contains("remove records of missing files: 1"));
+        assert!(report.contains("add new files: 1"));
+        assert!(report.contains(&format!("Missing files whose records would be removed (1):\n  - {}", dir.join("deleted.jpg").display())));
+        assert!(report.contains(&format!("New files to add (1):\n  - {}", dir.join("new.jpg").display())));
+
+        // Only a report: the missing row stays and nothing is journaled
+        assert_eq!(lib.database().media_count().unwrap(), 1);
+        assert!(journal::last_operation(lib.database().connection_ref()).unwrap().is_none());
+    }
+
+    #[test]
+    fn test_scan_reports_unmatched_sidecars() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut lib = Library::create(temp_dir.path()).unwrap();
+
+        let dir = temp_dir.path().join("images/2024/01-01");
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("a.jpg"), b"a").unwrap();
+        let a_id = insert_media(&lib, &hash_file(&dir.join("a.jpg")).unwrap(), "images/2024/01-01", "a.jpg");
+        // Written by an editor after the import
+        std::fs::write(dir.join("a.xmp"), b"<edits/>").unwrap();
+
+        let mut result = scan_library(&lib).unwrap();
+        assert!(result.is_clean());
+        result.unmatched_sidecars = find_unmatched_sidecars(&lib, &[]).unwrap();
+        assert_eq!(result.unmatched_sidecars.len(), 1);
+        assert_eq!((result.unmatched_sidecars[0].media_id, &result.unmatched_sidecars[0].path), (a_id, &dir.join("a.xmp")));
+        assert!(!result.is_clean());
+
+        let report = result.dry_run_report(&[]).render(&crate::photosort_core::cli::ReportFormat::Text);
+        assert!(report.contains("attach unrecorded sidecars: 1"));
+        assert!(report.contains(&format!("Unrecorded sidecars to attach (1):\n  - {}", dir.join("a.xmp").display())));
+
+        let op_id = journal::start(lib.database().connection_ref(), "scan").unwrap();
+        attach_sidecars(&mut lib, &result.unmatched_sidecars, op_id).unwrap();
+        journal::finish(lib.database().connection_ref(), op_id).unwrap();
+        assert_eq!(lib.database().sidecar_count().unwrap(), 1);
+        assert!(find_unmatched_sidecars(&lib, &[]).unwrap().is_empty());
+    }
+
+    #[test]
+    fn test_scan_walks_route_folders() {
+        use crate::photosort_core::import::ImportOptions;
+
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("source");
+        std::fs::create_dir_all(&source).unwrap();
+        std::fs::write(source.join("a.jpg"), b"routed photo").unwrap();
+        let mut lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        lib.set_type_routes(&[("JPG".to_string(), "jpg".to_string())]).unwrap();
+        lib.import(&source, &ImportOptions::default()).unwrap();
+
+        // What was imported under the route is known
+        assert!(scan_library(&lib).unwrap().is_clean());
+
+        let dir = lib.root().join("jpg/2024/01-01");
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("new.jpg"), b"added by hand").unwrap();
+        let result = scan_library(&lib).unwrap();
+        assert_eq!(result.new_files, [dir.join("new.jpg")]);
+    }
+
+    #[test]
+    fn test_scan_finds_leftover_temp_copies() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = Library::create(temp_dir.path()).unwrap();
+
+        // An import cut short while writing a photo and a stored object
+        let dir = temp_dir.path().join("images/2024/01-01");
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("a.jpg.photosort-tmp"), b"half a photo").unwrap();
+        let objects = temp_dir.path().join("objects/ab");
+        std::fs::create_dir_all(&objects).unwrap();
+        std::fs::write(objects.join("abcd.jpg.photosort-tmp"), b"half an object").unwrap();
+
+        let mut result = scan_library(&lib).unwrap();
+        assert!(!result.is_clean());
+        assert!(result.new_files.is_empty());
+        result.leftover_temp_files.sort();
+        assert_eq!(
+            result.leftover_temp_files,
+            [dir.join("a.jpg.photosort-tmp"), objects.join("abcd.jpg.photosort-tmp")]
+        );
+
+        assert_eq!(delete_leftover_temp_files(&result.leftover_temp_files).unwrap(), 2);
+        assert!(scan_library(&lib).unwrap().is_clean());
+    }
+
+    #[test]
+    fn test_scan_skips_nested_library() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = Library::create(temp_dir.path()).unwrap();
+
+        let dir = temp_dir.path().join("images/2024/01-01");
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("new.jpg"), b"new").unwrap();
+        // Someone made a library inside this one
+        let nested = Library::create(&temp_dir.path().join("images/old")).unwrap();
+        let nested_dir = nested.root().join("images/2020/05-01");
+        std::fs::create_dir_all(&nested_dir).unwrap();
+        std::fs::write(nested_dir.join("old.jpg"), b"old").unwrap();
+
+        let result = scan_library(&lib).unwrap();
+        assert_eq!(result.new_files, [dir.join("new.jpg")]);
+    }
 
     #[test]
     fn test_scan_result_is_clean() {
@@ -441,6 +1356,7 @@ mod tests {
         let result_with_missing = ScanResult {
             missing_files: vec![MissingFile {
                 id: 1,
+                hash: "abc".to_string(),
                 filename: "test.jpg".to_string(),
                 relpath: "images/2024/01-01".to_string(),
                 media_type: "image".to_string(),
@@ -450,4 +1366,32 @@ mod tests {
         };
         assert!(!result_with_missing.is_clean());
     }
+
+    #[test]
+    fn test_rescan_sidecars_attaches_new_extensions() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut lib = Library::create(temp_dir.path()).unwrap();
+
+        let dir = temp_dir.path().join("images/2024/01-01");
+        std::fs::create_dir_all(&dir).unwrap();
+        for name in ["a.jpg", "b.jpg", "a.cos", "b.pte"] {
+            std::fs::write(dir.join(name), name.as_bytes()).unwrap();
+        }
+        let a_id = insert_media(&lib, "hash-a", "images/2024/01-01", "a.jpg");
+        insert_media(&lib, "hash-b", "images/2024/01-01", "b.jpg");
+
+        assert_eq!(rescan_sidecars(&mut lib, &[], true).unwrap(), vec![dir.join("a.cos")]);
+        assert_eq!(lib.database().sidecar_count().unwrap(), 0);
+
+        assert_eq!(rescan_sidecars(&mut lib, &[], false).unwrap(), vec![dir.join("a.cos")]);
+        let media_id: i64 = lib.database().connection_ref()
+            .query_row("SELECT media_id FROM sidecars WHERE filename = 'a.cos'", [], |row| row.get(0))
+            .unwrap();
+        assert_eq!(media_id, a_id);
+
+        let extensions = vec!["pte".to_string()];
+        assert_eq!(rescan_sidecars(&mut lib, &extensions, false).unwrap(), vec![dir.join("b.pte")]);
+        assert!(rescan_sidecars(&mut lib, &extensions, false).unwrap().is_empty());
+        assert_eq!(lib.database().sidecar_count().unwrap(), 2);
+    }
 }
@@ -1,6 +1,7 @@
-use crate::photosort_core::cli::{MediaTypeFilter, OutputFormat};
+use crate::photosort_core::cli::{MediaTypeFilter, OutputFormat, WithinSecond};
 use crate::photosort_core::error::Result;
-use crate::photosort_core::import::Library;
+use crate::photosort_core::import::{short_hash, Library};
+use crate::photosort_core::media::filetype_family;
 use serde::Serialize;
 use std::path::PathBuf;
 
@@ -16,12 +17,17 @@ pub struct SearchQuery {
     pub max_size: Option<i64>,
     pub camera: Option<String>,
     pub lens: Option<String>,
+    /// Only this media record.
+    pub id: Option<i64>,
+    /// Order of media taken within the same second.
+    pub within_second: WithinSecond,
 }
 
 /// A search result item.
 #[derive(Debug, Serialize)]
 pub struct SearchResult {
     pub id: i64,
+    pub hash: String,
     pub filename: String,
     pub relpath: String,
     pub media_type: String,
@@ -34,6 +40,20 @@ pub struct SearchResult {
     pub full_path: PathBuf,
 }
 
+impl SearchResult {
+    /// The file's path for output: relative to the library root with forward
+    /// slashes (e.g. "images/2024/05-21/IMG_1.jpg"), or absolute.
+    pub fn display_path(&self, relative: bool) -> String {
+        if !relative {
+            return self.full_path.display().to_string();
+        }
+        match self.relpath.trim_matches('/') {
+            "" => self.filename.clone(),
+            relpath => format!("{}/{}", relpath, self.filename),
+        }
+    }
+}
+
 impl SearchQuery {
     /// Parse a date filter string like "2024-01-01" or "2024-01-01..2024-12-31"
     pub fn parse_date_filter(date_str: &str) -> (Option<String>, Option<String>) {
@@ -99,22 +119,45 @@ fn parse_size_value(s: &str) -> Option<i64> {
     num_part.trim().parse::<i64>().ok().map(|n| n * multiplier)
 }
 
+/// An ORDER BY clause sorting media by capture date, breaking ties within a
+/// second as asked and then by id, so the order is the same every time.
+/// `prefix` qualifies the columns, e.g. "m.".
+pub fn date_order(prefix: &str, within_second: WithinSecond, direction: &str) -> String {
+    // Dates are stored as "YYYY:MM:DD HH:MM:SS[.fraction]+HH:MM"
+    let second = format!("substr({}created_at, 1, 19)", prefix);
+    let keys = match within_second {
+        WithinSecond::Subsec => vec![format!("{}created_at", prefix), format!("{}filename", prefix)],
+        WithinSecond::Name => vec![second, format!("{}filename", prefix)],
+        WithinSecond::Size => vec![second, format!("{}file_size", prefix)],
+    };
+    keys.iter()
+        .chain(&[format!("{}id", prefix)])
+        .map(|key| format!("{} {}", key, direction))
+        .collect::<Vec<_>>()
+        .join(", ")
+}
+
 /// Execute a search query on the library.
 pub fn search(lib: &Library, query: &SearchQuery) -> Result<Vec<SearchResult>> {
     let db = lib.database();
-    let root = lib.root();
 
     // Build SQL query
     let mut sql = String::from(
         "SELECT m.id, m.filename, m.relpath, m.media_type, m.filetype, m.file_size,
                 m.created_at, m.camera_model,
-                (SELECT COUNT(*) FROM sidecars s WHERE s.media_id = m.id) as sidecar_count
+                (SELECT COUNT(*) FROM sidecars s WHERE s.media_id = m.id) as sidecar_count,
+                m.hash
          FROM media m
          WHERE 1=1"
     );
 
     let mut params: Vec<Box<dyn rusqlite::ToSql>> = Vec::new();
 
+    if let Some(id) = query.id {
+        sql.push_str(" AND m.id = ?");
+        params.push(Box::new(id));
+    }
+
     // Media type filter
     if let Some(ref media_type) = query.media_type {
         match media_type {
@@ -142,10 +185,12 @@ pub fn search(lib: &Library, query: &SearchQuery) -> Result<Vec<SearchResult>> {
 
     // Extension filter
     if !query.extensions.is_empty() {
-        let placeholders: Vec<&str> = query.extensions.iter().map(|_| "?").collect();
+        // "jpg" also finds files stored as JPEG, whether or not the import canonicalized them
+        let filetypes: Vec<String> = query.extensions.iter().flat_map(|e| filetype_family(e)).collect();
+        let placeholders: Vec<&str> = filetypes.iter().map(|_| "?").collect();
         sql.push_str(&format!(" AND UPPER(m.filetype) IN ({})", placeholders.join(",")));
-        for ext in &query.extensions {
-            params.push(Box::new(ext.to_uppercase()));
+        for filetype in filetypes {
+            params.push(Box::new(filetype));
         }
     }
 
@@ -171,7 +216,7 @@ pub fn search(lib: &Library, query: &SearchQuery) -> Result<Vec<SearchResult>> {
         params.push(Box::new(format!("%{}%", lens)));
     }
 
-    sql.push_str(" ORDER BY m.created_at DESC");
+    sql.push_str(&format!(" ORDER BY {}", date_order("m.", query.within_second, "DESC")));
 
     // Execute query
     let conn = db.connection_ref();
@@ -190,13 +235,14 @@ pub fn search(lib: &Library, query: &SearchQuery) -> Result<Vec<SearchResult>> {
             row.get::<_, String>(6)?,
             row.get::<_, Option<String>>(7)?,
             row.get::<_, i64>(8)?,
+            row.get::<_, String>(9)?,
         ))
     })?;
 
     let mut results = Vec::new();
 
     for row in rows {
-        let (id, filename, relpath, media_type, filetype, file_size, created_at, camera_model, sidecar_count) = row?;
+        let (id, filename, relpath, media_type, filetype, file_size, created_at, camera_model, sidecar_count, hash) = row?;
 
         let has_sidecar = sidecar_count > 0;
 
@@ -207,10 +253,11 @@ pub fn search(lib: &Library, query: &SearchQuery) -> Result<Vec<SearchResult>> {
             }
         }
 
-        let full_path = root.join(&relpath).join(&filename);
+        let full_path = lib.file_path(&relpath, &filename);
 
         results.push(SearchResult {
             id,
+            hash,
             filename,
             relpath,
             media_type,
@@ -226,12 +273,14 @@ pub fn search(lib: &Library, query: &SearchQuery) -> Result<Vec<SearchResult>> {
     Ok(results)
 }
 
-/// Format search results for output.
-pub fn format_results(results: &[SearchResult], format: &OutputFormat) -> String {
+/// Format search results for output. Tables show the first `hash_len`
+/// characters of each hash (all of it for 0); paths are library-relative
+/// when `relative` is set, so output can be shared without the machine's folders.
+pub fn format_results(results: &[SearchResult], format: &OutputFormat, hash_len: usize, relative: bool) -> String {
     match format {
         OutputFormat::Paths => {
             results.iter()
-                .map(|r| r.full_path.display().to_string())
+                .map(|r| r.display_path(relative))
                 .collect::<Vec<_>>()
                 .join("\n")
         }
@@ -239,14 +288,24 @@ pub fn format_results(results: &[SearchResult], format: &OutputFormat) -> String
             serde_json::to_string_pretty(results).unwrap_or_else(|_| "[]".to_string())
         }
         OutputFormat::Table => {
+            let hash_width = results
+                .iter()
+                .map(|r| short_hash(&r.hash, hash_len).len())
+                .max()
+                .unwrap_or(0)
+                .max("Hash".len());
             let mut output = String::new();
-            output.push_str(&format!("{:<40} {:>10} {:>8} {:>10}\n", "Filename", "Size", "Type", "Date"));
-            output.push_str(&format!("{}\n", "─".repeat(72)));
+            output.push_str(&format!(
+                "{:<hash_width$} {:<40} {:>10} {:>8} {:>10}\n",
+                "Hash", "Filename", "Size", "Type", "Date"
+            ));
+            output.push_str(&format!("{}\n", "─".repeat(hash_width + 73)));
             for r in results {
                 let size_str = format_size(r.file_size);
                 let date_str = &r.created_at[..10]; // Just YYYY:MM:DD
                 output.push_str(&format!(
-                    "{:<40} {:>10} {:>8} {:>10}\n",
+                    "{:<hash_width$} {:<40} {:>10} {:>8} {:>10}\n",
+                    short_hash(&r.hash, hash_len),
                     truncate_str(&r.filename, 40),
                     size_str,
                     r.filetype,
@@ -259,6 +318,21 @@ pub fn format_results(results: &[SearchResult], format: &OutputFormat) -> String
     }
 }
 
+/// Format one result in full, as `info` shows a single file.
+pub fn format_details(r: &SearchResult, hash_len: usize, relative: bool) -> String {
+    let mut output = String::new();
+    output.push_str(&format!("File: {}\n", r.display_path(relative)));
+    output.push_str(&format!("  Hash:    {}\n", short_hash(&r.hash, hash_len)));
+    output.push_str(&format!("  Type:    {} ({})\n", r.media_type, r.filetype));
+    output.push_str(&format!("  Size:    {}\n", format_size(r.file_size)));
+    output.push_str(&format!("  Date:    {}\n", r.created_at));
+    if let Some(camera) = &r.camera_model {
+        output.push_str(&format!("  Camera:  {}\n", camera));
+    }
+    output.push_str(&format!("  Sidecar: {}\n", if r.has_sidecar { "yes" } else { "no" }));
+    output
+}
+
 fn format_size(bytes: i64) -> String {
     if bytes >= 1_073_741_824 {
         format!("{:.1} GB", bytes as f64 / 1_073_741_824.0)
@@ -282,6 +356,58 @@ fn truncate_str(s: &str, max_len: usize) -> String {
 #[cfg(test)]
 mod tests {
     use super::*;
+    use assert_fs::TempDir;
+
+    #[test]
+    fn test_sort_within_second() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = Library::create(temp_dir.path()).unwrap();
+        // A burst within one second, plus a photo from the second before
+        for (filename, created_at, size) in [
+            ("IMG_2.jpg", "2024:01:01 10:00:00.90+00:00", 100),
+            ("IMG_3.jpg", "2024:01:01 10:00:00.10+00:00", 300),
+            ("IMG_1.jpg", "2024:01:01 10:00:00.50+00:00", 200),
+            ("IMG_0.jpg", "2024:01:01 09:59:59.00+00:00", 400),
+        ] {
+            lib.database()
+                .connection_ref()
+                .execute(
+                    "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+                     VALUES (?1, ?1, 'images/2024/01-01', 'image', 'JPG', ?3, ?2, '')",
+                    rusqlite::params![filename, created_at, size],
+                )
+                .unwrap();
+        }
+
+        let names = |within_second| {
+            let query = SearchQuery { within_second, ..Default::default() };
+            search(&lib, &query).unwrap().into_iter().map(|r| r.filename).collect::<Vec<_>>()
+        };
+        // Newest first, ties included
+        assert_eq!(names(WithinSecond::Subsec), ["IMG_2.jpg", "IMG_1.jpg", "IMG_3.jpg", "IMG_0.jpg"]);
+        assert_eq!(names(WithinSecond::Name), ["IMG_3.jpg", "IMG_2.jpg", "IMG_1.jpg", "IMG_0.jpg"]);
+        assert_eq!(names(WithinSecond::Size), ["IMG_3.jpg", "IMG_1.jpg", "IMG_2.jpg", "IMG_0.jpg"]);
+    }
+
+    #[test]
+    fn test_relative_output_paths() {
+        let temp_dir = TempDir::new().unwrap();
+        let lib = Library::create(temp_dir.path()).unwrap();
+        lib.database()
+            .connection_ref()
+            .execute(
+                "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+                 VALUES ('abc', 'IMG_1.jpg', 'images/2024/05-21', 'image', 'JPG', 4, '2024:05:21 12:00:00+00:00', '')",
+                [],
+            )
+            .unwrap();
+        let results = search(&lib, &SearchQuery::default()).unwrap();
+
+        let absolute = format_results(&results, &OutputFormat::Paths, 0, false);
+        assert_eq!(absolute, temp_dir.path().join("images/2024/05-21/IMG_1.jpg").display().to_string());
+        assert_eq!(format_results(&results, &OutputFormat::Paths, 0, true), "images/2024/05-21/IMG_1.jpg");
+        assert!(format_details(&results[0], 0, true).starts_with("File: images/2024/05-21/IMG_1.jpg\n"));
+    }
 
     #[test]
     fn test_parse_date_filter_single() {
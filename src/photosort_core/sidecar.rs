@@ -1,5 +1,6 @@
 use std::path::{Path, PathBuf};
 use time::OffsetDateTime;
+use unicode_normalization::UnicodeNormalization;
 
 /// Sidecar file extensions (lowercase).
 /// These files are associated with a parent media file and should move/rename together.
@@ -10,6 +11,19 @@ pub const SIDECAR_EXTENSIONS: &[&str] = &[
     "aae",         // Apple photo adjustments
     "pp3",         // RawTherapee
     "dop",         // DxO PhotoLab
+    "cos",         // Capture One
+];
+
+/// The built-in sidecar extensions followed by a library's own (lowercase).
+fn sidecar_extensions(extra: &[String]) -> impl Iterator<Item = &str> {
+    SIDECAR_EXTENSIONS.iter().copied().chain(extra.iter().map(String::as_str))
+}
+
+/// Low-resolution preview and thumbnail extensions written by action cameras (lowercase).
+/// By default these are stored as sidecars of the full-resolution file.
+pub const PREVIEW_EXTENSIONS: &[&str] = &[
+    "lrv", // GoPro / Insta360 low-res video
+    "thm", // GoPro thumbnail
 ];
 
 /// Information about a sidecar file.
@@ -25,10 +39,11 @@ pub struct Sidecar {
 }
 
 /// Find all sidecar files associated with a media file.
-/// Sidecars have the same base name but different extensions.
+/// Sidecars have the same base name but different extensions, either built in
+/// or among `extra`.
 ///
 /// Example: For "photo.jpg", finds "photo.xmp", "photo.photo-edit", etc.
-pub fn find_sidecars(media_path: &Path) -> Vec<PathBuf> {
+pub fn find_sidecars(media_path: &Path, extra: &[String]) -> Vec<PathBuf> {
     let mut sidecars = Vec::new();
 
     // Get base name without extension
@@ -41,7 +56,7 @@ pub fn find_sidecars(media_path: &Path) -> Vec<PathBuf> {
     };
 
     // Check for each sidecar extension
-    for ext in SIDECAR_EXTENSIONS {
+    for ext in sidecar_extensions(extra) {
         let sidecar_path = parent.join(format!("{}.{}", stem, ext));
         if sidecar_path.exists() && sidecar_path.is_file() {
             sidecars.push(sidecar_path);
@@ -51,14 +66,254 @@ pub fn find_sidecars(media_path: &Path) -> Vec<PathBuf> {
     sidecars
 }
 
-/// Check if a file is a sidecar based on its extension.
-pub fn is_sidecar(path: &Path) -> bool {
+/// Like `find_sidecars`, but base names are compared after Unicode NFC
+/// normalization, so "café.xmp" written by macOS (decomposed, NFD) belongs to
+/// "café.jpg" written elsewhere (composed, NFC).
+pub fn find_sidecars_normalized(media_path: &Path, extra: &[String]) -> Vec<PathBuf> {
+    find_sidecars_folded(media_path, extra, nfc)
+}
+
+/// Like `find_sidecars`, but names are compared ignoring case, as on a
+/// case-insensitive filesystem, so "img_1.XMP" belongs to "IMG_1.JPG" on any
+/// disk. With `normalize`, they are compared after NFC normalization too.
+pub fn find_sidecars_ignoring_case(media_path: &Path, extra: &[String], normalize: bool) -> Vec<PathBuf> {
+    find_sidecars_folded(media_path, extra, |name| {
+        if normalize { nfc(name) } else { name.to_string() }.to_lowercase()
+    })
+}
+
+/// Sidecars of a media file whose base name and extension, passed through
+/// `fold`, match the file's base name and a sidecar extension.
+fn find_sidecars_folded(media_path: &Path, extra: &[String], fold: impl Fn(&str) -> String) -> Vec<PathBuf> {
+    let Some(parent) = media_path.parent() else {
+        return Vec::new();
+    };
+    let Some(stem) = media_path.file_stem().and_then(|s| s.to_str()) else {
+        return Vec::new();
+    };
+    let Ok(entries) = std::fs::read_dir(parent) else {
+        return Vec::new();
+    };
+
+    let stem = fold(stem);
+    let mut sidecars: Vec<PathBuf> = entries
+        .filter_map(|e| e.ok())
+        .map(|e| e.path())
+        .filter(|path| {
+            let (Some(other), Some(ext)) = (
+                path.file_stem().and_then(|s| s.to_str()),
+                path.extension().and_then(|e| e.to_str()),
+            ) else {
+                return false;
+            };
+            let ext = fold(ext);
+            sidecar_extensions(extra).any(|known| known == ext) && fold(other) == stem && path.is_file()
+        })
+        .collect();
+    // Same order as find_sidecars: by extension, as listed, then by name
+    sidecars.sort_by_key(|path| {
+        let ext = fold(path.extension().and_then(|e| e.to_str()).unwrap_or_default());
+        (sidecar_extensions(extra).position(|known| known == ext), path.clone())
+    });
+    sidecars
+}
+
+/// A filename in Unicode NFC, the composed form Linux and Windows tools write.
+pub fn nfc(name: &str) -> String {
+    name.nfc().collect()
+}
+
+/// Find sidecars kept in subfolders next to a media file, as Capture One does
+/// ("CaptureOne/Settings153/IMG_1234.JPG.cos").
+///
+/// Each pattern is a relative folder path whose components may use `*` as a
+/// wildcard. A sidecar there may be named after the media's base name
+/// ("IMG_1234.xmp") or its full filename ("IMG_1234.JPG.cos").
+pub fn find_sidecars_in_subfolders(media_path: &Path, patterns: &[String], extra: &[String]) -> Vec<PathBuf> {
+    let mut sidecars = Vec::new();
+
+    let Some(parent) = media_path.parent() else {
+        return sidecars;
+    };
+    let (Some(stem), Some(filename)) = (
+        media_path.file_stem().and_then(|s| s.to_str()),
+        media_path.file_name().and_then(|s| s.to_str()),
+    ) else {
+        return sidecars;
+    };
+
+    for pattern in patterns {
+        for dir in matching_dirs(parent, pattern) {
+            for base in [stem, filename] {
+                for ext in sidecar_extensions(extra) {
+                    let sidecar_path = dir.join(format!("{}.{}", base, ext));
+                    if sidecar_path.is_file() && !sidecars.contains(&sidecar_path) {
+                        sidecars.push(sidecar_path);
+                    }
+                }
+            }
+        }
+    }
+
+    sidecars
+}
+
+/// Directories under `base` matching a relative path pattern with `*` wildcards.
+fn matching_dirs(base: &Path, pattern: &str) -> Vec<PathBuf> {
+    let mut dirs = vec![base.to_path_buf()];
+    for component in pattern.split('/').filter(|c| !c.is_empty()) {
+        dirs = dirs
+            .iter()
+            .flat_map(|dir| {
+                if !component.contains('*') {
+                    return vec![dir.join(component)];
+                }
+                let mut matches: Vec<PathBuf> = std::fs::read_dir(dir)
+                    .into_iter()
+                    .flatten()
+                    .filter_map(|e| e.ok())
+                    .filter(|e| e.file_name().to_str().is_some_and(|n| wildcard_match(component, n)))
+                    .map(|e| e.path())
+                    .collect();
+                // Directory listings come in no particular order
+                matches.sort();
+                matches
+            })
+            .filter(|d| d.is_dir())
+            .collect();
+    }
+    dirs
+}
+
+/// Match a name against a pattern where `*` stands for any run of characters.
+fn wildcard_match(pattern: &str, name: &str) -> bool {
+    let mut parts = pattern.split('*');
+    let first = parts.next().unwrap_or_default();
+    let Some(mut rest) = name.strip_prefix(first) else {
+        return false;
+    };
+    let mut parts: Vec<&str> = parts.collect();
+    let Some(last) = parts.pop() else {
+        return rest.is_empty();
+    };
+    for part in parts {
+        match rest.find(part) {
+            Some(i) => rest = &rest[i + part.len()..],
+            None => return false,
+        }
+    }
+    rest.len() >= last.len() && rest.ends_with(last)
+}
+
+/// Find the Apple Photos adjustments (`.AAE`) belonging to a media file.
+///
+/// Apple writes them in capitals ("IMG_1234.AAE"), which `find_sidecars`
+/// doesn't look for. An edited copy exported next to its original
+/// ("IMG_E1234.JPG") carries no adjustments of its own: they stay with the
+/// original, and only go to the edited copy when the original isn't there.
+pub fn find_apple_adjustments(media_path: &Path) -> Vec<PathBuf> {
+    let (Some(parent), Some(stem)) = (media_path.parent(), media_path.file_stem().and_then(|s| s.to_str())) else {
+        return Vec::new();
+    };
+    if is_sidecar(media_path, &[]) || is_preview(media_path) {
+        return Vec::new();
+    }
+
+    let stem = match apple_original_stem(stem) {
+        Some(original) if !has_media_named(parent, &original) => original,
+        Some(_) => return Vec::new(),
+        // Lowercase adjustments are found by find_sidecars already
+        None => {
+            let upper = parent.join(format!("{}.AAE", stem));
+            return if upper.is_file() && !parent.join(format!("{}.aae", stem)).exists() {
+                vec![upper]
+            } else {
+                Vec::new()
+            };
+        }
+    };
+    ["aae", "AAE"]
+        .iter()
+        .map(|ext| parent.join(format!("{}.{}", stem, ext)))
+        .find(|path| path.is_file())
+        .into_iter()
+        .collect()
+}
+
+/// The base name of the original an Apple Photos edit was exported from:
+/// "IMG_E1234" -> "IMG_1234".
+fn apple_original_stem(stem: &str) -> Option<String> {
+    let number = stem.strip_prefix("IMG_E")?;
+    (!number.is_empty() && number.bytes().all(|b| b.is_ascii_digit())).then(|| format!("IMG_{}", number))
+}
+
+/// Whether `dir` holds a file other than a sidecar or preview with this base name.
+fn has_media_named(dir: &Path, stem: &str) -> bool {
+    std::fs::read_dir(dir)
+        .into_iter()
+        .flatten()
+        .filter_map(|e| e.ok())
+        .map(|e| e.path())
+        .any(|path| {
+            path.file_stem().and_then(|s| s.to_str()) == Some(stem)
+                && !is_sidecar(&path, &[])
+                && !is_preview(&path)
+                && path.is_file()
+        })
+}
+
+/// Check if a file is a sidecar based on its extension, built in or among `extra`.
+pub fn is_sidecar(path: &Path, extra: &[String]) -> bool {
     path.extension()
         .and_then(|e| e.to_str())
-        .map(|e| SIDECAR_EXTENSIONS.contains(&e.to_lowercase().as_str()))
+        .map(|e| sidecar_extensions(extra).any(|ext| ext == e.to_lowercase()))
         .unwrap_or(false)
 }
 
+/// Check if a file is an action-camera preview based on its extension.
+pub fn is_preview(path: &Path) -> bool {
+    path.extension()
+        .and_then(|e| e.to_str())
+        .map(|e| PREVIEW_EXTENSIONS.contains(&e.to_lowercase().as_str()))
+        .unwrap_or(false)
+}
+
+/// Find preview files belonging to a full-resolution media file.
+///
+/// Previews share the media file's base name, except newer GoPro cameras
+/// change the second letter to `L` ("GX010123.MP4" -> "GL010123.LRV").
+pub fn find_previews(media_path: &Path) -> Vec<PathBuf> {
+    let mut previews = Vec::new();
+
+    if is_preview(media_path) {
+        return previews;
+    }
+    let Some(parent) = media_path.parent() else {
+        return previews;
+    };
+    let Some(stem) = media_path.file_stem().and_then(|s| s.to_str()) else {
+        return previews;
+    };
+
+    let mut stems = vec![stem.to_string()];
+    if stem.len() > 2 && (stem.starts_with("GX") || stem.starts_with("GH")) {
+        stems.push(format!("GL{}", &stem[2..]));
+    }
+
+    for stem in &stems {
+        for ext in PREVIEW_EXTENSIONS {
+            for ext in [ext.to_string(), ext.to_uppercase()] {
+                let preview_path = parent.join(format!("{}.{}", stem, ext));
+                if preview_path.is_file() && !previews.contains(&preview_path) {
+                    previews.push(preview_path);
+                }
+            }
+        }
+    }
+
+    previews
+}
+
 /// Get the expected sidecar filename for a media file and sidecar extension.
 ///
 /// Example: get_sidecar_filename("photo.jpg", "xmp") -> "photo.xmp"
@@ -89,13 +344,124 @@ pub fn rename_sidecar_for_media(
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_find_sidecars_normalized() {
+        let temp_dir = assert_fs::TempDir::new().unwrap();
+        let composed = "caf\u{e9}";
+        let decomposed = "cafe\u{301}";
+        let photo = temp_dir.path().join(format!("{}.jpg", composed));
+        std::fs::write(&photo, b"photo").unwrap();
+        std::fs::write(temp_dir.path().join(format!("{}.xmp", decomposed)), b"<x/>").unwrap();
+        std::fs::write(temp_dir.path().join("cafe.xmp"), b"<x/>").unwrap();
+
+        assert!(find_sidecars(&photo, &[]).is_empty());
+        assert_eq!(
+            find_sidecars_normalized(&photo, &[]),
+            [temp_dir.path().join(format!("{}.xmp", decomposed))]
+        );
+        assert_eq!(nfc(decomposed), composed);
+    }
+
+    #[test]
+    fn test_find_sidecars_ignoring_case() {
+        let temp_dir = assert_fs::TempDir::new().unwrap();
+        let dir = temp_dir.path();
+        for name in ["IMG_1.JPG", "img_1.XMP", "IMG_1.pp3", "IMG_10.xmp"] {
+            std::fs::write(dir.join(name), b"x").unwrap();
+        }
+
+        let photo = dir.join("IMG_1.JPG");
+        assert_eq!(find_sidecars_ignoring_case(&photo, &[], false), [dir.join("img_1.XMP"), dir.join("IMG_1.pp3")]);
+        // On a case-sensitive disk only the exact name matches
+        if !dir.join("img_1.jpg").exists() {
+            assert_eq!(find_sidecars(&photo, &[]), [dir.join("IMG_1.pp3")]);
+        }
+    }
+
+    #[test]
+    fn test_find_apple_adjustments() {
+        let temp_dir = assert_fs::TempDir::new().unwrap();
+        let dir = temp_dir.path();
+        for name in ["IMG_1234.jpg", "IMG_E1234.jpg", "IMG_1234.AAE", "IMG_E5678.jpg", "IMG_5678.aae"] {
+            std::fs::write(dir.join(name), b"x").unwrap();
+        }
+
+        // The adjustments stay with the original, not its edited copy
+        assert_eq!(find_apple_adjustments(&dir.join("IMG_1234.jpg")), vec![dir.join("IMG_1234.AAE")]);
+        assert!(find_apple_adjustments(&dir.join("IMG_E1234.jpg")).is_empty());
+        // An edited copy exported without its original takes them along
+        assert_eq!(find_apple_adjustments(&dir.join("IMG_E5678.jpg")), vec![dir.join("IMG_5678.aae")]);
+        assert!(find_apple_adjustments(&dir.join("IMG_1234.AAE")).is_empty());
+        assert_eq!(apple_original_stem("IMG_E0001"), Some("IMG_0001".to_string()));
+        assert_eq!(apple_original_stem("IMG_Edit"), None);
+    }
+
     #[test]
     fn test_is_sidecar() {
-        assert!(is_sidecar(Path::new("photo.xmp")));
-        assert!(is_sidecar(Path::new("photo.photo-edit")));
-        assert!(is_sidecar(Path::new("PHOTO.XMP"))); // case insensitive
-        assert!(!is_sidecar(Path::new("photo.jpg")));
-        assert!(!is_sidecar(Path::new("photo.mp4")));
+        assert!(is_sidecar(Path::new("photo.xmp"), &[]));
+        assert!(is_sidecar(Path::new("photo.photo-edit"), &[]));
+        assert!(is_sidecar(Path::new("PHOTO.XMP"), &[])); // case insensitive
+        assert!(!is_sidecar(Path::new("photo.jpg"), &[]));
+        assert!(!is_sidecar(Path::new("photo.mp4"), &[]));
+        assert!(!is_sidecar(Path::new("photo.pte"), &[]));
+        assert!(is_sidecar(Path::new("photo.PTE"), &["pte".to_string()]));
+    }
+
+    #[test]
+    fn test_is_preview() {
+        assert!(is_preview(Path::new("GL010123.LRV")));
+        assert!(is_preview(Path::new("GOPR0123.thm")));
+        assert!(!is_preview(Path::new("GX010123.MP4")));
+        assert!(!is_preview(Path::new("photo.xmp")));
+    }
+
+    #[test]
+    fn test_find_previews() {
+        let temp_dir = assert_fs::TempDir::new().unwrap();
+        let dir = temp_dir.path();
+        for name in ["GX010123.MP4", "GL010123.LRV", "GX010123.THM", "GOPR0001.MP4", "GOPR0001.LRV", "GX019999.MP4"] {
+            std::fs::write(dir.join(name), b"x").unwrap();
+        }
+
+        let mut previews = find_previews(&dir.join("GX010123.MP4"));
+        previews.sort();
+        assert_eq!(previews, vec![dir.join("GL010123.LRV"), dir.join("GX010123.THM")]);
+        assert_eq!(find_previews(&dir.join("GOPR0001.MP4")), vec![dir.join("GOPR0001.LRV")]);
+        assert!(find_previews(&dir.join("GX019999.MP4")).is_empty());
+        // A preview has no previews of its own
+        assert!(find_previews(&dir.join("GL010123.LRV")).is_empty());
+    }
+
+    #[test]
+    fn test_wildcard_match() {
+        assert!(wildcard_match("Settings*", "Settings153"));
+        assert!(wildcard_match("CaptureOne", "CaptureOne"));
+        assert!(wildcard_match("*edits*", "my edits 2"));
+        assert!(!wildcard_match("Settings*", "Cache"));
+        assert!(!wildcard_match("CaptureOne", "CaptureOne2"));
+        assert!(!wildcard_match("a*a", "a"));
+    }
+
+    #[test]
+    fn test_find_sidecars_in_subfolders() {
+        let temp_dir = assert_fs::TempDir::new().unwrap();
+        let dir = temp_dir.path();
+        let settings = dir.join("CaptureOne").join("Settings153");
+        std::fs::create_dir_all(&settings).unwrap();
+        for path in [
+            dir.join("IMG_1234.JPG"),
+            settings.join("IMG_1234.JPG.cos"),
+            settings.join("IMG_9999.JPG.cos"),
+        ] {
+            std::fs::write(path, b"x").unwrap();
+        }
+
+        let patterns = vec!["CaptureOne/Settings*".to_string()];
+        assert_eq!(
+            find_sidecars_in_subfolders(&dir.join("IMG_1234.JPG"), &patterns, &[]),
+            vec![settings.join("IMG_1234.JPG.cos")]
+        );
+        assert!(find_sidecars_in_subfolders(&dir.join("IMG_1234.JPG"), &["Other".to_string()], &[]).is_empty());
     }
 
     #[test]
@@ -0,0 +1,200 @@
+use crate::photosort_core::error::{PhotosortError, Result};
+use crate::photosort_core::import::hash_file;
+use crate::photosort_core::progress;
+use base64::{engine::general_purpose, Engine};
+use rayon::prelude::*;
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// SHA-256 checksums of a transfer, as written by `sha256sum` (or
+/// `shasum -a 256`, or the BSD `sha256 -r`/tagged formats) run in the
+/// source folder: one `<hex>  <path>` line per file.
+#[derive(Debug, Default)]
+pub struct SourceManifest {
+    /// Path relative to the source folder -> hash as stored in the library (base64).
+    entries: HashMap<PathBuf, String>,
+}
+
+/// Source files that don't match a manifest.
+#[derive(Debug, Default)]
+pub struct SourceCheck {
+    /// Files whose content differs from their checksum.
+    pub mismatched: Vec<PathBuf>,
+    /// Files the manifest doesn't list, so they can't be checked.
+    pub unlisted: Vec<PathBuf>,
+    /// Files the manifest lists that aren't in the source.
+    pub missing: Vec<PathBuf>,
+}
+
+impl SourceCheck {
+    pub fn is_ok(&self) -> bool {
+        self.mismatched.is_empty() && self.unlisted.is_empty() && self.missing.is_empty()
+    }
+
+    /// Number of problems found.
+    pub fn problems(&self) -> usize {
+        self.mismatched.len() + self.unlisted.len() + self.missing.len()
+    }
+
+    /// Some file with a problem, to point the user at.
+    pub fn first(&self) -> Option<&PathBuf> {
+        self.mismatched.first().or(self.missing.first()).or(self.unlisted.first())
+    }
+}
+
+impl SourceManifest {
+    pub fn load(path: &Path) -> Result<Self> {
+        let text = fs::read_to_string(path)?;
+        Self::parse(&text).map_err(|e| PhotosortError::Argument(format!("{}: {}", path.display(), e)))
+    }
+
+    pub fn parse(text: &str) -> std::result::Result<Self, String> {
+        let mut entries = HashMap::new();
+        for (number, line) in text.lines().enumerate() {
+            let line = line.trim_end_matches('\r');
+            if line.trim().is_empty() || line.starts_with('#') {
+                continue;
+            }
+            let (hex, path) = parse_line(line).ok_or_else(|| format!("line {} is not a SHA-256 checksum line", number + 1))?;
+            let hash = hex_to_base64(hex).ok_or_else(|| format!("line {} has an invalid SHA-256 checksum", number + 1))?;
+            let path = path.strip_prefix("./").unwrap_or(path);
+            entries.insert(PathBuf::from(path), hash);
+        }
+        Ok(SourceManifest { entries })
+    }
+
+    pub fn len(&self) -> usize {
+        self.entries.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.entries.is_empty()
+    }
+
+    /// Hash every file in `files` (all under `source_dir`) and compare it with the manifest.
+    pub fn check(&self, source_dir: &Path, files: &[PathBuf]) -> SourceCheck {
+        let bar = progress::bar(files.len() as u64);
+        bar.set_message("Checking source against manifest");
+
+        let outcomes: Vec<(&PathBuf, Option<bool>)> = files
+            .par_iter()
+            .map(|path| {
+                let relative = path.strip_prefix(source_dir).unwrap_or(path);
+                // None when unlisted, otherwise whether it matches
+                let outcome = self.entries.get(relative).map(|expected| match hash_file(path) {
+                    Ok(actual) => actual == *expected,
+                    Err(e) => {
+                        log::warn!("Failed to hash {}: {}", path.display(), e);
+                        false
+                    }
+                });
+                bar.inc(1);
+                (path, outcome)
+            })
+            .collect();
+        bar.finish_with_message("Source check complete");
+
+        let mut check = SourceCheck::default();
+        for (path, outcome) in outcomes {
+            match outcome {
+                Some(true) => {}
+                Some(false) => check.mismatched.push(path.clone()),
+                None => check.unlisted.push(path.clone()),
+            }
+        }
+        let present: HashSet<&Path> = files
+            .iter()
+            .map(|p| p.strip_prefix(source_dir).unwrap_or(p))
+            .collect();
+        check.missing = self
+            .entries
+            .keys()
+            .filter(|p| !present.contains(p.as_path()))
+            .map(|p| source_dir.join(p))
+            .collect();
+
+        check.mismatched.sort();
+        check.unlisted.sort();
+        check.missing.sort();
+        check
+    }
+}
+
+/// Split a checksum line into its hex digest and path.
+fn parse_line(line: &str) -> Option<(&str, &str)> {
+    // Tagged: "SHA256 (path) = hex"
+    if let Some(rest) = line.strip_prefix("SHA256 (") {
+        let (path, hex) = rest.rsplit_once(") = ")?;
+        return Some((hex.trim(), path));
+    }
+    // "hex  path", or "hex *path" in binary mode
+    let (hex, path) = line.split_once(' ')?;
+    let path = path.strip_prefix([' ', '*']).unwrap_or(path);
+    (!path.is_empty()).then_some((hex, path))
+}
+
+/// A hex SHA-256 digest in the library's base64 form.
+fn hex_to_base64(hex: &str) -> Option<String> {
+    if hex.len() != 64 {
+        return None;
+    }
+    let bytes = (0..hex.len())
+        .step_by(2)
+        .map(|i| u8::from_str_radix(hex.get(i..i + 2)?, 16).ok())
+        .collect::<Option<Vec<u8>>>()?;
+    Some(general_purpose::STANDARD.encode(bytes))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use assert_fs::TempDir;
+
+    // sha256("photo")
+    const PHOTO_SHA256: &str = "55c64d0fcd6f9d5f7c828093857e3fdfda68478bb4e9bd24d481ef391c7804e8";
+
+    #[test]
+    fn test_parse_formats() {
+        let manifest = SourceManifest::parse(&format!(
+            "# made on the laptop\n{0}  ./DCIM/IMG_1.jpg\n{0} *IMG_2.jpg\nSHA256 (IMG 3.jpg) = {0}\n",
+            PHOTO_SHA256
+        ))
+        .unwrap();
+        assert_eq!(manifest.len(), 3);
+        for path in ["DCIM/IMG_1.jpg", "IMG_2.jpg", "IMG 3.jpg"] {
+            assert!(manifest.entries.contains_key(Path::new(path)), "{}", path);
+        }
+
+        assert!(SourceManifest::parse("not a checksum\n").is_err());
+        assert!(SourceManifest::parse("abc123  IMG_1.jpg\n").is_err());
+    }
+
+    #[test]
+    fn test_check_finds_tampered_file() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path();
+        fs::write(source.join("good.jpg"), b"good").unwrap();
+        fs::write(source.join("bad.jpg"), b"changed in transit").unwrap();
+        fs::write(source.join("extra.jpg"), b"extra").unwrap();
+
+        let hex = |path: &str| {
+            let hash = general_purpose::STANDARD.decode(hash_file(&source.join(path)).unwrap()).unwrap();
+            hash.iter().map(|b| format!("{:02x}", b)).collect::<String>()
+        };
+        let manifest = SourceManifest::parse(&format!(
+            "{}  good.jpg\n{}  bad.jpg\n{}  lost.jpg\n",
+            hex("good.jpg"),
+            hex("extra.jpg"),
+            hex("good.jpg")
+        ))
+        .unwrap();
+
+        let files: Vec<PathBuf> = ["good.jpg", "bad.jpg", "extra.jpg"].iter().map(|f| source.join(f)).collect();
+        let check = manifest.check(source, &files);
+        assert_eq!(check.mismatched, vec![source.join("bad.jpg")]);
+        assert_eq!(check.unlisted, vec![source.join("extra.jpg")]);
+        assert_eq!(check.missing, vec![source.join("lost.jpg")]);
+        assert_eq!(check.problems(), 3);
+    }
+}
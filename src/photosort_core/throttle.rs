@@ -0,0 +1,91 @@
+use std::fs::{self, File};
+use std::io::{self, Read, Write};
+use std::path::Path;
+use std::sync::Mutex;
+use std::thread;
+use std::time::{Duration, Instant};
+
+/// Size of each write while copying at a limited rate.
+const CHUNK_SIZE: usize = 64 * 1024;
+
+/// Caps the combined rate of every copy sharing it, whichever thread they run on.
+#[derive(Debug)]
+pub struct RateLimiter {
+    bytes_per_sec: u64,
+    /// When everything let through so far will have been sent at the allowed rate.
+    next: Mutex<Option<Instant>>,
+}
+
+impl RateLimiter {
+    pub fn new(bytes_per_sec: u64) -> Self {
+        RateLimiter {
+            bytes_per_sec: bytes_per_sec.max(1),
+            next: Mutex::new(None),
+        }
+    }
+
+    /// Wait until `bytes` more can be sent without going over the rate.
+    pub fn take(&self, bytes: u64) {
+        let cost = Duration::from_secs_f64(bytes as f64 / self.bytes_per_sec as f64);
+        let now = Instant::now();
+        let until = {
+            let mut next = self.next.lock().unwrap();
+            // Time spent idle isn't saved up for a later burst
+            let until = next.map_or(now, |n| n.max(now)) + cost;
+            *next = Some(until);
+            until
+        };
+        thread::sleep(until.saturating_duration_since(now));
+    }
+}
+
+/// Copy a file like `fs::copy`, sending its content through `limiter`.
+pub fn copy(source: &Path, destination: &Path, limiter: &RateLimiter) -> io::Result<u64> {
+    let mut reader = File::open(source)?;
+    let mut writer = File::create(destination)?;
+    let mut buf = vec![0; CHUNK_SIZE];
+    let mut copied = 0;
+    loop {
+        let n = reader.read(&mut buf)?;
+        if n == 0 {
+            break;
+        }
+        limiter.take(n as u64);
+        writer.write_all(&buf[..n])?;
+        copied += n as u64;
+    }
+    writer.flush()?;
+    fs::set_permissions(destination, reader.metadata()?.permissions())?;
+    Ok(copied)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use assert_fs::TempDir;
+
+    #[test]
+    fn test_rate_applies_across_threads() {
+        let temp_dir = TempDir::new().unwrap();
+        let content = vec![7u8; 256 * 1024];
+        for name in ["a", "b"] {
+            fs::write(temp_dir.path().join(name), &content).unwrap();
+        }
+
+        // 512 KiB in total at 1 MiB/s can't take less than half a second,
+        // even split over two threads
+        let limiter = RateLimiter::new(1024 * 1024);
+        let started = Instant::now();
+        thread::scope(|s| {
+            for name in ["a", "b"] {
+                let (limiter, dir) = (&limiter, temp_dir.path());
+                s.spawn(move || copy(&dir.join(name), &dir.join(format!("{}.copy", name)), limiter).unwrap());
+            }
+        });
+        assert!(started.elapsed() >= Duration::from_millis(500));
+
+        for name in ["a", "b"] {
+            assert_eq!(fs::read(temp_dir.path().join(format!("{}.copy", name))).unwrap(), content);
+        }
+    }
+}
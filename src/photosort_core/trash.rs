@@ -0,0 +1,166 @@
+use crate::photosort_core::error::Result;
+use crate::photosort_core::objects::{linked_object, move_in_library, remove_unlinked_objects};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use time::OffsetDateTime;
+use walkdir::WalkDir;
+
+/// Folder (relative to the library root) holding deleted files until the trash is emptied.
+pub const TRASH_DIR: &str = ".trash";
+
+/// Timestamp naming each trash session folder.
+const TRASH_STAMP_FORMAT: &[time::format_description::FormatItem] =
+    time::macros::format_description!("[year][month][day]-[hour][minute][second]");
+
+/// A `.trash/<timestamp>/` folder receiving the files deleted by one operation.
+///
+/// The folder is claimed when the first file arrives, with a `-N` suffix if an
+/// operation in the same second already has that name, so two sessions never
+/// share one.
+pub struct Trash {
+    root: PathBuf,
+    stamp: String,
+    dir: Mutex<Option<PathBuf>>,
+}
+
+/// Outcome of emptying the trash.
+#[derive(Debug, Default)]
+pub struct EmptyTrashResult {
+    pub files_removed: usize,
+    pub bytes_freed: u64,
+}
+
+impl Trash {
+    /// Start a new trash session for the library at `root`.
+    pub fn new(root: &Path) -> Self {
+        let now = OffsetDateTime::now_local().unwrap_or_else(|_| OffsetDateTime::now_utc());
+        Trash {
+            root: root.to_path_buf(),
+            stamp: now.format(TRASH_STAMP_FORMAT).unwrap(),
+            dir: Mutex::new(None),
+        }
+    }
+
+    /// This session's folder, created on first use.
+    fn dir(&self) -> io::Result<PathBuf> {
+        let mut dir = self.dir.lock().unwrap();
+        if let Some(dir) = dir.as_ref() {
+            return Ok(dir.clone());
+        }
+        let trash_dir = self.root.join(TRASH_DIR);
+        fs::create_dir_all(&trash_dir)?;
+        let mut candidate = trash_dir.join(&self.stamp);
+        let mut n = 1;
+        // Creating the folder is what claims the name
+        loop {
+            match fs::create_dir(&candidate) {
+                Ok(()) => return Ok(dir.insert(candidate).clone()),
+                Err(e) if e.kind() == io::ErrorKind::AlreadyExists => {
+                    n += 1;
+                    candidate = trash_dir.join(format!("{}-{}", self.stamp, n));
+                }
+                Err(e) => return Err(e),
+            }
+        }
+    }
+
+    /// Move a library file into the trash, keeping its path relative to the root.
+    /// Returns where the file ended up.
+    pub fn move_file(&self, path: &Path) -> io::Result<PathBuf> {
+        let rel = path.strip_prefix(&self.root).unwrap_or(path);
+        let destination = self.dir()?.join(rel);
+        if linked_object(&self.root, path).is_some() {
+            // Relink rather than rename, or the link would dangle from its new folder
+            move_in_library(&self.root, path, &destination)?;
+            return Ok(destination);
+        }
+        if let Some(parent) = destination.parent() {
+            fs::create_dir_all(parent)?;
+        }
+
+        // The trash lives inside the library, so this is normally a cheap rename
+        if fs::rename(path, &destination).is_err() {
+            fs::copy(path, &destination)?;
+            fs::remove_file(path)?;
+        }
+        Ok(destination)
+    }
+}
+
+/// Permanently delete everything in the library's trash.
+pub fn empty_trash(root: &Path) -> Result<EmptyTrashResult> {
+    let trash_dir = root.join(TRASH_DIR);
+    let mut result = EmptyTrashResult::default();
+    if !trash_dir.exists() {
+        return Ok(result);
+    }
+
+    for entry in WalkDir::new(&trash_dir).into_iter().filter_map(|e| e.ok()) {
+        if entry.file_type().is_file() {
+            result.files_removed += 1;
+            result.bytes_freed += entry.metadata().map(|m| m.len()).unwrap_or(0);
+        }
+    }
+
+    fs::remove_dir_all(&trash_dir)?;
+
+    // In a content-addressed library the trash held links; drop the objects they kept alive
+    let (objects, bytes) = remove_unlinked_objects(root)?;
+    result.files_removed += objects;
+    result.bytes_freed += bytes;
+    Ok(result)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use assert_fs::TempDir;
+
+    #[test]
+    fn test_move_file_keeps_relative_path() {
+        let temp_dir = TempDir::new().unwrap();
+        let dir = temp_dir.path().join("images/2024/01-01");
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(dir.join("a.jpg"), b"data").unwrap();
+
+        let trash = Trash::new(temp_dir.path());
+        let trashed = trash.move_file(&dir.join("a.jpg")).unwrap();
+
+        assert!(!dir.join("a.jpg").exists());
+        assert!(trashed.starts_with(temp_dir.path().join(TRASH_DIR)));
+        assert!(trashed.ends_with("images/2024/01-01/a.jpg"));
+        assert_eq!(fs::read(&trashed).unwrap(), b"data");
+    }
+
+    #[test]
+    fn test_sessions_get_their_own_folder() {
+        let temp_dir = TempDir::new().unwrap();
+        fs::write(temp_dir.path().join("a.jpg"), b"a").unwrap();
+        fs::write(temp_dir.path().join("b.jpg"), b"b").unwrap();
+
+        // Started within the same second, as two quick removals would be
+        let (first, second) = (Trash::new(temp_dir.path()), Trash::new(temp_dir.path()));
+        let a = first.move_file(&temp_dir.path().join("a.jpg")).unwrap();
+        let b = second.move_file(&temp_dir.path().join("b.jpg")).unwrap();
+        assert_ne!(a.parent(), b.parent());
+        assert_eq!(fs::read(&a).unwrap(), b"a");
+        assert_eq!(fs::read(&b).unwrap(), b"b");
+    }
+
+    #[test]
+    fn test_empty_trash() {
+        let temp_dir = TempDir::new().unwrap();
+        fs::write(temp_dir.path().join("a.jpg"), b"12345").unwrap();
+        Trash::new(temp_dir.path()).move_file(&temp_dir.path().join("a.jpg")).unwrap();
+
+        let result = empty_trash(temp_dir.path()).unwrap();
+        assert_eq!(result.files_removed, 1);
+        assert_eq!(result.bytes_freed, 5);
+        assert!(!temp_dir.path().join(TRASH_DIR).exists());
+
+        // Emptying an empty trash is fine
+        assert_eq!(empty_trash(temp_dir.path()).unwrap().files_removed, 0);
+    }
+}
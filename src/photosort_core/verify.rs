@@ -0,0 +1,349 @@
+use crate::photosort_core::error::{PhotosortError, Result};
+use crate::photosort_core::import::{content_hash, hash_encoding_of, hash_file_as, Library, MisplacedMedia};
+use crate::photosort_core::progress;
+use crate::photosort_core::report::Report;
+use rayon::prelude::*;
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+
+/// Options for verifying a library.
+#[derive(Debug, Clone, Default)]
+pub struct VerifyOptions {
+    /// Fraction of files to check (0.0..=1.0). `None` checks everything.
+    pub sample: Option<f64>,
+    /// Seed for picking the sample, so a run can be reproduced.
+    pub seed: u64,
+    /// Set from another thread to stop early; files not yet checked are skipped.
+    pub cancel: Option<Arc<AtomicBool>>,
+    /// Also check every record's folder against the one its date sorts it into.
+    pub check_folders: bool,
+}
+
+/// Result of verifying a library.
+#[derive(Debug, Default)]
+pub struct VerifyResult {
+    /// Number of media files in the library.
+    pub total: usize,
+    /// Number of media files actually checked.
+    pub checked: usize,
+    pub missing: Vec<PathBuf>,
+    pub mismatched: Vec<PathBuf>,
+    /// True if the run was cancelled before every selected file was checked.
+    pub cancelled: bool,
+    /// Records filed outside their date folder, when `check_folders` is set.
+    pub misplaced: Vec<MisplacedMedia>,
+}
+
+impl VerifyResult {
+    pub fn failures(&self) -> usize {
+        self.missing.len() + self.mismatched.len()
+    }
+
+    pub fn is_ok(&self) -> bool {
+        self.failures() == 0 && self.misplaced.is_empty()
+    }
+
+    /// Fraction of checked files that failed.
+    pub fn error_rate(&self) -> f64 {
+        if self.checked == 0 {
+            0.0
+        } else {
+            self.failures() as f64 / self.checked as f64
+        }
+    }
+
+    /// Failures expected across the whole library, extrapolated from the sample.
+    pub fn estimated_failures(&self) -> f64 {
+        self.error_rate() * self.total as f64
+    }
+
+    /// Summary of the run. Sampled runs also report the seed and the
+    /// extrapolated error rate.
+    pub fn report(&self, options: &VerifyOptions) -> Report {
+        let mut report = Report::new(if self.cancelled { "Verify (cancelled)" } else { "Verify" })
+            .field("checked", "files checked", self.checked)
+            .field("total", "files in library", self.total)
+            .field("missing", "missing", self.missing.len())
+            .field("corrupt", "corrupt", self.mismatched.len());
+        if options.sample.is_some() {
+            report = report
+                .field("seed", "seed", options.seed)
+                .field_with_display(
+                    "error_rate",
+                    "error rate",
+                    self.error_rate(),
+                    format!("{:.2}%", self.error_rate() * 100.0),
+                )
+                .field_with_display(
+                    "estimated_failures",
+                    "bad files library-wide (estimated)",
+                    self.estimated_failures(),
+                    format!("{:.0}", self.estimated_failures()),
+                );
+        }
+
+        if options.check_folders {
+            report = report.field("misplaced", "misplaced", self.misplaced.len());
+        }
+
+        let rows = self
+            .missing
+            .iter()
+            .map(|p| (p, "missing"))
+            .chain(self.mismatched.iter().map(|p| (p, "corrupt")))
+            .map(|(p, problem)| vec![p.display().to_string().into(), problem.into()])
+            .collect();
+        report = report.list("failures", "failures", &["path", "problem"], rows);
+        if options.check_folders {
+            let rows = self
+                .misplaced
+                .iter()
+                .map(|m| vec![m.path.display().to_string().into(), m.expected.clone().into()])
+                .collect();
+            report = report.list("misplaced_files", "misplaced (with the folder they belong in)", &["path", "expected"], rows);
+        }
+        report
+    }
+}
+
+/// Parse a sample rate like "10%" or "0.1" into a fraction.
+pub fn parse_sample_rate(s: &str) -> Result<f64> {
+    let s = s.trim();
+    let fraction = match s.strip_suffix('%') {
+        Some(pct) => pct.trim().parse::<f64>().map(|p| p / 100.0),
+        None => s.parse::<f64>(),
+    }
+    .map_err(|_| PhotosortError::Argument(format!("invalid sample rate: {}", s)))?;
+
+    if !(fraction > 0.0 && fraction <= 1.0) {
+        return Err(PhotosortError::Argument(format!(
+            "sample rate must be between 0% and 100%: {}",
+            s
+        )));
+    }
+    Ok(fraction)
+}
+
+/// Pick `fraction` of the indices `0..total`, deterministically for a given seed.
+/// Returned indices are sorted.
+pub fn sample_indices(total: usize, fraction: f64, seed: u64) -> Vec<usize> {
+    let count = ((total as f64 * fraction).ceil() as usize).min(total);
+    let mut indices: Vec<usize> = (0..total).collect();
+    let mut rng = SplitMix64(seed);
+
+    // Partial Fisher-Yates: the first `count` slots end up a uniform sample
+    for i in 0..count {
+        let j = i + (rng.next() % (total - i) as u64) as usize;
+        indices.swap(i, j);
+    }
+
+    indices.truncate(count);
+    indices.sort_unstable();
+    indices
+}
+
+/// Small, dependency-free PRNG; plenty for picking a sample.
+struct SplitMix64(u64);
+
+impl SplitMix64 {
+    fn next(&mut self) -> u64 {
+        self.0 = self.0.wrapping_add(0x9E37_79B9_7F4A_7C15);
+        let mut z = self.0;
+        z = (z ^ (z >> 30)).wrapping_mul(0xBF58_476D_1CE4_E5B9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94D0_49BB_1331_11EB);
+        z ^ (z >> 31)
+    }
+}
+
+/// Check that library files exist and still match their stored hashes, and
+/// with `check_folders`, that every record is filed where its date sorts it.
+/// The folder check reads only the database, so it covers every record even
+/// when the files are sampled.
+pub fn verify(lib: &Library, options: &VerifyOptions) -> Result<VerifyResult> {
+    let conn = lib.database().connection_ref();
+
+    let mut stmt = conn.prepare("SELECT relpath, filename, COALESCE(stored_hash, hash) FROM media ORDER BY id")?;
+    let rows = stmt
+        .query_map([], |row| {
+            Ok((
+                row.get::<_, String>(0)?,
+                row.get::<_, String>(1)?,
+                row.get::<_, String>(2)?,
+            ))
+        })?
+        .collect::<rusqlite::Result<Vec<_>>>()?;
+
+    let files: Vec<(PathBuf, String)> = rows
+        .into_iter()
+        .map(|(relpath, filename, hash)| (lib.file_path(&relpath, &filename), hash))
+        .collect();
+    let mut result = verify_files(&files, options);
+    if options.check_folders {
+        result.misplaced = lib.misplaced_media()?;
+    }
+    Ok(result)
+}
+
+/// Check that files exist and match the hashes they should have, such as
+/// copies just written somewhere else. `files` holds (path, expected hash).
+pub fn verify_files(files: &[(PathBuf, String)], options: &VerifyOptions) -> VerifyResult {
+    let total = files.len();
+    let selected: Vec<&(PathBuf, String)> = match options.sample {
+        Some(fraction) => sample_indices(total, fraction, options.seed)
+            .into_iter()
+            .map(|i| &files[i])
+            .collect(),
+        None => files.iter().collect(),
+    };
+
+    let bar = progress::bar(selected.len() as u64);
+    bar.set_message("Verifying files");
+
+    let result = Mutex::new(VerifyResult {
+        total,
+        ..Default::default()
+    });
+    let is_cancelled = || {
+        options
+            .cancel
+            .as_ref()
+            .map(|c| c.load(Ordering::Relaxed))
+            .unwrap_or(false)
+    };
+
+    selected.par_iter().for_each(|(path, hash)| {
+        if is_cancelled() {
+            return;
+        }
+
+        let outcome = if !path.exists() {
+            Some(false)
+        } else {
+            match hash_file_as(&path, hash_encoding_of(hash)) {
+                Ok(actual) if actual == content_hash(hash) => None,
+                Ok(_) => Some(true),
+                Err(e) => {
+                    log::warn!("Failed to hash {}: {}", path.display(), e);
+                    Some(true)
+                }
+            }
+        };
+
+        let mut r = result.lock().unwrap();
+        r.checked += 1;
+        match outcome {
+            Some(false) => r.missing.push(path.clone()),
+            Some(true) => r.mismatched.push(path.clone()),
+            None => {}
+        }
+        bar.inc(1);
+    });
+
+    bar.finish_with_message("Verify complete");
+
+    let mut result = result.into_inner().unwrap();
+    result.cancelled = result.checked < selected.len();
+    result.missing.sort();
+    result.mismatched.sort();
+    result
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_sample_rate() {
+        assert_eq!(parse_sample_rate("10%").unwrap(), 0.1);
+        assert_eq!(parse_sample_rate("0.25").unwrap(), 0.25);
+        assert_eq!(parse_sample_rate("100%").unwrap(), 1.0);
+        assert!(parse_sample_rate("0%").is_err());
+        assert!(parse_sample_rate("150%").is_err());
+        assert!(parse_sample_rate("lots").is_err());
+    }
+
+    #[test]
+    fn test_sample_indices_deterministic() {
+        let a = sample_indices(1000, 0.1, 42);
+        let b = sample_indices(1000, 0.1, 42);
+        assert_eq!(a.len(), 100);
+        assert_eq!(a, b);
+
+        // Distinct, in range, and a different seed gives a different sample
+        let mut deduped = a.clone();
+        deduped.dedup();
+        assert_eq!(deduped.len(), 100);
+        assert!(a.iter().all(|&i| i < 1000));
+        assert_ne!(a, sample_indices(1000, 0.1, 7));
+    }
+
+    #[test]
+    fn test_sample_indices_rounds_up() {
+        assert_eq!(sample_indices(5, 0.1, 1).len(), 1);
+        assert_eq!(sample_indices(5, 1.0, 1), vec![0, 1, 2, 3, 4]);
+        assert!(sample_indices(0, 0.5, 1).is_empty());
+    }
+
+    #[test]
+    fn test_error_rate_extrapolation() {
+        let result = VerifyResult {
+            total: 1000,
+            checked: 100,
+            missing: vec![PathBuf::from("a.jpg")],
+            mismatched: vec![PathBuf::from("b.jpg")],
+            cancelled: false,
+            misplaced: Vec::new(),
+        };
+        assert!((result.error_rate() - 0.02).abs() < 1e-9);
+        assert!((result.estimated_failures() - 20.0).abs() < 1e-9);
+        assert!(!result.is_ok());
+    }
+
+    #[test]
+    fn test_check_folders_flags_file_in_wrong_date_folder() {
+        use crate::photosort_core::import::hash_file;
+        use assert_fs::TempDir;
+        use rusqlite::params;
+
+        let temp_dir = TempDir::new().unwrap();
+        let lib = Library::create(&temp_dir.path().join("lib")).unwrap();
+        for (name, relpath, created_at) in [
+            ("a.jpg", "images/2024/05-21", "2024:05:21 12:00:00.0+00:00"),
+            // Redated without being moved
+            ("b.jpg", "images/2024/05-20", "2024:05:21 09:30:00.0+00:00"),
+        ] {
+            let path = lib.file_path(relpath, name);
+            std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+            std::fs::write(&path, name).unwrap();
+            lib.database()
+                .connection_ref()
+                .execute(
+                    "INSERT INTO media (hash, filename, relpath, media_type, filetype, file_size, created_at, imported_at)
+                     VALUES (?1, ?2, ?3, 'image', 'JPG', 5, ?4, ?4)",
+                    params![hash_file(&path).unwrap(), name, relpath, created_at],
+                )
+                .unwrap();
+        }
+
+        // Only looked at when asked for
+        let result = verify(&lib, &VerifyOptions::default()).unwrap();
+        assert!(result.is_ok());
+        assert!(result.misplaced.is_empty());
+
+        let options = VerifyOptions { check_folders: true, ..Default::default() };
+        let result = verify(&lib, &options).unwrap();
+        assert_eq!(result.failures(), 0);
+        assert!(!result.is_ok());
+        assert_eq!(
+            result.misplaced,
+            vec![MisplacedMedia {
+                path: lib.file_path("images/2024/05-20", "b.jpg"),
+                relpath: "images/2024/05-20".to_string(),
+                expected: "images/2024/05-21".to_string(),
+            }]
+        );
+        let report = result.report(&options).render(&crate::photosort_core::cli::ReportFormat::Text);
+        assert!(report.contains("misplaced: 1"), "{}", report);
+    }
+}
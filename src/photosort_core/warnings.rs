@@ -0,0 +1,78 @@
+use log::{Level, LevelFilter, Log, Metadata, Record};
+use simplelog::{Config, SharedLogger};
+use std::collections::BTreeMap;
+use std::sync::Mutex;
+
+static COUNTS: Mutex<BTreeMap<String, usize>> = Mutex::new(BTreeMap::new());
+
+/// A logger that counts the warnings logged during a run by category, so
+/// `--fail-on-warnings` can tell whether a run was clean.
+pub struct WarningCollector;
+
+impl Log for WarningCollector {
+    fn enabled(&self, metadata: &Metadata) -> bool {
+        metadata.level() == Level::Warn
+    }
+
+    fn log(&self, record: &Record) {
+        if self.enabled(record.metadata()) {
+            *COUNTS.lock().unwrap().entry(category(record.target()).to_string()).or_default() += 1;
+        }
+    }
+
+    fn flush(&self) {}
+}
+
+impl SharedLogger for WarningCollector {
+    fn level(&self) -> LevelFilter {
+        LevelFilter::Warn
+    }
+
+    fn config(&self) -> Option<&Config> {
+        None
+    }
+
+    fn as_log(self: Box<Self>) -> Box<dyn Log> {
+        self
+    }
+}
+
+/// The category a warning is counted under: the module that logged it, e.g. "import".
+fn category(target: &str) -> &str {
+    target.rsplit("::").next().unwrap_or(target)
+}
+
+/// Warnings collected so far, as (category, count) in category order.
+pub fn counts() -> Vec<(String, usize)> {
+    COUNTS.lock().unwrap().iter().map(|(c, n)| (c.clone(), *n)).collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_collects_warnings_by_module() {
+        let warn = |target| {
+            WarningCollector.log(
+                &Record::builder()
+                    .level(Level::Warn)
+                    .target(target)
+                    .args(format_args!("warning"))
+                    .build(),
+            )
+        };
+        warn("photosort::photosort_core::import");
+        warn("photosort::photosort_core::import");
+        warn("photosort::photosort_core::hooks");
+        WarningCollector.log(
+            &Record::builder()
+                .level(Level::Info)
+                .target("photosort::photosort_core::exif")
+                .args(format_args!("not a warning"))
+                .build(),
+        );
+
+        assert_eq!(counts(), vec![("hooks".to_string(), 1), ("import".to_string(), 2)]);
+    }
+}
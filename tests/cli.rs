@@ -42,6 +42,34 @@ fn test_import_command() {
     assert!(library_dir.child("images").exists());
 }
 
+#[test]
+fn test_log_file_records_import() {
+    let temp_dir = assert_fs::TempDir::new().unwrap();
+    let library_dir = setup_test_library(&temp_dir);
+    let photo_dir = get_test_photos_dir();
+    let log_file = temp_dir.child("logs/run.log");
+    std::fs::create_dir_all(log_file.parent().unwrap()).unwrap();
+
+    let import = |extra: &[&str]| {
+        Command::cargo_bin("photosort")
+            .unwrap()
+            .arg("import")
+            .arg(&photo_dir)
+            .arg(library_dir.path())
+            .arg("--log-file")
+            .arg(log_file.path())
+            .args(extra)
+            .assert()
+            .success();
+        std::fs::read_to_string(log_file.path()).unwrap().matches("Import complete").count()
+    };
+
+    assert_eq!(import(&[]), 1);
+    assert_eq!(import(&["--log-append"]), 2);
+    // Without --log-append each run starts the log afresh
+    assert_eq!(import(&[]), 1);
+}
+
 #[test]
 fn test_info_command() {
     let temp_dir = assert_fs::TempDir::new().unwrap();
@@ -137,3 +165,196 @@ fn test_dry_run_import() {
         .success()
         .stdout(predicate::str::contains("0 images"));
 }
+
+#[test]
+fn test_import_reports_orphan_sidecars() {
+    let temp_dir = assert_fs::TempDir::new().unwrap();
+    let library_dir = setup_test_library(&temp_dir);
+    let source_dir = temp_dir.child("source");
+    source_dir.create_dir_all().unwrap();
+    source_dir.child("lonely.xmp").write_str("<x:xmpmeta/>").unwrap();
+
+    // Without the flag the orphan is reported, not silently dropped
+    let mut cmd = Command::cargo_bin("photosort").unwrap();
+    cmd.arg("import")
+        .arg(source_dir.path())
+        .arg(library_dir.path())
+        .assert()
+        .success()
+        .stdout(predicate::str::contains("lonely.xmp"))
+        .stdout(predicate::str::contains("sidecar with no matching photo"));
+    assert!(!library_dir.child("orphans").exists());
+
+    // With the flag it lands in the holding area
+    let mut cmd = Command::cargo_bin("photosort").unwrap();
+    cmd.arg("import")
+        .arg(source_dir.path())
+        .arg(library_dir.path())
+        .arg("--include-sidecars-without-photo")
+        .assert()
+        .success()
+        .stdout(predicate::str::contains("copied to orphans/"));
+    assert!(library_dir.child("orphans").child("lonely.xmp").exists());
+}
+
+#[test]
+fn test_import_skips_empty_files() {
+    let temp_dir = assert_fs::TempDir::new().unwrap();
+    let library_dir = setup_test_library(&temp_dir);
+    let source_dir = temp_dir.child("source");
+    source_dir.create_dir_all().unwrap();
+    source_dir.child("truncated.jpg").touch().unwrap();
+    source_dir.child("truncated.xmp").write_str("<x:xmpmeta/>").unwrap();
+
+    let mut cmd = Command::cargo_bin("photosort").unwrap();
+    cmd.arg("import")
+        .arg(source_dir.path())
+        .arg(library_dir.path())
+        .assert()
+        .success()
+        .stdout(predicate::str::contains("truncated.jpg (empty file)"))
+        .stdout(predicate::str::contains("sidecar with no matching photo").not());
+
+    assert_eq!(std::fs::read_dir(library_dir.child("images").path()).unwrap().count(), 0);
+}
+
+#[test]
+fn test_import_files_listed_on_stdin() {
+    let temp_dir = assert_fs::TempDir::new().unwrap();
+    let library_dir = setup_test_library(&temp_dir);
+    let cards = temp_dir.child("cards");
+    cards.child("a/IMG_1.jpg").write_str("one").unwrap();
+    cards.child("b/IMG_2.jpg").write_str("two").unwrap();
+    cards.child("b/IMG_3.jpg").write_str("three").unwrap();
+
+    // As `find ... -print0` would write it
+    let list: String = ["a/IMG_1.jpg", "b/IMG_2.jpg", "b/gone.jpg"]
+        .iter()
+        .map(|name| format!("{}\0", cards.child(name).path().display()))
+        .collect();
+
+    let mut cmd = Command::cargo_bin("photosort").unwrap();
+    cmd.arg("import")
+        .arg("-")
+        .arg(library_dir.path())
+        .arg("--null")
+        .write_stdin(list)
+        .assert()
+        .success()
+        .stdout(predicate::str::contains("images imported: 2"))
+        .stdout(predicate::str::contains("gone.jpg (listed but not found)"));
+}
+
+#[test]
+fn test_fail_on_warnings() {
+    let temp_dir = assert_fs::TempDir::new().unwrap();
+    let library_dir = setup_test_library(&temp_dir);
+    let first = temp_dir.child("first");
+    first.create_dir_all().unwrap();
+    first.child("a.jpg").write_str("first").unwrap();
+    let second = temp_dir.child("second");
+    second.create_dir_all().unwrap();
+    second.child("a.jpg").write_str("second").unwrap();
+
+    let mut cmd = Command::cargo_bin("photosort").unwrap();
+    cmd.arg("import").arg(first.path()).arg(library_dir.path()).assert().success();
+
+    // A different a.jpg is left out with a warning, since one is already in its folder
+    let mut cmd = Command::cargo_bin("photosort").unwrap();
+    cmd.arg("import")
+        .arg(second.path())
+        .arg(library_dir.path())
+        .arg("--dest-exists-policy")
+        .arg("skip")
+        .arg("--fail-on-warnings")
+        .assert()
+        .failure()
+        .stderr(predicate::str::contains("Warnings:"))
+        .stderr(predicate::str::contains("import: "));
+
+    let mut cmd = Command::cargo_bin("photosort").unwrap();
+    cmd.arg("import")
+        .arg(second.path())
+        .arg(library_dir.path())
+        .arg("--dest-exists-policy")
+        .arg("skip")
+        .assert()
+        .success();
+}
+
+#[test]
+fn test_verify_after_import_catches_corruption() {
+    let temp_dir = assert_fs::TempDir::new().unwrap();
+    let library_dir = setup_test_library(&temp_dir);
+    let source_dir = temp_dir.child("source");
+    source_dir.create_dir_all().unwrap();
+    source_dir.child("a.jpg").write_str("photo").unwrap();
+
+    // The hook damages each file right after it is copied and recorded
+    let mut cmd = Command::cargo_bin("photosort").unwrap();
+    cmd.arg("import")
+        .arg(source_dir.path())
+        .arg(library_dir.path())
+        .arg("--after-import-hook")
+        .arg("echo damaged >>")
+        .arg("--verify-after-import")
+        .assert()
+        .failure()
+        .stdout(predicate::str::contains("corrupt: 1"))
+        .stderr(predicate::str::contains("Verification failed: 1 files missing or corrupt"));
+
+    // An undamaged library passes
+    let clean_dir = temp_dir.child("clean");
+    let mut cmd = Command::cargo_bin("photosort").unwrap();
+    cmd.arg("create").arg(clean_dir.path()).assert().success();
+    let mut cmd = Command::cargo_bin("photosort").unwrap();
+    cmd.arg("import")
+        .arg(source_dir.path())
+        .arg(clean_dir.path())
+        .arg("--verify-after-import")
+        .assert()
+        .success()
+        .stdout(predicate::str::contains("corrupt: 0"));
+}
+
+#[test]
+fn test_inspect_lists_source_without_library() {
+    use base64::{engine::general_purpose, Engine};
+    use sha2::{Digest, Sha256};
+
+    let temp_dir = assert_fs::TempDir::new().unwrap();
+    let source_dir = temp_dir.child("source");
+    source_dir.child("trip").create_dir_all().unwrap();
+    source_dir.child("trip/a.jpg").write_str("not really a jpeg").unwrap();
+    source_dir.child("trip/a.xmp").write_str("<x:xmpmeta/>").unwrap();
+    source_dir.child("b.mp4").write_str("not really a video").unwrap();
+    source_dir.child("notes.txt").write_str("packing list").unwrap();
+
+    let mut cmd = Command::cargo_bin("photosort").unwrap();
+    let output = cmd
+        .arg("inspect")
+        .arg(source_dir.path())
+        .arg("--output")
+        .arg("json")
+        .output()
+        .unwrap();
+    assert!(output.status.success());
+
+    let files: serde_json::Value = serde_json::from_slice(&output.stdout).unwrap();
+    let files = files.as_array().unwrap();
+    let paths: Vec<&str> = files.iter().map(|f| f["path"].as_str().unwrap()).collect();
+    assert_eq!(paths, ["b.mp4", "trip/a.jpg"]);
+
+    assert_eq!(files[0]["media_type"], "video");
+    assert_eq!(files[0]["sidecars"].as_array().unwrap().len(), 0);
+    assert_eq!(files[1]["media_type"], "image");
+    assert_eq!(files[1]["sidecars"], serde_json::json!(["trip/a.xmp"]));
+    assert!(files[1]["folder"].as_str().unwrap().starts_with("images/"));
+    assert_eq!(
+        files[1]["hash"],
+        general_purpose::STANDARD.encode(Sha256::digest(b"not really a jpeg"))
+    );
+
+    // Nothing was created in the source
+    assert!(!source_dir.child("library.db").exists());
+}